@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// appendFsync is the appendfsync policy: when the append-only file is flushed
+// to disk.
+type appendFsync int
+
+const (
+	fsyncEverysec appendFsync = iota // once per second from serverCron
+	fsyncAlways                      // after every write, before the reply
+	fsyncNo                          // whenever the operating system decides
+)
+
+// aofRewriteItemsPerCmd is how many elements a rewrite puts in one command.
+const aofRewriteItemsPerCmd = 64
+
+var errRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+func parseAppendFsync(policy string) (appendFsync, error) {
+	switch strings.ToLower(policy) {
+	case "always":
+		return fsyncAlways, nil
+	case "everysec":
+		return fsyncEverysec, nil
+	case "no":
+		return fsyncNo, nil
+	}
+	return 0, fmt.Errorf("invalid appendfsync policy %q", policy)
+}
+
+// appendOnlyFile logs every write command so that the keyspace can be
+// rebuilt by replaying them.
+type appendOnlyFile struct {
+	mu        sync.Mutex
+	path      string // also where BGREWRITEAOF writes while appendonly is off
+	fsync     appendFsync
+	file      *os.File // nil while appendonly is off
+	unsynced  bool     // written since the last fsync
+	lastFsync time.Time
+
+	// selectedDB is the database the commands written last apply to, or -1
+	// when the next command must select one first.
+	selectedDB int
+
+	// While a rewrite runs, writes are also collected here to be appended
+	// to the rewritten file.
+	rewriting  bool
+	rewriteBuf bytes.Buffer
+}
+
+// open starts logging to the file at path.
+func (a *appendOnlyFile) open(path string, fsync appendFsync) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.path, a.fsync, a.file = path, fsync, f
+	a.lastFsync = time.Now()
+	a.selectedDB = -1
+	return nil
+}
+
+// enabled reports whether writes are being logged.
+func (a *appendOnlyFile) enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file != nil
+}
+
+// feed appends a command run in database dbid to the log, preceded by a
+// SELECT when the previous one ran in another database.
+func (a *appendOnlyFile) feed(dbid int, command []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil && !a.rewriting {
+		return
+	}
+	data := serializeStringArray(command)
+	if dbid != a.selectedDB {
+		data = append(serializeStringArray([]string{"SELECT", strconv.Itoa(dbid)}), data...)
+		a.selectedDB = dbid
+	}
+	if a.rewriting {
+		a.rewriteBuf.Write(data)
+	}
+	if a.file == nil {
+		return
+	}
+
+	if _, err := a.file.Write(data); err != nil {
+		if a.fsync == fsyncAlways {
+			log.Fatalf("Can't recover from AOF write error when the AOF fsync policy is 'always': %v", err)
+		}
+		log.Printf("Error writing to the AOF file: %v", err)
+		return
+	}
+	if a.fsync == fsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			log.Fatalf("Can't recover from AOF fsync error when the AOF fsync policy is 'always': %v", err)
+		}
+		return
+	}
+	a.unsynced = true
+}
+
+// cron fsyncs the log once per second under the everysec policy. The fsync
+// itself runs without the lock so that writes are not held up by the disk.
+func (a *appendOnlyFile) cron() {
+	a.mu.Lock()
+	if a.file == nil || a.fsync != fsyncEverysec || !a.unsynced || time.Since(a.lastFsync) < time.Second {
+		a.mu.Unlock()
+		return
+	}
+	f := a.file
+	a.unsynced = false
+	a.lastFsync = time.Now()
+	a.mu.Unlock()
+
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Printf("Error fsyncing the AOF file: %v", err)
+	}
+}
+
+// bgrewrite compacts the log in the background: the keyspace is written out
+// as the shortest commands that rebuild it, followed by the writes made while
+// that was in progress.
+func (a *appendOnlyFile) bgrewrite(dbs ...DataStore) error {
+	snaps, path, err := a.startRewrite(dbs...)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		start := time.Now()
+		if err := a.finishRewrite(snaps, path); err != nil {
+			log.Printf("Background AOF rewrite error: %v", err)
+			return
+		}
+		log.Printf("Background AOF rewrite terminated with success in %v", time.Since(start))
+	}()
+	return nil
+}
+
+// startRewrite snapshots the databases, given in order, and starts
+// collecting new writes. It returns the path the rewritten file goes to. No
+// write command may run concurrently, which callers ensure by holding
+// keyspaceLock.
+func (a *appendOnlyFile) startRewrite(dbs ...DataStore) ([]*Snapshot, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		return nil, "", errRewriteInProgress
+	}
+	a.rewriting = true
+	a.rewriteBuf.Reset()
+	// The collected writes follow the snapshot, which may end in any
+	// database.
+	a.selectedDB = -1
+	return takeSnapshots(dbs), a.path, nil
+}
+
+// finishRewrite writes the snapshots and the writes collected since to a
+// temporary file that then replaces the one at path.
+func (a *appendOnlyFile) finishRewrite(snaps []*Snapshot, path string) (err error) {
+	defer closeSnapshots(snaps)
+	defer func() {
+		if err != nil {
+			a.mu.Lock()
+			a.rewriting = false
+			a.rewriteBuf.Reset()
+			a.mu.Unlock()
+		}
+	}()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	if err := writeAOFSnapshot(w, snaps); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	// Writes are held up from here until the new file is in place, so that
+	// none of them can go missing in between.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := tmp.Write(a.rewriteBuf.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if a.file != nil {
+		// Keep appending to the rewritten file. Its descriptor is still
+		// open, so this can not fail for a missing file.
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		a.file.Close()
+		a.file = f
+		a.unsynced = false
+	}
+	a.rewriting = false
+	a.rewriteBuf.Reset()
+	return nil
+}
+
+// writeAOFSnapshot writes commands that rebuild the keys of the snapshots,
+// one for each database in order.
+func writeAOFSnapshot(w io.Writer, snaps []*Snapshot) error {
+	var buf bytes.Buffer
+	encode := func(key string, value any, expireAt int64) {
+		appendRewriteCommands(&buf, key, value)
+		if expireAt > 0 {
+			buf.Write(serializeStringArray([]string{"PEXPIREAT", key, strconv.FormatInt(expireAt, 10)}))
+		}
+	}
+	for dbid, snap := range snaps {
+		if snap.Len() == 0 {
+			continue
+		}
+		buf.Write(serializeStringArray([]string{"SELECT", strconv.Itoa(dbid)}))
+		for snap.Next(encode) {
+			if buf.Len() >= 64*1024 {
+				if _, err := w.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				buf.Reset()
+			}
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// appendRewriteCommands writes the commands that create key with value,
+// batching the elements of collections.
+func appendRewriteCommands(buf *bytes.Buffer, key string, value any) {
+	batch := func(name string, args []string, perItem int) {
+		for len(args) > 0 {
+			n := min(len(args), aofRewriteItemsPerCmd*perItem)
+			buf.Write(serializeStringArray(append([]string{name, key}, args[:n]...)))
+			args = args[n:]
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		buf.Write(serializeStringArray([]string{"SET", key, v}))
+	case *quicklist:
+		batch("RPUSH", v.elements(), 1)
+	case *dict[struct{}]:
+		batch("SADD", slices.Collect(v.keys()), 1)
+	case *hash:
+		for field, val := range v.fields.all() {
+			buf.Write(serializeStringArray([]string{"HSET", key, field, val}))
+			if when, ok := v.expireTime(field); ok {
+				buf.Write(serializeStringArray([]string{"HPEXPIREAT", key, strconv.FormatInt(when, 10), "FIELDS", "1", field}))
+			}
+		}
+	case *zset:
+		args := make([]string, 0, 2*v.length())
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			args = append(args, formatFloat(x.score), x.member)
+		}
+		batch("ZADD", args, 2)
+	case *stream:
+		for _, entry := range v.rangeEntries(StreamID{}, maxStreamID, 0, false) {
+			buf.Write(serializeStringArray(append([]string{"XADD", key, entry.ID.String()}, entry.Fields...)))
+		}
+		if v.length == 0 {
+			// An empty stream is made by adding an entry that is trimmed
+			// right away.
+			buf.Write(serializeStringArray([]string{"XADD", key, "MAXLEN", "0", "0-1", "x", "y"}))
+		}
+		// The entries alone do not tell the last ID nor what was deleted.
+		buf.Write(serializeStringArray([]string{"XSETID", key, v.lastID.String(),
+			"ENTRIESADDED", strconv.FormatUint(v.entriesAdded, 10),
+			"MAXDELETEDID", v.maxDeletedID.String()}))
+		for _, name := range v.groupNames() {
+			g := v.groups[name]
+			buf.Write(serializeStringArray([]string{"XGROUP", "CREATE", key, name, g.lastID.String(),
+				"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10)}))
+			// Pending entries are given back to their consumers as they
+			// were, and consumers with none are created.
+			for _, consumerName := range g.consumerNames() {
+				consumer := g.consumers[consumerName]
+				if consumer.pel.len() == 0 {
+					buf.Write(serializeStringArray([]string{"XGROUP", "CREATECONSUMER", key, name, consumerName}))
+				}
+				for _, id := range consumer.pel.ids {
+					nack := consumer.pel.nacks[id]
+					buf.Write(serializeStringArray([]string{"XCLAIM", key, name, consumerName, "0", id.String(),
+						"TIME", strconv.FormatInt(nack.deliveryTime, 10),
+						"RETRYCOUNT", strconv.FormatUint(nack.deliveryCount, 10),
+						"JUSTID", "FORCE"}))
+				}
+			}
+		}
+	}
+}
+
+// loadAppendOnlyFile replays the log at path and returns the number of
+// commands run. A missing file is not an error. A log that ends in the middle
+// of a command, as left by a crash, is truncated to the last complete one.
+func (srv *server) loadAppendOnlyFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	reader := bufio.NewReader(counter)
+	c := srv.newClient(io.Discard)
+
+	var (
+		loaded     int
+		valid      int64 // offset just past the last complete command
+		multiStart int64 // offset of the MULTI of an open transaction
+	)
+	for {
+		value, err := ReadRESP(reader)
+		offset := counter.n - int64(reader.Buffered())
+		if err == io.EOF && offset == valid {
+			break
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("!!! Warning: short read while loading the AOF file %s !!!", path)
+			break
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("bad file format reading the append only file: %v", err)
+		}
+
+		command, err := value.ToCommand()
+		if err != nil || len(command) == 0 {
+			return loaded, errors.New("bad file format reading the append only file")
+		}
+		command[0] = strings.ToUpper(command[0])
+		if _, exists := commandRegistry[command[0]]; !exists {
+			return loaded, fmt.Errorf("unknown command '%s' reading the append only file", command[0])
+		}
+		if command[0] == "MULTI" {
+			multiStart = valid
+		}
+		executeCommand(c, command)
+		valid = offset
+		loaded++
+	}
+
+	if c.inMulti {
+		log.Printf("Revert incomplete MULTI/EXEC transaction in AOF file %s", path)
+		valid = multiStart
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > valid {
+		log.Printf("AOF %s loaded anyway because of a truncated last command. Truncating to %d bytes", path, valid)
+		if err := os.Truncate(path, valid); err != nil {
+			return loaded, err
+		}
+	}
+	return loaded, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestAOF logs writes to a fresh append-only file for the rest of the
+// test.
+func useTestAOF(t *testing.T, fsync appendFsync) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := testServer.aof.open(path, fsync); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() {
+		testServer.aof.file.Close()
+	})
+	return path
+}
+
+func reloadTestAOF(t *testing.T, path string) int {
+	t.Helper()
+	testServer.aof.file.Close()
+	testServer = newServer()
+	loaded, err := testServer.loadAppendOnlyFile(path)
+	if err != nil {
+		t.Fatalf("loadAppendOnlyFile: %v", err)
+	}
+	return loaded
+}
+
+func TestAOF_LogAndReplay(t *testing.T) {
+	testServer = newServer()
+	path := useTestAOF(t, fsyncAlways)
+
+	c := testServer.newClient(io.Discard)
+	for _, cmd := range [][]string{
+		{"SET", "str", "v", "EX", "100"},
+		{"SET", "str", "other", "NX"}, // not written, so not logged
+		{"GET", "str"},                // reads are not logged
+		{"RPUSH", "list", "a", "b"},
+		{"EXPIRE", "list", "100"},
+		{"DEL", "missing"},
+		{"MULTI"},
+		{"INCR", "counter"},
+		{"INCR", "counter"},
+		{"EXEC"},
+		{"SET", "gone", "v"},
+		{"DELIFEQ", "gone", "v"},
+		{"LPUSH", "str", "x"}, // WRONGTYPE
+	} {
+		executeClientCommand(c, cmd)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	for _, want := range []string{"PXAT", "PEXPIREAT", "*1\r\n$5\r\nMULTI\r\n", "*1\r\n$4\r\nEXEC\r\n", "*2\r\n$3\r\nDEL\r\n$4\r\ngone\r\n"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Expected the log to contain %q:\n%s", want, log)
+		}
+	}
+	for _, unwanted := range []string{"NX", "GET", "missing", "DELIFEQ", "EXPIRE\r\n", "LPUSH"} {
+		if strings.Contains(log, unwanted) {
+			t.Errorf("Expected the log not to contain %q:\n%s", unwanted, log)
+		}
+	}
+
+	ttl := testServer.dbs[0].ExpireTime("str")
+	// The log starts by selecting database 0.
+	if loaded := reloadTestAOF(t, path); loaded != 10 {
+		t.Errorf("Expected 10 commands replayed, got %d", loaded)
+	}
+	if v, _, _ := testServer.dbs[0].Get("str"); v != "v" {
+		t.Errorf("Expected str to be v, got %q", v)
+	}
+	if got := testServer.dbs[0].ExpireTime("str"); got != ttl {
+		t.Errorf("Expected the same absolute expiry %d, got %d", ttl, got)
+	}
+	if list, _ := testServer.dbs[0].LRange("list", 0, -1); !reflect.DeepEqual(list, []string{"a", "b"}) {
+		t.Errorf("Unexpected list %v", list)
+	}
+	if v, _, _ := testServer.dbs[0].Get("counter"); v != "2" {
+		t.Errorf("Expected counter to be 2, got %q", v)
+	}
+	if testServer.dbs[0].Exists("gone") {
+		t.Error("Expected gone to be deleted")
+	}
+}
+
+// TestAOF_ExpiredKeys checks that keys whose TTL elapsed are logged as
+// deleted, lazily expired ones before the command that found them gone.
+func TestAOF_ExpiredKeys(t *testing.T) {
+	testServer = newServer()
+	path := useTestAOF(t, fsyncAlways)
+
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"SET", "counter", "5", "PX", "1"})
+	executeClientCommand(c, []string{"SELECT", "1"})
+	executeClientCommand(c, []string{"SET", "idle", "v", "PX", "1"})
+	time.Sleep(5 * time.Millisecond)
+	executeClientCommand(c, []string{"SELECT", "0"})
+	executeClientCommand(c, []string{"INCR", "counter"})
+	testServer.activeExpire()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	del := strings.Index(log, "*2\r\n$3\r\nDEL\r\n$7\r\ncounter\r\n")
+	if incr := strings.Index(log, "INCR"); del < 0 || del > incr {
+		t.Errorf("Expected counter to be deleted before INCR:\n%s", log)
+	}
+	if !strings.HasSuffix(log, "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*2\r\n$3\r\nDEL\r\n$4\r\nidle\r\n") {
+		t.Errorf("Expected idle to be deleted in database 1:\n%s", log)
+	}
+
+	reloadTestAOF(t, path)
+	if v, _, _ := testServer.dbs[0].Get("counter"); v != "1" {
+		t.Errorf("Expected counter to be 1, got %q", v)
+	}
+}
+
+func TestAOF_TruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	for name, tail := range map[string]string{
+		"command":     "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1",
+		"bulk":        "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$5\r\nab",
+		"transaction": "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n",
+	} {
+		if err := os.WriteFile(path, []byte(complete+tail), 0644); err != nil {
+			t.Fatal(err)
+		}
+		testServer = newServer()
+		if _, err := testServer.loadAppendOnlyFile(path); err != nil {
+			t.Errorf("%s: expected a truncated log to load, got %v", name, err)
+			continue
+		}
+		if v, _, _ := testServer.dbs[0].Get("a"); v != "1" {
+			t.Errorf("%s: expected a to be 1, got %q", name, v)
+		}
+		if testServer.dbs[0].Exists("b") {
+			t.Errorf("%s: expected the incomplete write to be dropped", name)
+		}
+		if data, _ := os.ReadFile(path); string(data) != complete {
+			t.Errorf("%s: expected the log to be truncated, got %q", name, data)
+		}
+	}
+
+	os.WriteFile(path, []byte(complete+"garbage\r\n"), 0644)
+	if _, err := testServer.loadAppendOnlyFile(path); err == nil {
+		t.Error("Expected an error for a corrupt log")
+	}
+}
+
+// TestAOF_Rewrite checks that a rewrite keeps writes made while it runs.
+func TestAOF_Rewrite(t *testing.T) {
+	testServer = newServer()
+	path := useTestAOF(t, fsyncEverysec)
+
+	for i := 0; i < 100; i++ {
+		executeTestCommand([]string{"INCR", "counter"})
+	}
+	executeTestCommand([]string{"HSET", "hash", "f", "v", "g", "w"})
+	executeTestCommand([]string{"HEXPIRE", "hash", "100", "FIELDS", "1", "g"})
+	executeTestCommand([]string{"ZADD", "zset", "-inf", "low", "1.5", "mid"})
+	executeTestCommand([]string{"SADD", "set", "a", "b"})
+	executeTestCommand([]string{"SET", "ttl", "v", "PX", "100000"})
+	executeTestCommand([]string{"XADD", "stream", "1-1", "f", "v"})
+	executeTestCommand([]string{"XADD", "stream", "2-0", "f", "v"})
+	executeTestCommand([]string{"XDEL", "stream", "2-0"})
+	executeTestCommand([]string{"XGROUP", "CREATE", "stream", "group", "0"})
+	executeTestCommand([]string{"XREADGROUP", "GROUP", "group", "reader", "STREAMS", "stream", ">"})
+	executeTestCommand([]string{"XGROUP", "CREATECONSUMER", "stream", "group", "idle"})
+	executeTestCommand([]string{"XADD", "empty", "1-0", "f", "v"})
+	executeTestCommand([]string{"XDEL", "empty", "1-0"})
+
+	snaps, _, err := testServer.aof.startRewrite(testServer.dbs...)
+	if err != nil {
+		t.Fatalf("startRewrite: %v", err)
+	}
+	if _, _, err := testServer.aof.startRewrite(testServer.dbs...); err != errRewriteInProgress {
+		t.Errorf("Expected a rewrite in progress error, got %v", err)
+	}
+	executeTestCommand([]string{"INCR", "counter"})
+	executeTestCommand([]string{"RPUSH", "list", "x"})
+	if err := testServer.aof.finishRewrite(snaps, path); err != nil {
+		t.Fatalf("finishRewrite: %v", err)
+	}
+	// Writes after the rewrite go to the new file.
+	executeTestCommand([]string{"SADD", "set", "c"})
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "INCR"); n != 1 {
+		t.Errorf("Expected only the INCR made during the rewrite to be kept, got %d", n)
+	}
+
+	ttl := testServer.dbs[0].ExpireTime("ttl")
+	fieldTTL, _ := testServer.dbs[0].HExpireTime("hash", "f", "g")
+	reloadTestAOF(t, path)
+	if v, _, _ := testServer.dbs[0].Get("counter"); v != "101" {
+		t.Errorf("Expected counter to be 101, got %q", v)
+	}
+	if got := testServer.dbs[0].ExpireTime("ttl"); got != ttl {
+		t.Errorf("Expected the expiry to survive the rewrite, got %d", got)
+	}
+	if v, _, _ := testServer.dbs[0].HGet("hash", "f"); v != "v" {
+		t.Errorf("Expected hash field f to be v, got %q", v)
+	}
+	if got, _ := testServer.dbs[0].HExpireTime("hash", "f", "g"); !reflect.DeepEqual(got, fieldTTL) {
+		t.Errorf("Expected the field expiry times %v to survive the rewrite, got %v", fieldTTL, got)
+	}
+	if n, _ := testServer.dbs[0].ZCard("zset"); n != 2 {
+		t.Errorf("Expected 2 zset members, got %d", n)
+	}
+	if n, _ := testServer.dbs[0].SCard("set"); n != 3 {
+		t.Errorf("Expected 3 set members, got %d", n)
+	}
+	if list, _ := testServer.dbs[0].LRange("list", 0, -1); !reflect.DeepEqual(list, []string{"x"}) {
+		t.Errorf("Unexpected list %v", list)
+	}
+	// Streams keep their last ID, even once empty.
+	for key, want := range map[string]StreamID{"stream": {2, 0}, "empty": {1, 0}} {
+		if lastID, exists, _ := testServer.dbs[0].XLastID(key); !exists || lastID != want {
+			t.Errorf("%s: expected last ID %v, got %v", key, want, lastID)
+		}
+	}
+	if n, _ := testServer.dbs[0].XLen("stream"); n != 1 {
+		t.Errorf("Expected 1 stream entry, got %d", n)
+	}
+	pending, _ := testServer.dbs[0].XPending("stream", "group", PendingQuery{End: maxStreamID, Count: 10})
+	if len(pending) != 1 || pending[0].ID != (StreamID{1, 1}) || pending[0].Consumer != "reader" || pending[0].DeliveryCount != 1 {
+		t.Errorf("Unexpected pending entries %v", pending)
+	}
+	if consumers, _ := testServer.dbs[0].XInfoConsumers("stream", "group"); len(consumers) != 2 {
+		t.Errorf("Expected 2 consumers, got %v", consumers)
+	}
+}
+
+// TestAOF_Databases checks that writes to other databases are logged after a
+// SELECT, and that a rewrite keeps every database.
+func TestAOF_Databases(t *testing.T) {
+	testServer = newServer()
+	path := useTestAOF(t, fsyncAlways)
+
+	c0, c2 := testServer.newClient(io.Discard), testServer.newClient(io.Discard)
+	executeClientCommand(c2, []string{"SELECT", "2"})
+	executeClientCommand(c2, []string{"SET", "a", "2"})
+	executeClientCommand(c0, []string{"SET", "a", "0"})
+	executeClientCommand(c2, []string{"SET", "b", "2"})
+	executeClientCommand(c2, []string{"MOVE", "b", "5"})
+
+	check := func(when string) {
+		t.Helper()
+		for _, want := range []struct {
+			db         int
+			key, value string
+		}{{0, "a", "0"}, {2, "a", "2"}, {2, "b", ""}, {5, "b", "2"}} {
+			if v, _, _ := testServer.dbs[want.db].Get(want.key); v != want.value {
+				t.Errorf("%s: expected %s in database %d to be %q, got %q", when, want.key, want.db, want.value, v)
+			}
+		}
+	}
+	if loaded := reloadTestAOF(t, path); loaded != 7 {
+		t.Errorf("Expected 4 writes and 3 SELECTs replayed, got %d", loaded)
+	}
+	check("replayed")
+
+	testServer.aof.open(path, fsyncAlways)
+	snaps, _, err := testServer.aof.startRewrite(testServer.dbs...)
+	if err != nil {
+		t.Fatalf("startRewrite: %v", err)
+	}
+	// Collected during the rewrite, so it must select its database again.
+	executeClientCommand(testServer.newClient(io.Discard), []string{"SET", "c", "0"})
+	if err := testServer.aof.finishRewrite(snaps, path); err != nil {
+		t.Fatalf("finishRewrite: %v", err)
+	}
+	reloadTestAOF(t, path)
+	check("rewritten")
+	if v, _, _ := testServer.dbs[0].Get("c"); v != "0" {
+		t.Errorf("Expected c in database 0, got %q", v)
+	}
+}
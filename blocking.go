@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Blocking commands, such as XREAD with BLOCK, park the client until one of
+// its keys is ready. The command first runs as usual; when it finds nothing
+// to return, its handler calls blockForKeys and returns nil, and the client's
+// goroutine then waits for a reply without holding keyspaceLock.
+//
+// Writes that may make a key ready call signalKeyAsReady. Once the write is
+// done, and still holding keyspaceLock exclusively, the server runs the
+// commands of the clients blocked on the ready keys again on their behalf, in
+// the order the clients blocked, and hands the reply to each one that could
+// be served. So the client that blocked first is served first, and it is
+// served atomically with the write that woke it, like in Redis.
+
+// blockRequest is what a blocked client waits for.
+type blockRequest struct {
+	// command runs again whenever one of keys of database db is ready.
+	command []string
+	db      int
+	keys    []string
+	// deadline is when the client gives up and gets timeoutReply, or zero
+	// to wait forever.
+	deadline     time.Time
+	timeoutReply []byte
+	// reply receives the reply of the command once it could be served.
+	reply chan []byte
+}
+
+// blockingKey is a key of one of the databases.
+type blockingKey struct {
+	db  int
+	key string
+}
+
+// blockingState tracks the blocked clients of a server.
+type blockingState struct {
+	// mu guards waiting, which clients blocking and timing out holding
+	// keyspaceLock shared may update concurrently.
+	mu sync.Mutex
+	// waiting lists the clients blocked on each key, in the order they
+	// blocked.
+	waiting map[blockingKey][]*client
+
+	// ready lists the keys signalled since the blocked clients were last
+	// served. It is only used holding keyspaceLock exclusively.
+	ready    []blockingKey
+	readySet map[blockingKey]struct{}
+}
+
+func newBlockingState() *blockingState {
+	return &blockingState{
+		waiting:  make(map[blockingKey][]*client),
+		readySet: make(map[blockingKey]struct{}),
+	}
+}
+
+func (b *blockingState) add(c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range c.blocked.keys {
+		bk := blockingKey{c.blocked.db, key}
+		b.waiting[bk] = append(b.waiting[bk], c)
+	}
+}
+
+// remove unregisters a blocked client and reports whether it was still
+// waiting.
+func (b *blockingState) remove(c *client) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.removeLocked(c)
+}
+
+// removeID unregisters the blocked client with the given ID, and returns
+// what it was waiting for, or nil if it was not waiting.
+func (b *blockingState) removeID(id int64) *blockRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, clients := range b.waiting {
+		for _, c := range clients {
+			if c.id == id {
+				b.removeLocked(c)
+				return c.blocked
+			}
+		}
+	}
+	return nil
+}
+
+func (b *blockingState) removeLocked(c *client) bool {
+	removed := false
+	for _, key := range c.blocked.keys {
+		bk := blockingKey{c.blocked.db, key}
+		clients := b.waiting[bk]
+		for i, other := range clients {
+			if other == c {
+				clients = append(clients[:i:i], clients[i+1:]...)
+				removed = true
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(b.waiting, bk)
+		} else {
+			b.waiting[bk] = clients
+		}
+	}
+	return removed
+}
+
+// waitingOn returns the clients blocked on key of database db.
+func (b *blockingState) waitingOn(db int, key string) []*client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*client(nil), b.waiting[blockingKey{db, key}]...)
+}
+
+// signal marks key of database db ready.
+func (b *blockingState) signal(db int, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bk := blockingKey{db, key}
+	if _, queued := b.readySet[bk]; queued || len(b.waiting[bk]) == 0 {
+		return
+	}
+	b.readySet[bk] = struct{}{}
+	b.ready = append(b.ready, bk)
+}
+
+// signalDBs marks ready every key that clients of databases dbs are blocked
+// on, for when the keys of those databases changed wholesale.
+func (b *blockingState) signalDBs(dbs ...int) {
+	b.mu.Lock()
+	keys := make([]blockingKey, 0, len(b.waiting))
+	for bk := range b.waiting {
+		if slices.Contains(dbs, bk.db) {
+			keys = append(keys, bk)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, bk := range keys {
+		b.signal(bk.db, bk.key)
+	}
+}
+
+func (b *blockingState) nextReady() (blockingKey, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.ready) == 0 {
+		return blockingKey{}, false
+	}
+	key := b.ready[0]
+	b.ready = b.ready[1:]
+	delete(b.readySet, key)
+	return key, true
+}
+
+// blockForKeys blocks the client running command until one of keys is ready,
+// or replies with timeoutReply once timeout has elapsed, 0 meaning never.
+// Handlers call it when they have nothing to return and reply with its
+// result. Commands never block inside a transaction, and while the command
+// runs again for a client that is still blocked, nil tells the server to
+// keep waiting.
+func blockForKeys(c *client, command, keys []string, timeout time.Duration, timeoutReply []byte) []byte {
+	if c.retryBlocked {
+		return nil
+	}
+	if c.inExec || c.isMaster {
+		return timeoutReply
+	}
+
+	c.blocked = &blockRequest{
+		command:      command,
+		db:           c.dbid,
+		keys:         keys,
+		timeoutReply: timeoutReply,
+		reply:        make(chan []byte, 1),
+	}
+	if timeout > 0 {
+		c.blocked.deadline = time.Now().Add(timeout)
+	}
+	c.srv.blocking.add(c)
+	return nil
+}
+
+// parseBlockTimeout parses the timeout of a blocking list command, in seconds
+// with an optional fraction, 0 meaning forever.
+func parseBlockTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	// Like Redis, the timeout is rounded up to whole milliseconds.
+	ms := math.Ceil(seconds * 1000)
+	if ms > float64(math.MaxInt64/int64(time.Millisecond)) {
+		return 0, errors.New("ERR timeout is out of range")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// signalKeyAsReady tells the clients blocked on key that it may have
+// something for them. Callers must hold keyspaceLock exclusively.
+func signalKeyAsReady(c *client, key string) {
+	c.srv.blocking.signal(c.dbid, key)
+}
+
+// serveBlockedClients runs the commands of the clients blocked on the keys
+// signalled ready, until no key is left ready. Callers must hold keyspaceLock
+// exclusively.
+func (srv *server) serveBlockedClients() {
+	for {
+		key, ok := srv.blocking.nextReady()
+		if !ok {
+			return
+		}
+		for _, w := range srv.blocking.waitingOn(key.db, key.key) {
+			w.retryBlocked = true
+			reply := call(w, w.blocked.command)
+			w.retryBlocked = false
+			if reply == nil {
+				continue
+			}
+			srv.blocking.remove(w)
+			w.blocked.reply <- reply
+		}
+	}
+}
+
+// waitUnblocked waits until the blocked client is served, times out or
+// disconnects, and returns its reply.
+func (srv *server) waitUnblocked(c *client) []byte {
+	req := c.blocked
+	defer func() { c.blocked = nil }()
+
+	var timeout <-chan time.Time
+	if !req.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(req.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	gone, stopWatching := watchDisconnect(c)
+	defer stopWatching()
+
+	select {
+	case reply := <-req.reply:
+		return reply
+	case <-timeout:
+	case <-gone:
+	}
+
+	// The client is served holding keyspaceLock exclusively, so it either is
+	// still waiting or already has its reply.
+	srv.keyspaceLock.RLock()
+	removed := srv.blocking.remove(c)
+	srv.keyspaceLock.RUnlock()
+	if !removed {
+		return <-req.reply
+	}
+	return req.timeoutReply
+}
+
+// unblockClient ends the wait of the blocked client with the given ID, with
+// the reply it gets on timeout or with an UNBLOCKED error, and reports
+// whether it was blocked. Callers must hold keyspaceLock.
+func (srv *server) unblockClient(id int64, withError bool) bool {
+	req := srv.blocking.removeID(id)
+	if req == nil {
+		return false
+	}
+	reply := req.timeoutReply
+	if withError {
+		reply = SerializeError("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+	}
+	req.reply <- reply
+	return true
+}
+
+// watchDisconnect returns a channel that is closed if the client's connection
+// is closed while it is blocked, and a function that stops watching, which
+// must be called before the connection is read from again.
+//
+// The connection itself is read, whatever the client pipelined before, and
+// what arrives is kept in c.in for the commands that follow. The goroutine
+// reading it owns c.in.ahead while the client is blocked: the client's read
+// loop is waiting for the blocked command's reply meanwhile, and the stop
+// function interrupts the goroutine's Read with a deadline and waits for it
+// to exit, so its writes to the buffer happen before the loop reads on.
+func watchDisconnect(c *client) (<-chan struct{}, func()) {
+	if c.in == nil {
+		return nil, func() {}
+	}
+	conn := c.in.conn
+
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			c.in.ahead.Write(buf[:n])
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					close(gone)
+				}
+				return
+			}
+		}
+	}()
+	return gone, func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
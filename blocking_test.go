@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until n clients are blocked on key.
+func waitBlocked(t *testing.T, srv *server, key string, n int) {
+	t.Helper()
+	waitFor(t, "clients to block", func() bool {
+		srv.keyspaceLock.RLock()
+		defer srv.keyspaceLock.RUnlock()
+		return len(srv.blocking.waitingOn(0, key)) == n
+	})
+}
+
+// receive returns the next reply sent on replies.
+func receive(t *testing.T, replies <-chan string) string {
+	t.Helper()
+	select {
+	case reply := <-replies:
+		return reply
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a blocked client to be served")
+		return ""
+	}
+}
+
+func TestProcessCommand_BlockingPops(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"RPUSH", "list", "a", "b", "c", "d"})
+	executeTestCommand([]string{"SET", "str", "v"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"BLPOP", "missing", "list", "0"}, "*2\r\n$4\r\nlist\r\n$1\r\na\r\n"},
+		{[]string{"BRPOP", "list", "0"}, "*2\r\n$4\r\nlist\r\n$1\r\nd\r\n"},
+		{[]string{"BLPOP", "str", "list", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"BLPOP", "list", "-1"}, "-ERR timeout is negative\r\n"},
+		{[]string{"BLPOP", "list", "soon"}, "-ERR timeout is not a float or out of range\r\n"},
+		{[]string{"BLMOVE", "list", "other", "RIGHT", "LEFT", "0"}, "$1\r\nc\r\n"},
+		{[]string{"BLMOVE", "list", "other", "UP", "LEFT", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"BLMOVE", "list", "str", "LEFT", "LEFT", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"LRANGE", "other", "0", "-1"}, "*1\r\n$1\r\nc\r\n"},
+		{[]string{"RPUSH", "list", "e", "f"}, ":3\r\n"},
+		{[]string{"BLMPOP", "0", "2", "missing", "list", "RIGHT", "COUNT", "2"}, "*2\r\n$4\r\nlist\r\n*2\r\n$1\r\nf\r\n$1\r\ne\r\n"},
+		{[]string{"BLMPOP", "0", "1", "list", "LEFT", "COUNT", "10"}, "*2\r\n$4\r\nlist\r\n*1\r\n$1\r\nb\r\n"},
+		{[]string{"EXISTS", "list"}, ":0\r\n"},
+		{[]string{"BLMPOP", "0", "0", "list", "LEFT"}, "-ERR numkeys should be greater than 0\r\n"},
+		{[]string{"BLMPOP", "0", "2", "list", "LEFT"}, "-ERR syntax error\r\n"},
+		{[]string{"BLMPOP", "0", "1", "list", "LEFT", "COUNT", "0"}, "-ERR count should be greater than 0\r\n"},
+		{[]string{"BLMPOP", "0", "1", "list", "LEFT", "BOGUS"}, "-ERR syntax error\r\n"},
+		// Timeouts are in seconds, with a fraction.
+		{[]string{"BLPOP", "list", "0.01"}, "*-1\r\n"},
+		{[]string{"BLMOVE", "list", "other", "LEFT", "LEFT", "0.01"}, "$-1\r\n"},
+		{[]string{"BLMPOP", "0.01", "1", "list", "LEFT"}, "*-1\r\n"},
+	}
+
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	// Inside a transaction, blocking commands reply as if they timed out.
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"BLPOP", "list", "0"})
+	if got := string(executeClientCommand(c, []string{"EXEC"})); got != "*1\r\n*-1\r\n" {
+		t.Errorf("Expected BLPOP not to block in MULTI, got %q", got)
+	}
+}
+
+func TestProcessCommand_BLPOP_Wakeup(t *testing.T) {
+	testServer = newServer()
+
+	// Clients are served in the order they blocked, one element each.
+	replies := make([]chan string, 3)
+	for i := range replies {
+		replies[i] = make(chan string, 1)
+		go func() {
+			replies[i] <- string(executeTestCommand([]string{"BLPOP", "queue", "0"}))
+		}()
+		waitBlocked(t, testServer, "queue", i+1)
+	}
+	executeTestCommand([]string{"RPUSH", "queue", "a", "b"})
+	for i, want := range []string{"a", "b"} {
+		if got := receive(t, replies[i]); got != "*2\r\n$5\r\nqueue\r\n$1\r\n"+want+"\r\n" {
+			t.Errorf("Expected %s, got %q", want, got)
+		}
+	}
+	if n := len(testServer.blocking.waitingOn(0, "queue")); n != 1 {
+		t.Errorf("Expected 1 client left waiting, got %d", n)
+	}
+
+	// A transaction wakes the client once it is done, when the list holds
+	// what it left.
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"LPUSH", "queue", "x"})
+	executeClientCommand(c, []string{"RPUSH", "queue", "y"})
+	executeClientCommand(c, []string{"EXEC"})
+	if got := receive(t, replies[2]); got != "*2\r\n$5\r\nqueue\r\n$1\r\nx\r\n" {
+		t.Errorf("Expected x, got %q", got)
+	}
+
+	// BLMOVE pushing to a list serves the clients blocked on it.
+	executeTestCommand([]string{"DEL", "queue"})
+	moved, popped := make(chan string, 1), make(chan string, 1)
+	go func() {
+		moved <- string(executeTestCommand([]string{"BLMOVE", "src", "queue", "LEFT", "RIGHT", "0"}))
+	}()
+	waitBlocked(t, testServer, "src", 1)
+	go func() {
+		popped <- string(executeTestCommand([]string{"BRPOP", "queue", "0"}))
+	}()
+	waitBlocked(t, testServer, "queue", 1)
+	executeTestCommand([]string{"LPUSH", "src", "z"})
+	if got := receive(t, moved); got != "$1\r\nz\r\n" {
+		t.Errorf("Expected BLMOVE to move z, got %q", got)
+	}
+	if got := receive(t, popped); got != "*2\r\n$5\r\nqueue\r\n$1\r\nz\r\n" {
+		t.Errorf("Expected BRPOP to pop z, got %q", got)
+	}
+}
+
+func TestProcessCommand_CLIENT_UNBLOCK(t *testing.T) {
+	testServer = newServer()
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"CLIENT", "UNBLOCK", "12345"}, ":0\r\n"},
+		{[]string{"CLIENT", "UNBLOCK", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"CLIENT", "UNBLOCK", "1", "LATER"}, "-ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR\r\n"},
+		{[]string{"CLIENT", "ID", "extra"}, "-ERR wrong number of arguments for 'client|id' command\r\n"},
+		{[]string{"CLIENT", "BOGUS"}, "-ERR unknown subcommand 'BOGUS'. Try CLIENT HELP.\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	first, second := testServer.newClient(io.Discard), testServer.newClient(io.Discard)
+	if got, want := string(executeClientCommand(second, []string{"CLIENT", "ID"})), ":"+strconv.FormatInt(second.id, 10)+"\r\n"; got != want || second.id <= first.id {
+		t.Errorf("Expected CLIENT ID to be %q, got %q", want, got)
+	}
+
+	for _, reason := range []string{"TIMEOUT", "ERROR"} {
+		replies := make(chan string, 1)
+		go func() {
+			replies <- string(executeClientCommand(first, []string{"BLPOP", "queue", "0"}))
+		}()
+		waitBlocked(t, testServer, "queue", 1)
+		if got := string(executeTestCommand([]string{"CLIENT", "UNBLOCK", strconv.FormatInt(first.id, 10), reason})); got != ":1\r\n" {
+			t.Errorf("Expected CLIENT UNBLOCK to unblock the client, got %q", got)
+		}
+		want := "*-1\r\n"
+		if reason == "ERROR" {
+			want = "-UNBLOCKED client unblocked via CLIENT UNBLOCK\r\n"
+		}
+		if got := receive(t, replies); got != want {
+			t.Errorf("%s: expected %q, got %q", reason, want, got)
+		}
+	}
+	if n := len(testServer.blocking.waitingOn(0, "queue")); n != 0 {
+		t.Errorf("Expected no client left waiting, got %d", n)
+	}
+}
+
+// TestBlocking_Disconnect checks that a client that disconnects while blocked
+// stops waiting, so that what is pushed next goes to the next client.
+func TestBlocking_Disconnect(t *testing.T) {
+	srv := startTestServer(t)
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(serializeStringArray([]string{"BLPOP", "queue", "0"}))
+	waitBlocked(t, srv, "queue", 1)
+	conn.Close()
+	waitBlocked(t, srv, "queue", 0)
+
+	other, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(serializeStringArray([]string{"BLPOP", "queue", "0"}))
+	waitBlocked(t, srv, "queue", 1)
+	executeClientCommand(srv.newClient(io.Discard), []string{"RPUSH", "queue", "job"})
+
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ReadRESP(bufio.NewReader(other))
+	if err != nil || len(reply.Array) != 2 || reply.Array[1].Bulk != "job" {
+		t.Errorf("Expected the job to go to the connected client, got %v, %v", reply, err)
+	}
+}
+
+// TestBlocking_DisconnectPipelined checks that a disconnect is noticed when
+// the client pipelined commands after the blocking one, and that those
+// commands run in order once the client is served.
+func TestBlocking_DisconnectPipelined(t *testing.T) {
+	srv := startTestServer(t)
+	blpop, ping := serializeStringArray([]string{"BLPOP", "queue", "0"}), serializeStringArray([]string{"PING"})
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(blpop, ping...))
+	waitBlocked(t, srv, "queue", 1)
+	conn.Close()
+	waitBlocked(t, srv, "queue", 0)
+
+	other, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(append(blpop, ping...))
+	waitBlocked(t, srv, "queue", 1)
+	// Sent while blocked, so read ahead by the server.
+	other.Write(serializeStringArray([]string{"ECHO", "later"}))
+	time.Sleep(20 * time.Millisecond)
+	executeClientCommand(srv.newClient(io.Discard), []string{"RPUSH", "queue", "job"})
+
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(other)
+	reply, err := ReadRESP(reader)
+	if err != nil || len(reply.Array) != 2 || reply.Array[1].Bulk != "job" {
+		t.Fatalf("Expected the job, got %v, %v", reply, err)
+	}
+	for _, want := range []string{"PONG", "later"} {
+		if reply, err := ReadRESP(reader); err != nil || reply.Str != want && reply.Bulk != want {
+			t.Errorf("Expected %s, got %v, %v", want, reply, err)
+		}
+	}
+}
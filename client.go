@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// client is the per-connection state that commands run against.
+//
+// mu is held while the client's own command runs and its reply is written,
+// and by anyone pushing an out-of-band message to it, so pushed messages can
+// never interleave with or overtake a reply.
+type client struct {
+	// id identifies the client for CLIENT commands, in the order clients
+	// connected.
+	id int64
+
+	mu   sync.Mutex
+	conn io.Writer
+	// reader buffers what the client sends, if it is connected, read from
+	// in.
+	reader *bufio.Reader
+	in     *connReader
+
+	srv *server
+	// db is the database selected with SELECT, numbered dbid.
+	db   DataStore
+	dbid int
+
+	// Pub/sub subscriptions, guarded by the server's pubsub.mu.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// Transaction state: commands queued since MULTI, and whether one of
+	// them was rejected so that EXEC must abort.
+	inMulti    bool
+	multiQueue [][]string
+	multiError bool
+
+	// inExec is set while EXEC runs the queue, and execPropagated once the
+	// MULTI wrapping its writes has been propagated.
+	inExec         bool
+	execPropagated bool
+
+	// propagateAs, when set by a write command's handler, is propagated in
+	// place of the command as sent. preventPropagation suppresses it.
+	propagateAs        []string
+	preventPropagation bool
+
+	// isMaster marks the client that applies the replication stream from
+	// this server's master; it may write even though the server is a
+	// replica. replListeningPort is the port a replica reported with
+	// REPLCONF listening-port.
+	isMaster          bool
+	replListeningPort string
+
+	// asking is set by ASKING to let the next command reach a cluster slot
+	// that is being imported.
+	asking bool
+
+	// blocked is set while the client waits in a blocking command, and
+	// retryBlocked while that command runs again for it.
+	blocked      *blockRequest
+	retryBlocked bool
+
+	// closeAfterReply is set by QUIT to end the connection once the reply
+	// has been written.
+	closeAfterReply bool
+}
+
+// connReader reads a client's connection, starting with what was read ahead
+// of reader while the client was blocked.
+type connReader struct {
+	conn  net.Conn
+	ahead bytes.Buffer
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if r.ahead.Len() > 0 {
+		return r.ahead.Read(p)
+	}
+	return r.conn.Read(p)
+}
+
+var errDBIndex = errors.New("ERR DB index is out of range")
+
+// selectDB switches the client to database dbid.
+func (c *client) selectDB(dbid int) error {
+	if dbid < 0 || dbid >= len(c.srv.dbs) {
+		return errDBIndex
+	}
+	c.db, c.dbid = c.srv.dbs[dbid], dbid
+	return nil
+}
+
+// push writes an out-of-band message, such as a published message, to the
+// client.
+func (c *client) push(msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(msg)
+}
+
+// addr returns the client's remote address, or "" if it has no connection.
+func (c *client) addr() string {
+	if conn, ok := c.conn.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// close drops the client's connection, which ends its read loop.
+func (c *client) close() {
+	if closer, ok := c.conn.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// resetMulti leaves the transaction state.
+func (c *client) resetMulti() {
+	c.inMulti = false
+	c.multiQueue = nil
+	c.multiError = false
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// clusterSlots is the number of hash slots the keyspace is divided into.
+const clusterSlots = 16384
+
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys with.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the slot of key. When the key contains a {hash tag},
+// only the tag is hashed, so that related keys can share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+// clusterNode is a node of the cluster as this node knows it.
+type clusterNode struct {
+	id    string
+	host  string
+	port  int
+	epoch int // the node's position in the config file
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+// clusterState is the slot layout of a static cluster: which node serves
+// each slot, and which slots this node is moving to or from another.
+type clusterState struct {
+	mu        sync.RWMutex
+	myself    *clusterNode
+	nodes     []*clusterNode // in config order
+	slots     [clusterSlots]*clusterNode
+	migrating map[int]*clusterNode // slots of ours being moved to a node
+	importing map[int]*clusterNode // slots being moved here from a node
+}
+
+// loadClusterConfig reads the cluster layout from the file at path. The node
+// listening on port is this one.
+func loadClusterConfig(path string, port int) (*clusterState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseClusterConfig(f, port)
+}
+
+// parseClusterConfig parses a cluster layout with one line per node:
+//
+//	<id> <host:port> [<slot> | <first>-<last> | [<slot>->-<id>] | [<slot>-<-<id>] ...]
+//
+// Slots are given one by one or as ranges. Like in CLUSTER NODES, [slot->-id]
+// marks a slot this node is migrating to node id, and [slot-<-id] one it is
+// importing from it. Blank lines and lines starting with # are ignored.
+func parseClusterConfig(r io.Reader, port int) (*clusterState, error) {
+	cs := &clusterState{
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+	}
+	byID := make(map[string]*clusterNode)
+	type pendingMove struct {
+		node, other string
+		slot        int
+		importing   bool
+	}
+	var moves []pendingMove
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		bad := func(format string, args ...any) error {
+			return fmt.Errorf("cluster config line %d: %s", lineno, fmt.Sprintf(format, args...))
+		}
+		if len(fields) < 2 {
+			return nil, bad("expected a node id and address")
+		}
+
+		// Accept the host:port@cport,hostname form of CLUSTER NODES.
+		address, _, _ := strings.Cut(fields[1], "@")
+		address, _, _ = strings.Cut(address, ",")
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, bad("bad address %q", fields[1])
+		}
+		nodePort, err := strconv.Atoi(portStr)
+		if err != nil || nodePort <= 0 || nodePort > 65535 {
+			return nil, bad("bad port in %q", fields[1])
+		}
+		id := fields[0]
+		if byID[id] != nil {
+			return nil, bad("duplicate node id %s", id)
+		}
+		node := &clusterNode{id: id, host: host, port: nodePort, epoch: len(cs.nodes) + 1}
+		byID[id] = node
+		cs.nodes = append(cs.nodes, node)
+		if nodePort == port {
+			if cs.myself != nil {
+				return nil, bad("more than one node with port %d", port)
+			}
+			cs.myself = node
+		}
+
+		for _, spec := range fields[2:] {
+			if strings.HasPrefix(spec, "[") && strings.HasSuffix(spec, "]") {
+				spec = spec[1 : len(spec)-1]
+				move := pendingMove{node: id}
+				var slot string
+				if s, other, ok := strings.Cut(spec, "->-"); ok {
+					slot, move.other = s, other
+				} else if s, other, ok := strings.Cut(spec, "-<-"); ok {
+					slot, move.other, move.importing = s, other, true
+				} else {
+					return nil, bad("bad slot migration %q", spec)
+				}
+				if move.slot, err = parseSlot(slot); err != nil {
+					return nil, bad("%v", err)
+				}
+				moves = append(moves, move)
+				continue
+			}
+
+			first, last := spec, spec
+			if a, b, ok := strings.Cut(spec, "-"); ok {
+				first, last = a, b
+			}
+			start, err := parseSlot(first)
+			if err != nil {
+				return nil, bad("%v", err)
+			}
+			end, err := parseSlot(last)
+			if err != nil || end < start {
+				return nil, bad("bad slot range %q", spec)
+			}
+			for slot := start; slot <= end; slot++ {
+				if cs.slots[slot] != nil {
+					return nil, bad("slot %d is already served by %s", slot, cs.slots[slot].id)
+				}
+				cs.slots[slot] = node
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cs.myself == nil {
+		return nil, fmt.Errorf("no node in the cluster config listens on port %d", port)
+	}
+
+	// Only this node's own migrations matter to it.
+	for _, move := range moves {
+		other := byID[move.other]
+		if other == nil {
+			return nil, fmt.Errorf("cluster config: slot %d migrates to or from unknown node %s", move.slot, move.other)
+		}
+		if move.node != cs.myself.id {
+			continue
+		}
+		if move.importing {
+			cs.importing[move.slot] = other
+		} else {
+			cs.migrating[move.slot] = other
+		}
+	}
+	return cs, nil
+}
+
+func parseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, fmt.Errorf("invalid slot %q", arg)
+	}
+	return slot, nil
+}
+
+// redirect checks that this node can serve a command on keys. It returns the
+// error that sends the client elsewhere, or nil. asking is set when the
+// client sent ASKING, which lets it reach a slot being imported.
+func (cs *clusterState) redirect(db DataStore, keys []string, asking bool) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return SerializeError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	owner := cs.slots[slot]
+	if owner == nil {
+		return SerializeError("CLUSTERDOWN Hash slot not served")
+	}
+	migratingTo, importingFrom := cs.migrating[slot], cs.importing[slot]
+	if owner != cs.myself && (importingFrom == nil || !asking) {
+		return SerializeError(fmt.Sprintf("MOVED %d %s", slot, owner.addr()))
+	}
+	if migratingTo == nil && importingFrom == nil {
+		return nil
+	}
+
+	// While a slot moves, its keys are on either node: a key that is not
+	// here anymore may already be on the target.
+	missing := 0
+	for _, key := range keys {
+		if !db.Exists(key) {
+			missing++
+		}
+	}
+	switch {
+	case missing == 0:
+		return nil
+	case len(keys) > 1 && (missing < len(keys) || importingFrom != nil):
+		return SerializeError("TRYAGAIN Multiple keys request during rehashing of slot")
+	case migratingTo != nil && owner == cs.myself:
+		return SerializeError(fmt.Sprintf("ASK %d %s", slot, migratingTo.addr()))
+	}
+	return nil
+}
+
+// clusterRedirect returns the error redirecting c's command, or nil when this
+// node serves it. EXEC is checked against every queued command, which must
+// all go to one slot.
+func clusterRedirect(c *client, cmd redisCommand, command []string, asking bool) []byte {
+	if c.srv.cluster == nil || c.isMaster {
+		return nil
+	}
+	var keys []string
+	if command[0] == "EXEC" && c.inMulti {
+		for _, queued := range c.multiQueue {
+			if queuedCmd, ok := commandRegistry[queued[0]]; ok {
+				keys = append(keys, commandKeys(queuedCmd, queued)...)
+			}
+		}
+	} else {
+		keys = commandKeys(cmd, command)
+	}
+	return c.srv.cluster.redirect(c.db, keys, asking)
+}
+
+func (cs *clusterState) node(id string) *clusterNode {
+	for _, n := range cs.nodes {
+		if n.id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// slotRange is a run of consecutive slots served by one node.
+type slotRange struct {
+	start, end int
+	node       *clusterNode
+}
+
+// slotRanges returns the runs of slots served by each node, in slot order.
+// Callers must hold cs.mu.
+func (cs *clusterState) slotRanges() []slotRange {
+	var ranges []slotRange
+	for slot := 0; slot < clusterSlots; slot++ {
+		node := cs.slots[slot]
+		if node == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].node == node && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{slot, slot, node})
+	}
+	return ranges
+}
+
+// nodesDescription returns the CLUSTER NODES reply.
+func (cs *clusterState) nodesDescription() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	ranges := cs.slotRanges()
+	var b strings.Builder
+	for _, n := range cs.nodes {
+		flags := "master"
+		if n == cs.myself {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s@%d %s - 0 0 %d connected", n.id, n.addr(), n.port+10000, flags, n.epoch)
+		for _, r := range ranges {
+			if r.node != n {
+				continue
+			}
+			if r.start == r.end {
+				fmt.Fprintf(&b, " %d", r.start)
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r.start, r.end)
+			}
+		}
+		if n == cs.myself {
+			for _, slot := range sortedSlots(cs.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cs.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(cs.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cs.importing[slot].id)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func sortedSlots(slots map[int]*clusterNode) []int {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// info returns the CLUSTER INFO reply.
+func (cs *clusterState) info() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	assigned := 0
+	masters := make(map[*clusterNode]bool)
+	for _, node := range cs.slots {
+		if node != nil {
+			assigned++
+			masters[node] = true
+		}
+	}
+	state := "ok"
+	if assigned < clusterSlots {
+		state = "fail"
+	}
+	return fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n",
+		state, assigned, assigned, len(cs.nodes), len(masters), len(cs.nodes), cs.myself.epoch)
+}
+
+var errClusterUnknownNode = errors.New("ERR I don't know about node")
+
+// setSlot applies CLUSTER SETSLOT. db is checked for keys left in a slot
+// handed to another node.
+func (cs *clusterState) setSlot(db DataStore, slot int, action, nodeID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var node *clusterNode
+	if action != "STABLE" {
+		if node = cs.node(nodeID); node == nil {
+			return fmt.Errorf("%v %s", errClusterUnknownNode, nodeID)
+		}
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cs.slots[slot] != cs.myself {
+			return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if node == cs.myself {
+			return errors.New("ERR Target node is myself")
+		}
+		cs.migrating[slot] = node
+	case "IMPORTING":
+		if cs.slots[slot] == cs.myself {
+			return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		if node == cs.myself {
+			return errors.New("ERR Source node is myself")
+		}
+		cs.importing[slot] = node
+	case "STABLE":
+		delete(cs.migrating, slot)
+		delete(cs.importing, slot)
+	case "NODE":
+		if cs.slots[slot] == cs.myself && node != cs.myself && countKeysInSlot(db, slot) > 0 {
+			return fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		cs.slots[slot] = node
+		delete(cs.migrating, slot)
+		if node == cs.myself {
+			delete(cs.importing, slot)
+		}
+	}
+	return nil
+}
+
+// keysInSlot returns up to count of the keys in slot, sorted.
+func keysInSlot(db DataStore, slot, count int) []string {
+	var keys []string
+	db.ForEachKey(func(key string) bool {
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys[:min(count, len(keys))]
+}
+
+func countKeysInSlot(db DataStore, slot int) int {
+	n := 0
+	db.ForEachKey(func(key string) bool {
+		if keyHashSlot(key) == slot {
+			n++
+		}
+		return true
+	})
+	return n
+}
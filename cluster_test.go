@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("Expected 0x31c3, got %#x", got)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	tests := []struct {
+		key    string
+		hashed string
+	}{
+		{"foo", "foo"},
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+		{"foo{}{bar}", "foo{}{bar}"}, // an empty tag hashes the whole key
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{bar}{zap}", "bar"},
+		{"{unclosed", "{unclosed"},
+	}
+	for _, test := range tests {
+		if got, want := keyHashSlot(test.key), int(crc16(test.hashed)&(clusterSlots-1)); got != want {
+			t.Errorf("%q: expected slot %d, got %d", test.key, want, got)
+		}
+	}
+	if slot := keyHashSlot("foo"); slot != 12182 {
+		t.Errorf("Expected foo in slot 12182, got %d", slot)
+	}
+}
+
+const testClusterConfig = `
+# Two nodes splitting the slots in half. Slot 5061 (key "bar") moves from a to b.
+node-a 127.0.0.1:7000 0-8191 [5061->-node-b]
+node-b 127.0.0.1:7001@17001 8192-16383 [5061-<-node-a]
+`
+
+// useTestCluster makes testServer the node listening on port.
+func useTestCluster(t *testing.T, config string, port int) {
+	t.Helper()
+	cs, err := parseClusterConfig(strings.NewReader(config), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer = newServer()
+	testServer.cluster = cs
+}
+
+func TestClusterConfig_Errors(t *testing.T) {
+	for name, config := range map[string]string{
+		"overlap":      "a 127.0.0.1:7000 0-100\nb 127.0.0.1:7001 100-200",
+		"no myself":    "a 127.0.0.1:7001 0-100",
+		"bad range":    "a 127.0.0.1:7000 100-0",
+		"bad slot":     "a 127.0.0.1:7000 16384",
+		"unknown node": "a 127.0.0.1:7000 0-100 [5->-c]",
+		"duplicate":    "a 127.0.0.1:7000\na 127.0.0.1:7001",
+	} {
+		if _, err := parseClusterConfig(strings.NewReader(config), 7000); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCluster_Redirection(t *testing.T) {
+	useTestCluster(t, "node-a 127.0.0.1:7000 0-8191\nnode-b 127.0.0.1:7001 8192-16383", 7000)
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"SET", "bar", "1"}, "+OK\r\n"},
+		{[]string{"GET", "foo"}, "-MOVED 12182 127.0.0.1:7001\r\n"},
+		{[]string{"SET", "{bar}.x", "2"}, "+OK\r\n"},
+		{[]string{"GEOSEARCHSTORE", "bar", "foo", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"CLUSTER", "KEYSLOT", "{bar}.x"}, ":5061\r\n"},
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "5061"}, ":2\r\n"},
+		{[]string{"CLUSTER", "GETKEYSINSLOT", "5061", "1"}, "*1\r\n$3\r\nbar\r\n"},
+		{[]string{"CLUSTER", "MYID"}, "$6\r\nnode-a\r\n"},
+		{[]string{"ASKING"}, "+OK\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"SET", "bar", "1"})
+	executeClientCommand(c, []string{"SET", "hello", "1"}) // slot 866, also served here
+	if got := string(executeClientCommand(c, []string{"EXEC"})); got != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+		t.Errorf("Expected EXEC across slots to fail, got %q", got)
+	}
+	if c.inMulti {
+		t.Error("Expected the transaction to be discarded")
+	}
+
+	slots := string(executeTestCommand([]string{"CLUSTER", "SLOTS"}))
+	want := "*2\r\n*3\r\n:0\r\n:8191\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$6\r\nnode-a\r\n" +
+		"*3\r\n:8192\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$6\r\nnode-b\r\n"
+	if slots != want {
+		t.Errorf("Unexpected CLUSTER SLOTS reply %q", slots)
+	}
+}
+
+// TestCluster_Migration checks the ASK redirections while slot 5061 moves
+// from node a to node b.
+func TestCluster_Migration(t *testing.T) {
+	useTestCluster(t, testClusterConfig, 7000)
+	testServer.dbs[0].Set("bar", "1")
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"GET", "bar"}, "$1\r\n1\r\n"},
+		{[]string{"GET", "{bar}.moved"}, "-ASK 5061 127.0.0.1:7001\r\n"},
+		{[]string{"SET", "{bar}.new", "v"}, "-ASK 5061 127.0.0.1:7001\r\n"},
+		{[]string{"GEOSEARCHSTORE", "{bar}.moved", "bar", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+	if nodes := string(executeTestCommand([]string{"CLUSTER", "NODES"})); !strings.Contains(nodes, "node-a 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-8191 [5061->-node-b]\n") {
+		t.Errorf("Unexpected CLUSTER NODES reply %q", nodes)
+	}
+
+	// The importing side only serves the slot after ASKING.
+	useTestCluster(t, testClusterConfig, 7001)
+	c := testServer.newClient(io.Discard)
+	if got := string(executeClientCommand(c, []string{"SET", "bar", "1"})); got != "-MOVED 5061 127.0.0.1:7000\r\n" {
+		t.Errorf("Expected MOVED without ASKING, got %q", got)
+	}
+	executeClientCommand(c, []string{"ASKING"})
+	if got := string(executeClientCommand(c, []string{"SET", "bar", "1"})); got != "+OK\r\n" {
+		t.Errorf("Expected SET after ASKING to be served, got %q", got)
+	}
+	if got := string(executeClientCommand(c, []string{"GET", "bar"})); got != "-MOVED 5061 127.0.0.1:7000\r\n" {
+		t.Errorf("Expected ASKING to only apply to one command, got %q", got)
+	}
+
+	// Handing the slot over ends the migration.
+	for _, cmd := range [][]string{{"CLUSTER", "SETSLOT", "5061", "NODE", "node-b"}, {"GET", "bar"}} {
+		if got := string(executeClientCommand(c, cmd)); got == "" || got[0] == '-' {
+			t.Errorf("%v: unexpected reply %q", cmd, got)
+		}
+	}
+}
+
+func TestCluster_Disabled(t *testing.T) {
+	testServer = newServer()
+	if got := string(executeTestCommand([]string{"CLUSTER", "KEYSLOT", "foo"})); got != "-ERR This instance has cluster support disabled\r\n" {
+		t.Errorf("Unexpected reply %q", got)
+	}
+}
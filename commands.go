@@ -1,32 +1,276 @@
 package main
 
-type CommandHandler func([]string) []byte
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
 
-var commandRegistry = make(map[string]CommandHandler)
+type CommandHandler func(c *client, command []string) []byte
 
-func registerCommand(name string, handler CommandHandler) {
-	commandRegistry[name] = handler
+// commandFlags describe how a command interacts with client state and the
+// keyspace.
+type commandFlags int
+
+const (
+	// cmdSubscribedOK commands may run while the client is in subscribed mode.
+	cmdSubscribedOK commandFlags = 1 << iota
+	// cmdNoKeyspace commands never touch the keyspace, so they run without
+	// holding keyspaceLock.
+	cmdNoKeyspace
+	// cmdTransaction commands act on the transaction itself and are never
+	// queued by MULTI.
+	cmdTransaction
+	// cmdWrite commands may change the keyspace. They run holding
+	// keyspaceLock exclusively, are propagated to the append-only file and
+	// replicas, and are refused by replicas.
+	cmdWrite
+	// cmdAsking commands reach a cluster slot being imported as if they
+	// were sent after ASKING.
+	cmdAsking
+)
+
+type redisCommand struct {
+	handler CommandHandler
+	// arity is the exact number of arguments including the command name, or
+	// when negative, the minimum number.
+	arity int
+	flags commandFlags
+	// firstKey and lastKey are the positions of the first and last key
+	// arguments, every keyStep apart. A negative lastKey counts from the
+	// end, and a firstKey of 0 means the command takes no keys.
+	firstKey, lastKey, keyStep int
+	// keysFunc, when set, finds the keys of a command whose key positions
+	// depend on its other arguments.
+	keysFunc func(command []string) []string
+}
+
+var commandRegistry = make(map[string]redisCommand)
+
+func registerCommand(name string, handler CommandHandler, arity int, flags commandFlags, firstKey, lastKey, keyStep int) {
+	commandRegistry[name] = redisCommand{
+		handler:  handler,
+		arity:    arity,
+		flags:    flags,
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		keyStep:  keyStep,
+	}
+}
+
+// registerKeysFunc sets the function that finds the keys of a registered
+// command.
+func registerKeysFunc(name string, fn func(command []string) []string) {
+	cmd := commandRegistry[name]
+	cmd.keysFunc = fn
+	commandRegistry[name] = cmd
+}
+
+// commandKeys returns the key arguments of a command that passed the arity
+// check.
+func commandKeys(cmd redisCommand, command []string) []string {
+	if cmd.keysFunc != nil {
+		return cmd.keysFunc(command)
+	}
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(command)
+	}
+	var keys []string
+	for i := cmd.firstKey; i <= last && i < len(command); i += cmd.keyStep {
+		keys = append(keys, command[i])
+	}
+	return keys
 }
 
 func init() {
 	registerConnectionCommands()
 	registerStringCommands()
+	registerKeyCommands()
 	registerListCommands()
 	registerSetCommands()
 	registerHashCommands()
+	registerZSetCommands()
+	registerGeoCommands()
+	registerStreamCommands()
+	registerStreamGroupCommands()
+	registerPubSubCommands()
+	registerTransactionCommands()
+	registerServerCommands()
+	registerReplicationCommands()
+	registerClusterCommands()
+	registerDumpCommands()
 }
 
-func executeCommand(command []string) []byte {
+func executeCommand(c *client, command []string) []byte {
 	if len(command) == 0 {
 		return SerializeError("ERR empty command")
 	}
 
 	cmdName := command[0]
-	handler, exists := commandRegistry[cmdName]
+	cmd, exists := commandRegistry[cmdName]
 	if !exists {
+		c.multiError = c.inMulti
 		return SerializeError("ERR unknown command '" + cmdName + "'")
 	}
 
-	return handler(command)
+	if (cmd.arity > 0 && len(command) != cmd.arity) || len(command) < -cmd.arity {
+		c.multiError = c.inMulti
+		return SerializeError("ERR wrong number of arguments for '" + strings.ToLower(cmdName) + "' command")
+	}
+
+	if cmd.flags&cmdSubscribedOK == 0 && c.srv.pubsub.subscriptionCount(c) > 0 {
+		return SerializeError("ERR Can't execute '" + strings.ToLower(cmdName) +
+			"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	}
+
+	// ASKING only applies to the command that follows it.
+	asking := c.asking || cmd.flags&cmdAsking != 0
+	c.asking = false
+	if redirect := clusterRedirect(c, cmd, command, asking); redirect != nil {
+		if cmdName == "EXEC" {
+			c.resetMulti()
+		} else {
+			c.multiError = c.inMulti
+		}
+		return redirect
+	}
+
+	if cmd.flags&cmdWrite != 0 && !c.isMaster && c.srv.repl.isReplica() {
+		c.multiError = c.inMulti
+		return SerializeError("READONLY You can't write against a read only replica.")
+	}
+
+	if c.inMulti && cmd.flags&cmdTransaction == 0 {
+		c.multiQueue = append(c.multiQueue, command)
+		return SerializeSimpleString("QUEUED")
+	}
+
+	if cmd.flags&cmdNoKeyspace != 0 {
+		return cmd.handler(c, command)
+	}
+
+	reply := callLocked(c, cmd, command)
+	if c.blocked != nil {
+		return c.srv.waitUnblocked(c)
+	}
+	return reply
+}
+
+// callLocked calls a command holding keyspaceLock, and once a write is done,
+// serves the clients blocked on the keys it made ready.
+func callLocked(c *client, cmd redisCommand, command []string) []byte {
+	// Deferred first so that keyspace events are published after the lock
+	// is released.
+	defer c.srv.events.flush(c.srv.pubsub)
+	if cmd.flags&cmdWrite == 0 {
+		c.srv.keyspaceLock.RLock()
+		defer c.srv.keyspaceLock.RUnlock()
+		return call(c, command)
+	}
+
+	c.srv.keyspaceLock.Lock()
+	defer c.srv.keyspaceLock.Unlock()
+	reply := call(c, command)
+	c.srv.serveBlockedClients()
+	return reply
+}
+
+// call runs a command and propagates it if it changed the keyspace. A handler
+// can set c.propagateAs to propagate a different command with the same
+// effect, such as one with an absolute instead of a relative expiry, or set
+// c.preventPropagation when the only change was a lazily expired key.
+func call(c *client, command []string) []byte {
+	cmd := commandRegistry[command[0]]
+	if cmd.flags&cmdWrite == 0 {
+		reply := cmd.handler(c, command)
+		c.srv.propagateExpired()
+		return reply
+	}
+
+	dirty := c.db.Dirty()
+	c.propagateAs, c.preventPropagation = nil, false
+	reply := cmd.handler(c, command)
+	c.srv.propagateExpired()
+	if c.db.Dirty() != dirty && !c.preventPropagation {
+		if c.propagateAs != nil {
+			command = c.propagateAs
+		}
+		propagate(c, command)
+	}
+	c.propagateAs, c.preventPropagation = nil, false
+	return reply
+}
+
+// propagate sends a command that changed the keyspace to the append-only file
+// and the replicas. Writes made by EXEC are wrapped in MULTI/EXEC so that they
+// are replayed atomically too.
+func propagate(c *client, command []string) {
+	if c.inExec && !c.execPropagated {
+		propagateCommand(c, []string{"MULTI"})
+		c.execPropagated = true
+	}
+	propagateCommand(c, command)
 }
 
+// propagateCommand sends one command on, for the database c has selected.
+// The stream a replica receives from its master is relayed to its own
+// replicas as is, so commands run by the master's client only go to the
+// append-only file.
+func propagateCommand(c *client, command []string) {
+	c.srv.aof.feed(c.dbid, command)
+	if !c.isMaster {
+		c.srv.repl.feed(c.dbid, command)
+	}
+}
+
+// expiredKey is a key of database dbid deleted because its TTL elapsed.
+type expiredKey struct {
+	dbid int
+	key  string
+}
+
+// expiredKeys queues the keys deleted because their TTL elapsed until they
+// are propagated. Keys expire with their store locked, so they are sent on
+// by propagateExpired once the command or expiry cycle that deleted them is
+// done with the store.
+type expiredKeys struct {
+	mu         sync.Mutex
+	pending    []expiredKey
+	hasPending atomic.Bool
+}
+
+func (e *expiredKeys) add(dbid int, key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, expiredKey{dbid, key})
+	e.hasPending.Store(true)
+}
+
+// propagateExpired sends a DEL for each key expired since it last ran, as
+// Redis does, so that the append-only file and the replicas drop the key
+// before any command that found it gone is replayed. It runs before the
+// command itself is propagated. A replica relays its master's stream as is
+// and gets the master's DELs with it, so it only logs its own.
+func (srv *server) propagateExpired() {
+	if !srv.expired.hasPending.Load() {
+		return
+	}
+	srv.expired.mu.Lock()
+	keys := srv.expired.pending
+	srv.expired.pending = nil
+	srv.expired.hasPending.Store(false)
+	srv.expired.mu.Unlock()
+
+	replica := srv.repl.isReplica()
+	for _, k := range keys {
+		del := []string{"DEL", k.key}
+		srv.aof.feed(k.dbid, del)
+		if !replica {
+			srv.repl.feed(k.dbid, del)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func registerClusterCommands() {
+	registerCommand("CLUSTER", handleCluster, -2, 0, 0, 0, 0)
+	registerCommand("ASKING", handleAsking, 1, cmdNoKeyspace, 0, 0, 0)
+}
+
+var errClusterDisabled = SerializeError("ERR This instance has cluster support disabled")
+
+// handleAsking lets the next command reach a slot this node is importing.
+func handleAsking(c *client, command []string) []byte {
+	if c.srv.cluster == nil {
+		return errClusterDisabled
+	}
+	c.asking = true
+	return SerializeSimpleString("OK")
+}
+
+// handleCluster handles the CLUSTER subcommands.
+func handleCluster(c *client, command []string) []byte {
+	cs := c.srv.cluster
+	if cs == nil {
+		return errClusterDisabled
+	}
+
+	sub := strings.ToUpper(command[1])
+	args := command[2:]
+	switch {
+	case sub == "MYID" && len(args) == 0:
+		return SerializeBulkString(cs.myself.id)
+	case sub == "KEYSLOT" && len(args) == 1:
+		return SerializeInteger(keyHashSlot(args[0]))
+	case sub == "COUNTKEYSINSLOT" && len(args) == 1:
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return SerializeError("ERR Invalid slot")
+		}
+		return SerializeInteger(countKeysInSlot(c.db, slot))
+	case sub == "GETKEYSINSLOT" && len(args) == 2:
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return SerializeError("ERR Invalid slot")
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return SerializeError("ERR Invalid number of keys")
+		}
+		return serializeStringArray(keysInSlot(c.db, slot, count))
+	case sub == "SLOTS" && len(args) == 0:
+		return clusterSlotsReply(cs)
+	case sub == "SHARDS" && len(args) == 0:
+		return clusterShardsReply(cs)
+	case sub == "NODES" && len(args) == 0:
+		return SerializeBulkString(cs.nodesDescription())
+	case sub == "INFO" && len(args) == 0:
+		return SerializeBulkString(cs.info())
+	case sub == "SETSLOT" && len(args) >= 2:
+		return clusterSetSlot(c, args)
+	case sub == "MYID" || sub == "KEYSLOT" || sub == "COUNTKEYSINSLOT" || sub == "GETKEYSINSLOT" ||
+		sub == "SLOTS" || sub == "SHARDS" || sub == "NODES" || sub == "INFO" || sub == "SETSLOT":
+		return SerializeError("ERR wrong number of arguments for 'cluster|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try CLUSTER HELP.")
+}
+
+// clusterSetSlot handles CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE node-id
+// and CLUSTER SETSLOT slot STABLE, which move a slot between nodes.
+func clusterSetSlot(c *client, args []string) []byte {
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return SerializeError("ERR Invalid or out of range slot")
+	}
+	action := strings.ToUpper(args[1])
+	nodeID := ""
+	switch {
+	case action == "STABLE" && len(args) == 2:
+	case (action == "MIGRATING" || action == "IMPORTING" || action == "NODE") && len(args) == 3:
+		nodeID = args[2]
+	default:
+		return SerializeError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+
+	if err := c.srv.cluster.setSlot(c.db, slot, action, nodeID); err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeSimpleString("OK")
+}
+
+// clusterNodeReply describes a node for CLUSTER SLOTS.
+func clusterNodeReply(n *clusterNode) []byte {
+	return SerializeArray([][]byte{
+		SerializeBulkString(n.host),
+		SerializeInteger(n.port),
+		SerializeBulkString(n.id),
+	})
+}
+
+func clusterSlotsReply(cs *clusterState) []byte {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	ranges := cs.slotRanges()
+	elements := make([][]byte, 0, len(ranges))
+	for _, r := range ranges {
+		elements = append(elements, SerializeArray([][]byte{
+			SerializeInteger(r.start),
+			SerializeInteger(r.end),
+			clusterNodeReply(r.node),
+		}))
+	}
+	return SerializeArray(elements)
+}
+
+// clusterShardsReply describes each node with its slot ranges. Every node is
+// a shard of its own, since there are no cluster replicas.
+func clusterShardsReply(cs *clusterState) []byte {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	ranges := cs.slotRanges()
+	shards := make([][]byte, 0, len(cs.nodes))
+	for _, n := range cs.nodes {
+		var slots [][]byte
+		for _, r := range ranges {
+			if r.node == n {
+				slots = append(slots, SerializeInteger(r.start), SerializeInteger(r.end))
+			}
+		}
+		node := SerializeArray([][]byte{
+			SerializeBulkString("id"), SerializeBulkString(n.id),
+			SerializeBulkString("port"), SerializeInteger(n.port),
+			SerializeBulkString("ip"), SerializeBulkString(n.host),
+			SerializeBulkString("endpoint"), SerializeBulkString(n.host),
+			SerializeBulkString("role"), SerializeBulkString("master"),
+			SerializeBulkString("replication-offset"), SerializeInteger(0),
+			SerializeBulkString("health"), SerializeBulkString("online"),
+		})
+		shards = append(shards, SerializeArray([][]byte{
+			SerializeBulkString("slots"), SerializeArray(slots),
+			SerializeBulkString("nodes"), SerializeArray([][]byte{node}),
+		}))
+	}
+	return SerializeArray(shards)
+}
@@ -1,23 +1,93 @@
 package main
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 func registerConnectionCommands() {
-	registerCommand("PING", handlePing)
-	registerCommand("ECHO", handleEcho)
+	registerCommand("PING", handlePing, -1, cmdSubscribedOK|cmdNoKeyspace, 0, 0, 0)
+	registerCommand("ECHO", handleEcho, 2, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("QUIT", handleQuit, -1, cmdSubscribedOK|cmdNoKeyspace|cmdTransaction, 0, 0, 0)
+	registerCommand("SELECT", handleSelect, 2, cmdNoKeyspace, 0, 0, 0)
+	// CLIENT runs holding keyspaceLock so that CLIENT UNBLOCK can not race
+	// with the blocked client being served.
+	registerCommand("CLIENT", handleClient, -2, 0, 0, 0, 0)
 }
 
-func handlePing(command []string) []byte {
+// handlePing replies PONG, or in subscribed mode a ["pong", message] array
+// as pushed messages and replies share the connection.
+func handlePing(c *client, command []string) []byte {
+	if c.srv.pubsub.subscriptionCount(c) > 0 {
+		message := ""
+		if len(command) > 1 {
+			message = command[1]
+		}
+		return serializeStringArray([]string{"pong", message})
+	}
+
 	if len(command) == 1 {
 		return SerializeSimpleString("PONG")
 	}
 	return SerializeBulkString(command[1])
 }
 
-func handleEcho(command []string) []byte {
+func handleEcho(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
 	return SerializeBulkString(command[1])
 }
 
+// handleSelect switches the connection to another database. A cluster only
+// has database 0.
+func handleSelect(c *client, command []string) []byte {
+	dbid, err := strconv.Atoi(command[1])
+	if err != nil {
+		return SerializeError(errNotInteger.Error())
+	}
+	if c.srv.cluster != nil && dbid != 0 {
+		return SerializeError("ERR SELECT is not allowed in cluster mode")
+	}
+	if err := c.selectDB(dbid); err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeSimpleString("OK")
+}
+
+// handleQuit replies OK and asks handleConnection to close the connection.
+func handleQuit(c *client, command []string) []byte {
+	c.closeAfterReply = true
+	return SerializeSimpleString("OK")
+}
+
+// handleClient handles the CLIENT subcommands:
+//
+//	CLIENT ID
+//	CLIENT UNBLOCK client-id [TIMEOUT|ERROR]
+func handleClient(c *client, command []string) []byte {
+	sub := strings.ToUpper(command[1])
+	switch {
+	case sub == "ID" && len(command) == 2:
+		return SerializeInteger(int(c.id))
+	case sub == "UNBLOCK" && (len(command) == 3 || len(command) == 4):
+		id, err := strconv.ParseInt(command[2], 10, 64)
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		withError := false
+		if len(command) == 4 {
+			switch strings.ToUpper(command[3]) {
+			case "TIMEOUT":
+			case "ERROR":
+				withError = true
+			default:
+				return SerializeError("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR")
+			}
+		}
+		return SerializeInteger(boolToInt(c.srv.unblockClient(id, withError)))
+	case sub == "ID" || sub == "UNBLOCK":
+		return SerializeError("ERR wrong number of arguments for 'client|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try CLIENT HELP.")
+}
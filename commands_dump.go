@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerDumpCommands() {
+	registerCommand("DUMP", handleDump, 2, 0, 1, 1, 1)
+	registerCommand("RESTORE", handleRestore, -4, cmdWrite, 1, 1, 1)
+	registerCommand("RESTORE-ASKING", handleRestore, -4, cmdWrite|cmdAsking, 1, 1, 1)
+	registerCommand("MIGRATE", handleMigrate, -6, cmdWrite, 3, 3, 1)
+	registerKeysFunc("MIGRATE", migrateKeys)
+}
+
+// handleDump returns the serialized value of a key, which RESTORE turns back
+// into a key, here or on another instance.
+func handleDump(c *client, command []string) []byte {
+	payload, _, exists := c.db.Dump(command[1])
+	if !exists {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(string(payload))
+}
+
+// handleRestore handles RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency]. The ttl is in milliseconds, 0 for no
+// expiry, and an absolute unix time with ABSTTL. IDLETIME and FREQ are
+// validated and ignored since keys have no access statistics.
+//
+// RESTORE-ASKING is the same command, sent by MIGRATE to a cluster node that
+// is importing the key's slot.
+func handleRestore(c *client, command []string) []byte {
+	key := command[1]
+	ttl, err := strconv.ParseInt(command[2], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+
+	var replace, absTTL, idle, freq bool
+	for i := 4; i < len(command); i++ {
+		switch opt := strings.ToUpper(command[i]); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absTTL = true
+		case opt == "IDLETIME" && i+1 < len(command) && !freq:
+			i++
+			seconds, err := strconv.ParseInt(command[i], 10, 64)
+			if err != nil {
+				return SerializeError("ERR value is not an integer or out of range")
+			}
+			if seconds < 0 {
+				return SerializeError("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			idle = true
+		case opt == "FREQ" && i+1 < len(command) && !idle:
+			i++
+			frequency, err := strconv.ParseInt(command[i], 10, 64)
+			if err != nil {
+				return SerializeError("ERR value is not an integer or out of range")
+			}
+			if frequency < 0 || frequency > 255 {
+				return SerializeError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			freq = true
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+	if ttl < 0 {
+		return SerializeError("ERR Invalid TTL value, must be >= 0")
+	}
+
+	if !replace && c.db.Exists(key) {
+		return SerializeError("BUSYKEY Target key name already exists.")
+	}
+	value, err := decodeDumpPayload([]byte(command[3]))
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	expireAt := ttl
+	if ttl > 0 && !absTTL {
+		now := mstime()
+		if ttl > math.MaxInt64-now {
+			return SerializeError("ERR invalid expire time in 'restore' command")
+		}
+		expireAt += now
+	}
+	if expireAt > 0 && expireAt <= mstime() {
+		// The key would expire straight away, so it is not created. With
+		// REPLACE the old value is still deleted.
+		deleted := replace && c.db.Delete(key)
+		c.propagateAs = []string{"DEL", key}
+		if deleted {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+		}
+		return SerializeSimpleString("OK")
+	}
+
+	c.db.RestoreKey(key, value, expireAt)
+	c.propagateAs = []string{"RESTORE", key, strconv.FormatInt(expireAt, 10), command[3], "REPLACE", "ABSTTL"}
+	notifyKeyspaceEvent(c, notifyGeneric, "restore", key)
+	signalKeyAsReady(c, key)
+	return SerializeSimpleString("OK")
+}
+
+// migrateKeys returns the keys of MIGRATE: the key argument, or when it is
+// empty, the keys following KEYS.
+func migrateKeys(command []string) []string {
+	for i := 6; i < len(command); i++ {
+		switch strings.ToUpper(command[i]) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			return command[i+1:]
+		}
+	}
+	return command[3:4]
+}
+
+// handleMigrate handles MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...].
+// It restores the keys on the target instance and, unless COPY is given,
+// deletes them here. The timeout in milliseconds applies to connecting and
+// to each exchange with the target.
+//
+// Like in Redis, the server is blocked while the keys are transferred: the
+// keyspace stays locked so that the keys can not change before they are
+// deleted.
+func handleMigrate(c *client, command []string) []byte {
+	var copyKeys, replace bool
+	var auth []string
+	keys := command[3:4]
+	for i := 6; i < len(command); i++ {
+		switch opt := strings.ToUpper(command[i]); {
+		case opt == "COPY":
+			copyKeys = true
+		case opt == "REPLACE":
+			replace = true
+		case opt == "AUTH" && i+1 < len(command):
+			auth = []string{"AUTH", command[i+1]}
+			i++
+		case opt == "AUTH2" && i+2 < len(command):
+			auth = []string{"AUTH", command[i+1], command[i+2]}
+			i += 2
+		case opt == "KEYS":
+			if command[3] != "" {
+				return SerializeError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = command[i+1:]
+			i = len(command)
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+
+	timeout, err := strconv.ParseInt(command[5], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	dbid, err := strconv.Atoi(command[4])
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	restoreCmd := "RESTORE"
+	if c.srv.cluster != nil {
+		restoreCmd = "RESTORE-ASKING"
+	}
+	var found []string
+	var requests [][]string
+	for _, key := range keys {
+		payload, expireAt, exists := c.db.Dump(key)
+		if !exists {
+			continue
+		}
+		var ttl int64
+		if expireAt > 0 {
+			ttl = max(expireAt-mstime(), 1)
+		}
+		restore := []string{restoreCmd, key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		found = append(found, key)
+		requests = append(requests, restore)
+	}
+	if len(found) == 0 {
+		return SerializeSimpleString("NOKEY")
+	}
+
+	// A new connection starts in database 0.
+	if dbid != 0 {
+		requests = append([][]string{{"SELECT", strconv.Itoa(dbid)}}, requests...)
+	}
+	if auth != nil {
+		requests = append([][]string{auth}, requests...)
+	}
+	replies, err := migrateExchange(net.JoinHostPort(command[1], command[2]), time.Duration(timeout)*time.Millisecond, requests)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	// Keys whose RESTORE failed stay here, and the first error is reported.
+	var targetErr string
+	setup := len(requests) - len(found)
+	for i, reply := range replies {
+		if reply.Type != Error {
+			if i >= setup && !copyKeys {
+				key := found[i-setup]
+				if c.db.Delete(key) {
+					propagate(c, []string{"DEL", key})
+					notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+				}
+			}
+			continue
+		}
+		if targetErr == "" {
+			targetErr = reply.Str
+		}
+		if i < setup {
+			// AUTH or SELECT failed, so nothing was restored.
+			break
+		}
+	}
+	c.preventPropagation = true
+	if targetErr != "" {
+		return SerializeError("ERR Target instance replied with error: " + targetErr)
+	}
+	return SerializeSimpleString("OK")
+}
+
+// migrateExchange sends commands to a target instance in a pipeline and
+// returns their replies.
+func migrateExchange(address string, timeout time.Duration, requests [][]string) ([]RESPValue, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, errMigrateConnect
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	for _, request := range requests {
+		w.Write(serializeStringArray(request))
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := w.Flush(); err != nil {
+		return nil, errMigrateWrite
+	}
+
+	reader := bufio.NewReader(conn)
+	replies := make([]RESPValue, 0, len(requests))
+	for range requests {
+		conn.SetDeadline(time.Now().Add(timeout))
+		reply, err := ReadRESP(reader)
+		if err != nil {
+			return nil, errMigrateRead
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+var (
+	errMigrateConnect = errors.New("IOERR error or timeout connecting to the client")
+	errMigrateWrite   = errors.New("IOERR error or timeout writing to target instance")
+	errMigrateRead    = errors.New("IOERR error or timeout reading from target instance")
+)
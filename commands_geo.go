@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func registerGeoCommands() {
+	registerCommand("GEOADD", handleGeoAdd, -5, cmdWrite, 1, 1, 1)
+	registerCommand("GEODIST", handleGeoDist, -4, 0, 1, 1, 1)
+	registerCommand("GEOPOS", handleGeoPos, -2, 0, 1, 1, 1)
+	registerCommand("GEOHASH", handleGeoHash, -2, 0, 1, 1, 1)
+	registerCommand("GEOSEARCH", handleGeoSearch, -7, 0, 1, 1, 1)
+	registerCommand("GEOSEARCHSTORE", handleGeoSearchStore, -8, cmdWrite, 1, 2, 1)
+}
+
+// geoSort is the result ordering requested by GEOSEARCH.
+type geoSort int
+
+const (
+	geoSortNone geoSort = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+// geoSearchOptions holds everything GEOSEARCH and GEOSEARCHSTORE parse besides
+// the keys.
+type geoSearchOptions struct {
+	query     GeoQuery
+	sort      geoSort
+	count     int
+	any       bool
+	withDist  bool
+	withCoord bool
+	withHash  bool
+	storeDist bool
+}
+
+func handleGeoAdd(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 5, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	var opts ZAddOptions
+	i := 2
+flags:
+	for ; i < len(command); i++ {
+		switch strings.ToUpper(command[i]) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "CH":
+			opts.CH = true
+		default:
+			break flags
+		}
+	}
+
+	args := command[i:]
+	if len(args) == 0 || len(args)%3 != 0 || (opts.NX && opts.XX) {
+		return SerializeError("ERR syntax error")
+	}
+
+	members := make([]ScoredMember, 0, len(args)/3)
+	for j := 0; j < len(args); j += 3 {
+		longitude, latitude, err := parseLongLat(args[j], args[j+1])
+		if err != nil {
+			return SerializeError("ERR " + err.Error())
+		}
+		hash, _ := geohashEncodeWGS84(longitude, latitude, geoStepMax)
+		members = append(members, ScoredMember{Member: args[j+2], Score: float64(hash.bits)})
+	}
+
+	dirty := c.db.Dirty()
+	n, err := c.db.ZAdd(command[1], opts, members...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if c.db.Dirty() != dirty {
+		notifyKeyspaceEvent(c, notifyZSet, "zadd", command[1])
+	}
+	return SerializeInteger(n)
+}
+
+func handleGeoDist(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	if len(command) > 5 {
+		return SerializeError("ERR syntax error")
+	}
+
+	conversion := 1.0
+	if len(command) == 5 {
+		var err error
+		if conversion, err = parseGeoUnit(command[4]); err != nil {
+			return SerializeError("ERR " + err.Error())
+		}
+	}
+
+	score1, found1, err := c.db.ZScore(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	score2, found2, err := c.db.ZScore(command[1], command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !found1 || !found2 {
+		return SerializeNullBulkString()
+	}
+
+	lon1, lat1 := decodeGeoScore(score1)
+	lon2, lat2 := decodeGeoScore(score2)
+	return SerializeBulkString(formatGeoDist(geohashDistance(lon1, lat1, lon2, lat2) / conversion))
+}
+
+func handleGeoPos(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	elements := make([][]byte, 0, len(command)-2)
+	for _, member := range command[2:] {
+		score, found, err := c.db.ZScore(command[1], member)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if !found {
+			elements = append(elements, SerializeNullArray())
+			continue
+		}
+		longitude, latitude := decodeGeoScore(score)
+		elements = append(elements, serializeGeoCoords(longitude, latitude))
+	}
+	return SerializeArray(elements)
+}
+
+func handleGeoHash(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	elements := make([][]byte, 0, len(command)-2)
+	for _, member := range command[2:] {
+		score, found, err := c.db.ZScore(command[1], member)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if !found {
+			elements = append(elements, SerializeNullBulkString())
+			continue
+		}
+		elements = append(elements, SerializeBulkString(geohashString(score)))
+	}
+	return SerializeArray(elements)
+}
+
+// handleGeoSearch handles
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT lon lat BYRADIUS r unit|BYBOX w h unit
+// [ASC|DESC] [COUNT n [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH].
+func handleGeoSearch(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 7, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	opts, err := parseGeoSearchOptions(command[0], command[2:], false)
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	points, err := geoSearch(c, command[1], opts)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	conversion := opts.query.Shape.Conversion
+	elements := make([][]byte, 0, len(points))
+	for _, p := range points {
+		if !opts.withDist && !opts.withHash && !opts.withCoord {
+			elements = append(elements, SerializeBulkString(p.Member))
+			continue
+		}
+		item := [][]byte{SerializeBulkString(p.Member)}
+		if opts.withDist {
+			item = append(item, SerializeBulkString(formatGeoDist(p.Dist/conversion)))
+		}
+		if opts.withHash {
+			item = append(item, SerializeInteger(int(p.Score)))
+		}
+		if opts.withCoord {
+			item = append(item, serializeGeoCoords(p.Longitude, p.Latitude))
+		}
+		elements = append(elements, SerializeArray(item))
+	}
+	return SerializeArray(elements)
+}
+
+// handleGeoSearchStore handles GEOSEARCHSTORE destination source ... [STOREDIST],
+// storing the matches as a sorted set scored by geohash, or by distance with
+// STOREDIST.
+func handleGeoSearchStore(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 8, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	opts, err := parseGeoSearchOptions(command[0], command[3:], true)
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	points, err := geoSearch(c, command[2], opts)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	members := make([]ScoredMember, 0, len(points))
+	for _, p := range points {
+		score := p.Score
+		if opts.storeDist {
+			score = p.Dist / opts.query.Shape.Conversion
+		}
+		members = append(members, ScoredMember{Member: p.Member, Score: score})
+	}
+	existed := c.db.Exists(command[1])
+	stored := c.db.ZReplace(command[1], members)
+	if stored > 0 {
+		notifyKeyspaceEvent(c, notifyZSet, "geosearchstore", command[1])
+	} else if existed {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", command[1])
+	}
+	return SerializeInteger(stored)
+}
+
+// geoSearch runs the query and applies the requested ordering and COUNT.
+func geoSearch(c *client, key string, opts geoSearchOptions) ([]GeoPoint, error) {
+	if opts.any {
+		opts.query.Limit = opts.count
+	}
+	points, err := c.db.GeoSearch(key, opts.query)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.sort {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Dist < points[j].Dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Dist > points[j].Dist })
+	}
+
+	if opts.count > 0 && len(points) > opts.count {
+		points = points[:opts.count]
+	}
+	return points, nil
+}
+
+func parseGeoSearchOptions(cmdName string, args []string, store bool) (geoSearchOptions, error) {
+	var opts geoSearchOptions
+	fromMember, fromLonLat, byRadius, byBox := false, false, false, false
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch arg := strings.ToUpper(args[i]); {
+		case arg == "WITHDIST":
+			opts.withDist = true
+		case arg == "WITHHASH":
+			opts.withHash = true
+		case arg == "WITHCOORD":
+			opts.withCoord = true
+		case arg == "ANY":
+			opts.any = true
+		case arg == "ASC":
+			opts.sort = geoSortAsc
+		case arg == "DESC":
+			opts.sort = geoSortDesc
+		case arg == "STOREDIST" && store:
+			opts.storeDist = true
+		case arg == "COUNT" && remaining > 0:
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, fmt.Errorf("value is not an integer or out of range")
+			}
+			if count <= 0 {
+				return opts, fmt.Errorf("COUNT must be > 0")
+			}
+			opts.count = count
+			i++
+		case arg == "FROMMEMBER" && remaining > 0:
+			if fromLonLat {
+				return opts, errSyntax
+			}
+			opts.query.FromMember = args[i+1]
+			opts.query.UseMember = true
+			fromMember = true
+			i++
+		case arg == "FROMLONLAT" && remaining > 1:
+			if fromMember {
+				return opts, errSyntax
+			}
+			longitude, latitude, err := parseLongLat(args[i+1], args[i+2])
+			if err != nil {
+				return opts, err
+			}
+			opts.query.Shape.Longitude, opts.query.Shape.Latitude = longitude, latitude
+			fromLonLat = true
+			i += 2
+		case arg == "BYRADIUS" && remaining > 1:
+			if byBox {
+				return opts, errSyntax
+			}
+			radius, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return opts, fmt.Errorf("need numeric radius")
+			}
+			if radius < 0 {
+				return opts, fmt.Errorf("radius cannot be negative")
+			}
+			conversion, err := parseGeoUnit(args[i+2])
+			if err != nil {
+				return opts, err
+			}
+			opts.query.Shape.Radius, opts.query.Shape.Conversion = radius, conversion
+			byRadius = true
+			i += 2
+		case arg == "BYBOX" && remaining > 2:
+			if byRadius {
+				return opts, errSyntax
+			}
+			width, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return opts, fmt.Errorf("need numeric width")
+			}
+			height, err := strconv.ParseFloat(args[i+2], 64)
+			if err != nil {
+				return opts, fmt.Errorf("need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return opts, fmt.Errorf("height or width cannot be negative")
+			}
+			conversion, err := parseGeoUnit(args[i+3])
+			if err != nil {
+				return opts, err
+			}
+			opts.query.Shape.ByBox = true
+			opts.query.Shape.Width, opts.query.Shape.Height, opts.query.Shape.Conversion = width, height, conversion
+			byBox = true
+			i += 3
+		default:
+			return opts, errSyntax
+		}
+	}
+
+	if store && (opts.withDist || opts.withHash || opts.withCoord) {
+		return opts, fmt.Errorf("%s is not compatible with WITHDIST, WITHHASH and WITHCOORD options", cmdName)
+	}
+	if !fromMember && !fromLonLat {
+		return opts, fmt.Errorf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", strings.ToLower(cmdName))
+	}
+	if !byRadius && !byBox {
+		return opts, fmt.Errorf("exactly one of BYRADIUS and BYBOX can be specified for %s", strings.ToLower(cmdName))
+	}
+	if opts.any && opts.count == 0 {
+		return opts, fmt.Errorf("the ANY argument requires COUNT argument")
+	}
+
+	// COUNT without ANY needs the closest matches, so sort them.
+	if opts.count > 0 && opts.sort == geoSortNone && !opts.any {
+		opts.sort = geoSortAsc
+	}
+	return opts, nil
+}
+
+// parseLongLat parses and range checks a longitude/latitude pair.
+func parseLongLat(lonArg, latArg string) (float64, float64, error) {
+	longitude, err := parseFloatArg(lonArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	latitude, err := parseFloatArg(latArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return longitude, latitude, nil
+}
+
+// parseGeoUnit returns the number of meters in the given unit.
+func parseGeoUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, fmt.Errorf("unsupported unit provided. please use M, KM, FT, MI")
+}
+
+func formatGeoDist(dist float64) string {
+	return strconv.FormatFloat(dist, 'f', 4, 64)
+}
+
+// serializeGeoCoords replies with a [longitude, latitude] pair printed with 17
+// decimal places and trailing zeros trimmed, like Redis.
+func serializeGeoCoords(longitude, latitude float64) []byte {
+	format := func(f float64) string {
+		s := strconv.FormatFloat(f, 'f', 17, 64)
+		s = strings.TrimRight(s, "0")
+		return strings.TrimSuffix(s, ".")
+	}
+	return SerializeArray([][]byte{
+		SerializeBulkString(format(longitude)),
+		SerializeBulkString(format(latitude)),
+	})
+}
@@ -1,40 +1,73 @@
 package main
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 func registerHashCommands() {
-	registerCommand("HSET", handleHSet)
-	registerCommand("HGET", handleHGet)
-	registerCommand("HGETALL", handleHGetAll)
-	registerCommand("HDEL", handleHDel)
-	registerCommand("HEXISTS", handleHExists)
-	registerCommand("HLEN", handleHLen)
+	registerCommand("HSET", handleHSet, -4, cmdWrite, 1, 1, 1)
+	registerCommand("HGET", handleHGet, 3, 0, 1, 1, 1)
+	registerCommand("HGETALL", handleHGetAll, 2, 0, 1, 1, 1)
+	registerCommand("HDEL", handleHDel, -3, cmdWrite, 1, 1, 1)
+	registerCommand("HEXISTS", handleHExists, 3, 0, 1, 1, 1)
+	registerCommand("HLEN", handleHLen, 2, 0, 1, 1, 1)
+	registerCommand("HSETNX", handleHSetNX, 4, cmdWrite, 1, 1, 1)
+	registerCommand("HMGET", handleHMGet, -3, 0, 1, 1, 1)
+	registerCommand("HKEYS", handleHKeys, 2, 0, 1, 1, 1)
+	registerCommand("HVALS", handleHVals, 2, 0, 1, 1, 1)
+	registerCommand("HINCRBY", handleHIncrBy, 4, cmdWrite, 1, 1, 1)
+	registerCommand("HINCRBYFLOAT", handleHIncrByFloat, 4, cmdWrite, 1, 1, 1)
+	registerCommand("HSTRLEN", handleHStrLen, 3, 0, 1, 1, 1)
+	registerCommand("HRANDFIELD", handleHRandField, -2, 0, 1, 1, 1)
+	registerCommand("HEXPIRE", handleHExpire, -6, cmdWrite, 1, 1, 1)
+	registerCommand("HPEXPIRE", handleHPExpire, -6, cmdWrite, 1, 1, 1)
+	registerCommand("HEXPIREAT", handleHExpireAt, -6, cmdWrite, 1, 1, 1)
+	registerCommand("HPEXPIREAT", handleHPExpireAt, -6, cmdWrite, 1, 1, 1)
+	registerCommand("HTTL", handleHTTL, -5, 0, 1, 1, 1)
+	registerCommand("HPTTL", handleHPTTL, -5, 0, 1, 1, 1)
+	registerCommand("HEXPIRETIME", handleHExpireTime, -5, 0, 1, 1, 1)
+	registerCommand("HPEXPIRETIME", handleHPExpireTime, -5, 0, 1, 1, 1)
+	registerCommand("HPERSIST", handleHPersist, -5, cmdWrite, 1, 1, 1)
+	registerCommand("HGETEX", handleHGetEx, -5, cmdWrite, 1, 1, 1)
+	registerCommand("HSETEX", handleHSetEx, -6, cmdWrite, 1, 1, 1)
+	registerCommand("HSCAN", handleHScan, -3, 0, 1, 1, 1)
 }
 
-func handleHSet(command []string) []byte {
-	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
-		return SerializeError("ERR " + err.Error())
+func handleHSet(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil || len(command)%2 != 0 {
+		return SerializeError("ERR wrong number of arguments for 'hset' command")
+	}
+	added, err := c.db.HSet(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
 	}
-	added := storeInstance.HSet(command[1], command[2], command[3])
+	notifyKeyspaceEvent(c, notifyHash, "hset", command[1])
 	return SerializeInteger(added)
 }
 
-func handleHGet(command []string) []byte {
+func handleHGet(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	value, exists := storeInstance.HGet(command[1], command[2])
+	value, exists, err := c.db.HGet(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	if !exists {
 		return SerializeNullBulkString()
 	}
 	return SerializeBulkString(value)
 }
 
-func handleHGetAll(command []string) []byte {
+func handleHGetAll(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	hash := storeInstance.HGetAll(command[1])
+	hash, err := c.db.HGetAll(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	elements := make([][]byte, 0, len(hash)*2)
 	for field, value := range hash {
 		elements = append(elements, SerializeBulkString(field))
@@ -43,27 +76,176 @@ func handleHGetAll(command []string) []byte {
 	return SerializeArray(elements)
 }
 
-func handleHDel(command []string) []byte {
+func handleHDel(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	deleted := storeInstance.HDel(command[1], command[2:]...)
+	deleted, err := c.db.HDel(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if deleted > 0 {
+		notifyKeyspaceEvent(c, notifyHash, "hdel", command[1])
+		notifyIfDeleted(c, command[1])
+	}
 	return SerializeInteger(deleted)
 }
 
-func handleHExists(command []string) []byte {
+func handleHExists(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	exists := storeInstance.HExists(command[1], command[2])
+	exists, err := c.db.HExists(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return SerializeInteger(boolToInt(exists))
 }
 
-func handleHLen(command []string) []byte {
+func handleHLen(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	length := storeInstance.HLen(command[1])
+	length, err := c.db.HLen(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return SerializeInteger(length)
 }
 
+func handleHSetNX(c *client, command []string) []byte {
+	set, err := c.db.HSetNX(command[1], command[2], command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if set {
+		notifyKeyspaceEvent(c, notifyHash, "hset", command[1])
+	}
+	return SerializeInteger(boolToInt(set))
+}
+
+func handleHMGet(c *client, command []string) []byte {
+	values, exist, err := c.db.HMGet(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeFieldValues(values, exist)
+}
+
+// serializeFieldValues replies with the values of fields, with a null for
+// each field the hash does not hold.
+func serializeFieldValues(values []string, exist []bool) []byte {
+	elements := make([][]byte, len(values))
+	for i, value := range values {
+		if exist[i] {
+			elements[i] = SerializeBulkString(value)
+		} else {
+			elements[i] = SerializeNullBulkString()
+		}
+	}
+	return SerializeArray(elements)
+}
+
+func handleHKeys(c *client, command []string) []byte {
+	fields, err := c.db.HKeys(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeStringArray(fields)
+}
+
+func handleHVals(c *client, command []string) []byte {
+	values, err := c.db.HVals(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeStringArray(values)
+}
+
+func handleHIncrBy(c *client, command []string) []byte {
+	delta, err := strconv.ParseInt(command[3], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	value, err := c.db.HIncrBy(command[1], command[2], delta)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyHash, "hincrby", command[1])
+	return SerializeInteger(int(value))
+}
+
+// handleHIncrByFloat handles HINCRBYFLOAT key field increment. It is
+// propagated as setting the result, keeping the field's TTL, so that replicas
+// do not add up floats differently.
+func handleHIncrByFloat(c *client, command []string) []byte {
+	delta, err := parseFloatArg(command[3])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	value, err := c.db.HIncrByFloat(command[1], command[2], delta)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	result := formatFloat(value)
+	c.propagateAs = []string{"HSETEX", command[1], "KEEPTTL", "FIELDS", "1", command[2], result}
+	notifyKeyspaceEvent(c, notifyHash, "hincrbyfloat", command[1])
+	return SerializeBulkString(result)
+}
+
+func handleHStrLen(c *client, command []string) []byte {
+	length, err := c.db.HStrLen(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(length)
+}
+
+// handleHRandField handles HRANDFIELD key [count [WITHVALUES]]. With a count
+// it replies with up to count different fields, or with a negative count,
+// -count fields that may repeat, each followed by its value with WITHVALUES.
+func handleHRandField(c *client, command []string) []byte {
+	if len(command) == 2 {
+		fields, _, err := c.db.HRandField(command[1], 1)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if len(fields) == 0 {
+			return SerializeNullBulkString()
+		}
+		return SerializeBulkString(fields[0])
+	}
+	if len(command) > 4 || len(command) == 4 && strings.ToUpper(command[3]) != "WITHVALUES" {
+		return SerializeError("ERR syntax error")
+	}
+	count, err := parseRandomCount(command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	fields, values, err := c.db.HRandField(command[1], count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if len(command) == 3 {
+		return serializeStringArray(fields)
+	}
+	pairs := make([]string, 0, 2*len(fields))
+	for i, field := range fields {
+		pairs = append(pairs, field, values[i])
+	}
+	return serializeStringArray(pairs)
+}
+
+// handleHScan handles HSCAN key cursor [MATCH pattern] [COUNT count], like
+// SCAN, replying with the fields interleaved with their values.
+func handleHScan(c *client, command []string) []byte {
+	cursor, args, err := parseScanArgs(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	cursor, pairs, err := c.db.HScan(command[1], cursor, args)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeScan(cursor, serializeStringArray(pairs))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Commands that give hash fields a TTL. Fields are named after a FIELDS
+// numfields argument that runs to the end of the command.
+
+var (
+	errNumFields        = errors.New("ERR Parameter `numFields` should be greater than 0")
+	errNumFieldsMatch   = errors.New("ERR The `numfields` parameter must match the number of arguments")
+	errFieldsArgMissing = errors.New("ERR Mandatory argument FIELDS is missing or not at the right position")
+)
+
+// parseHashFields parses the FIELDS numfields field ... arguments starting at
+// args[pos], with each field followed by its value when pairs is set.
+func parseHashFields(args []string, pos int, pairs bool) ([]string, error) {
+	if pos+1 >= len(args) || strings.ToUpper(args[pos]) != "FIELDS" {
+		return nil, errFieldsArgMissing
+	}
+	numFields, err := strconv.Atoi(args[pos+1])
+	if err != nil || numFields <= 0 {
+		return nil, errNumFields
+	}
+	fields := args[pos+2:]
+	if pairs && len(fields) != 2*numFields || !pairs && len(fields) != numFields {
+		return nil, errNumFieldsMatch
+	}
+	return fields, nil
+}
+
+func handleHExpire(c *client, command []string) []byte {
+	return hexpireGeneric(c, command, mstime(), 1000)
+}
+
+func handleHPExpire(c *client, command []string) []byte {
+	return hexpireGeneric(c, command, mstime(), 1)
+}
+
+func handleHExpireAt(c *client, command []string) []byte {
+	return hexpireGeneric(c, command, 0, 1000)
+}
+
+func handleHPExpireAt(c *client, command []string) []byte {
+	return hexpireGeneric(c, command, 0, 1)
+}
+
+// hexpireGeneric implements the HEXPIRE family, HEXPIRE key time
+// [NX | XX | GT | LT] FIELDS numfields field ..., working out the expiry like
+// expireGeneric. The fields it changed are propagated as HPEXPIREAT.
+func hexpireGeneric(c *client, command []string, basetime, unit int64) []byte {
+	cmdName := strings.ToLower(command[0])
+	when, err := strconv.ParseInt(command[2], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+
+	pos, flags := 3, ExpireFlags(0)
+	if strings.ToUpper(command[3]) != "FIELDS" {
+		if flags, err = parseExpireFlags(command[3:4]); err != nil {
+			return SerializeError(errFieldsArgMissing.Error())
+		}
+		pos++
+	}
+	fields, err := parseHashFields(command, pos, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	// Past hashMaxExpireTime, adding basetime could overflow.
+	if when < 0 || when > hashMaxExpireTime/unit {
+		return SerializeError("ERR invalid expire time in '" + cmdName + "' command")
+	}
+	if when = when*unit + basetime; when > hashMaxExpireTime {
+		return SerializeError("ERR invalid expire time in '" + cmdName + "' command")
+	}
+
+	results, err := c.db.HExpire(command[1], when, flags, fields...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	var changed []string
+	updated, deleted := false, false
+	for i, result := range results {
+		switch result {
+		case hashFieldUpdated:
+			updated = true
+		case hashFieldDeleted:
+			deleted = true
+		default:
+			continue
+		}
+		changed = append(changed, fields[i])
+	}
+	propagateHashFields(c, []string{"HPEXPIREAT", command[1], strconv.FormatInt(when, 10)}, changed)
+	if updated {
+		notifyKeyspaceEvent(c, notifyHash, "hexpire", command[1])
+	}
+	if deleted {
+		notifyKeyspaceEvent(c, notifyHash, "hdel", command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return serializeIntegers(results)
+}
+
+// propagateHashFields propagates command followed by FIELDS and fields, or
+// nothing when there are no fields.
+func propagateHashFields(c *client, command []string, fields []string) {
+	if len(fields) == 0 {
+		c.preventPropagation = true
+		return
+	}
+	c.propagateAs = append(command, append([]string{"FIELDS", strconv.Itoa(len(fields))}, fields...)...)
+}
+
+func serializeIntegers(values []int) []byte {
+	elements := make([][]byte, len(values))
+	for i, value := range values {
+		elements[i] = SerializeInteger(value)
+	}
+	return SerializeArray(elements)
+}
+
+func handleHTTL(c *client, command []string) []byte {
+	return httlGeneric(c, command, false, false)
+}
+
+func handleHPTTL(c *client, command []string) []byte {
+	return httlGeneric(c, command, true, false)
+}
+
+func handleHExpireTime(c *client, command []string) []byte {
+	return httlGeneric(c, command, false, true)
+}
+
+func handleHPExpireTime(c *client, command []string) []byte {
+	return httlGeneric(c, command, true, true)
+}
+
+// httlGeneric implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME like
+// ttlGeneric, with a reply for each field.
+func httlGeneric(c *client, command []string, outputMs, outputAbs bool) []byte {
+	fields, err := parseHashFields(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	times, err := c.db.HExpireTime(command[1], fields...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	results := make([]int, len(times))
+	now := mstime()
+	for i, when := range times {
+		if when < 0 {
+			results[i] = int(when)
+			continue
+		}
+		ttl := when
+		if !outputAbs {
+			ttl = max(when-now, 0)
+		}
+		if !outputMs {
+			ttl = (ttl + 500) / 1000
+		}
+		results[i] = int(ttl)
+	}
+	return serializeIntegers(results)
+}
+
+// handleHPersist handles HPERSIST key FIELDS numfields field ....
+func handleHPersist(c *client, command []string) []byte {
+	fields, err := parseHashFields(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	results, err := c.db.HPersist(command[1], fields...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	var persisted []string
+	for i, result := range results {
+		if result == hashFieldUpdated {
+			persisted = append(persisted, fields[i])
+		}
+	}
+	propagateHashFields(c, []string{"HPERSIST", command[1]}, persisted)
+	if len(persisted) > 0 {
+		notifyKeyspaceEvent(c, notifyHash, "hpersist", command[1])
+	}
+	return serializeIntegers(results)
+}
+
+// handleHGetEx handles HGETEX key [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// FIELDS numfields field .... The fields it changed are propagated as
+// HPEXPIREAT or HPERSIST.
+func handleHGetEx(c *client, command []string) []byte {
+	pos, expireAt, persist := 2, int64(0), false
+	switch opt := strings.ToUpper(command[2]); opt {
+	case "FIELDS":
+	case "PERSIST":
+		persist = true
+		pos++
+	case "EX", "PX", "EXAT", "PXAT":
+		when, err := parseExpireOption("hgetex", opt, command[3])
+		if err != nil {
+			return SerializeError("ERR " + err.Error())
+		}
+		if when > hashMaxExpireTime {
+			return SerializeError("ERR invalid expire time in 'hgetex' command")
+		}
+		expireAt = when
+		pos += 2
+	default:
+		return SerializeError(errFieldsArgMissing.Error())
+	}
+	fields, err := parseHashFields(command, pos, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	values, exist, err := c.db.HGetEx(command[1], expireAt, persist, fields...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	var changed []string
+	if expireAt != 0 || persist {
+		for i, field := range fields {
+			if exist[i] {
+				changed = append(changed, field)
+			}
+		}
+	}
+	switch {
+	case persist:
+		propagateHashFields(c, []string{"HPERSIST", command[1]}, changed)
+	default:
+		propagateHashFields(c, []string{"HPEXPIREAT", command[1], strconv.FormatInt(expireAt, 10)}, changed)
+	}
+	switch {
+	case len(changed) == 0:
+	case persist:
+		notifyKeyspaceEvent(c, notifyHash, "hpersist", command[1])
+	case expireAt <= mstime():
+		notifyKeyspaceEvent(c, notifyHash, "hdel", command[1])
+		notifyIfDeleted(c, command[1])
+	default:
+		notifyKeyspaceEvent(c, notifyHash, "hexpire", command[1])
+	}
+	return serializeFieldValues(values, exist)
+}
+
+// handleHSetEx handles HSETEX key [FNX | FXX] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+// FIELDS numfields field value .... It is propagated with an absolute expiry.
+func handleHSetEx(c *client, command []string) []byte {
+	var opts HSetExOptions
+	expireSet, pos := false, 2
+	for ; pos < len(command) && strings.ToUpper(command[pos]) != "FIELDS"; pos++ {
+		switch opt := strings.ToUpper(command[pos]); opt {
+		case "FNX", "FXX":
+			if opts.FNX || opts.FXX {
+				return SerializeError("ERR " + errSyntax.Error())
+			}
+			opts.FNX, opts.FXX = opt == "FNX", opt == "FXX"
+		case "KEEPTTL":
+			if expireSet {
+				return SerializeError("ERR " + errSyntax.Error())
+			}
+			opts.KeepTTL, expireSet = true, true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireSet || pos+1 >= len(command) {
+				return SerializeError("ERR " + errSyntax.Error())
+			}
+			pos++
+			when, err := parseExpireOption("hsetex", opt, command[pos])
+			if err != nil {
+				return SerializeError("ERR " + err.Error())
+			}
+			if when > hashMaxExpireTime {
+				return SerializeError("ERR invalid expire time in 'hsetex' command")
+			}
+			opts.ExpireAt, expireSet = when, true
+		default:
+			return SerializeError(errFieldsArgMissing.Error())
+		}
+	}
+	pairs, err := parseHashFields(command, pos, true)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	set, err := c.db.HSetEx(command[1], opts, pairs...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !set {
+		c.preventPropagation = true
+		return SerializeInteger(0)
+	}
+
+	propagated := []string{"HSETEX", command[1]}
+	switch {
+	case opts.KeepTTL:
+		propagated = append(propagated, "KEEPTTL")
+	case opts.ExpireAt != 0:
+		propagated = append(propagated, "PXAT", strconv.FormatInt(opts.ExpireAt, 10))
+	}
+	c.propagateAs = append(propagated, append([]string{"FIELDS", strconv.Itoa(len(pairs) / 2)}, pairs...)...)
+	notifyKeyspaceEvent(c, notifyHash, "hset", command[1])
+	switch {
+	case opts.ExpireAt == 0:
+	case opts.ExpireAt <= mstime():
+		notifyKeyspaceEvent(c, notifyHash, "hdel", command[1])
+		notifyIfDeleted(c, command[1])
+	default:
+		notifyKeyspaceEvent(c, notifyHash, "hexpire", command[1])
+	}
+	return SerializeInteger(1)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func registerKeyCommands() {
+	registerCommand("EXPIRE", handleExpire, -3, cmdWrite, 1, 1, 1)
+	registerCommand("PEXPIRE", handlePExpire, -3, cmdWrite, 1, 1, 1)
+	registerCommand("EXPIREAT", handleExpireAt, -3, cmdWrite, 1, 1, 1)
+	registerCommand("PEXPIREAT", handlePExpireAt, -3, cmdWrite, 1, 1, 1)
+	registerCommand("TTL", handleTTL, 2, 0, 1, 1, 1)
+	registerCommand("PTTL", handlePTTL, 2, 0, 1, 1, 1)
+	registerCommand("EXPIRETIME", handleExpireTime, 2, 0, 1, 1, 1)
+	registerCommand("PEXPIRETIME", handlePExpireTime, 2, 0, 1, 1, 1)
+	registerCommand("PERSIST", handlePersist, 2, cmdWrite, 1, 1, 1)
+	registerCommand("TYPE", handleType, 2, 0, 1, 1, 1)
+	registerCommand("OBJECT", handleObject, -2, 0, 2, 2, 1)
+	registerCommand("SCAN", handleScan, -2, 0, 0, 0, 0)
+	registerCommand("KEYS", handleKeys, 2, 0, 0, 0, 0)
+	registerCommand("RANDOMKEY", handleRandomKey, 1, 0, 0, 0, 0)
+	registerCommand("DBSIZE", handleDBSize, 1, 0, 0, 0, 0)
+	registerCommand("RENAME", handleRename, 3, cmdWrite, 1, 2, 1)
+	registerCommand("RENAMENX", handleRenameNX, 3, cmdWrite, 1, 2, 1)
+	registerCommand("COPY", handleCopy, -3, cmdWrite, 1, 2, 1)
+	registerCommand("MOVE", handleMove, 3, cmdWrite, 1, 1, 1)
+}
+
+func handleExpire(c *client, command []string) []byte {
+	return expireGeneric(c, command, mstime(), 1000)
+}
+
+func handlePExpire(c *client, command []string) []byte {
+	return expireGeneric(c, command, mstime(), 1)
+}
+
+func handleExpireAt(c *client, command []string) []byte {
+	return expireGeneric(c, command, 0, 1000)
+}
+
+func handlePExpireAt(c *client, command []string) []byte {
+	return expireGeneric(c, command, 0, 1)
+}
+
+// expireGeneric implements the EXPIRE family. The time argument is multiplied
+// by unit to get milliseconds and added to basetime, which is zero for the
+// absolute *AT variants. A successful update is propagated as PEXPIREAT.
+func expireGeneric(c *client, command []string, basetime, unit int64) []byte {
+	cmdName := strings.ToLower(command[0])
+	if err := validateMinArgs(command, 3, cmdName); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	when, err := strconv.ParseInt(command[2], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+
+	flags, err := parseExpireFlags(command[3:])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	if when > math.MaxInt64/unit || when < math.MinInt64/unit {
+		return SerializeError("ERR invalid expire time in '" + cmdName + "' command")
+	}
+	when *= unit
+	if when > math.MaxInt64-basetime {
+		return SerializeError("ERR invalid expire time in '" + cmdName + "' command")
+	}
+	when += basetime
+
+	updated := c.db.Expire(command[1], when, flags)
+	c.propagateAs = []string{"PEXPIREAT", command[1], strconv.FormatInt(when, 10)}
+	c.preventPropagation = !updated
+	if updated {
+		// A time in the past deletes the key.
+		if c.db.Exists(command[1]) {
+			notifyKeyspaceEvent(c, notifyGeneric, "expire", command[1])
+		} else {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", command[1])
+		}
+	}
+	return SerializeInteger(boolToInt(updated))
+}
+
+func parseExpireFlags(args []string) (ExpireFlags, error) {
+	var flags ExpireFlags
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			flags |= ExpireNX
+		case "XX":
+			flags |= ExpireXX
+		case "GT":
+			flags |= ExpireGT
+		case "LT":
+			flags |= ExpireLT
+		default:
+			return 0, fmt.Errorf("Unsupported option %s", arg)
+		}
+	}
+
+	if flags&ExpireNX != 0 && flags&(ExpireXX|ExpireGT|ExpireLT) != 0 {
+		return 0, fmt.Errorf("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flags&ExpireGT != 0 && flags&ExpireLT != 0 {
+		return 0, fmt.Errorf("GT and LT options at the same time are not compatible")
+	}
+	return flags, nil
+}
+
+func handleTTL(c *client, command []string) []byte {
+	return ttlGeneric(c, command, false, false)
+}
+
+func handlePTTL(c *client, command []string) []byte {
+	return ttlGeneric(c, command, true, false)
+}
+
+func handleExpireTime(c *client, command []string) []byte {
+	return ttlGeneric(c, command, false, true)
+}
+
+func handlePExpireTime(c *client, command []string) []byte {
+	return ttlGeneric(c, command, true, true)
+}
+
+// ttlGeneric implements TTL, PTTL, EXPIRETIME and PEXPIRETIME. Second
+// resolution replies are rounded to the nearest second like Redis does.
+func ttlGeneric(c *client, command []string, outputMs, outputAbs bool) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	when := c.db.ExpireTime(command[1])
+	if when < 0 {
+		return SerializeInteger(int(when))
+	}
+
+	ttl := when
+	if !outputAbs {
+		ttl = when - mstime()
+		if ttl < 0 {
+			ttl = 0
+		}
+	}
+	if !outputMs {
+		ttl = (ttl + 500) / 1000
+	}
+	return SerializeInteger(int(ttl))
+}
+
+func handlePersist(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	removed := c.db.Persist(command[1])
+	if removed {
+		notifyKeyspaceEvent(c, notifyGeneric, "persist", command[1])
+	}
+	return SerializeInteger(boolToInt(removed))
+}
+
+func handleType(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	return SerializeSimpleString(c.db.Type(command[1]))
+}
+
+// objectHelp is the reply to OBJECT HELP.
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"VERSION <key>",
+	"    Return the version of the key, which changes whenever it is modified.",
+	"HELP",
+	"    Print this help.",
+}
+
+// handleObject handles OBJECT VERSION key, which returns the key's current
+// version. Every modification of a key, including deleting and re-creating
+// it, moves it to a higher version, so clients can detect concurrent changes
+// and make a later SET conditional on the version with IFVER. OBJECT HELP
+// lists the subcommands.
+func handleObject(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	switch sub := strings.ToUpper(command[1]); {
+	case sub == "HELP" && len(command) == 2:
+		lines := make([][]byte, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = SerializeSimpleString(line)
+		}
+		return SerializeArray(lines)
+	case sub == "HELP":
+		return SerializeError("ERR wrong number of arguments for 'object|help' command")
+	case sub != "VERSION":
+		return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try OBJECT HELP.")
+	}
+	if len(command) != 3 {
+		return SerializeError("ERR wrong number of arguments for 'object|version' command")
+	}
+
+	version, exists := c.db.Version(command[2])
+	if !exists {
+		return SerializeNullBulkString()
+	}
+	return SerializeInteger(int(version))
+}
+
+// scanTypes are the names the TYPE option of SCAN accepts.
+var scanTypes = map[string]bool{"string": true, "list": true, "set": true, "zset": true, "hash": true, "stream": true}
+
+// parseScanArgs parses the cursor at command[pos] and the MATCH and COUNT
+// options after it, and TYPE too when withType is set.
+func parseScanArgs(command []string, pos int, withType bool) (uint64, ScanArgs, error) {
+	cursor, err := strconv.ParseUint(command[pos], 10, 64)
+	if err != nil {
+		return 0, ScanArgs{}, errors.New("ERR invalid cursor")
+	}
+	args := ScanArgs{Count: 10}
+	for pos++; pos < len(command); pos += 2 {
+		opt := strings.ToUpper(command[pos])
+		if pos+1 >= len(command) {
+			return 0, ScanArgs{}, errors.New("ERR " + errSyntax.Error())
+		}
+		switch {
+		case opt == "MATCH":
+			args.Match = command[pos+1]
+		case opt == "COUNT":
+			if args.Count, err = strconv.Atoi(command[pos+1]); err != nil {
+				return 0, ScanArgs{}, errNotInteger
+			}
+			if args.Count < 1 {
+				return 0, ScanArgs{}, errors.New("ERR " + errSyntax.Error())
+			}
+		case opt == "TYPE" && withType:
+			args.Type = strings.ToLower(command[pos+1])
+			if !scanTypes[args.Type] {
+				return 0, ScanArgs{}, fmt.Errorf("ERR unknown type name '%s'", command[pos+1])
+			}
+		default:
+			return 0, ScanArgs{}, errors.New("ERR " + errSyntax.Error())
+		}
+	}
+	return cursor, args, nil
+}
+
+// serializeScan replies with the next cursor and the elements of a scan step.
+func serializeScan(cursor uint64, elements []byte) []byte {
+	return SerializeArray([][]byte{SerializeBulkString(strconv.FormatUint(cursor, 10)), elements})
+}
+
+// handleScan handles SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// A scan started with cursor 0 and continued with the cursor each call
+// returns until that is 0 again returns every key that exists throughout,
+// though possibly more than once.
+func handleScan(c *client, command []string) []byte {
+	cursor, args, err := parseScanArgs(command, 1, true)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	cursor, keys := c.db.Scan(cursor, args)
+	return serializeScan(cursor, serializeStringArray(keys))
+}
+
+// handleKeys handles KEYS pattern, which returns every key matching the
+// glob-style pattern in one go, so SCAN is better suited to large keyspaces.
+func handleKeys(c *client, command []string) []byte {
+	return serializeStringArray(c.db.Keys(command[1]))
+}
+
+func handleRandomKey(c *client, command []string) []byte {
+	key, ok := c.db.RandomKey()
+	if !ok {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(key)
+}
+
+func handleDBSize(c *client, command []string) []byte {
+	return SerializeInteger(c.db.DBSize())
+}
+
+func handleRename(c *client, command []string) []byte {
+	if _, err := renameGeneric(c, command, false); err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeSimpleString("OK")
+}
+
+func handleRenameNX(c *client, command []string) []byte {
+	renamed, err := renameGeneric(c, command, true)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(boolToInt(renamed))
+}
+
+// renameGeneric implements RENAME and RENAMENX key newkey, which move the
+// value and TTL of key to newkey whatever type it holds. Renaming a key to
+// itself changes nothing and is not propagated.
+func renameGeneric(c *client, command []string, nx bool) (bool, error) {
+	source, destination := command[1], command[2]
+	renamed, err := c.db.Rename(source, destination, nx)
+	if err != nil || !renamed || source == destination {
+		c.preventPropagation = true
+		return renamed, err
+	}
+	notifyKeyspaceEvent(c, notifyGeneric, "rename_from", source)
+	notifyKeyspaceEvent(c, notifyGeneric, "rename_to", destination)
+	signalKeyAsReady(c, destination)
+	return true, nil
+}
+
+// handleCopy handles COPY source destination [DB destination-db] [REPLACE],
+// which copies the value and TTL of source to destination, in the selected
+// database unless DB names another, replacing it only with REPLACE.
+func handleCopy(c *client, command []string) []byte {
+	replace, dbid := false, c.dbid
+	for i := 3; i < len(command); i++ {
+		switch opt := strings.ToUpper(command[i]); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "DB" && i+1 < len(command):
+			i++
+			var err error
+			if dbid, err = strconv.Atoi(command[i]); err != nil {
+				return SerializeError(errNotInteger.Error())
+			}
+		default:
+			return SerializeError("ERR " + errSyntax.Error())
+		}
+	}
+
+	if dbid < 0 || dbid >= len(c.srv.dbs) {
+		return SerializeError(errDBIndex.Error())
+	}
+	if c.srv.cluster != nil && dbid != c.dbid {
+		return SerializeError("ERR Copying to another database is not allowed in cluster mode")
+	}
+
+	copied, err := c.db.Copy(command[1], c.srv.dbs[dbid], command[2], replace)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !copied {
+		c.preventPropagation = true
+		return SerializeInteger(0)
+	}
+	c.srv.events.notify(notifyGeneric, "copy_to", command[2], dbid)
+	c.srv.blocking.signal(dbid, command[2])
+	return SerializeInteger(1)
+}
+
+// handleMove handles MOVE key db, which moves key with its TTL to another
+// database unless that already holds the key.
+func handleMove(c *client, command []string) []byte {
+	if c.srv.cluster != nil {
+		return SerializeError("ERR MOVE is not allowed in cluster mode")
+	}
+	dbid, err := strconv.Atoi(command[2])
+	if err != nil {
+		return SerializeError(errNotInteger.Error())
+	}
+	if dbid < 0 || dbid >= len(c.srv.dbs) {
+		return SerializeError(errDBIndex.Error())
+	}
+
+	key := command[1]
+	moved, err := c.db.Move(key, c.srv.dbs[dbid])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !moved {
+		c.preventPropagation = true
+		return SerializeInteger(0)
+	}
+	notifyKeyspaceEvent(c, notifyGeneric, "move_from", key)
+	c.srv.events.notify(notifyGeneric, "move_to", key, dbid)
+	c.srv.blocking.signal(dbid, key)
+	return SerializeInteger(1)
+}
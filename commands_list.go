@@ -1,55 +1,115 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
 
 func registerListCommands() {
-	registerCommand("LPUSH", handleLPush)
-	registerCommand("RPUSH", handleRPush)
-	registerCommand("LPOP", handleLPop)
-	registerCommand("RPOP", handleRPop)
-	registerCommand("LRANGE", handleLRange)
-	registerCommand("LLEN", handleLLen)
+	registerCommand("LPUSH", handleLPush, -3, cmdWrite, 1, 1, 1)
+	registerCommand("RPUSH", handleRPush, -3, cmdWrite, 1, 1, 1)
+	registerCommand("LPOP", handleLPop, -2, cmdWrite, 1, 1, 1)
+	registerCommand("RPOP", handleRPop, -2, cmdWrite, 1, 1, 1)
+	registerCommand("LRANGE", handleLRange, 4, 0, 1, 1, 1)
+	registerCommand("LLEN", handleLLen, 2, 0, 1, 1, 1)
+	registerCommand("LPUSHX", handleLPushX, -3, cmdWrite, 1, 1, 1)
+	registerCommand("RPUSHX", handleRPushX, -3, cmdWrite, 1, 1, 1)
+	registerCommand("LINDEX", handleLIndex, 3, 0, 1, 1, 1)
+	registerCommand("LSET", handleLSet, 4, cmdWrite, 1, 1, 1)
+	registerCommand("LINSERT", handleLInsert, 5, cmdWrite, 1, 1, 1)
+	registerCommand("LREM", handleLRem, 4, cmdWrite, 1, 1, 1)
+	registerCommand("LTRIM", handleLTrim, 4, cmdWrite, 1, 1, 1)
+	registerCommand("LPOS", handleLPos, -3, 0, 1, 1, 1)
+	registerCommand("LMOVE", handleLMove, 5, cmdWrite, 1, 2, 1)
+	registerCommand("LMPOP", handleLMPop, -4, cmdWrite, 0, 0, 0)
+	registerKeysFunc("LMPOP", numKeysKeys(1))
+	registerCommand("BLPOP", handleBLPop, -3, cmdWrite, 1, -2, 1)
+	registerCommand("BRPOP", handleBRPop, -3, cmdWrite, 1, -2, 1)
+	registerCommand("BLMOVE", handleBLMove, 6, cmdWrite, 1, 2, 1)
+	registerCommand("BLMPOP", handleBLMPop, -5, cmdWrite, 0, 0, 0)
+	registerKeysFunc("BLMPOP", numKeysKeys(2))
 }
 
-func handleLPush(command []string) []byte {
+func handleLPush(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	length := storeInstance.LPush(command[1], command[2:]...)
+	length, err := c.db.LPush(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyList, "lpush", command[1])
+	signalKeyAsReady(c, command[1])
 	return SerializeInteger(length)
 }
 
-func handleRPush(command []string) []byte {
+func handleRPush(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	length := storeInstance.RPush(command[1], command[2:]...)
+	length, err := c.db.RPush(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyList, "rpush", command[1])
+	signalKeyAsReady(c, command[1])
 	return SerializeInteger(length)
 }
 
-func handleLPop(command []string) []byte {
-	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
-		return SerializeError("ERR " + err.Error())
+func handleLPop(c *client, command []string) []byte {
+	return listPop(c, command, true)
+}
+
+func handleRPop(c *client, command []string) []byte {
+	return listPop(c, command, false)
+}
+
+// listPop implements LPOP and RPOP key [count], which pop an element from the
+// head or tail of a list, or with a count, up to count elements as an array.
+func listPop(c *client, command []string, left bool) []byte {
+	if len(command) > 3 {
+		return SerializeError("ERR wrong number of arguments for '" + strings.ToLower(command[0]) + "' command")
 	}
-	value, exists := storeInstance.LPop(command[1])
-	if !exists {
-		return SerializeNullBulkString()
+	if len(command) == 2 {
+		var value string
+		var exists bool
+		var err error
+		if left {
+			value, exists, err = c.db.LPop(command[1])
+		} else {
+			value, exists, err = c.db.RPop(command[1])
+		}
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if !exists {
+			return SerializeNullBulkString()
+		}
+		notifyKeyspaceEvent(c, notifyList, listEndEvent(left, "pop"), command[1])
+		notifyIfDeleted(c, command[1])
+		return SerializeBulkString(value)
 	}
-	return SerializeBulkString(value)
-}
 
-func handleRPop(command []string) []byte {
-	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
-		return SerializeError("ERR " + err.Error())
+	count, err := strconv.Atoi(command[2])
+	if err != nil || count < 0 {
+		return SerializeError("ERR value is out of range, must be positive")
 	}
-	value, exists := storeInstance.RPop(command[1])
-	if !exists {
-		return SerializeNullBulkString()
+	popped, err := c.db.LMPop(command[1], left, count)
+	if err != nil {
+		return SerializeError(err.Error())
 	}
-	return SerializeBulkString(value)
+	if popped == nil {
+		return SerializeNullArray()
+	}
+	if len(popped) > 0 {
+		notifyKeyspaceEvent(c, notifyList, listEndEvent(left, "pop"), command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return serializeStringArray(popped)
 }
 
-func handleLRange(command []string) []byte {
+func handleLRange(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
@@ -59,18 +119,412 @@ func handleLRange(command []string) []byte {
 		return SerializeError("ERR " + err.Error())
 	}
 	
-	values := storeInstance.LRange(command[1], intArgs[0], intArgs[1])
+	values, err := c.db.LRange(command[1], intArgs[0], intArgs[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return serializeStringArray(values)
 }
 
-func handleLLen(command []string) []byte {
+func handleLLen(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	length := storeInstance.LLen(command[1])
+	length, err := c.db.LLen(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(length)
+}
+
+func handleLPushX(c *client, command []string) []byte {
+	length, err := c.db.LPushX(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if length > 0 {
+		notifyKeyspaceEvent(c, notifyList, "lpush", command[1])
+	}
+	return SerializeInteger(length)
+}
+
+func handleRPushX(c *client, command []string) []byte {
+	length, err := c.db.RPushX(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if length > 0 {
+		notifyKeyspaceEvent(c, notifyList, "rpush", command[1])
+	}
 	return SerializeInteger(length)
 }
 
+func handleLIndex(c *client, command []string) []byte {
+	index, err := strconv.Atoi(command[2])
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	value, exists, err := c.db.LIndex(command[1], index)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !exists {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(value)
+}
+
+func handleLSet(c *client, command []string) []byte {
+	index, err := strconv.Atoi(command[2])
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	if err := c.db.LSet(command[1], index, command[3]); err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyList, "lset", command[1])
+	return SerializeSimpleString("OK")
+}
+
+// handleLInsert handles LINSERT key BEFORE|AFTER pivot element.
+func handleLInsert(c *client, command []string) []byte {
+	var before bool
+	switch strings.ToUpper(command[2]) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return SerializeError("ERR syntax error")
+	}
+	length, err := c.db.LInsert(command[1], before, command[3], command[4])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if length > 0 {
+		notifyKeyspaceEvent(c, notifyList, "linsert", command[1])
+	}
+	return SerializeInteger(length)
+}
+
+func handleLRem(c *client, command []string) []byte {
+	count, err := strconv.Atoi(command[2])
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	removed, err := c.db.LRem(command[1], count, command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(c, notifyList, "lrem", command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return SerializeInteger(removed)
+}
+
+func handleLTrim(c *client, command []string) []byte {
+	intArgs, err := parseIntArgs(command[2:4])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	exists := c.db.Exists(command[1])
+	if err := c.db.LTrim(command[1], intArgs[0], intArgs[1]); err != nil {
+		return SerializeError(err.Error())
+	}
+	if exists {
+		notifyKeyspaceEvent(c, notifyList, "ltrim", command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return SerializeSimpleString("OK")
+}
+
+// handleLPos handles LPOS key element [RANK rank] [COUNT num-matches]
+// [MAXLEN len]. Without COUNT it replies with the index of the match, or
+// null, and with it an array of the indexes.
+func handleLPos(c *client, command []string) []byte {
+	rank, count, maxLen := 1, -1, 0
+	for i := 3; i < len(command); i += 2 {
+		if i+1 >= len(command) {
+			return SerializeError("ERR syntax error")
+		}
+		value, err := strconv.Atoi(command[i+1])
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(command[i]) {
+		case "RANK":
+			if value == 0 {
+				return SerializeError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = value
+		case "COUNT":
+			if value < 0 {
+				return SerializeError("ERR COUNT can't be negative")
+			}
+			count = value
+		case "MAXLEN":
+			if value < 0 {
+				return SerializeError("ERR MAXLEN can't be negative")
+			}
+			maxLen = value
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+
+	limit := count
+	if count < 0 {
+		limit = 1
+	}
+	matches, err := c.db.LPos(command[1], command[2], rank, limit, maxLen)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if count >= 0 {
+		elements := make([][]byte, len(matches))
+		for i, index := range matches {
+			elements[i] = SerializeInteger(index)
+		}
+		return SerializeArray(elements)
+	}
+	if len(matches) == 0 {
+		return SerializeNullBulkString()
+	}
+	return SerializeInteger(matches[0])
+}
+
+// handleLMove handles LMOVE source destination LEFT|RIGHT LEFT|RIGHT, which
+// moves an element from one end of the source list to one end of the
+// destination list and replies with it.
+func handleLMove(c *client, command []string) []byte {
+	fromLeft, err := parseListEnd(command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	toLeft, err := parseListEnd(command[4])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	value, moved, err := listMove(c, command[1], command[2], fromLeft, toLeft)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !moved {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(value)
+}
+
+// handleLMPop handles LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count],
+// which pops up to count elements, 1 by default, from the first non-empty
+// list. It replies with the key and the elements, or null when all are
+// empty.
+func handleLMPop(c *client, command []string) []byte {
+	keys, left, count, err := parseMPopArgs(command, 1)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	key, popped, err := listMPop(c, keys, left, count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if popped == nil {
+		return SerializeNullArray()
+	}
+	return SerializeArray([][]byte{SerializeBulkString(key), serializeStringArray(popped)})
+}
+
+// numKeysKeys returns a keys function for commands whose keys follow a count
+// of them at position pos.
+func numKeysKeys(pos int) func(command []string) []string {
+	return func(command []string) []string {
+		numKeys, err := strconv.Atoi(command[pos])
+		if err != nil || numKeys < 1 || numKeys > len(command)-pos-1 {
+			return nil
+		}
+		return command[pos+1 : pos+1+numKeys]
+	}
+}
+
+// parseListEnd parses the LEFT or RIGHT argument of a list command, and
+// reports whether it is LEFT.
+func parseListEnd(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, errors.New("ERR syntax error")
+}
+
+// listEndEvent names the pop or push at one end of a list, as in keyspace
+// events and propagated commands.
+func listEndEvent(left bool, op string) string {
+	if left {
+		return "l" + op
+	}
+	return "r" + op
+}
+
+// listMove moves an element between lists for LMOVE and BLMOVE, sending the
+// events for it and waking clients blocked on the destination. It is
+// propagated as the LMOVE it amounts to.
+func listMove(c *client, source, destination string, fromLeft, toLeft bool) (string, bool, error) {
+	value, moved, err := c.db.LMove(source, destination, fromLeft, toLeft)
+	if err != nil || !moved {
+		return "", false, err
+	}
+	c.propagateAs = []string{"LMOVE", source, destination, listEndName(fromLeft), listEndName(toLeft)}
+	notifyKeyspaceEvent(c, notifyList, listEndEvent(fromLeft, "pop"), source)
+	notifyKeyspaceEvent(c, notifyList, listEndEvent(toLeft, "push"), destination)
+	notifyIfDeleted(c, source)
+	signalKeyAsReady(c, destination)
+	return value, true, nil
+}
+
+func listEndName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// parseMPopArgs parses the numkeys key [key ...] LEFT|RIGHT [COUNT count]
+// arguments of LMPOP and BLMPOP, starting at numkeys at position pos.
+func parseMPopArgs(command []string, pos int) ([]string, bool, int, error) {
+	numKeys, err := strconv.Atoi(command[pos])
+	if err != nil || numKeys < 1 {
+		return nil, false, 0, errors.New("ERR numkeys should be greater than 0")
+	}
+	wherePos := pos + 1 + numKeys
+	if wherePos >= len(command) {
+		return nil, false, 0, errors.New("ERR syntax error")
+	}
+	left, err := parseListEnd(command[wherePos])
+	if err != nil {
+		return nil, false, 0, err
+	}
+	count := 1
+	switch rest := command[wherePos+1:]; {
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "COUNT":
+		if count, err = strconv.Atoi(rest[1]); err != nil || count < 1 {
+			return nil, false, 0, errors.New("ERR count should be greater than 0")
+		}
+	case len(rest) != 0:
+		return nil, false, 0, errors.New("ERR syntax error")
+	}
+	return command[pos+1 : wherePos], left, count, nil
+}
+
+// listMPop pops up to count elements from the first of keys that holds a
+// non-empty list, for LMPOP and BLMPOP, and returns the key and the elements,
+// or nil elements when all are empty. Keys holding other types are skipped
+// when retrying a blocked client, as they may have been set while it waited.
+// It is propagated as the LPOP or RPOP with a count it amounts to.
+func listMPop(c *client, keys []string, left bool, count int) (string, []string, error) {
+	for _, key := range keys {
+		popped, err := c.db.LMPop(key, left, count)
+		if err == errWrongType && c.retryBlocked {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(popped) == 0 {
+			continue
+		}
+		c.propagateAs = []string{strings.ToUpper(listEndEvent(left, "pop")), key, strconv.Itoa(len(popped))}
+		notifyKeyspaceEvent(c, notifyList, listEndEvent(left, "pop"), key)
+		notifyIfDeleted(c, key)
+		return key, popped, nil
+	}
+	return "", nil, nil
+}
+
+func handleBLPop(c *client, command []string) []byte {
+	return blockingPop(c, command, true)
+}
+
+func handleBRPop(c *client, command []string) []byte {
+	return blockingPop(c, command, false)
+}
+
+// blockingPop implements BLPOP and BRPOP key [key ...] timeout, which pop an
+// element from the first non-empty list, waiting up to timeout seconds for
+// one to be pushed when all are empty. They reply with the key and the
+// element.
+func blockingPop(c *client, command []string, left bool) []byte {
+	timeout, err := parseBlockTimeout(command[len(command)-1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	keys := command[1 : len(command)-1]
+	key, popped, err := listMPop(c, keys, left, 1)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if popped == nil {
+		return blockForKeys(c, command, keys, timeout, SerializeNullArray())
+	}
+	c.propagateAs = []string{strings.ToUpper(listEndEvent(left, "pop")), key}
+	return serializeStringArray([]string{key, popped[0]})
+}
+
+// handleBLMove handles BLMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// timeout, which moves an element from one end of the source list to one end
+// of the destination list, waiting up to timeout seconds for the source to
+// have one. It replies with the element.
+func handleBLMove(c *client, command []string) []byte {
+	fromLeft, err := parseListEnd(command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	toLeft, err := parseListEnd(command[4])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	timeout, err := parseBlockTimeout(command[5])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	value, moved, err := listMove(c, command[1], command[2], fromLeft, toLeft)
+	if err == errWrongType && c.retryBlocked {
+		return nil
+	}
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !moved {
+		return blockForKeys(c, command, command[1:2], timeout, SerializeNullBulkString())
+	}
+	return SerializeBulkString(value)
+}
+
+// handleBLMPop handles BLMPOP timeout numkeys key [key ...] LEFT|RIGHT
+// [COUNT count], which pops up to count elements, 1 by default, from the
+// first non-empty list, waiting up to timeout seconds for one to be pushed
+// when all are empty. It replies with the key and the elements.
+func handleBLMPop(c *client, command []string) []byte {
+	timeout, err := parseBlockTimeout(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	keys, left, count, err := parseMPopArgs(command, 2)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	key, popped, err := listMPop(c, keys, left, count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if popped != nil {
+		return SerializeArray([][]byte{SerializeBulkString(key), serializeStringArray(popped)})
+	}
+	return blockForKeys(c, command, keys, timeout, SerializeNullArray())
+}
+
 func serializeStringArray(values []string) []byte {
 	elements := make([][]byte, len(values))
 	for i, v := range values {
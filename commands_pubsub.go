@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+func registerPubSubCommands() {
+	registerCommand("SUBSCRIBE", handleSubscribe, -2, cmdSubscribedOK|cmdNoKeyspace, 0, 0, 0)
+	registerCommand("UNSUBSCRIBE", handleUnsubscribe, -1, cmdSubscribedOK|cmdNoKeyspace, 0, 0, 0)
+	registerCommand("PSUBSCRIBE", handlePSubscribe, -2, cmdSubscribedOK|cmdNoKeyspace, 0, 0, 0)
+	registerCommand("PUNSUBSCRIBE", handlePUnsubscribe, -1, cmdSubscribedOK|cmdNoKeyspace, 0, 0, 0)
+	registerCommand("PUBLISH", handlePublish, 3, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("PUBSUB", handlePubSub, -2, cmdNoKeyspace, 0, 0, 0)
+}
+
+func handleSubscribe(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	var reply bytes.Buffer
+	for _, channel := range command[1:] {
+		reply.Write(serializeSubscription("subscribe", channel, c.srv.pubsub.subscribe(c, channel)))
+	}
+	return reply.Bytes()
+}
+
+func handlePSubscribe(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	var reply bytes.Buffer
+	for _, pattern := range command[1:] {
+		reply.Write(serializeSubscription("psubscribe", pattern, c.srv.pubsub.psubscribe(c, pattern)))
+	}
+	return reply.Bytes()
+}
+
+// handleUnsubscribe leaves the given channels, or all of them when none are
+// named. Each channel gets its own confirmation.
+func handleUnsubscribe(c *client, command []string) []byte {
+	channels := command[1:]
+	if len(channels) == 0 {
+		channels, _ = c.srv.pubsub.subscriptions(c)
+		if len(channels) == 0 {
+			return serializeNoSubscription("unsubscribe", c.srv.pubsub.subscriptionCount(c))
+		}
+	}
+
+	var reply bytes.Buffer
+	for _, channel := range channels {
+		reply.Write(serializeSubscription("unsubscribe", channel, c.srv.pubsub.unsubscribe(c, channel)))
+	}
+	return reply.Bytes()
+}
+
+func handlePUnsubscribe(c *client, command []string) []byte {
+	patterns := command[1:]
+	if len(patterns) == 0 {
+		_, patterns = c.srv.pubsub.subscriptions(c)
+		if len(patterns) == 0 {
+			return serializeNoSubscription("punsubscribe", c.srv.pubsub.subscriptionCount(c))
+		}
+	}
+
+	var reply bytes.Buffer
+	for _, pattern := range patterns {
+		reply.Write(serializeSubscription("punsubscribe", pattern, c.srv.pubsub.punsubscribe(c, pattern)))
+	}
+	return reply.Bytes()
+}
+
+func handlePublish(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	return SerializeInteger(c.srv.pubsub.publish(command[1], command[2]))
+}
+
+// handlePubSub handles the PUBSUB CHANNELS, NUMSUB and NUMPAT introspection
+// subcommands.
+func handlePubSub(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	sub := strings.ToUpper(command[1])
+	args := command[2:]
+	switch {
+	case sub == "CHANNELS" && len(args) <= 1:
+		if len(args) == 1 {
+			return serializeStringArray(c.srv.pubsub.activeChannels(args[0], true))
+		}
+		return serializeStringArray(c.srv.pubsub.activeChannels("", false))
+	case sub == "NUMSUB":
+		elements := make([][]byte, 0, len(args)*2)
+		for _, channel := range args {
+			elements = append(elements, SerializeBulkString(channel), SerializeInteger(c.srv.pubsub.numSub(channel)))
+		}
+		return SerializeArray(elements)
+	case sub == "NUMPAT" && len(args) == 0:
+		return SerializeInteger(c.srv.pubsub.numPat())
+	case sub == "CHANNELS" || sub == "NUMPAT":
+		return SerializeError("ERR wrong number of arguments for 'pubsub|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try PUBSUB HELP.")
+}
+
+func serializeSubscription(kind, name string, count int) []byte {
+	return SerializeArray([][]byte{
+		SerializeBulkString(kind),
+		SerializeBulkString(name),
+		SerializeInteger(count),
+	})
+}
+
+func serializeNoSubscription(kind string, count int) []byte {
+	return SerializeArray([][]byte{
+		SerializeBulkString(kind),
+		SerializeNullBulkString(),
+		SerializeInteger(count),
+	})
+}
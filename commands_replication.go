@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func registerReplicationCommands() {
+	registerCommand("REPLICAOF", handleReplicaOf, 3, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("SLAVEOF", handleReplicaOf, 3, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("PSYNC", handlePSync, 3, 0, 0, 0, 0)
+	registerCommand("REPLCONF", handleReplConf, -1, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("ROLE", handleRole, 1, cmdNoKeyspace, 0, 0, 0)
+}
+
+// handleReplicaOf implements REPLICAOF host port and REPLICAOF NO ONE.
+func handleReplicaOf(c *client, command []string) []byte {
+	host, port := command[1], command[2]
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		c.srv.repl.becomeMaster()
+		return SerializeSimpleString("OK")
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return SerializeError("ERR Invalid master port")
+	}
+	if !c.srv.repl.setMaster(host, port) {
+		return SerializeSimpleString("OK Already connected to specified master")
+	}
+	return SerializeSimpleString("OK")
+}
+
+// handlePSync implements PSYNC replicationid offset, sent by a replica to
+// start receiving the replication stream. The replica passes ? and -1 when
+// it has no history. The reply is written by the replica's link, which then
+// keeps streaming on the connection.
+func handlePSync(c *client, command []string) []byte {
+	offset, err := strconv.ParseInt(command[2], 10, 64)
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	return c.srv.repl.syncReplica(c, command[1], offset)
+}
+
+// handleReplConf implements REPLCONF option value [option value ...], which
+// a replica uses to describe itself and to acknowledge the offset it has
+// processed.
+func handleReplConf(c *client, command []string) []byte {
+	if len(command)%2 == 0 {
+		return SerializeError("ERR syntax error")
+	}
+
+	for i := 1; i < len(command); i += 2 {
+		switch option := strings.ToLower(command[i]); option {
+		case "listening-port":
+			if _, err := strconv.Atoi(command[i+1]); err != nil {
+				return SerializeError("ERR value is not an integer or out of range")
+			}
+			c.replListeningPort = command[i+1]
+		case "capa", "ip-address":
+			// Nothing to negotiate: only PSYNC2 is spoken.
+		case "ack":
+			// Acknowledgements get no reply.
+			if offset, err := strconv.ParseInt(command[i+1], 10, 64); err == nil {
+				c.srv.repl.ack(c, offset)
+			}
+			return nil
+		case "getack":
+			// Only meaningful from a master, whose link answers it.
+			return nil
+		default:
+			return SerializeError("ERR Unrecognized REPLCONF option: " + command[i])
+		}
+	}
+	return SerializeSimpleString("OK")
+}
+
+// handleRole describes the server's part in replication.
+func handleRole(c *client, command []string) []byte {
+	return c.srv.repl.role()
+}
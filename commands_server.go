@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+func registerServerCommands() {
+	registerCommand("FLUSHDB", handleFlushDB, -1, cmdWrite, 0, 0, 0)
+	registerCommand("FLUSHALL", handleFlushAll, -1, cmdWrite, 0, 0, 0)
+	registerCommand("SWAPDB", handleSwapDB, 3, cmdWrite, 0, 0, 0)
+	registerCommand("SAVE", handleSave, 1, 0, 0, 0, 0)
+	registerCommand("BGSAVE", handleBGSave, -1, 0, 0, 0, 0)
+	registerCommand("LASTSAVE", handleLastSave, 1, cmdNoKeyspace, 0, 0, 0)
+	registerCommand("BGREWRITEAOF", handleBGRewriteAOF, 1, 0, 0, 0, 0)
+	registerCommand("CONFIG", handleConfig, -2, cmdNoKeyspace, 0, 0, 0)
+}
+
+// handleFlushDB empties the selected database.
+func handleFlushDB(c *client, command []string) []byte {
+	async, err := parseFlushMode(command)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	c.db.Flush(async)
+	return SerializeSimpleString("OK")
+}
+
+// handleFlushAll empties every database.
+func handleFlushAll(c *client, command []string) []byte {
+	async, err := parseFlushMode(command)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	c.srv.flushAll(async)
+	return SerializeSimpleString("OK")
+}
+
+// parseFlushMode parses the [ASYNC|SYNC] argument of FLUSHDB and FLUSHALL.
+// ASYNC leaves freeing the deleted keys to the background.
+func parseFlushMode(command []string) (bool, error) {
+	if len(command) == 1 {
+		return false, nil
+	}
+	if len(command) == 2 {
+		switch strings.ToUpper(command[1]) {
+		case "ASYNC":
+			return true, nil
+		case "SYNC":
+			return false, nil
+		}
+	}
+	return false, errors.New("ERR syntax error")
+}
+
+// handleSwapDB handles SWAPDB index1 index2, which exchanges the keys of two
+// databases, so that the clients of each see the keys of the other.
+func handleSwapDB(c *client, command []string) []byte {
+	if c.srv.cluster != nil {
+		return SerializeError("ERR SWAPDB is not allowed in cluster mode")
+	}
+	first, err := strconv.Atoi(command[1])
+	if err != nil {
+		return SerializeError("ERR invalid first DB index")
+	}
+	second, err := strconv.Atoi(command[2])
+	if err != nil {
+		return SerializeError("ERR invalid second DB index")
+	}
+	if first < 0 || first >= len(c.srv.dbs) || second < 0 || second >= len(c.srv.dbs) {
+		return SerializeError(errDBIndex.Error())
+	}
+
+	c.srv.dbs[first].SwapWith(c.srv.dbs[second])
+	// Clients blocked in either database may find their keys there now.
+	c.srv.blocking.signalDBs(first, second)
+	return SerializeSimpleString("OK")
+}
+
+// handleSave writes the dump file and replies once it is on disk.
+func handleSave(c *client, command []string) []byte {
+	if err := c.srv.rdb.save(c.srv.dbs...); err != nil {
+		if err == errSaveInProgress {
+			return SerializeError(err.Error())
+		}
+		return SerializeError("ERR " + err.Error())
+	}
+	return SerializeSimpleString("OK")
+}
+
+// handleBGSave starts writing the dump file in the background. SCHEDULE is
+// accepted for compatibility.
+func handleBGSave(c *client, command []string) []byte {
+	if len(command) > 2 || (len(command) == 2 && strings.ToUpper(command[1]) != "SCHEDULE") {
+		return SerializeError("ERR syntax error")
+	}
+	if err := c.srv.rdb.bgsave(c.srv.dbs...); err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeSimpleString("Background saving started")
+}
+
+func handleLastSave(c *client, command []string) []byte {
+	return SerializeInteger(int(c.srv.rdb.lastSaveTime()))
+}
+
+// handleBGRewriteAOF starts compacting the append-only file. It holds
+// keyspaceLock shared like any read, which keeps writes out while the
+// snapshot is taken.
+func handleBGRewriteAOF(c *client, command []string) []byte {
+	if err := c.srv.aof.bgrewrite(c.srv.dbs...); err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeSimpleString("Background append only file rewriting started")
+}
+
+// handleConfig handles CONFIG GET pattern [pattern ...] and CONFIG SET
+// parameter value [parameter value ...].
+func handleConfig(c *client, command []string) []byte {
+	sub := strings.ToUpper(command[1])
+	args := command[2:]
+	switch {
+	case sub == "GET" && len(args) > 0:
+		var pairs []string
+		seen := make(map[string]bool)
+		for _, pattern := range args {
+			found := c.srv.configGet(pattern)
+			for i := 0; i < len(found); i += 2 {
+				if !seen[found[i]] {
+					seen[found[i]] = true
+					pairs = append(pairs, found[i], found[i+1])
+				}
+			}
+		}
+		return serializeStringArray(pairs)
+	case sub == "SET" && len(args) > 0 && len(args)%2 == 0:
+		for i := 0; i < len(args); i += 2 {
+			if err := c.srv.configSet(args[i], args[i+1]); err != nil {
+				return SerializeError(err.Error())
+			}
+		}
+		return SerializeSimpleString("OK")
+	case sub == "GET" || sub == "SET":
+		return SerializeError("ERR wrong number of arguments for 'config|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try CONFIG HELP.")
+}
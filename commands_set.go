@@ -1,52 +1,280 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
 
 func registerSetCommands() {
-	registerCommand("SADD", handleSAdd)
-	registerCommand("SMEMBERS", handleSMembers)
-	registerCommand("SISMEMBER", handleSIsMember)
-	registerCommand("SREM", handleSRem)
-	registerCommand("SCARD", handleSCard)
+	registerCommand("SADD", handleSAdd, -3, cmdWrite, 1, 1, 1)
+	registerCommand("SMEMBERS", handleSMembers, 2, 0, 1, 1, 1)
+	registerCommand("SISMEMBER", handleSIsMember, 3, 0, 1, 1, 1)
+	registerCommand("SREM", handleSRem, -3, cmdWrite, 1, 1, 1)
+	registerCommand("SCARD", handleSCard, 2, 0, 1, 1, 1)
+	registerCommand("SMISMEMBER", handleSMIsMember, -3, 0, 1, 1, 1)
+	registerCommand("SINTER", handleSInter, -2, 0, 1, -1, 1)
+	registerCommand("SUNION", handleSUnion, -2, 0, 1, -1, 1)
+	registerCommand("SDIFF", handleSDiff, -2, 0, 1, -1, 1)
+	registerCommand("SINTERSTORE", handleSInterStore, -3, cmdWrite, 1, -1, 1)
+	registerCommand("SUNIONSTORE", handleSUnionStore, -3, cmdWrite, 1, -1, 1)
+	registerCommand("SDIFFSTORE", handleSDiffStore, -3, cmdWrite, 1, -1, 1)
+	registerCommand("SINTERCARD", handleSInterCard, -3, 0, 0, 0, 0)
+	registerKeysFunc("SINTERCARD", numKeysKeys(1))
+	registerCommand("SMOVE", handleSMove, 4, cmdWrite, 1, 2, 1)
+	registerCommand("SPOP", handleSPop, -2, cmdWrite, 1, 1, 1)
+	registerCommand("SRANDMEMBER", handleSRandMember, -2, 0, 1, 1, 1)
+	registerCommand("SSCAN", handleSScan, -3, 0, 1, 1, 1)
 }
 
-func handleSAdd(command []string) []byte {
+func handleSAdd(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	added := storeInstance.SAdd(command[1], command[2:]...)
+	added, err := c.db.SAdd(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if added > 0 {
+		notifyKeyspaceEvent(c, notifySet, "sadd", command[1])
+	}
 	return SerializeInteger(added)
 }
 
-func handleSMembers(command []string) []byte {
+func handleSMembers(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	members := storeInstance.SMembers(command[1])
+	members, err := c.db.SMembers(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return serializeStringArray(members)
 }
 
-func handleSIsMember(command []string) []byte {
+func handleSIsMember(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	isMember := storeInstance.SIsMember(command[1], command[2])
+	isMember, err := c.db.SIsMember(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return SerializeInteger(boolToInt(isMember))
 }
 
-func handleSRem(command []string) []byte {
+func handleSRem(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	removed := storeInstance.SRem(command[1], command[2:]...)
+	removed, err := c.db.SRem(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(c, notifySet, "srem", command[1])
+		notifyIfDeleted(c, command[1])
+	}
 	return SerializeInteger(removed)
 }
 
-func handleSCard(command []string) []byte {
+func handleSCard(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	cardinality := storeInstance.SCard(command[1])
+	cardinality, err := c.db.SCard(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	return SerializeInteger(cardinality)
 }
 
+func handleSMIsMember(c *client, command []string) []byte {
+	isMember, err := c.db.SMIsMember(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	elements := make([][]byte, len(isMember))
+	for i, ok := range isMember {
+		elements[i] = SerializeInteger(boolToInt(ok))
+	}
+	return SerializeArray(elements)
+}
+
+func handleSInter(c *client, command []string) []byte {
+	return setOpReply(c.db.SInter(command[1:]...))
+}
+
+func handleSUnion(c *client, command []string) []byte {
+	return setOpReply(c.db.SUnion(command[1:]...))
+}
+
+func handleSDiff(c *client, command []string) []byte {
+	return setOpReply(c.db.SDiff(command[1:]...))
+}
+
+func setOpReply(members []string, err error) []byte {
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeStringArray(members)
+}
+
+func handleSInterStore(c *client, command []string) []byte {
+	return setOpStore(c, command, c.db.SInterStore)
+}
+
+func handleSUnionStore(c *client, command []string) []byte {
+	return setOpStore(c, command, c.db.SUnionStore)
+}
+
+func handleSDiffStore(c *client, command []string) []byte {
+	return setOpStore(c, command, c.db.SDiffStore)
+}
+
+// setOpStore implements SINTERSTORE, SUNIONSTORE and SDIFFSTORE destination
+// key [key ...], which store the result at destination and reply with its
+// size.
+func setOpStore(c *client, command []string, store func(destination string, keys ...string) (int, error)) []byte {
+	destination := command[1]
+	existed := c.db.Exists(destination)
+	size, err := store(destination, command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if size > 0 {
+		notifyKeyspaceEvent(c, notifySet, strings.ToLower(command[0]), destination)
+	} else if existed {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", destination)
+	}
+	return SerializeInteger(size)
+}
+
+// handleSInterCard handles SINTERCARD numkeys key [key ...] [LIMIT limit].
+func handleSInterCard(c *client, command []string) []byte {
+	numKeys, err := strconv.Atoi(command[1])
+	if err != nil || numKeys < 1 {
+		return SerializeError("ERR numkeys should be greater than 0")
+	}
+	if numKeys > len(command)-2 {
+		return SerializeError("ERR Number of keys can't be greater than number of args")
+	}
+	limit := 0
+	switch rest := command[2+numKeys:]; {
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "LIMIT":
+		if limit, err = strconv.Atoi(rest[1]); err != nil || limit < 0 {
+			return SerializeError("ERR LIMIT can't be negative")
+		}
+	case len(rest) != 0:
+		return SerializeError("ERR syntax error")
+	}
+
+	count, err := c.db.SInterCard(limit, command[2:2+numKeys]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(count)
+}
+
+func handleSMove(c *client, command []string) []byte {
+	source, destination := command[1], command[2]
+	moved, err := c.db.SMove(source, destination, command[3])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if moved && source != destination {
+		notifyKeyspaceEvent(c, notifySet, "srem", source)
+		notifyKeyspaceEvent(c, notifySet, "sadd", destination)
+		notifyIfDeleted(c, source)
+	}
+	return SerializeInteger(boolToInt(moved))
+}
+
+// handleSPop handles SPOP key [count], which removes and replies with a
+// random member, or with a count, an array of up to count of them. As the
+// members are random, it is propagated as the SREM of the ones it removed.
+func handleSPop(c *client, command []string) []byte {
+	if len(command) > 3 {
+		return SerializeError("ERR wrong number of arguments for 'spop' command")
+	}
+	count := 1
+	if len(command) == 3 {
+		var err error
+		if count, err = strconv.Atoi(command[2]); err != nil || count < 0 {
+			return SerializeError("ERR value is out of range, must be positive")
+		}
+	}
+	popped, err := c.db.SPop(command[1], count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if len(popped) > 0 {
+		c.propagateAs = append([]string{"SREM", command[1]}, popped...)
+		notifyKeyspaceEvent(c, notifySet, "spop", command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	if len(command) == 3 {
+		return serializeStringArray(popped)
+	}
+	if len(popped) == 0 {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(popped[0])
+}
+
+// handleSRandMember handles SRANDMEMBER key [count]. With a count it replies
+// with up to count different members, or with a negative count, -count
+// members that may repeat.
+func handleSRandMember(c *client, command []string) []byte {
+	if len(command) > 3 {
+		return SerializeError("ERR wrong number of arguments for 'srandmember' command")
+	}
+	if len(command) == 2 {
+		members, err := c.db.SRandMember(command[1], 1)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if len(members) == 0 {
+			return SerializeNullBulkString()
+		}
+		return SerializeBulkString(members[0])
+	}
+	count, err := parseRandomCount(command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	members, err := c.db.SRandMember(command[1], count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeStringArray(members)
+}
+
+// parseRandomCount parses the count of SRANDMEMBER and HRANDFIELD. Negative
+// counts are bounded as in Redis, which keeps their negation and the reply
+// they ask for in range.
+func parseRandomCount(arg string) (int, error) {
+	count, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if count < -(math.MaxInt64 / 2) {
+		return 0, errors.New("ERR value is out of range")
+	}
+	return count, nil
+}
+
+// handleSScan handles SSCAN key cursor [MATCH pattern] [COUNT count], like
+// SCAN.
+func handleSScan(c *client, command []string) []byte {
+	cursor, args, err := parseScanArgs(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	cursor, members, err := c.db.SScan(command[1], cursor, args)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeScan(cursor, serializeStringArray(members))
+}
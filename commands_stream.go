@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerStreamCommands() {
+	registerCommand("XADD", handleXAdd, -5, cmdWrite, 1, 1, 1)
+	registerCommand("XRANGE", handleXRange, -4, 0, 1, 1, 1)
+	registerCommand("XREVRANGE", handleXRevRange, -4, 0, 1, 1, 1)
+	registerCommand("XLEN", handleXLen, 2, 0, 1, 1, 1)
+	registerCommand("XDEL", handleXDel, -3, cmdWrite, 1, 1, 1)
+	registerCommand("XTRIM", handleXTrim, -4, cmdWrite, 1, 1, 1)
+	registerCommand("XSETID", handleXSetID, -3, cmdWrite, 1, 1, 1)
+	registerCommand("XREAD", handleXRead, -4, 0, 0, 0, 0)
+	registerKeysFunc("XREAD", xreadKeys)
+}
+
+// streamEntriesReply serializes entries as an array of [id, [field, value,
+// ...]] pairs. Entries with nil fields, which were deleted, have a null array
+// instead.
+func streamEntriesReply(entries []StreamEntry) []byte {
+	elements := make([][]byte, len(entries))
+	for i, entry := range entries {
+		fields := SerializeNullArray()
+		if entry.Fields != nil {
+			fields = serializeStringArray(entry.Fields)
+		}
+		elements[i] = SerializeArray([][]byte{SerializeBulkString(entry.ID.String()), fields})
+	}
+	return SerializeArray(elements)
+}
+
+// parseStreamTrimArgs parses the options of XADD, or with xadd false of XTRIM,
+// starting at args[i]. It returns the options and the index of the first
+// argument that is not one of them, which for XADD is the entry's ID.
+func parseStreamTrimArgs(args []string, i int, xadd bool) (XAddArgs, int, error) {
+	var opts XAddArgs
+	var trim StreamTrim
+	strategy, limitGiven := "", false
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		moreArgs := len(args) - 1 - i
+		switch {
+		case xadd && opt == "*":
+			// The ID, which can not be an option.
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs > 0:
+			if strategy != "" {
+				return opts, 0, errors.New("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			strategy = opt
+			if moreArgs >= 2 && (args[i+1] == "~" || args[i+1] == "=") {
+				trim.Approx = args[i+1] == "~"
+				i++
+			}
+			i++
+			if opt == "MAXLEN" {
+				maxLen, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return opts, 0, errNotInteger
+				}
+				if maxLen < 0 {
+					return opts, 0, errors.New("ERR The MAXLEN argument must be >= 0.")
+				}
+				trim.ByMaxLen, trim.MaxLen = true, maxLen
+			} else {
+				minID, _, err := parseStreamID(args[i], 0, false)
+				if err != nil {
+					return opts, 0, err
+				}
+				trim.MinID = minID
+			}
+			continue
+		case opt == "LIMIT" && moreArgs > 0:
+			i++
+			limit, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return opts, 0, errNotInteger
+			}
+			if limit < 0 {
+				return opts, 0, errors.New("ERR The LIMIT argument must be >= 0.")
+			}
+			trim.Limit, limitGiven = limit, true
+			continue
+		case xadd && opt == "NOMKSTREAM":
+			opts.NoMkStream = true
+			continue
+		case !xadd:
+			return opts, 0, errors.New("ERR syntax error")
+		}
+		break
+	}
+
+	switch {
+	case strategy == "" && limitGiven:
+		return opts, 0, errors.New("ERR syntax error, LIMIT cannot be used without specifying a trimming strategy")
+	case strategy == "" && !xadd:
+		return opts, 0, errors.New("ERR syntax error, XTRIM must be called with a trimming strategy")
+	case limitGiven && !trim.Approx:
+		return opts, 0, errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	case trim.Approx && !limitGiven:
+		// Like Redis, bound the work of approximate trimming to 100 chunks.
+		trim.Limit = 100 * streamChunkSize
+	}
+	if strategy != "" {
+		opts.Trim = &trim
+	}
+	return opts, i, nil
+}
+
+// handleXAdd handles XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...]. It is propagated with
+// the ID that was generated and any trimming made exact, so that replicas
+// end up with the same entries.
+func handleXAdd(c *client, command []string) []byte {
+	key := command[1]
+	args, idPos, err := parseStreamTrimArgs(command, 2, true)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if idPos+1 >= len(command) || (len(command)-idPos-1)%2 != 0 {
+		return SerializeError("ERR wrong number of arguments for 'xadd' command")
+	}
+
+	if command[idPos] == "*" {
+		args.AutoID = true
+	} else {
+		if args.ID, args.AutoSeq, err = parseStreamID(command[idPos], 0, true); err != nil {
+			return SerializeError(err.Error())
+		}
+		if !args.AutoSeq && args.ID.isZero() {
+			return SerializeError(errStreamIDZero.Error())
+		}
+	}
+	fields := command[idPos+1:]
+
+	id, trimmed, added, err := c.db.XAdd(key, args, fields)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !added {
+		return SerializeNullBulkString()
+	}
+
+	c.propagateAs = []string{"XADD", key}
+	if args.Trim != nil {
+		length, _ := c.db.XLen(key)
+		c.propagateAs = append(c.propagateAs, "MAXLEN", "=", strconv.Itoa(length))
+	}
+	c.propagateAs = append(append(c.propagateAs, id.String()), fields...)
+
+	notifyKeyspaceEvent(c, notifyStream, "xadd", key)
+	if trimmed > 0 {
+		notifyKeyspaceEvent(c, notifyStream, "xtrim", key)
+	}
+	signalKeyAsReady(c, key)
+	return SerializeBulkString(id.String())
+}
+
+// parseStreamRangeID parses an end of an XRANGE interval: "-", "+", an ID
+// whose sequence defaults to missingSeq, or one of these after "(" to
+// exclude it.
+func parseStreamRangeID(s string, missingSeq uint64) (StreamID, bool, error) {
+	exclusive := len(s) > 1 && s[0] == '('
+	if exclusive {
+		s = s[1:]
+	}
+	switch s {
+	case "-":
+		return StreamID{}, exclusive, nil
+	case "+":
+		return maxStreamID, exclusive, nil
+	}
+	id, _, err := parseStreamID(s, missingSeq, false)
+	return id, exclusive, err
+}
+
+func handleXRange(c *client, command []string) []byte {
+	return xrangeGeneric(c, command, false)
+}
+
+func handleXRevRange(c *client, command []string) []byte {
+	return xrangeGeneric(c, command, true)
+}
+
+// xrangeGeneric implements XRANGE key start end [COUNT count] and XREVRANGE
+// key end start [COUNT count].
+func xrangeGeneric(c *client, command []string, rev bool) []byte {
+	startArg, endArg := command[2], command[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, startEx, err := parseStreamRangeID(startArg, 0)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	end, endEx, err := parseStreamRangeID(endArg, maxStreamID.Seq)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if startEx {
+		var ok bool
+		if start, ok = start.next(); !ok {
+			return SerializeError("ERR invalid start ID for the interval")
+		}
+	}
+	if endEx {
+		var ok bool
+		if end, ok = end.prev(); !ok {
+			return SerializeError("ERR invalid end ID for the interval")
+		}
+	}
+
+	count := -1
+	for i := 4; i < len(command); i++ {
+		if strings.ToUpper(command[i]) != "COUNT" || i+1 == len(command) {
+			return SerializeError("ERR syntax error")
+		}
+		i++
+		n, err := strconv.Atoi(command[i])
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		count = max(n, 0)
+	}
+
+	entries, err := c.db.XRange(command[1], start, end, max(count, 0), rev)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if count == 0 {
+		return SerializeNullArray()
+	}
+	return streamEntriesReply(entries)
+}
+
+func handleXLen(c *client, command []string) []byte {
+	length, err := c.db.XLen(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(length)
+}
+
+// handleXDel removes entries by ID and replies with how many existed.
+func handleXDel(c *client, command []string) []byte {
+	ids := make([]StreamID, 0, len(command)-2)
+	for _, arg := range command[2:] {
+		id, _, err := parseStreamID(arg, 0, false)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	deleted, err := c.db.XDel(command[1], ids...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if deleted > 0 {
+		notifyKeyspaceEvent(c, notifyStream, "xdel", command[1])
+	}
+	return SerializeInteger(deleted)
+}
+
+// handleXTrim handles XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count].
+// Approximate trimming is propagated as the exact length it left.
+func handleXTrim(c *client, command []string) []byte {
+	key := command[1]
+	args, _, err := parseStreamTrimArgs(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	trimmed, err := c.db.XTrim(key, *args.Trim)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if trimmed > 0 {
+		length, _ := c.db.XLen(key)
+		c.propagateAs = []string{"XTRIM", key, "MAXLEN", "=", strconv.Itoa(length)}
+		notifyKeyspaceEvent(c, notifyStream, "xtrim", key)
+	}
+	return SerializeInteger(trimmed)
+}
+
+// handleXSetID handles XSETID key last-id [ENTRIESADDED entries-added]
+// [MAXDELETEDID max-deleted-id], which sets the ID new entries must exceed.
+func handleXSetID(c *client, command []string) []byte {
+	lastID, _, err := parseStreamID(command[2], 0, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	var entriesAdded *uint64
+	var maxDeletedID *StreamID
+	for i := 3; i < len(command); i++ {
+		opt := strings.ToUpper(command[i])
+		if i+1 == len(command) || (opt != "ENTRIESADDED" && opt != "MAXDELETEDID") {
+			return SerializeError("ERR syntax error")
+		}
+		i++
+		if opt == "ENTRIESADDED" {
+			n, err := strconv.ParseInt(command[i], 10, 64)
+			if err != nil {
+				return SerializeError("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return SerializeError("ERR entries_added must be positive")
+			}
+			added := uint64(n)
+			entriesAdded = &added
+		} else {
+			id, _, err := parseStreamID(command[i], 0, false)
+			if err != nil {
+				return SerializeError(err.Error())
+			}
+			maxDeletedID = &id
+		}
+	}
+
+	if err := c.db.XSetID(command[1], lastID, entriesAdded, maxDeletedID); err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyStream, "xsetid", command[1])
+	return SerializeSimpleString("OK")
+}
+
+// xreadKeys returns the keys of XREAD and XREADGROUP: the first half of the
+// arguments after STREAMS.
+func xreadKeys(command []string) []string {
+	for i := 1; i < len(command); i++ {
+		switch strings.ToUpper(command[i]) {
+		case "COUNT", "BLOCK":
+			i++
+		case "GROUP":
+			i += 2
+		case "STREAMS":
+			streams := command[i+1:]
+			return streams[:len(streams)/2]
+		}
+	}
+	return nil
+}
+
+// xreadArgs are the arguments of XREAD and XREADGROUP.
+type xreadArgs struct {
+	group, consumer string
+	count           int
+	// block is how long to wait for entries, 0 meaning forever, or
+	// negative not to wait.
+	block time.Duration
+	noAck bool
+	// streamsPos is the index of the first key.
+	streamsPos int
+	keys, ids  []string
+}
+
+// parseXReadArgs parses the arguments of XREAD, or with group of
+// XREADGROUP.
+func parseXReadArgs(command []string, group bool) (xreadArgs, error) {
+	args := xreadArgs{block: -1}
+	name, groupGiven := strings.ToLower(command[0]), false
+	for i := 1; i < len(command) && args.streamsPos == 0; i++ {
+		opt := strings.ToUpper(command[i])
+		moreArgs := len(command) - 1 - i
+		switch {
+		case opt == "COUNT" && moreArgs > 0:
+			i++
+			n, err := strconv.Atoi(command[i])
+			if err != nil {
+				return args, errNotInteger
+			}
+			args.count = max(n, 0)
+		case opt == "BLOCK" && moreArgs > 0:
+			i++
+			ms, err := strconv.ParseInt(command[i], 10, 64)
+			if err != nil {
+				return args, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return args, errors.New("ERR timeout is negative")
+			}
+			args.block = time.Duration(ms) * time.Millisecond
+		case opt == "STREAMS" && moreArgs > 0:
+			args.streamsPos = i + 1
+		case opt == "GROUP" && moreArgs > 1:
+			if !group {
+				return args, errors.New("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			args.group, args.consumer, groupGiven = command[i+1], command[i+2], true
+			i += 2
+		case opt == "NOACK":
+			if !group {
+				return args, errors.New("ERR The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			args.noAck = true
+		default:
+			return args, errors.New("ERR syntax error")
+		}
+	}
+	if args.streamsPos == 0 {
+		return args, errors.New("ERR syntax error")
+	}
+	if group && !groupGiven {
+		return args, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+
+	streams := command[args.streamsPos:]
+	if len(streams)%2 != 0 {
+		return args, errors.New("ERR Unbalanced '" + name + "' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	args.keys, args.ids = streams[:len(streams)/2], streams[len(streams)/2:]
+	return args, nil
+}
+
+// handleXRead handles XREAD [COUNT count] [BLOCK milliseconds] STREAMS key
+// [key ...] id [id ...], which returns the entries of each stream with an ID
+// greater than the one given for it, "$" standing for the stream's last ID.
+// With BLOCK and nothing to return, it waits for an entry to be added, with
+// "$" resolved to the last ID when the command was sent.
+func handleXRead(c *client, command []string) []byte {
+	args, err := parseXReadArgs(command, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	ids := make([]StreamID, len(args.keys))
+	resolved := false
+	for i, arg := range args.ids {
+		if arg == "$" {
+			lastID, _, err := c.db.XLastID(args.keys[i])
+			if err != nil {
+				return SerializeError(err.Error())
+			}
+			ids[i], resolved = lastID, true
+			continue
+		}
+		id, _, err := parseStreamID(arg, 0, false)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		ids[i] = id
+	}
+
+	var results [][]byte
+	for i, key := range args.keys {
+		start, ok := ids[i].next()
+		if !ok {
+			continue
+		}
+		entries, err := c.db.XRange(key, start, maxStreamID, args.count, false)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if len(entries) > 0 {
+			results = append(results, SerializeArray([][]byte{SerializeBulkString(key), streamEntriesReply(entries)}))
+		}
+	}
+	if len(results) > 0 {
+		return SerializeArray(results)
+	}
+	if args.block < 0 {
+		return SerializeNullArray()
+	}
+
+	if resolved {
+		// Wait for entries after the last IDs as they are now.
+		command = append([]string(nil), command...)
+		for i := range ids {
+			command[args.streamsPos+len(args.keys)+i] = ids[i].String()
+		}
+	}
+	return blockForKeys(c, command, args.keys, args.block, SerializeNullArray())
+}
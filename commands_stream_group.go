@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func registerStreamGroupCommands() {
+	registerCommand("XGROUP", handleXGroup, -2, cmdWrite, 2, 2, 1)
+	registerCommand("XREADGROUP", handleXReadGroup, -7, cmdWrite, 0, 0, 0)
+	registerKeysFunc("XREADGROUP", xreadKeys)
+	registerCommand("XACK", handleXAck, -4, cmdWrite, 1, 1, 1)
+	registerCommand("XPENDING", handleXPending, -3, 0, 1, 1, 1)
+	registerCommand("XCLAIM", handleXClaim, -6, cmdWrite, 1, 1, 1)
+	registerCommand("XAUTOCLAIM", handleXAutoClaim, -6, cmdWrite, 1, 1, 1)
+	registerCommand("XINFO", handleXInfo, -2, 0, 2, 2, 1)
+}
+
+// groupError words the errors of a consumer group lookup. Commands differ in
+// how they report a missing stream or group; noGroup is their message for
+// either, and a missing group alone is reported like XGROUP does when
+// noGroup is empty.
+func groupError(err error, key, group, noGroup string) []byte {
+	switch {
+	case noGroup != "" && (err == errNoSuchKey || err == errNoGroup):
+		return SerializeError(noGroup)
+	case err == errNoGroup:
+		return SerializeError("NOGROUP No such consumer group '" + group + "' for key name '" + key + "'")
+	}
+	return SerializeError(err.Error())
+}
+
+// parseEntriesRead parses the argument of ENTRIESREAD.
+func parseEntriesRead(arg string) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if n < 0 && n != streamEntriesReadUnknown {
+		return 0, errors.New("ERR value for ENTRIESREAD must be positive or -1")
+	}
+	return n, nil
+}
+
+// parseGroupID parses the ID a group is set to, "$" standing for the
+// stream's last ID.
+func parseGroupID(c *client, key, arg string) (StreamID, error) {
+	if arg == "$" {
+		lastID, _, err := c.db.XLastID(key)
+		return lastID, err
+	}
+	id, _, err := parseStreamID(arg, 0, false)
+	return id, err
+}
+
+// handleXGroup handles the XGROUP subcommands, which manage the consumer
+// groups of a stream:
+//
+//	XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+//	XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+//	XGROUP DESTROY key group
+//	XGROUP CREATECONSUMER key group consumer
+//	XGROUP DELCONSUMER key group consumer
+func handleXGroup(c *client, command []string) []byte {
+	sub := strings.ToUpper(command[1])
+	args := command[2:]
+	switch {
+	case (sub == "CREATE" || sub == "SETID") && len(args) >= 3:
+		return xgroupSetGroup(c, sub, args)
+	case sub == "DESTROY" && len(args) == 2:
+		destroyed, err := c.db.XGroupDestroy(args[0], args[1])
+		if err != nil {
+			return groupError(err, args[0], args[1], "")
+		}
+		if destroyed {
+			notifyKeyspaceEvent(c, notifyStream, "xgroup-destroy", args[0])
+			// Clients blocked reading the group learn it is gone.
+			signalKeyAsReady(c, args[0])
+		}
+		return SerializeInteger(boolToInt(destroyed))
+	case sub == "CREATECONSUMER" && len(args) == 3:
+		created, err := c.db.XGroupCreateConsumer(args[0], args[1], args[2])
+		if err != nil {
+			return groupError(err, args[0], args[1], "")
+		}
+		if created {
+			notifyKeyspaceEvent(c, notifyStream, "xgroup-createconsumer", args[0])
+		}
+		return SerializeInteger(boolToInt(created))
+	case sub == "DELCONSUMER" && len(args) == 3:
+		pending, deleted, err := c.db.XGroupDelConsumer(args[0], args[1], args[2])
+		if err != nil {
+			return groupError(err, args[0], args[1], "")
+		}
+		if deleted {
+			notifyKeyspaceEvent(c, notifyStream, "xgroup-delconsumer", args[0])
+		}
+		return SerializeInteger(pending)
+	case sub == "CREATE" || sub == "SETID" || sub == "DESTROY" || sub == "CREATECONSUMER" || sub == "DELCONSUMER":
+		return SerializeError("ERR wrong number of arguments for 'xgroup|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try XGROUP HELP.")
+}
+
+// xgroupSetGroup implements XGROUP CREATE and XGROUP SETID.
+func xgroupSetGroup(c *client, sub string, args []string) []byte {
+	key, group := args[0], args[1]
+	mkStream, entriesRead := false, int64(streamEntriesReadUnknown)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "MKSTREAM" && sub == "CREATE":
+			mkStream = true
+		case opt == "ENTRIESREAD" && i+1 < len(args):
+			i++
+			n, err := parseEntriesRead(args[i])
+			if err != nil {
+				return SerializeError(err.Error())
+			}
+			entriesRead = n
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+	id, err := parseGroupID(c, key, args[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	if sub == "CREATE" {
+		err = c.db.XGroupCreate(key, group, id, entriesRead, mkStream)
+	} else {
+		err = c.db.XGroupSetID(key, group, id, entriesRead)
+	}
+	if err == errNoSuchKey {
+		err = errXGroupKeyMissing
+	}
+	if err != nil {
+		return groupError(err, key, group, "")
+	}
+
+	// "$" is propagated as the ID it stood for.
+	c.propagateAs = []string{"XGROUP", sub, key, group, id.String(), "ENTRIESREAD", strconv.FormatInt(entriesRead, 10)}
+	if mkStream {
+		c.propagateAs = append(c.propagateAs, "MKSTREAM")
+	}
+	notifyKeyspaceEvent(c, notifyStream, "xgroup-"+strings.ToLower(sub), key)
+	return SerializeSimpleString("OK")
+}
+
+// propagateGroupState sends on the changes a read or claim made to a group
+// as the commands that make them on their own: the consumer's creation, an
+// XCLAIM for each entry that became pending, with its delivery time and
+// count, an XACK for each entry that is no longer pending, and the group's
+// last delivered ID.
+func propagateGroupState(c *client, key, group, consumer string, created bool, pending []PendingEntry, acked []StreamID, lastID *StreamID, entriesRead int64) {
+	if created {
+		propagate(c, []string{"XGROUP", "CREATECONSUMER", key, group, consumer})
+	}
+	for _, p := range pending {
+		propagate(c, []string{"XCLAIM", key, group, consumer, "0", p.ID.String(),
+			"TIME", strconv.FormatInt(p.DeliveryTime, 10),
+			"RETRYCOUNT", strconv.FormatUint(p.DeliveryCount, 10),
+			"FORCE", "JUSTID"})
+	}
+	if len(acked) > 0 {
+		xack := []string{"XACK", key, group}
+		for _, id := range acked {
+			xack = append(xack, id.String())
+		}
+		propagate(c, xack)
+	}
+	if lastID != nil {
+		propagate(c, []string{"XGROUP", "SETID", key, group, lastID.String(), "ENTRIESREAD", strconv.FormatInt(entriesRead, 10)})
+	}
+	c.preventPropagation = true
+}
+
+// handleXReadGroup handles XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]. With the
+// ID ">" it delivers the entries the group has not read yet to the
+// consumer, where they stay pending until acknowledged unless NOACK is
+// given. With any other ID it delivers again the entries pending for the
+// consumer after that ID. Only reads of new entries block.
+func handleXReadGroup(c *client, command []string) []byte {
+	args, err := parseXReadArgs(command, true)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	reads := make([]XReadGroupArgs, len(args.keys))
+	history := false
+	for i, arg := range args.ids {
+		reads[i] = XReadGroupArgs{Count: args.count, NoAck: args.noAck}
+		switch arg {
+		case ">":
+			continue
+		case "$":
+			return SerializeError("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		}
+		id, _, err := parseStreamID(arg, 0, false)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		reads[i].History, reads[i].Start, history = true, id, true
+	}
+
+	// Every group must exist before anything is read.
+	for _, key := range args.keys {
+		err := c.db.XGroupExists(key, args.group)
+		switch {
+		case c.retryBlocked && err == errNoSuchKey:
+			return SerializeError("UNBLOCKED the stream key no longer exists")
+		case c.retryBlocked && err == errNoGroup:
+			return SerializeError("NOGROUP the consumer group this client was blocked on no longer exists")
+		case err != nil:
+			return groupError(err, key, args.group, "NOGROUP No such key '"+key+"' or consumer group '"+args.group+"' in XREADGROUP with GROUP option")
+		}
+	}
+
+	var results [][]byte
+	for i, key := range args.keys {
+		result, err := c.db.XReadGroup(key, args.group, args.consumer, reads[i])
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+
+		var pending []PendingEntry
+		var lastID *StreamID
+		if !reads[i].History && len(result.Entries) > 0 {
+			lastID = &result.LastID
+			if !args.noAck {
+				for _, entry := range result.Entries {
+					pending = append(pending, PendingEntry{ID: entry.ID, DeliveryTime: result.DeliveryTime, DeliveryCount: 1})
+				}
+			}
+		}
+		propagateGroupState(c, key, args.group, args.consumer, result.ConsumerCreated, pending, nil, lastID, result.EntriesRead)
+		if result.ConsumerCreated {
+			notifyKeyspaceEvent(c, notifyStream, "xgroup-createconsumer", key)
+		}
+
+		// History reads always reply for their stream.
+		if len(result.Entries) > 0 || reads[i].History {
+			results = append(results, SerializeArray([][]byte{SerializeBulkString(key), streamEntriesReply(result.Entries)}))
+		}
+	}
+	if len(results) > 0 {
+		return SerializeArray(results)
+	}
+	if args.block < 0 || history {
+		return SerializeNullArray()
+	}
+	return blockForKeys(c, command, args.keys, args.block, SerializeNullArray())
+}
+
+// handleXAck handles XACK key group id [id ...], which acknowledges pending
+// entries and replies with how many were pending.
+func handleXAck(c *client, command []string) []byte {
+	ids := make([]StreamID, 0, len(command)-3)
+	for _, arg := range command[3:] {
+		id, _, err := parseStreamID(arg, 0, false)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	acked, err := c.db.XAck(command[1], command[2], ids...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(acked)
+}
+
+// handleXPending handles XPENDING key group [[IDLE min-idle-time] start end
+// count [consumer]]. Without a range it sums up the group's pending entries;
+// with one it lists them, with their consumer, idle time and delivery count.
+func handleXPending(c *client, command []string) []byte {
+	key, group := command[1], command[2]
+	noGroup := "NOGROUP No such key '" + key + "' or consumer group '" + group + "'"
+	if len(command) == 3 {
+		summary, err := c.db.XPendingSummary(key, group)
+		if err != nil {
+			return groupError(err, key, group, noGroup)
+		}
+		if summary.Count == 0 {
+			return SerializeArray([][]byte{SerializeInteger(0), SerializeNullBulkString(), SerializeNullBulkString(), SerializeNullArray()})
+		}
+		consumers := make([][]byte, len(summary.Consumers))
+		for i, consumer := range summary.Consumers {
+			consumers[i] = serializeStringArray([]string{consumer.Name, strconv.Itoa(consumer.Count)})
+		}
+		return SerializeArray([][]byte{
+			SerializeInteger(summary.Count),
+			SerializeBulkString(summary.First.String()),
+			SerializeBulkString(summary.Last.String()),
+			SerializeArray(consumers),
+		})
+	}
+
+	var q PendingQuery
+	pos := 3
+	if strings.ToUpper(command[pos]) == "IDLE" && len(command) > pos+1 {
+		minIdle, err := strconv.ParseInt(command[pos+1], 10, 64)
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		q.MinIdle = minIdle
+		pos += 2
+	}
+	rest := command[pos:]
+	if len(rest) < 3 || len(rest) > 4 {
+		return SerializeError("ERR syntax error")
+	}
+	count, err := strconv.Atoi(rest[2])
+	if err != nil {
+		return SerializeError("ERR value is not an integer or out of range")
+	}
+	q.Count = max(count, 0)
+	if q.Start, err = parseIntervalStart(rest[0]); err != nil {
+		return SerializeError(err.Error())
+	}
+	if q.End, err = parseIntervalEnd(rest[1]); err != nil {
+		return SerializeError(err.Error())
+	}
+	if len(rest) == 4 {
+		q.ByConsumer, q.Consumer = true, rest[3]
+	}
+
+	entries, err := c.db.XPending(key, group, q)
+	if err != nil {
+		return groupError(err, key, group, noGroup)
+	}
+	now := mstime()
+	elements := make([][]byte, len(entries))
+	for i, entry := range entries {
+		elements[i] = SerializeArray([][]byte{
+			SerializeBulkString(entry.ID.String()),
+			SerializeBulkString(entry.Consumer),
+			SerializeInteger(int(max(now-entry.DeliveryTime, 0))),
+			SerializeInteger(int(entry.DeliveryCount)),
+		})
+	}
+	return SerializeArray(elements)
+}
+
+// parseIntervalStart parses the start of an ID interval, which may be
+// excluded with "(".
+func parseIntervalStart(arg string) (StreamID, error) {
+	id, exclusive, err := parseStreamRangeID(arg, 0)
+	if err != nil || !exclusive {
+		return id, err
+	}
+	next, ok := id.next()
+	if !ok {
+		return id, errors.New("ERR invalid start ID for the interval")
+	}
+	return next, nil
+}
+
+// parseIntervalEnd parses the end of an ID interval, which may be excluded
+// with "(".
+func parseIntervalEnd(arg string) (StreamID, error) {
+	id, exclusive, err := parseStreamRangeID(arg, maxStreamID.Seq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+	prev, ok := id.prev()
+	if !ok {
+		return id, errors.New("ERR invalid end ID for the interval")
+	}
+	return prev, nil
+}
+
+// claimReply serializes what XCLAIM or XAUTOCLAIM claimed: the entries, or
+// with justID only their IDs.
+func claimReply(result XClaimResult, justID bool) []byte {
+	if !justID {
+		return streamEntriesReply(result.Claimed)
+	}
+	ids := make([]string, len(result.Claimed))
+	for i, entry := range result.Claimed {
+		ids[i] = entry.ID.String()
+	}
+	return serializeStringArray(ids)
+}
+
+// handleXClaim handles XCLAIM key group consumer min-idle-time id [id ...]
+// [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE]
+// [JUSTID] [LASTID lastid], which gives the consumer the listed entries that
+// have been pending for at least min-idle-time milliseconds.
+func handleXClaim(c *client, command []string) []byte {
+	key, group, consumer := command[1], command[2], command[3]
+	minIdle, err := strconv.ParseInt(command[4], 10, 64)
+	if err != nil {
+		return SerializeError("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	var ids []StreamID
+	i := 5
+	for ; i < len(command); i++ {
+		id, _, err := parseStreamID(command[i], 0, false)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := mstime()
+	args := XClaimArgs{MinIdle: max(minIdle, 0), DeliveryTime: -1, RetryCount: -1}
+	for ; i < len(command); i++ {
+		opt := strings.ToUpper(command[i])
+		moreArgs := i+1 < len(command)
+		switch {
+		case opt == "FORCE":
+			args.Force = true
+		case opt == "JUSTID":
+			args.JustID = true
+		case opt == "IDLE" && moreArgs:
+			i++
+			idle, err := strconv.ParseInt(command[i], 10, 64)
+			if err != nil {
+				return SerializeError("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			args.DeliveryTime = now - idle
+		case opt == "TIME" && moreArgs:
+			i++
+			if args.DeliveryTime, err = strconv.ParseInt(command[i], 10, 64); err != nil {
+				return SerializeError("ERR Invalid TIME option argument for XCLAIM")
+			}
+		case opt == "RETRYCOUNT" && moreArgs:
+			i++
+			if args.RetryCount, err = strconv.ParseInt(command[i], 10, 64); err != nil {
+				return SerializeError("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+		case opt == "LASTID" && moreArgs:
+			i++
+			lastID, _, err := parseStreamID(command[i], 0, false)
+			if err != nil {
+				return SerializeError(err.Error())
+			}
+			args.LastID = &lastID
+		default:
+			return SerializeError("ERR Unrecognized XCLAIM option '" + command[i] + "'")
+		}
+	}
+	if args.DeliveryTime < 0 || args.DeliveryTime > now {
+		args.DeliveryTime = now
+	}
+
+	result, err := c.db.XClaim(key, group, consumer, ids, args)
+	if err != nil {
+		return groupError(err, key, group, "NOGROUP No such key '"+key+"' or consumer group '"+group+"'")
+	}
+	var lastID *StreamID
+	if result.LastIDMoved {
+		lastID = &result.LastID
+	}
+	propagateGroupState(c, key, group, consumer, result.ConsumerCreated, result.Pending, result.Deleted, lastID, result.EntriesRead)
+	if result.ConsumerCreated {
+		notifyKeyspaceEvent(c, notifyStream, "xgroup-createconsumer", key)
+	}
+	return claimReply(result, args.JustID)
+}
+
+// handleXAutoClaim handles XAUTOCLAIM key group consumer min-idle-time start
+// [COUNT count] [JUSTID], which gives the consumer up to count entries
+// pending for at least min-idle-time milliseconds, scanning the group's
+// pending entries from start. It replies with where to continue the scan,
+// the entries claimed, and the IDs of pending entries found deleted from the
+// stream, which are no longer pending.
+func handleXAutoClaim(c *client, command []string) []byte {
+	key, group, consumer := command[1], command[2], command[3]
+	minIdle, err := strconv.ParseInt(command[4], 10, 64)
+	if err != nil {
+		return SerializeError("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, err := parseIntervalStart(command[5])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+
+	count := 100
+	args := XClaimArgs{MinIdle: max(minIdle, 0), DeliveryTime: mstime(), RetryCount: -1}
+	for i := 6; i < len(command); i++ {
+		switch opt := strings.ToUpper(command[i]); {
+		case opt == "COUNT" && i+1 < len(command):
+			i++
+			n, err := strconv.Atoi(command[i])
+			if err != nil || n < 1 || n > math.MaxInt/xautoclaimAttemptsFactor {
+				return SerializeError("ERR COUNT must be > 0")
+			}
+			count = n
+		case opt == "JUSTID":
+			args.JustID = true
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+
+	result, err := c.db.XAutoClaim(key, group, consumer, start, count, args)
+	if err != nil {
+		return groupError(err, key, group, "NOGROUP No such key '"+key+"' or consumer group '"+group+"'")
+	}
+	propagateGroupState(c, key, group, consumer, result.ConsumerCreated, result.Pending, result.Deleted, nil, result.EntriesRead)
+	if result.ConsumerCreated {
+		notifyKeyspaceEvent(c, notifyStream, "xgroup-createconsumer", key)
+	}
+
+	deleted := make([]string, len(result.Deleted))
+	for i, id := range result.Deleted {
+		deleted[i] = id.String()
+	}
+	return SerializeArray([][]byte{
+		SerializeBulkString(result.Next.String()),
+		claimReply(result, args.JustID),
+		serializeStringArray(deleted),
+	})
+}
+
+// handleXInfo handles the XINFO subcommands, which describe a stream:
+//
+//	XINFO STREAM key [FULL [COUNT count]]
+//	XINFO GROUPS key
+//	XINFO CONSUMERS key group
+func handleXInfo(c *client, command []string) []byte {
+	sub := strings.ToUpper(command[1])
+	args := command[2:]
+	switch {
+	case sub == "STREAM" && len(args) >= 1:
+		return xinfoStream(c, args)
+	case sub == "GROUPS" && len(args) == 1:
+		groups, err := c.db.XInfoGroups(args[0])
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		elements := make([][]byte, len(groups))
+		for i, g := range groups {
+			elements[i] = SerializeArray([][]byte{
+				SerializeBulkString("name"), SerializeBulkString(g.Name),
+				SerializeBulkString("consumers"), SerializeInteger(g.Consumers),
+				SerializeBulkString("pending"), SerializeInteger(g.Pending),
+				SerializeBulkString("last-delivered-id"), SerializeBulkString(g.LastID.String()),
+				SerializeBulkString("entries-read"), entriesReadReply(g.EntriesRead),
+				SerializeBulkString("lag"), lagReply(g),
+			})
+		}
+		return SerializeArray(elements)
+	case sub == "CONSUMERS" && len(args) == 2:
+		consumers, err := c.db.XInfoConsumers(args[0], args[1])
+		if err != nil {
+			return groupError(err, args[0], args[1], "")
+		}
+		now := mstime()
+		elements := make([][]byte, len(consumers))
+		for i, consumer := range consumers {
+			inactive := int64(-1)
+			if consumer.ActiveTime >= 0 {
+				inactive = max(now-consumer.ActiveTime, 0)
+			}
+			elements[i] = SerializeArray([][]byte{
+				SerializeBulkString("name"), SerializeBulkString(consumer.Name),
+				SerializeBulkString("pending"), SerializeInteger(consumer.Pending),
+				SerializeBulkString("idle"), SerializeInteger(int(max(now-consumer.SeenTime, 0))),
+				SerializeBulkString("inactive"), SerializeInteger(int(inactive)),
+			})
+		}
+		return SerializeArray(elements)
+	case sub == "STREAM" || sub == "GROUPS" || sub == "CONSUMERS":
+		return SerializeError("ERR wrong number of arguments for 'xinfo|" + strings.ToLower(sub) + "' command")
+	}
+	return SerializeError("ERR unknown subcommand '" + command[1] + "'. Try XINFO HELP.")
+}
+
+// entriesReadReply is a group's entries read counter, null when unknown.
+func entriesReadReply(entriesRead int64) []byte {
+	if entriesRead == streamEntriesReadUnknown {
+		return SerializeNullBulkString()
+	}
+	return SerializeInteger(int(entriesRead))
+}
+
+// lagReply is a group's lag, null when unknown.
+func lagReply(g StreamGroupInfo) []byte {
+	if !g.LagKnown {
+		return SerializeNullBulkString()
+	}
+	return SerializeInteger(int(g.Lag))
+}
+
+// optionalEntryReply serializes an entry that may be missing.
+func optionalEntryReply(entry *StreamEntry) []byte {
+	if entry == nil {
+		return SerializeNullBulkString()
+	}
+	return SerializeArray([][]byte{SerializeBulkString(entry.ID.String()), serializeStringArray(entry.Fields)})
+}
+
+// xinfoStream implements XINFO STREAM key [FULL [COUNT count]]. FULL lists
+// the entries and the groups with their pending entries and consumers, up to
+// count of each, 10 by default and all with 0.
+func xinfoStream(c *client, args []string) []byte {
+	key := args[0]
+	full, count := false, 10
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && strings.ToUpper(args[1]) == "FULL":
+		full = true
+	case len(args) == 4 && strings.ToUpper(args[1]) == "FULL" && strings.ToUpper(args[2]) == "COUNT":
+		n, err := strconv.Atoi(args[3])
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		full, count = true, max(n, 0)
+	default:
+		return SerializeError("ERR syntax error")
+	}
+
+	info, err := c.db.XInfoStream(key, full, count)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	reply := [][]byte{
+		SerializeBulkString("length"), SerializeInteger(info.Length),
+		SerializeBulkString("radix-tree-keys"), SerializeInteger(info.Chunks),
+		SerializeBulkString("radix-tree-nodes"), SerializeInteger(info.Chunks),
+		SerializeBulkString("last-generated-id"), SerializeBulkString(info.LastID.String()),
+		SerializeBulkString("max-deleted-entry-id"), SerializeBulkString(info.MaxDeletedID.String()),
+		SerializeBulkString("entries-added"), SerializeInteger(int(info.EntriesAdded)),
+		SerializeBulkString("recorded-first-entry-id"), SerializeBulkString(info.FirstID.String()),
+	}
+	if !full {
+		reply = append(reply,
+			SerializeBulkString("groups"), SerializeInteger(info.NumGroups),
+			SerializeBulkString("first-entry"), optionalEntryReply(info.First),
+			SerializeBulkString("last-entry"), optionalEntryReply(info.Last),
+		)
+		return SerializeArray(reply)
+	}
+
+	groups := make([][]byte, len(info.Groups))
+	for i, g := range info.Groups {
+		pel := make([][]byte, len(g.PEL))
+		for j, p := range g.PEL {
+			pel[j] = SerializeArray([][]byte{
+				SerializeBulkString(p.ID.String()),
+				SerializeBulkString(p.Consumer),
+				SerializeInteger(int(p.DeliveryTime)),
+				SerializeInteger(int(p.DeliveryCount)),
+			})
+		}
+		consumers := make([][]byte, len(g.ConsumerInfos))
+		for j, consumer := range g.ConsumerInfos {
+			consumerPEL := make([][]byte, len(consumer.PEL))
+			for k, p := range consumer.PEL {
+				consumerPEL[k] = SerializeArray([][]byte{
+					SerializeBulkString(p.ID.String()),
+					SerializeInteger(int(p.DeliveryTime)),
+					SerializeInteger(int(p.DeliveryCount)),
+				})
+			}
+			consumers[j] = SerializeArray([][]byte{
+				SerializeBulkString("name"), SerializeBulkString(consumer.Name),
+				SerializeBulkString("seen-time"), SerializeInteger(int(consumer.SeenTime)),
+				SerializeBulkString("active-time"), SerializeInteger(int(consumer.ActiveTime)),
+				SerializeBulkString("pel-count"), SerializeInteger(consumer.Pending),
+				SerializeBulkString("pending"), SerializeArray(consumerPEL),
+			})
+		}
+		groups[i] = SerializeArray([][]byte{
+			SerializeBulkString("name"), SerializeBulkString(g.Name),
+			SerializeBulkString("last-delivered-id"), SerializeBulkString(g.LastID.String()),
+			SerializeBulkString("entries-read"), entriesReadReply(g.EntriesRead),
+			SerializeBulkString("lag"), lagReply(g),
+			SerializeBulkString("pel-count"), SerializeInteger(g.Pending),
+			SerializeBulkString("pending"), SerializeArray(pel),
+			SerializeBulkString("consumers"), SerializeArray(consumers),
+		})
+	}
+	reply = append(reply,
+		SerializeBulkString("entries"), streamEntriesReply(info.Entries),
+		SerializeBulkString("groups"), SerializeArray(groups),
+	)
+	return SerializeArray(reply)
+}
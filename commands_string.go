@@ -1,70 +1,237 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
 
 func registerStringCommands() {
-	registerCommand("SET", handleSet)
-	registerCommand("GET", handleGet)
-	registerCommand("INCR", handleIncr)
-	registerCommand("DECR", handleDecr)
-	registerCommand("EXISTS", handleExists)
-	registerCommand("DEL", handleDel)
+	registerCommand("SET", handleSet, -3, cmdWrite, 1, 1, 1)
+	registerCommand("GET", handleGet, 2, 0, 1, 1, 1)
+	registerCommand("INCR", handleIncr, 2, cmdWrite, 1, 1, 1)
+	registerCommand("DECR", handleDecr, 2, cmdWrite, 1, 1, 1)
+	registerCommand("EXISTS", handleExists, -2, 0, 1, -1, 1)
+	registerCommand("DEL", handleDel, -2, cmdWrite, 1, -1, 1)
+	registerCommand("DELIFEQ", handleDelIfEq, 3, cmdWrite, 1, 1, 1)
 }
 
-func handleSet(command []string) []byte {
+func handleSet(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	storeInstance.Set(command[1], command[2])
+
+	opts, err := parseSetOptions(command[3:])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	old, hadOld, written, err := c.db.SetWithOptions(command[1], command[2], opts)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	c.propagateAs, c.preventPropagation = setPropagation(command[1], command[2], opts), !written
+	if written {
+		notifyKeyspaceEvent(c, notifyString, "set", command[1])
+		if opts.ExpireAt > 0 {
+			notifyKeyspaceEvent(c, notifyGeneric, "expire", command[1])
+		}
+	}
+	if opts.Get {
+		if !hadOld {
+			return SerializeNullBulkString()
+		}
+		return SerializeBulkString(old)
+	}
+	if !written {
+		return SerializeNullBulkString()
+	}
 	return SerializeSimpleString("OK")
 }
 
-func handleGet(command []string) []byte {
+// parseSetOptions parses the SET arguments that follow the value:
+// [NX | XX | IFEQ comparison-value | IFVER version] [GET] [EX seconds |
+// PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds |
+// KEEPTTL].
+func parseSetOptions(args []string) (SetOptions, error) {
+	var opts SetOptions
+	expireSet, conditionSet := false, false
+
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			if conditionSet {
+				return opts, errSyntax
+			}
+			opts.NX, conditionSet = true, true
+		case "XX":
+			if conditionSet {
+				return opts, errSyntax
+			}
+			opts.XX, conditionSet = true, true
+		case "IFEQ":
+			if conditionSet || i+1 >= len(args) {
+				return opts, errSyntax
+			}
+			i++
+			opts.IfEq, opts.Compare, conditionSet = true, args[i], true
+		case "IFVER":
+			if conditionSet || i+1 >= len(args) {
+				return opts, errSyntax
+			}
+			i++
+			version, err := strconv.ParseUint(args[i], 10, 64)
+			if err != nil {
+				return opts, errors.New("value is not an integer or out of range")
+			}
+			opts.IfVer, opts.Version, conditionSet = true, version, true
+		case "GET":
+			opts.Get = true
+		case "KEEPTTL":
+			if expireSet {
+				return opts, errSyntax
+			}
+			opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireSet || opts.KeepTTL || i+1 >= len(args) {
+				return opts, errSyntax
+			}
+			i++
+			when, err := parseExpireOption("set", opt, args[i])
+			if err != nil {
+				return opts, err
+			}
+			opts.ExpireAt = when
+			expireSet = true
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// setPropagation returns the unconditional SET with an absolute expiry that
+// replays a successful SET.
+func setPropagation(key, value string, opts SetOptions) []string {
+	propagated := []string{"SET", key, value}
+	if opts.KeepTTL {
+		propagated = append(propagated, "KEEPTTL")
+	}
+	if opts.ExpireAt > 0 {
+		propagated = append(propagated, "PXAT", strconv.FormatInt(opts.ExpireAt, 10))
+	}
+	return propagated
+}
+
+// parseExpireOption converts the value of an EX/PX/EXAT/PXAT option of a
+// command to an absolute unix time in milliseconds.
+func parseExpireOption(cmdName, opt, arg string) (int64, error) {
+	when, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+	invalid := errors.New("invalid expire time in '" + cmdName + "' command")
+	if when <= 0 {
+		return 0, invalid
+	}
+
+	if opt == "EX" || opt == "EXAT" {
+		if when > math.MaxInt64/1000 {
+			return 0, invalid
+		}
+		when *= 1000
+	}
+	if opt == "EX" || opt == "PX" {
+		now := mstime()
+		if when > math.MaxInt64-now {
+			return 0, invalid
+		}
+		when += now
+	}
+	return when, nil
+}
+
+func handleGet(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	value, exists := storeInstance.Get(command[1])
+	value, exists, err := c.db.Get(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
 	if !exists {
 		return SerializeNullBulkString()
 	}
 	return SerializeBulkString(value)
 }
 
-func handleIncr(command []string) []byte {
+func handleIncr(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	num, err := storeInstance.Incr(command[1])
+	num, err := c.db.Incr(command[1])
 	if err != nil {
-		return SerializeError("ERR value is not an integer or out of range")
+		return SerializeError(err.Error())
 	}
+	notifyKeyspaceEvent(c, notifyString, "incrby", command[1])
 	return SerializeInteger(num)
 }
 
-func handleDecr(command []string) []byte {
+func handleDecr(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	num, err := storeInstance.Decr(command[1])
+	num, err := c.db.Decr(command[1])
 	if err != nil {
-		return SerializeError("ERR value is not an integer or out of range")
+		return SerializeError(err.Error())
 	}
+	notifyKeyspaceEvent(c, notifyString, "incrby", command[1])
 	return SerializeInteger(num)
 }
 
-func handleExists(command []string) []byte {
+func handleExists(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	exists := storeInstance.Exists(command[1])
-	return SerializeInteger(boolToInt(exists))
+	// A key given several times is counted each time, as in Redis.
+	count := 0
+	for _, key := range command[1:] {
+		if c.db.Exists(key) {
+			count++
+		}
+	}
+	return SerializeInteger(count)
 }
 
-func handleDel(command []string) []byte {
+func handleDel(c *client, command []string) []byte {
 	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
 		return SerializeError("ERR " + err.Error())
 	}
-	deleted := storeInstance.Delete(command[1])
-	return SerializeInteger(boolToInt(deleted))
+	deleted := 0
+	for _, key := range command[1:] {
+		if c.db.Delete(key) {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+			signalKeyAsReady(c, key)
+			deleted++
+		}
+	}
+	return SerializeInteger(deleted)
 }
 
+// handleDelIfEq deletes a key only if it holds the given string value, so a
+// client can release something it set without racing other writers.
+func handleDelIfEq(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	deleted, err := c.db.DeleteIfEqual(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	c.propagateAs, c.preventPropagation = []string{"DEL", command[1]}, !deleted
+	if deleted {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", command[1])
+	}
+	return SerializeInteger(boolToInt(deleted))
+}
@@ -0,0 +1,56 @@
+package main
+
+func registerTransactionCommands() {
+	registerCommand("MULTI", handleMulti, 1, cmdNoKeyspace|cmdTransaction, 0, 0, 0)
+	registerCommand("EXEC", handleExec, 1, cmdNoKeyspace|cmdTransaction, 0, 0, 0)
+	registerCommand("DISCARD", handleDiscard, 1, cmdNoKeyspace|cmdTransaction, 0, 0, 0)
+}
+
+// handleMulti starts queueing the client's commands until EXEC or DISCARD.
+func handleMulti(c *client, command []string) []byte {
+	if c.inMulti {
+		return SerializeError("ERR MULTI calls can not be nested")
+	}
+	c.inMulti = true
+	return SerializeSimpleString("OK")
+}
+
+// handleExec runs the queued commands and replies with an array of their
+// replies. The queue runs with keyspaceLock held exclusively, so no other
+// client's command can interleave with it. A transaction in which a command
+// failed to queue is discarded instead.
+func handleExec(c *client, command []string) []byte {
+	if !c.inMulti {
+		return SerializeError("ERR EXEC without MULTI")
+	}
+
+	queue, aborted := c.multiQueue, c.multiError
+	c.resetMulti()
+	if aborted {
+		return SerializeError("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	defer c.srv.events.flush(c.srv.pubsub)
+	c.srv.keyspaceLock.Lock()
+	defer c.srv.keyspaceLock.Unlock()
+
+	c.inExec = true
+	replies := make([][]byte, 0, len(queue))
+	for _, queued := range queue {
+		replies = append(replies, call(c, queued))
+	}
+	if c.execPropagated {
+		propagateCommand(c, []string{"EXEC"})
+	}
+	c.inExec, c.execPropagated = false, false
+	c.srv.serveBlockedClients()
+	return SerializeArray(replies)
+}
+
+func handleDiscard(c *client, command []string) []byte {
+	if !c.inMulti {
+		return SerializeError("ERR DISCARD without MULTI")
+	}
+	c.resetMulti()
+	return SerializeSimpleString("OK")
+}
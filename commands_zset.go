@@ -0,0 +1,432 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// zrangeAuto lets ZRANGE pick the range type from its BYSCORE/BYLEX options.
+const zrangeAuto ZRangeBy = -1
+
+func registerZSetCommands() {
+	registerCommand("ZADD", handleZAdd, -4, cmdWrite, 1, 1, 1)
+	registerCommand("ZINCRBY", handleZIncrBy, 4, cmdWrite, 1, 1, 1)
+	registerCommand("ZREM", handleZRem, -3, cmdWrite, 1, 1, 1)
+	registerCommand("ZSCORE", handleZScore, 3, 0, 1, 1, 1)
+	registerCommand("ZCARD", handleZCard, 2, 0, 1, 1, 1)
+	registerCommand("ZCOUNT", handleZCount, 4, 0, 1, 1, 1)
+	registerCommand("ZLEXCOUNT", handleZLexCount, 4, 0, 1, 1, 1)
+	registerCommand("ZRANK", handleZRank, -3, 0, 1, 1, 1)
+	registerCommand("ZREVRANK", handleZRevRank, -3, 0, 1, 1, 1)
+	registerCommand("ZRANGE", handleZRange, -4, 0, 1, 1, 1)
+	registerCommand("ZREVRANGE", handleZRevRange, -4, 0, 1, 1, 1)
+	registerCommand("ZRANGEBYSCORE", handleZRangeByScore, -4, 0, 1, 1, 1)
+	registerCommand("ZREVRANGEBYSCORE", handleZRevRangeByScore, -4, 0, 1, 1, 1)
+	registerCommand("ZRANGEBYLEX", handleZRangeByLex, -4, 0, 1, 1, 1)
+	registerCommand("ZREVRANGEBYLEX", handleZRevRangeByLex, -4, 0, 1, 1, 1)
+	registerCommand("ZPOPMIN", handleZPopMin, -2, cmdWrite, 1, 1, 1)
+	registerCommand("ZPOPMAX", handleZPopMax, -2, cmdWrite, 1, 1, 1)
+	registerCommand("ZREMRANGEBYSCORE", handleZRemRangeByScore, 4, cmdWrite, 1, 1, 1)
+	registerCommand("ZREMRANGEBYRANK", handleZRemRangeByRank, 4, cmdWrite, 1, 1, 1)
+	registerCommand("ZREMRANGEBYLEX", handleZRemRangeByLex, 4, cmdWrite, 1, 1, 1)
+	registerCommand("ZSCAN", handleZScan, -3, 0, 1, 1, 1)
+}
+
+func handleZAdd(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	var opts ZAddOptions
+	incr := false
+	i := 2
+flags:
+	for ; i < len(command); i++ {
+		switch strings.ToUpper(command[i]) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GT":
+			opts.GT = true
+		case "LT":
+			opts.LT = true
+		case "CH":
+			opts.CH = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	args := command[i:]
+	if len(args) == 0 || len(args)%2 != 0 {
+		return SerializeError("ERR syntax error")
+	}
+	if opts.NX && opts.XX {
+		return SerializeError("ERR XX and NX options at the same time are not compatible")
+	}
+	if (opts.GT && opts.NX) || (opts.LT && opts.NX) || (opts.GT && opts.LT) {
+		return SerializeError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(args) > 2 {
+		return SerializeError("ERR INCR option supports a single increment-element pair")
+	}
+
+	members := make([]ScoredMember, 0, len(args)/2)
+	for j := 0; j < len(args); j += 2 {
+		score, err := parseFloatArg(args[j])
+		if err != nil {
+			return SerializeError("ERR " + err.Error())
+		}
+		members = append(members, ScoredMember{Member: args[j+1], Score: score})
+	}
+
+	if incr {
+		score, updated, err := c.db.ZIncrBy(command[1], opts, members[0].Member, members[0].Score)
+		if err != nil {
+			return SerializeError(err.Error())
+		}
+		if !updated {
+			return SerializeNullBulkString()
+		}
+		notifyKeyspaceEvent(c, notifyZSet, "zincr", command[1])
+		return SerializeBulkString(formatFloat(score))
+	}
+
+	dirty := c.db.Dirty()
+	count, err := c.db.ZAdd(command[1], opts, members...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if c.db.Dirty() != dirty {
+		notifyKeyspaceEvent(c, notifyZSet, "zadd", command[1])
+	}
+	return SerializeInteger(count)
+}
+
+func handleZIncrBy(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	delta, err := parseFloatArg(command[2])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	score, _, err := c.db.ZIncrBy(command[1], ZAddOptions{}, command[3], delta)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	notifyKeyspaceEvent(c, notifyZSet, "zincr", command[1])
+	return SerializeBulkString(formatFloat(score))
+}
+
+func handleZRem(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	removed, err := c.db.ZRem(command[1], command[2:]...)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(c, notifyZSet, "zrem", command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return SerializeInteger(removed)
+}
+
+func handleZScore(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	score, exists, err := c.db.ZScore(command[1], command[2])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !exists {
+		return SerializeNullBulkString()
+	}
+	return SerializeBulkString(formatFloat(score))
+}
+
+func handleZCard(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	length, err := c.db.ZCard(command[1])
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(length)
+}
+
+func handleZCount(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	r, err := parseScoreRange(command[2], command[3])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	count, err := c.db.ZCount(command[1], r)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(count)
+}
+
+func handleZLexCount(c *client, command []string) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	r, err := parseLexRange(command[2], command[3])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	count, err := c.db.ZLexCount(command[1], r)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return SerializeInteger(count)
+}
+
+func handleZRank(c *client, command []string) []byte {
+	return zrankGeneric(c, command, false)
+}
+
+func handleZRevRank(c *client, command []string) []byte {
+	return zrankGeneric(c, command, true)
+}
+
+// zrankGeneric implements ZRANK and ZREVRANK key member [WITHSCORE].
+func zrankGeneric(c *client, command []string, reverse bool) []byte {
+	if err := validateMinArgs(command, 3, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	withScore := false
+	if len(command) > 4 || (len(command) == 4 && !strings.EqualFold(command[3], "WITHSCORE")) {
+		return SerializeError("ERR syntax error")
+	} else if len(command) == 4 {
+		withScore = true
+	}
+
+	rank, score, exists, err := c.db.ZRank(command[1], command[2], reverse)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if !exists {
+		if withScore {
+			return SerializeNullArray()
+		}
+		return SerializeNullBulkString()
+	}
+	if withScore {
+		return SerializeArray([][]byte{SerializeInteger(rank), SerializeBulkString(formatFloat(score))})
+	}
+	return SerializeInteger(rank)
+}
+
+func handleZRange(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, zrangeAuto, false)
+}
+
+func handleZRevRange(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, ZRangeByIndex, true)
+}
+
+func handleZRangeByScore(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, ZRangeByScore, false)
+}
+
+func handleZRevRangeByScore(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, ZRangeByScore, true)
+}
+
+func handleZRangeByLex(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, ZRangeByLex, false)
+}
+
+func handleZRevRangeByLex(c *client, command []string) []byte {
+	return zrangeGeneric(c, command, ZRangeByLex, true)
+}
+
+// zrangeGeneric implements ZRANGE and its older variants. ZRANGE passes
+// zrangeAuto and reads BYSCORE, BYLEX and REV from its arguments, the other
+// commands fix the range type and direction.
+func zrangeGeneric(c *client, command []string, by ZRangeBy, rev bool) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+
+	auto := by == zrangeAuto
+	if auto {
+		by = ZRangeByIndex
+	}
+	withScores, limit := false, false
+	offset, count := 0, -1
+
+	for i := 4; i < len(command); i++ {
+		switch opt := strings.ToUpper(command[i]); {
+		case opt == "WITHSCORES":
+			withScores = true
+		case opt == "LIMIT" && i+2 < len(command):
+			intArgs, err := parseIntArgs(command[i+1 : i+3])
+			if err != nil {
+				return SerializeError("ERR " + err.Error())
+			}
+			offset, count = intArgs[0], intArgs[1]
+			limit = true
+			i += 2
+		case auto && opt == "BYSCORE" && by == ZRangeByIndex:
+			by = ZRangeByScore
+		case auto && opt == "BYLEX" && by == ZRangeByIndex:
+			by = ZRangeByLex
+		case auto && opt == "REV":
+			rev = true
+		default:
+			return SerializeError("ERR syntax error")
+		}
+	}
+
+	if limit && by == ZRangeByIndex {
+		return SerializeError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && by == ZRangeByLex {
+		return SerializeError("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	minArg, maxArg := command[2], command[3]
+	if rev && by != ZRangeByIndex {
+		minArg, maxArg = maxArg, minArg
+	}
+
+	q, err := parseZRangeQuery(by, minArg, maxArg)
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	q.Rev, q.Offset, q.Count = rev, offset, count
+
+	members, err := c.db.ZRange(command[1], q)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeScoredMembers(members, withScores)
+}
+
+// parseZRangeQuery builds a query of the given kind from its two bounds.
+func parseZRangeQuery(by ZRangeBy, min, max string) (ZRangeQuery, error) {
+	q := ZRangeQuery{By: by, Count: -1}
+	var err error
+	switch by {
+	case ZRangeByScore:
+		q.Score, err = parseScoreRange(min, max)
+	case ZRangeByLex:
+		q.Lex, err = parseLexRange(min, max)
+	default:
+		var intArgs []int
+		intArgs, err = parseIntArgs([]string{min, max})
+		if err == nil {
+			q.Start, q.Stop = intArgs[0], intArgs[1]
+		}
+	}
+	return q, err
+}
+
+func handleZPopMin(c *client, command []string) []byte {
+	return zpopGeneric(c, command, false)
+}
+
+func handleZPopMax(c *client, command []string) []byte {
+	return zpopGeneric(c, command, true)
+}
+
+func zpopGeneric(c *client, command []string, max bool) []byte {
+	if err := validateMinArgs(command, 2, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	if len(command) > 3 {
+		return SerializeError("ERR syntax error")
+	}
+
+	count := 1
+	if len(command) == 3 {
+		n, err := strconv.Atoi(command[2])
+		if err != nil {
+			return SerializeError("ERR value is not an integer or out of range")
+		}
+		if n < 0 {
+			return SerializeError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	members, err := c.db.ZPop(command[1], count, max)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if len(members) > 0 {
+		notifyKeyspaceEvent(c, notifyZSet, strings.ToLower(command[0]), command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return serializeScoredMembers(members, true)
+}
+
+func handleZRemRangeByScore(c *client, command []string) []byte {
+	return zremrangeGeneric(c, command, ZRangeByScore)
+}
+
+func handleZRemRangeByRank(c *client, command []string) []byte {
+	return zremrangeGeneric(c, command, ZRangeByIndex)
+}
+
+func handleZRemRangeByLex(c *client, command []string) []byte {
+	return zremrangeGeneric(c, command, ZRangeByLex)
+}
+
+func zremrangeGeneric(c *client, command []string, by ZRangeBy) []byte {
+	if err := validateMinArgs(command, 4, strings.ToLower(command[0])); err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	q, err := parseZRangeQuery(by, command[2], command[3])
+	if err != nil {
+		return SerializeError("ERR " + err.Error())
+	}
+	removed, err := c.db.ZRemRange(command[1], q)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(c, notifyZSet, strings.ToLower(command[0]), command[1])
+		notifyIfDeleted(c, command[1])
+	}
+	return SerializeInteger(removed)
+}
+
+// serializeScoredMembers replies with the members, interleaved with their
+// scores when withScores is set.
+func serializeScoredMembers(members []ScoredMember, withScores bool) []byte {
+	elements := make([][]byte, 0, len(members)*2)
+	for _, m := range members {
+		elements = append(elements, SerializeBulkString(m.Member))
+		if withScores {
+			elements = append(elements, SerializeBulkString(formatFloat(m.Score)))
+		}
+	}
+	return SerializeArray(elements)
+}
+
+// handleZScan handles ZSCAN key cursor [MATCH pattern] [COUNT count], like
+// SCAN, replying with the members interleaved with their scores.
+func handleZScan(c *client, command []string) []byte {
+	cursor, args, err := parseScanArgs(command, 2, false)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	cursor, members, err := c.db.ZScan(command[1], cursor, args)
+	if err != nil {
+		return SerializeError(err.Error())
+	}
+	return serializeScan(cursor, serializeScoredMembers(members, true))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configParam is a setting that CONFIG GET and CONFIG SET can reach.
+type configParam struct {
+	get func(srv *server) string
+	set func(srv *server, value string) error
+}
+
+var configParams = map[string]configParam{
+	"databases": {
+		get: func(srv *server) string {
+			return strconv.Itoa(len(srv.dbs))
+		},
+		set: func(srv *server, value string) error {
+			return errors.New("can't set immutable config")
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(srv *server) string {
+			return formatKeyspaceEvents(int(srv.events.flags.Load()))
+		},
+		set: func(srv *server, value string) error {
+			flags, err := parseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			srv.events.flags.Store(int64(flags))
+			return nil
+		},
+	},
+}
+
+// configGet returns the names and values of the settings matching a glob
+// pattern, sorted by name.
+func (srv *server) configGet(pattern string) []string {
+	var names []string
+	for name := range configParams {
+		if stringMatch(strings.ToLower(pattern), name, false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, name, configParams[name].get(srv))
+	}
+	return pairs
+}
+
+// configSet changes a setting.
+func (srv *server) configSet(name, value string) error {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if err := param.set(srv, value); err != nil {
+		return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err)
+	}
+	return nil
+}
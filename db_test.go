@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestProcessCommand_Databases(t *testing.T) {
+	testServer = newServer()
+	c0, c1 := testServer.newClient(io.Discard), testServer.newClient(io.Discard)
+
+	tests := []struct {
+		c        *client
+		command  []string
+		expected string
+	}{
+		{c1, []string{"SELECT", "1"}, "+OK\r\n"},
+		{c1, []string{"SELECT", "16"}, "-ERR DB index is out of range\r\n"},
+		{c1, []string{"SELECT", "-1"}, "-ERR DB index is out of range\r\n"},
+		{c1, []string{"SELECT", "one"}, "-ERR value is not an integer or out of range\r\n"},
+		{c0, []string{"SET", "k", "a"}, "+OK\r\n"},
+		{c1, []string{"GET", "k"}, "$-1\r\n"},
+		{c1, []string{"SET", "k", "b"}, "+OK\r\n"},
+		{c0, []string{"GET", "k"}, "$1\r\na\r\n"},
+
+		{c0, []string{"SET", "m", "v", "EX", "100"}, "+OK\r\n"},
+		{c0, []string{"MOVE", "m", "1"}, ":1\r\n"},
+		{c0, []string{"EXISTS", "m"}, ":0\r\n"},
+		{c1, []string{"TTL", "m"}, ":100\r\n"},
+		{c1, []string{"MOVE", "m", "1"}, "-ERR source and destination objects are the same\r\n"},
+		{c0, []string{"SET", "m", "x"}, "+OK\r\n"},
+		{c1, []string{"MOVE", "m", "0"}, ":0\r\n"},
+		{c1, []string{"MOVE", "missing", "0"}, ":0\r\n"},
+		{c1, []string{"MOVE", "m", "16"}, "-ERR DB index is out of range\r\n"},
+		{c1, []string{"MOVE", "m", "x"}, "-ERR value is not an integer or out of range\r\n"},
+
+		{c0, []string{"COPY", "k", "copy", "DB", "1"}, ":1\r\n"},
+		{c1, []string{"GET", "copy"}, "$1\r\na\r\n"},
+		{c0, []string{"COPY", "k", "k", "DB", "1"}, ":0\r\n"},
+		{c0, []string{"COPY", "k", "k", "DB", "1", "REPLACE"}, ":1\r\n"},
+		{c1, []string{"GET", "k"}, "$1\r\na\r\n"},
+		{c1, []string{"SET", "k", "b"}, "+OK\r\n"},
+
+		{c0, []string{"SWAPDB", "0", "1"}, "+OK\r\n"},
+		{c0, []string{"GET", "k"}, "$1\r\nb\r\n"},
+		{c1, []string{"GET", "k"}, "$1\r\na\r\n"},
+		{c0, []string{"DBSIZE"}, ":3\r\n"},
+		{c1, []string{"DBSIZE"}, ":2\r\n"},
+		{c0, []string{"SWAPDB", "0", "0"}, "+OK\r\n"},
+		{c0, []string{"SWAPDB", "x", "1"}, "-ERR invalid first DB index\r\n"},
+		{c0, []string{"SWAPDB", "0", "x"}, "-ERR invalid second DB index\r\n"},
+		{c0, []string{"SWAPDB", "0", "16"}, "-ERR DB index is out of range\r\n"},
+
+		{c1, []string{"FLUSHDB", "BOGUS"}, "-ERR syntax error\r\n"},
+		{c1, []string{"FLUSHDB"}, "+OK\r\n"},
+		{c1, []string{"DBSIZE"}, ":0\r\n"},
+		{c0, []string{"DBSIZE"}, ":3\r\n"},
+		{c1, []string{"SET", "k", "c"}, "+OK\r\n"},
+		{c0, []string{"FLUSHDB", "ASYNC"}, "+OK\r\n"},
+		{c0, []string{"DBSIZE"}, ":0\r\n"},
+		{c0, []string{"SET", "k", "d"}, "+OK\r\n"},
+		{c0, []string{"FLUSHALL", "ASYNC"}, "+OK\r\n"},
+		{c0, []string{"DBSIZE"}, ":0\r\n"},
+		{c1, []string{"DBSIZE"}, ":0\r\n"},
+		{c1, []string{"FLUSHALL", "SYNC", "ASYNC"}, "-ERR syntax error\r\n"},
+
+		{c0, []string{"CONFIG", "GET", "databases"}, "*2\r\n$9\r\ndatabases\r\n$2\r\n16\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeClientCommand(test.c, test.command)); got != test.expected {
+			t.Errorf("Command %v in database %d: expected %q, got %q", test.command, test.c.dbid, test.expected, got)
+		}
+	}
+}
+
+// TestDatabases_Blocking checks that a client only wakes up for its key in
+// the database it selected, including when SWAPDB brings the key in.
+func TestDatabases_Blocking(t *testing.T) {
+	testServer = newServer()
+	c1 := testServer.newClient(io.Discard)
+	executeClientCommand(c1, []string{"SELECT", "1"})
+
+	replies := make(chan string, 1)
+	go func() {
+		replies <- string(executeClientCommand(c1, []string{"BLPOP", "queue", "0"}))
+	}()
+	waitBlocked := func(n int) {
+		waitFor(t, "the client to block", func() bool {
+			testServer.keyspaceLock.RLock()
+			defer testServer.keyspaceLock.RUnlock()
+			return len(testServer.blocking.waitingOn(1, "queue")) == n
+		})
+	}
+	waitBlocked(1)
+
+	executeTestCommand([]string{"RPUSH", "queue", "a"})
+	waitBlocked(1)
+	if n, _ := testServer.dbs[0].LLen("queue"); n != 1 {
+		t.Errorf("Expected the list in database 0 to be left alone, got %d elements", n)
+	}
+
+	executeTestCommand([]string{"SWAPDB", "0", "1"})
+	if got := receive(t, replies); got != "*2\r\n$5\r\nqueue\r\n$1\r\na\r\n" {
+		t.Errorf("Expected a from the swapped in list, got %q", got)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand"
+)
+
+// Dict sizing, as in Redis.
+const (
+	dictInitialSize = 4
+	dictMinFill     = 8  // shrink when less than 1/dictMinFill full
+	dictEmptyVisits = 10 // empty buckets a rehash step may skip per bucket moved
+)
+
+// A dict is a hash table with chained buckets, like Redis' dict, holding the
+// keyspace and the elements of sets, hashes and sorted sets. Unlike a Go map
+// it can be walked a few buckets at a time with a cursor, which is what SCAN
+// and its siblings need.
+//
+// The table has a power of two number of buckets. It grows when it holds as
+// many entries as buckets, and shrinks when it is less than an eighth full.
+// Resizing allocates a second table and moves the buckets of the first one
+// over a few at a time, on the operations that follow, so that no single
+// operation pays for the whole table. Lookups and deletes go through both
+// tables meanwhile, and new entries go in the second.
+//
+// Like a nil map, a nil dict reads as empty.
+type dict[V any] struct {
+	seed   maphash.Seed
+	tables [2][]*dictEntry[V]
+	used   [2]int
+
+	// rehashIdx is the next bucket of tables[0] to move to tables[1], or -1
+	// when the dict is not being resized.
+	rehashIdx int
+	// pauseRehash is non-zero while an iterator or a scan is going through
+	// the tables, so that no entry moves under it.
+	pauseRehash int
+}
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+	next  *dictEntry[V]
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{seed: maphash.MakeSeed(), rehashIdx: -1}
+}
+
+func (d *dict[V]) len() int {
+	if d == nil {
+		return 0
+	}
+	return d.used[0] + d.used[1]
+}
+
+func (d *dict[V]) rehashing() bool {
+	return d.rehashIdx >= 0
+}
+
+func (d *dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+// find returns the entry for key, or nil.
+func (d *dict[V]) find(key string) *dictEntry[V] {
+	if d.len() == 0 {
+		return nil
+	}
+	d.rehashStep()
+	h := d.hash(key)
+	for t := range d.tables {
+		table := d.tables[t]
+		if len(table) == 0 {
+			continue
+		}
+		for e := table[h&uint64(len(table)-1)]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dict[V]) get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (d *dict[V]) has(key string) bool {
+	return d.find(key) != nil
+}
+
+// set sets key to value, and reports whether the key was added rather than
+// updated.
+func (d *dict[V]) set(key string, value V) bool {
+	if e := d.find(key); e != nil {
+		e.value = value
+		return false
+	}
+	d.expandIfNeeded()
+	t := 0
+	if d.rehashing() {
+		t = 1
+	}
+	table := d.tables[t]
+	i := d.hash(key) & uint64(len(table)-1)
+	table[i] = &dictEntry[V]{key: key, value: value, next: table[i]}
+	d.used[t]++
+	return true
+}
+
+// delete removes key, and reports whether the dict held it.
+func (d *dict[V]) delete(key string) bool {
+	if d.len() == 0 {
+		return false
+	}
+	d.rehashStep()
+	h := d.hash(key)
+	for t := range d.tables {
+		table := d.tables[t]
+		if len(table) == 0 {
+			continue
+		}
+		i := h & uint64(len(table)-1)
+		for prev, e := (*dictEntry[V])(nil), table[i]; e != nil; prev, e = e, e.next {
+			if e.key != key {
+				continue
+			}
+			if prev == nil {
+				table[i] = e.next
+			} else {
+				prev.next = e.next
+			}
+			d.used[t]--
+			d.shrinkIfNeeded()
+			return true
+		}
+	}
+	return false
+}
+
+// clear removes every entry.
+func (d *dict[V]) clear() {
+	d.tables = [2][]*dictEntry[V]{}
+	d.used = [2]int{}
+	d.rehashIdx = -1
+}
+
+func (d *dict[V]) expandIfNeeded() {
+	switch {
+	case d.rehashing():
+	case len(d.tables[0]) == 0:
+		d.tables[0] = make([]*dictEntry[V], dictInitialSize)
+	case d.used[0] >= len(d.tables[0]):
+		d.resize(d.used[0] + 1)
+	}
+}
+
+func (d *dict[V]) shrinkIfNeeded() {
+	if d.rehashing() || len(d.tables[0]) <= dictInitialSize || d.used[0]*dictMinFill > len(d.tables[0]) {
+		return
+	}
+	d.resize(d.used[0])
+}
+
+// resize starts moving the entries to a table of the smallest power of two
+// size that holds at least size of them.
+func (d *dict[V]) resize(size int) {
+	n := dictInitialSize
+	for n < size {
+		n *= 2
+	}
+	if n == len(d.tables[0]) {
+		return
+	}
+	d.tables[1] = make([]*dictEntry[V], n)
+	d.rehashIdx = 0
+}
+
+// rehashStep moves one bucket to the new table while the dict is resized,
+// unless an iterator has paused that.
+func (d *dict[V]) rehashStep() {
+	if d.rehashing() && d.pauseRehash == 0 {
+		d.rehash(1)
+	}
+}
+
+// rehash moves n non-empty buckets of tables[0] to tables[1], finishing the
+// resize once none is left.
+func (d *dict[V]) rehash(n int) {
+	if !d.rehashing() {
+		return
+	}
+	emptyVisits := n * dictEmptyVisits
+	old, table := d.tables[0], d.tables[1]
+	for ; n > 0 && d.used[0] > 0; n-- {
+		for old[d.rehashIdx] == nil {
+			d.rehashIdx++
+			if emptyVisits--; emptyVisits == 0 {
+				return
+			}
+		}
+		for e := old[d.rehashIdx]; e != nil; {
+			next := e.next
+			i := d.hash(e.key) & uint64(len(table)-1)
+			e.next, table[i] = table[i], e
+			d.used[0]--
+			d.used[1]++
+			e = next
+		}
+		old[d.rehashIdx] = nil
+		d.rehashIdx++
+	}
+	if d.used[0] == 0 {
+		d.tables = [2][]*dictEntry[V]{table, nil}
+		d.used = [2]int{d.used[1], 0}
+		d.rehashIdx = -1
+	}
+}
+
+// all iterates over the entries. The entry being visited may be deleted, and
+// entries may be looked up, but entries added meanwhile may or may not be
+// visited.
+func (d *dict[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		if d == nil {
+			return
+		}
+		d.pauseRehash++
+		defer func() { d.pauseRehash-- }()
+		for t := range d.tables {
+			// Not ranging over d.tables[t], which an insert may replace.
+			for i := 0; i < len(d.tables[t]); i++ {
+				for e := d.tables[t][i]; e != nil; {
+					next := e.next
+					if !yield(e.key, e.value) {
+						return
+					}
+					e = next
+				}
+			}
+		}
+	}
+}
+
+// keys iterates over the keys, like all.
+func (d *dict[V]) keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range d.all() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// scan calls fn for the entries of the bucket at cursor, and of the buckets
+// of the other table that it maps to during a resize, and returns the cursor
+// of the next call, or 0 when every bucket has been visited.
+//
+// The cursor counts with its bits reversed, as in Redis: the bucket indexes
+// of a table are the low bits of the hash, so visiting them high bit first
+// means that the buckets of a table twice or half the size that an entry can
+// move to during a resize are either all visited already or all still to be
+// visited. Every entry present for the whole of a scan is thus returned at
+// least once, though some may be returned more than once.
+func (d *dict[V]) scan(cursor uint64, fn func(key string, value V)) uint64 {
+	if d.len() == 0 {
+		return 0
+	}
+	d.pauseRehash++
+	defer func() { d.pauseRehash-- }()
+
+	emit := func(table []*dictEntry[V], i uint64) {
+		for e := table[i]; e != nil; e = e.next {
+			fn(e.key, e.value)
+		}
+	}
+	next := func(cursor, mask uint64) uint64 {
+		// Increment the reversed cursor, with the bits above mask set so
+		// that the increment carries past them.
+		cursor |= ^mask
+		return bits.Reverse64(bits.Reverse64(cursor) + 1)
+	}
+
+	if !d.rehashing() {
+		mask := uint64(len(d.tables[0]) - 1)
+		emit(d.tables[0], cursor&mask)
+		return next(cursor, mask)
+	}
+
+	small, large := d.tables[0], d.tables[1]
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	m0, m1 := uint64(len(small)-1), uint64(len(large)-1)
+	emit(small, cursor&m0)
+	// The buckets of the larger table that the smaller one's expands to.
+	for {
+		emit(large, cursor&m1)
+		cursor = next(cursor, m1)
+		if cursor&(m0^m1) == 0 {
+			return cursor
+		}
+	}
+}
+
+// randomKey returns a key picked at random, not quite uniformly: a random
+// non-empty bucket is picked first, then an entry of it.
+func (d *dict[V]) randomKey() (string, bool) {
+	if d.len() == 0 {
+		return "", false
+	}
+	d.rehashStep()
+	for {
+		t, i := 0, 0
+		if d.rehashing() {
+			// tables[0] is empty below rehashIdx.
+			size := len(d.tables[0]) - d.rehashIdx + len(d.tables[1])
+			if i = d.rehashIdx + rand.Intn(size); i >= len(d.tables[0]) {
+				t, i = 1, i-len(d.tables[0])
+			}
+		} else {
+			i = rand.Intn(len(d.tables[0]))
+		}
+		e := d.tables[t][i]
+		if e == nil {
+			continue
+		}
+		n := 0
+		for x := e; x != nil; x = x.next {
+			n++
+		}
+		for n = rand.Intn(n); n > 0; n-- {
+			e = e.next
+		}
+		return e.key, true
+	}
+}
+
+// clone returns a copy of the dict, with values copied by cloneValue.
+func (d *dict[V]) clone(cloneValue func(V) V) *dict[V] {
+	c := newDict[V]()
+	for key, value := range d.all() {
+		if cloneValue != nil {
+			value = cloneValue(value)
+		}
+		c.set(key, value)
+	}
+	return c
+}
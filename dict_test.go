@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestDict_MatchesMap(t *testing.T) {
+	d, m := newDict[int](), make(map[string]int)
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rand.Intn(2000))
+		switch rand.Intn(3) {
+		case 0, 1:
+			_, had := m[key]
+			if added := d.set(key, i); added == had {
+				t.Fatalf("set(%q) reported added=%v, map had it: %v", key, added, had)
+			}
+			m[key] = i
+		case 2:
+			_, had := m[key]
+			if deleted := d.delete(key); deleted != had {
+				t.Fatalf("delete(%q) = %v, map had it: %v", key, deleted, had)
+			}
+			delete(m, key)
+		}
+		if d.len() != len(m) {
+			t.Fatalf("len() = %d, expected %d", d.len(), len(m))
+		}
+	}
+
+	for key, value := range m {
+		if got, ok := d.get(key); !ok || got != value {
+			t.Errorf("get(%q) = %d, %v, expected %d", key, got, ok, value)
+		}
+	}
+	seen := make(map[string]bool)
+	for key, value := range d.all() {
+		if seen[key] || m[key] != value {
+			t.Errorf("all() yielded %q=%d, seen before: %v", key, value, seen[key])
+		}
+		seen[key] = true
+	}
+	if len(seen) != len(m) {
+		t.Errorf("all() yielded %d keys, expected %d", len(seen), len(m))
+	}
+}
+
+func TestDict_DeleteWhileIterating(t *testing.T) {
+	d := newDict[int]()
+	for i := 0; i < 100; i++ {
+		d.set(strconv.Itoa(i), i)
+	}
+	for key, value := range d.all() {
+		if value%2 == 0 {
+			d.delete(key)
+		}
+	}
+	if d.len() != 50 {
+		t.Fatalf("Expected 50 keys left, got %d", d.len())
+	}
+	for key, value := range d.all() {
+		if value%2 == 0 {
+			t.Errorf("Expected %q to be deleted", key)
+		}
+	}
+}
+
+// scanAll runs a whole scan of d, calling between after each step.
+func scanAll(d *dict[int], between func()) map[string]int {
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for {
+		cursor = d.scan(cursor, func(key string, _ int) { seen[key]++ })
+		if cursor == 0 {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestDict_Scan(t *testing.T) {
+	d := newDict[int]()
+	if cursor := d.scan(0, func(string, int) { t.Error("Scan of an empty dict returned a key") }); cursor != 0 {
+		t.Errorf("Expected cursor 0 for an empty dict, got %d", cursor)
+	}
+	for i := 0; i < 1000; i++ {
+		d.set(strconv.Itoa(i), i)
+	}
+	d.rehash(1 << 20)
+
+	seen := scanAll(d, func() {})
+	if len(seen) != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("Key %q returned %d times while the table stayed the same", key, n)
+		}
+	}
+}
+
+// Keys present for the whole scan must be returned however the table is
+// resized in between the steps.
+func TestDict_ScanWhileResizing(t *testing.T) {
+	for _, grow := range []bool{true, false} {
+		d := newDict[int]()
+		for i := 0; i < 500; i++ {
+			d.set("stay"+strconv.Itoa(i), i)
+		}
+		if !grow {
+			for i := 0; i < 5000; i++ {
+				d.set("go"+strconv.Itoa(i), i)
+			}
+		}
+
+		step := 0
+		seen := scanAll(d, func() {
+			step++
+			// Growth stops at some point, or the scan would never catch up.
+			if grow && step <= 400 {
+				for i := 0; i < 5; i++ {
+					d.set("new"+strconv.Itoa(step*5+i), 0)
+				}
+			} else if !grow {
+				for i := 0; i < 40; i++ {
+					d.delete("go" + strconv.Itoa((step*40+i)%5000))
+				}
+			}
+		})
+		for i := 0; i < 500; i++ {
+			if key := "stay" + strconv.Itoa(i); seen[key] == 0 {
+				t.Errorf("grow=%v: scan missed %q", grow, key)
+			}
+		}
+	}
+}
+
+func TestDict_RandomKey(t *testing.T) {
+	d := newDict[int]()
+	if _, ok := d.randomKey(); ok {
+		t.Error("Expected no key from an empty dict")
+	}
+	for i := 0; i < 100; i++ {
+		d.set(strconv.Itoa(i), i)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key, ok := d.randomKey()
+		if !ok || !d.has(key) {
+			t.Fatalf("randomKey() = %q, %v", key, ok)
+		}
+		seen[key] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("Expected most keys to come up, got %d of 100", len(seen))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A DUMP payload is a value in its RDB encoding, preceded by its type byte
+// and followed by the RDB version and a CRC-64 of everything before it, both
+// little endian. Payloads are interchangeable with real Redis.
+var (
+	errDumpPayload    = errors.New("ERR DUMP payload version or checksum are wrong")
+	errDumpDataFormat = errors.New("ERR Bad data format")
+)
+
+// createDumpPayload serializes a value for DUMP.
+func createDumpPayload(value any) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(rdbValueType(value))
+	rdbAppendValue(&buf, value)
+	binary.Write(&buf, binary.LittleEndian, uint16(rdbVersion))
+	binary.Write(&buf, binary.LittleEndian, crc64Jones(0, buf.Bytes()))
+	return buf.Bytes()
+}
+
+// verifyDumpPayload checks the footer of a payload: the RDB version must be
+// one we can load and the checksum must match.
+func verifyDumpPayload(p []byte) error {
+	if len(p) < 10 {
+		return errDumpPayload
+	}
+	footer := p[len(p)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxVersion {
+		return errDumpPayload
+	}
+	if crc64Jones(0, p[:len(p)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return errDumpPayload
+	}
+	return nil
+}
+
+// decodeDumpPayload returns the value serialized in a payload.
+func decodeDumpPayload(p []byte) (any, error) {
+	if err := verifyDumpPayload(p); err != nil {
+		return nil, err
+	}
+	r := &rdbReader{buf: p[:len(p)-10]}
+	typ, err := r.readByte()
+	if err != nil {
+		return nil, errDumpDataFormat
+	}
+	value, err := r.readValue(typ)
+	if err != nil || value == nil || r.pos != len(r.buf) {
+		return nil, errDumpDataFormat
+	}
+	return value, nil
+}
+
+// Dump returns the DUMP payload of the value at key along with its absolute
+// expiry (0 for none), and whether the key exists.
+func (s *store) Dump(key string) ([]byte, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireIfNeeded(key)
+	value, exists := s.data.get(key)
+	if !exists {
+		return nil, 0, false
+	}
+	return createDumpPayload(value), s.expires[key], true
+}
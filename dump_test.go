@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDumpPayload(t *testing.T) {
+	// The payload of the integer 10 as Redis 8 dumps it, and as given in the
+	// Redis DUMP documentation for an older version.
+	want := "\x00\xc0\n\f\x00\xa5\xe9c\x85\xf4\x84\xfd\xf2"
+	if got := string(createDumpPayload("10")); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	for _, payload := range []string{want, "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"} {
+		if value, err := decodeDumpPayload([]byte(payload)); err != nil || value != "10" {
+			t.Errorf("Expected 10, got %v (%v)", value, err)
+		}
+	}
+
+	corrupted := []byte(want)
+	corrupted[2] = 11
+	if _, err := decodeDumpPayload(corrupted); err != errDumpPayload {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+	if _, err := decodeDumpPayload([]byte("\x00\xc0")); err != errDumpPayload {
+		t.Errorf("Expected a short payload to be rejected, got %v", err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	testServer = newServer()
+	fillTestStore(testServer.dbs[0])
+
+	dst := newServer()
+	c := dst.newClient(io.Discard)
+	for _, key := range []string{"str", "int", "big", "long", "list", "set", "hash", "zset", "stream", "ttl"} {
+		payload := executeTestCommand([]string{"DUMP", key})
+		value, err := ReadRESP(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil || value.Type != BulkString {
+			t.Fatalf("%s: unexpected DUMP reply %q", key, payload)
+		}
+		ttl := "0"
+		if key == "ttl" {
+			ttl = "60000"
+		}
+		if got := string(executeClientCommand(c, []string{"RESTORE", key, ttl, value.Bulk})); got != "+OK\r\n" {
+			t.Errorf("%s: unexpected RESTORE reply %q", key, got)
+		}
+	}
+	checkTestStore(t, dst.dbs[0])
+
+	if got := string(executeTestCommand([]string{"DUMP", "missing"})); got != "$-1\r\n" {
+		t.Errorf("Expected a null reply for a missing key, got %q", got)
+	}
+}
+
+func TestRestore_Options(t *testing.T) {
+	testServer = newServer()
+	payload := string(createDumpPayload("v"))
+	corrupted := strings.Replace(payload, "v", "w", 1)
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"RESTORE", "k", "0", payload}, "+OK\r\n"},
+		{[]string{"RESTORE", "k", "0", payload}, "-BUSYKEY Target key name already exists.\r\n"},
+		{[]string{"RESTORE", "k", "0", payload, "REPLACE", "IDLETIME", "10"}, "+OK\r\n"},
+		{[]string{"RESTORE", "k", "0", corrupted, "REPLACE"}, "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{[]string{"RESTORE", "k", "-1", payload, "REPLACE"}, "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{[]string{"RESTORE", "k", "0", payload, "FREQ", "256"}, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{[]string{"RESTORE", "k", "0", payload, "FREQ", "1", "IDLETIME", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"RESTORE", "k", "0", payload, "BOGUS"}, "-ERR syntax error\r\n"},
+		{[]string{"RESTORE", "t", "5000", payload}, "+OK\r\n"},
+		{[]string{"TTL", "t"}, ":5\r\n"},
+		{[]string{"RESTORE", "a", "4102444800000", payload, "ABSTTL"}, "+OK\r\n"},
+		{[]string{"PEXPIRETIME", "a"}, ":4102444800000\r\n"},
+		// An absolute time in the past deletes the key instead.
+		{[]string{"RESTORE", "a", "1", payload, "ABSTTL", "REPLACE"}, "+OK\r\n"},
+		{[]string{"EXISTS", "a"}, ":0\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	target := startTestServer(t)
+	testServer = newServer()
+	testServer.dbs[0].Set("a", "1")
+	testServer.dbs[0].RPush("b", "x", "y")
+	testServer.dbs[0].Set("c", "3")
+	target.dbs[0].Set("c", "old")
+
+	port := target.port()
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"MIGRATE", "127.0.0.1", port, "a", "0", "1000"}, "+OK\r\n"},
+		{[]string{"MIGRATE", "127.0.0.1", port, "a", "0", "1000"}, "+NOKEY\r\n"},
+		{[]string{"MIGRATE", "127.0.0.1", port, "b", "0", "1000", "KEYS", "c"}, "-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string\r\n"},
+		{[]string{"MIGRATE", "127.0.0.1", port, "", "0", "1000", "COPY", "KEYS", "b", "c", "missing"}, "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n"},
+		{[]string{"EXISTS", "b"}, ":1\r\n"},
+		{[]string{"MIGRATE", "127.0.0.1", port, "c", "0", "1000", "REPLACE"}, "+OK\r\n"},
+		{[]string{"EXISTS", "c"}, ":0\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if got, _, _ := target.dbs[0].Get(key); got != want {
+			t.Errorf("%s: expected %q on the target, got %q", key, want, got)
+		}
+	}
+	if list, _ := target.dbs[0].LRange("b", 0, -1); len(list) != 2 {
+		t.Errorf("Expected COPY to restore b on the target, got %v", list)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import "time"
+
+// ExpireFlags are the NX/XX/GT/LT conditions accepted by the EXPIRE family.
+type ExpireFlags int
+
+const (
+	ExpireNX ExpireFlags = 1 << iota // only set when the key has no TTL
+	ExpireXX                         // only set when the key already has a TTL
+	ExpireGT                         // only set when the new TTL is greater
+	ExpireLT                         // only set when the new TTL is smaller
+)
+
+// allow reports whether the flags let an expiry of current, if there is one,
+// be changed to when.
+func (flags ExpireFlags) allow(current int64, hasTTL bool, when int64) bool {
+	if flags&ExpireNX != 0 && hasTTL {
+		return false
+	}
+	if flags&ExpireXX != 0 && !hasTTL {
+		return false
+	}
+	// No TTL counts as an infinite one for GT and LT.
+	if flags&ExpireGT != 0 && (!hasTTL || when <= current) {
+		return false
+	}
+	if flags&ExpireLT != 0 && hasTTL && when >= current {
+		return false
+	}
+	return true
+}
+
+// Active expiry tuning, modelled on Redis' activeExpireCycle.
+const (
+	activeExpireKeysPerLoop     = 20
+	activeExpireAcceptableStale = 10 // percent of sampled keys
+	activeExpireTimeLimit       = 25 * time.Millisecond
+)
+
+// mstime returns the current unix time in milliseconds.
+func mstime() int64 {
+	return time.Now().UnixMilli()
+}
+
+// expireIfNeeded deletes key if its TTL has elapsed and reports whether it did.
+// Callers must hold s.mu.
+func (s *store) expireIfNeeded(key string) bool {
+	when, exists := s.expires[key]
+	if !exists || when > mstime() {
+		return false
+	}
+	s.removeExpired(key)
+	return true
+}
+
+// removeExpired deletes a key whose TTL has elapsed and reports it to the
+// expire hook. Callers must hold s.mu.
+func (s *store) removeExpired(key string) {
+	s.removeKey(key)
+	if s.onExpire != nil {
+		s.onExpire(key)
+	}
+}
+
+// SetExpireHook registers fn to be called, with the store locked, for every
+// key deleted because its TTL elapsed.
+func (s *store) SetExpireHook(fn func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExpire = fn
+}
+
+// SetFieldExpireHook registers fn to be called, with the store locked, for
+// every hash that had fields deleted because their TTL elapsed, with whether
+// that deleted the key.
+func (s *store) SetFieldExpireHook(fn func(key string, deleted bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onFieldExpire = fn
+}
+
+// Expire sets the absolute expiry of key to when (unix milliseconds). A time
+// in the past deletes the key straight away. It returns false if the key does
+// not exist or the flags prevented the update.
+func (s *store) Expire(key string, when int64, flags ExpireFlags) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	if !s.exists(key) {
+		return false
+	}
+
+	current, hasTTL := s.expires[key]
+	if !flags.allow(current, hasTTL, when) {
+		return false
+	}
+
+	if when <= mstime() {
+		s.removeKey(key)
+		return true
+	}
+	s.beforeWrite(key)
+	s.expires[key] = when
+	s.touch(key)
+	return true
+}
+
+// ExpireTime returns the absolute expiry of key in unix milliseconds, -1 if
+// the key has no TTL or -2 if it does not exist.
+func (s *store) ExpireTime(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	if !s.exists(key) {
+		return -2
+	}
+	when, exists := s.expires[key]
+	if !exists {
+		return -1
+	}
+	return when
+}
+
+func (s *store) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	if _, exists := s.expires[key]; !exists {
+		return false
+	}
+	s.beforeWrite(key)
+	delete(s.expires, key)
+	s.touch(key)
+	return true
+}
+
+// ActiveExpireCycle samples keys that carry a TTL and deletes the expired
+// ones, repeating while a noticeable share of the sample was stale and the
+// time budget allows, then does the same for hashes with field TTLs. It
+// returns the number of keys removed because their TTL elapsed.
+func (s *store) ActiveExpireCycle() int {
+	deadline := time.Now().Add(activeExpireTimeLimit)
+	total := 0
+
+	for {
+		s.mu.Lock()
+		now := mstime()
+		sampled, expired := 0, 0
+		// Map iteration starts at a random position, which is all the
+		// sampling we need.
+		for key, when := range s.expires {
+			if sampled == activeExpireKeysPerLoop {
+				break
+			}
+			sampled++
+			if when <= now {
+				s.removeExpired(key)
+				expired++
+			}
+		}
+		s.mu.Unlock()
+
+		total += expired
+		if sampled == 0 || expired*100 <= sampled*activeExpireAcceptableStale {
+			break
+		}
+		if time.Now().After(deadline) {
+			return total
+		}
+	}
+	s.activeExpireFields(deadline)
+	return total
+}
+
+// activeExpireFields samples hashes with field TTLs and deletes their elapsed
+// fields, in the same way as ActiveExpireCycle does for keys.
+func (s *store) activeExpireFields(deadline time.Time) {
+	for {
+		s.mu.Lock()
+		now := mstime()
+		sampled, expired := 0, 0
+		for key := range s.hashTTLKeys {
+			if sampled == activeExpireKeysPerLoop {
+				break
+			}
+			h, ok := s.value(key).(*hash)
+			if !ok || len(h.expires) == 0 {
+				delete(s.hashTTLKeys, key)
+				continue
+			}
+			sampled++
+			if s.expireHashFields(key, h, now) > 0 {
+				expired++
+			}
+		}
+		s.mu.Unlock()
+
+		if sampled == 0 || expired*100 <= sampled*activeExpireAcceptableStale {
+			return
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+	}
+}
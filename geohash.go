@@ -0,0 +1,363 @@
+package main
+
+import "math"
+
+// Geohash limits. Latitudes are limited to the range covered by the web
+// mercator projection, as in Redis.
+const (
+	geoStepMax      = 26
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLongMin      = -180.0
+	geoLongMax      = 180.0
+	earthRadiusM    = 6372797.560856
+	mercatorMax     = 20037726.37
+	geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+type geoHashRange struct {
+	min, max float64
+}
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// align52 shifts the hash so it can be compared with the 52-bit scores stored
+// in the sorted set.
+func (h geoHashBits) align52() uint64 {
+	return h.bits << (52 - h.step*2)
+}
+
+type geoHashArea struct {
+	hash      geoHashBits
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+type geoHashNeighbors struct {
+	north, east, west, south                   geoHashBits
+	northEast, southEast, northWest, southWest geoHashBits
+}
+
+// geoHashRadius is the box containing the search centre together with the
+// eight boxes around it.
+type geoHashRadius struct {
+	hash      geoHashBits
+	area      geoHashArea
+	neighbors geoHashNeighbors
+}
+
+var (
+	geoLongRange = geoHashRange{min: geoLongMin, max: geoLongMax}
+	geoLatRange  = geoHashRange{min: geoLatMin, max: geoLatMax}
+)
+
+// interleave64 spreads the bits of xlo over the even positions and the bits
+// of ylo over the odd positions of the result.
+func interleave64(xlo, ylo uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	s := [...]uint{1, 2, 4, 8, 16}
+
+	x, y := uint64(xlo), uint64(ylo)
+	for i := len(b) - 1; i >= 0; i-- {
+		x = (x | (x << s[i])) & b[i]
+		y = (y | (y << s[i])) & b[i]
+	}
+	return x | (y << 1)
+}
+
+// deinterleave64 is the inverse of interleave64: the even bits end up in the
+// low 32 bits of the result and the odd bits in the high 32 bits.
+func deinterleave64(interleaved uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x, y := interleaved, interleaved>>1
+	for i := range b {
+		x = (x | (x >> s[i])) & b[i]
+		y = (y | (y >> s[i])) & b[i]
+	}
+	return x | (y << 32)
+}
+
+// geohashEncode encodes a coordinate pair at the given precision. It fails
+// for coordinates outside the supported or the requested range.
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint) (geoHashBits, bool) {
+	return geohashEncode(geoLongRange, geoLatRange, longitude, latitude, step)
+}
+
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	sep := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := float64(uint32(sep))
+	ilono := float64(uint32(sep >> 32))
+	cells := float64(uint64(1) << hash.step)
+
+	return geoHashArea{
+		hash: hash,
+		latitude: geoHashRange{
+			min: latRange.min + (ilato/cells)*latScale,
+			max: latRange.min + ((ilato+1)/cells)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (ilono/cells)*longScale,
+			max: longRange.min + ((ilono+1)/cells)*longScale,
+		},
+	}
+}
+
+// decodeGeoScore turns a sorted set score back into the centre of its cell.
+func decodeGeoScore(score float64) (longitude, latitude float64) {
+	area := geohashDecode(geoLongRange, geoLatRange, geoHashBits{bits: uint64(score), step: geoStepMax})
+	longitude = math.Max(geoLongMin, math.Min(geoLongMax, (area.longitude.min+area.longitude.max)/2))
+	latitude = math.Max(geoLatMin, math.Min(geoLatMax, (area.latitude.min+area.latitude.max)/2))
+	return longitude, latitude
+}
+
+// geohashString renders a score as the standard 11 character geohash. Scores
+// use a latitude range of +-85 degrees while geohash.org uses +-90, so the
+// position is decoded and re-encoded first.
+func geohashString(score float64) string {
+	longitude, latitude := decodeGeoScore(score)
+	hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{-90, 90}, longitude, latitude, geoStepMax)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		// Only 52 bits are available; the last character is assumed zero.
+		if i < 10 {
+			idx = int((hash.bits >> (52 - (uint(i)+1)*5)) & 0x1f)
+		}
+		buf[i] = geoHashAlphabet[idx]
+	}
+	return string(buf)
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashNeighborsOf(hash geoHashBits) geoHashNeighbors {
+	move := func(dx, dy int) geoHashBits {
+		h := hash
+		geohashMoveX(&h, dx)
+		geohashMoveY(&h, dy)
+		return h
+	}
+	return geoHashNeighbors{
+		east:      move(1, 0),
+		west:      move(-1, 0),
+		south:     move(0, -1),
+		north:     move(0, 1),
+		northWest: move(-1, 1),
+		southWest: move(-1, -1),
+		northEast: move(1, 1),
+		southEast: move(1, -1),
+	}
+}
+
+func degRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// geohashDistance is the haversine distance in meters between two points.
+func geohashDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lat1r, lon1r := degRad(lat1d), degRad(lon1d)
+	lat2r, lon2r := degRad(lat2d), degRad(lon2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	return 2.0 * earthRadiusM * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+func geohashLatDistance(lat1d, lat2d float64) float64 {
+	return earthRadiusM * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// geohashEstimateStepsByRadius picks the precision whose cells are just
+// large enough for the nine boxes around the centre to cover the radius.
+func geohashEstimateStepsByRadius(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // Make sure the range is included in most of the base cases.
+
+	// Cells get narrower towards the poles.
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	step = max(1, min(geoStepMax, step))
+	return uint(step)
+}
+
+// GeoShape is the area searched by GEOSEARCH: a circle of the given radius
+// or a box of the given width and height around a centre. Distances are in
+// the unit described by Conversion (meters per unit).
+type GeoShape struct {
+	ByBox               bool
+	Longitude, Latitude float64
+	Radius              float64
+	Width, Height       float64
+	Conversion          float64
+}
+
+// boundingBox returns min longitude, min latitude, max longitude and max
+// latitude of the shape.
+func (shape GeoShape) boundingBox() [4]float64 {
+	longitude, latitude := shape.Longitude, shape.Latitude
+	height := shape.Conversion * shape.Radius
+	width := height
+	if shape.ByBox {
+		height = shape.Conversion * shape.Height / 2
+		width = shape.Conversion * shape.Width / 2
+	}
+
+	latDelta := radDeg(height / earthRadiusM)
+	longDeltaTop := radDeg(width / earthRadiusM / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusM / math.Cos(degRad(latitude-latDelta)))
+
+	// The hemispheres widen in opposite directions.
+	if latitude < 0 {
+		return [4]float64{longitude - longDeltaBottom, latitude - latDelta, longitude + longDeltaBottom, latitude + latDelta}
+	}
+	return [4]float64{longitude - longDeltaTop, latitude - latDelta, longitude + longDeltaTop, latitude + latDelta}
+}
+
+// distanceIfInShape returns the distance in meters from the centre of the
+// shape to the point, and whether the point lies inside the shape.
+func (shape GeoShape) distanceIfInShape(longitude, latitude float64) (float64, bool) {
+	x1, y1 := shape.Longitude, shape.Latitude
+	if !shape.ByBox {
+		distance := geohashDistance(x1, y1, longitude, latitude)
+		return distance, distance <= shape.Radius*shape.Conversion
+	}
+
+	// Latitude distance is cheaper to compute, so check it first.
+	if geohashLatDistance(latitude, y1) > shape.Height*shape.Conversion/2 {
+		return 0, false
+	}
+	if geohashDistance(longitude, latitude, x1, latitude) > shape.Width*shape.Conversion/2 {
+		return 0, false
+	}
+	return geohashDistance(x1, y1, longitude, latitude), true
+}
+
+// areas computes the geohash box around the shape's centre and those of its
+// neighbours that can contain matching points.
+func (shape GeoShape) areas() geoHashRadius {
+	bounds := shape.boundingBox()
+	minLon, minLat, maxLon, maxLat := bounds[0], bounds[1], bounds[2], bounds[3]
+	longitude, latitude := shape.Longitude, shape.Latitude
+
+	radiusMeters := shape.Radius
+	if shape.ByBox {
+		radiusMeters = math.Sqrt((shape.Width/2)*(shape.Width/2) + (shape.Height/2)*(shape.Height/2))
+	}
+	radiusMeters *= shape.Conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, latitude)
+	hash, _ := geohashEncodeWGS84(longitude, latitude, steps)
+	neighbors := geohashNeighborsOf(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// Near the edges of the covered area the estimated step may not be small
+	// enough for one of the neighbours to reach far enough.
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	decreaseStep := north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncodeWGS84(longitude, latitude, steps)
+		neighbors = geohashNeighborsOf(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	// Exclude the neighbours that cannot contain matches.
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+	}
+
+	return geoHashRadius{hash: hash, area: area, neighbors: neighbors}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestGeohash_EncodeDecode(t *testing.T) {
+	for _, p := range [][2]float64{{13.361389, 38.115556}, {-122.27652, 37.805186}, {180, 85.05}, {-180, -85.05}, {0, 0}} {
+		hash, ok := geohashEncodeWGS84(p[0], p[1], geoStepMax)
+		if !ok {
+			t.Fatalf("%v: encode failed", p)
+		}
+		longitude, latitude := decodeGeoScore(float64(hash.bits))
+		if math.Abs(longitude-p[0]) > 1e-5 || math.Abs(latitude-p[1]) > 1e-5 {
+			t.Errorf("%v: decoded to %v,%v", p, longitude, latitude)
+		}
+	}
+
+	if _, ok := geohashEncodeWGS84(0, 86, geoStepMax); ok {
+		t.Error("Expected latitude 86 to be rejected")
+	}
+}
+
+// TestGeoSearch_MatchesBruteForce checks that the neighbour box search finds
+// exactly the points a full scan would, for both radius and box shapes.
+func TestGeoSearch_MatchesBruteForce(t *testing.T) {
+	s := newStore()
+	rng := rand.New(rand.NewSource(1))
+
+	members := make([]ScoredMember, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		longitude := rng.Float64()*20 - 10
+		latitude := rng.Float64()*20 + 40
+		hash, _ := geohashEncodeWGS84(longitude, latitude, geoStepMax)
+		members = append(members, ScoredMember{Member: "p" + strconv.Itoa(i), Score: float64(hash.bits)})
+	}
+	s.ZAdd("geo", ZAddOptions{}, members...)
+
+	shapes := []GeoShape{
+		{Longitude: 0, Latitude: 50, Radius: 300, Conversion: 1000},
+		{Longitude: 5, Latitude: 45, Radius: 50, Conversion: 1000},
+		{Longitude: -3, Latitude: 55, ByBox: true, Width: 400, Height: 150, Conversion: 1000},
+		{Longitude: 0, Latitude: 50, Radius: 5000, Conversion: 1000},
+	}
+
+	for _, shape := range shapes {
+		expected := map[string]bool{}
+		for _, m := range members {
+			longitude, latitude := decodeGeoScore(m.Score)
+			if _, ok := shape.distanceIfInShape(longitude, latitude); ok {
+				expected[m.Member] = true
+			}
+		}
+
+		points, err := s.GeoSearch("geo", GeoQuery{Shape: shape})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(expected) {
+			t.Errorf("%+v: expected %d points, got %d", shape, len(expected), len(points))
+		}
+		for _, p := range points {
+			if !expected[p.Member] {
+				t.Errorf("%+v: unexpected point %s", shape, p.Member)
+			}
+		}
+	}
+}
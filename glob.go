@@ -0,0 +1,129 @@
+package main
+
+// maxGlobNesting bounds the recursion of stringMatch on patterns with many
+// stars.
+const maxGlobNesting = 1000
+
+// stringMatch reports whether str matches the glob-style pattern, using the
+// same rules as Redis:
+//
+//	h?llo     matches hello, hallo and hxllo
+//	h*llo     matches hllo and heeeello
+//	h[ae]llo  matches hello and hallo, but not hillo
+//	h[^e]llo  matches hallo, hbllo, ... but not hello
+//	h[a-b]llo matches hallo and hbllo
+//
+// A backslash escapes the special characters.
+func stringMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func stringMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	if nesting > maxGlobNesting {
+		return false
+	}
+
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for s < len(str) {
+				if stringMatchImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				s++
+			}
+			// The rest of the pattern matches nowhere in the rest of the
+			// string, so earlier stars need not try longer matches either.
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p >= len(pattern) {
+					p-- // unterminated class; let the outer loop finish
+					break
+				}
+				if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, ch := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, ch = toLowerASCII(start), toLowerASCII(end), toLowerASCII(ch)
+					}
+					p += 2
+					if ch >= start && ch <= end {
+						match = true
+					}
+				} else if equalBytes(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if !equalBytes(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func equalBytes(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLowerASCII(a) == toLowerASCII(b)
+	}
+	return a == b
+}
+
+func toLowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
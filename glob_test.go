@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		match   bool
+	}{
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "heeeello", false, true},
+		{"h*llo", "hllo", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"HELLO", "hello", false, false},
+		{"news.*", "news.tech", false, true},
+		{"a*b*c", "aXXbYYc", false, true},
+		{"a*b*c", "aXXbYY", false, false},
+		{"abc*", "abc", false, true},
+		{"[abc", "a", false, true},
+		{"", "", false, true},
+		{"a", "", false, false},
+	}
+
+	for _, test := range tests {
+		if got := stringMatch(test.pattern, test.str, test.nocase); got != test.match {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, expected %v", test.pattern, test.str, test.nocase, got, test.match)
+		}
+	}
+}
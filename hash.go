@@ -0,0 +1,98 @@
+package main
+
+// hash is a hash value. Fields given a TTL by HEXPIRE and the like have their
+// expiry, in unix milliseconds, in expires, which stays nil until one does.
+// An elapsed field is deleted the next time the hash is looked up, or by the
+// active expiry cycle, like Redis' hash field expiration.
+type hash struct {
+	fields  *dict[string]
+	expires map[string]int64
+}
+
+// hashMaxExpireTime is the latest expiry a field can have, as in Redis.
+const hashMaxExpireTime = 1<<48 - 1
+
+func newHash() *hash {
+	return &hash{fields: newDict[string]()}
+}
+
+// hashFromPairs returns a hash holding the fields of field, value pairs.
+func hashFromPairs(pairs []string) *hash {
+	h := newHash()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.fields.set(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func (h *hash) len() int {
+	return h.fields.len()
+}
+
+// set sets a field, clearing its TTL.
+func (h *hash) set(field, value string) {
+	h.fields.set(field, value)
+	delete(h.expires, field)
+}
+
+func (h *hash) delete(field string) bool {
+	if !h.fields.delete(field) {
+		return false
+	}
+	delete(h.expires, field)
+	return true
+}
+
+// expireTime returns the expiry of a field, and whether it has one.
+func (h *hash) expireTime(field string) (int64, bool) {
+	when, ok := h.expires[field]
+	return when, ok
+}
+
+func (h *hash) setExpire(field string, when int64) {
+	if h.expires == nil {
+		h.expires = make(map[string]int64)
+	}
+	h.expires[field] = when
+}
+
+// persist removes the TTL of a field, and reports whether it had one.
+func (h *hash) persist(field string) bool {
+	if _, ok := h.expires[field]; !ok {
+		return false
+	}
+	delete(h.expires, field)
+	return true
+}
+
+// hasElapsed reports whether a field has a TTL that elapsed by now.
+func (h *hash) hasElapsed(now int64) bool {
+	for _, when := range h.expires {
+		if when <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// expireFields deletes the fields whose TTL elapsed by now and returns how
+// many it deleted.
+func (h *hash) expireFields(now int64) int {
+	deleted := 0
+	for field, when := range h.expires {
+		if when <= now {
+			h.fields.delete(field)
+			delete(h.expires, field)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (h *hash) clone() *hash {
+	clone := &hash{fields: h.fields.clone(nil)}
+	for field, when := range h.expires {
+		clone.setExpire(field, when)
+	}
+	return clone
+}
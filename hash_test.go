@@ -0,0 +1,213 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProcessCommand_Hashes(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"SET", "str", "v"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"HSET", "h", "a", "1", "b", "2", "a", "3"}, ":2\r\n"},
+		{[]string{"HSET", "h", "b", "20", "c", "x"}, ":1\r\n"},
+		{[]string{"HSET", "h", "a", "1", "b"}, "-ERR wrong number of arguments for 'hset' command\r\n"},
+		{[]string{"HGET", "h", "a"}, "$1\r\n3\r\n"},
+		{[]string{"HMGET", "h", "a", "nope", "c"}, "*3\r\n$1\r\n3\r\n$-1\r\n$1\r\nx\r\n"},
+		{[]string{"HMGET", "missing", "a"}, "*1\r\n$-1\r\n"},
+		{[]string{"HMGET", "str", "a"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"HSETNX", "h", "a", "9"}, ":0\r\n"},
+		{[]string{"HSETNX", "h", "d", "9"}, ":1\r\n"},
+		{[]string{"HSETNX", "new", "f", "v"}, ":1\r\n"},
+		{[]string{"HSTRLEN", "h", "b"}, ":2\r\n"},
+		{[]string{"HSTRLEN", "h", "nope"}, ":0\r\n"},
+		{[]string{"HSTRLEN", "missing", "a"}, ":0\r\n"},
+		{[]string{"HINCRBY", "h", "a", "5"}, ":8\r\n"},
+		{[]string{"HINCRBY", "h", "a", "-10"}, ":-2\r\n"},
+		{[]string{"HINCRBY", "h", "counter", "1"}, ":1\r\n"},
+		{[]string{"HINCRBY", "h", "c", "1"}, "-ERR hash value is not an integer\r\n"},
+		{[]string{"HINCRBY", "h", "a", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"HSET", "h", "big", "9223372036854775806"}, ":1\r\n"},
+		{[]string{"HINCRBY", "h", "big", "2"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"HINCRBY", "other", "f", "3"}, ":3\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "d", "0.5"}, "$3\r\n9.5\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "-1.25"}, "$5\r\n-1.25\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "c", "1"}, "-ERR hash value is not a float\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "d", "x"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"HINCRBYFLOAT", "h", "d", "inf"}, "-ERR increment would produce NaN or Infinity\r\n"},
+		{[]string{"HINCRBYFLOAT", "str", "d", "1"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"HKEYS", "missing"}, "*0\r\n"},
+		{[]string{"HVALS", "str"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"HKEYS", "other"}, "*1\r\n$1\r\nf\r\n"},
+		{[]string{"HVALS", "other"}, "*1\r\n$1\r\n3\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	fields := []string{"a", "b", "big", "c", "counter", "d", "f"}
+	if got := replyMembers(t, executeTestCommand([]string{"HKEYS", "h"})); !reflect.DeepEqual(got, fields) {
+		t.Errorf("Expected fields %v, got %v", fields, got)
+	}
+	if got := replyMembers(t, executeTestCommand([]string{"HVALS", "h"})); !reflect.DeepEqual(got, []string{"-1.25", "-2", "1", "20", "9.5", "9223372036854775806", "x"}) {
+		t.Errorf("Unexpected values %v", got)
+	}
+}
+
+func TestProcessCommand_HRANDFIELD(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"HRANDFIELD", "missing"}, "$-1\r\n"},
+		{[]string{"HRANDFIELD", "missing", "2"}, "*0\r\n"},
+		{[]string{"HRANDFIELD", "h", "0"}, "*0\r\n"},
+		{[]string{"HRANDFIELD", "h", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"HRANDFIELD", "h", "-9223372036854775808"}, "-ERR value is out of range\r\n"},
+		{[]string{"HRANDFIELD", "h", "-4611686018427387904", "WITHVALUES"}, "-ERR value is out of range\r\n"},
+		{[]string{"HRANDFIELD", "missing", "-4611686018427387903"}, "*0\r\n"},
+		{[]string{"HRANDFIELD", "h", "-4611686018427387903"}, "-ERR value is out of range\r\n"},
+		{[]string{"HRANDFIELD", "h", "-4611686018427387903", "WITHVALUES"}, "-ERR value is out of range\r\n"},
+		{[]string{"HRANDFIELD", "h", "1", "WITHSCORES"}, "-ERR syntax error\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	if got := replyMembers(t, executeTestCommand([]string{"HRANDFIELD", "h", "5"})); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Expected every field, got %v", got)
+	}
+	if got := replyMembers(t, executeTestCommand([]string{"HRANDFIELD", "h", "-10"})); len(got) != 10 || len(slices.Compact(got)) > 3 {
+		t.Errorf("Expected 10 fields with repeats, got %v", got)
+	}
+
+	// With values, each field is followed by its own value.
+	reply := executeTestCommand([]string{"HRANDFIELD", "h", "-4", "WITHVALUES"})
+	pairs := replyStrings(t, reply)
+	if len(pairs) != 8 {
+		t.Fatalf("Expected 4 field value pairs, got %q", reply)
+	}
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for i := 0; i < len(pairs); i += 2 {
+		if values[pairs[i]] != pairs[i+1] {
+			t.Errorf("Field %q paired with %q", pairs[i], pairs[i+1])
+		}
+	}
+}
+
+func TestProcessCommand_HashFieldExpire(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"SET", "str", "v"})
+	executeTestCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3", "d", "4"})
+	later := strconv.FormatInt(mstime()+100000, 10)
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"HEXPIRE", "h", "100", "FIELDS", "2", "a", "nope"}, "*2\r\n:1\r\n:-2\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "3", "a", "b", "nope"}, "*3\r\n:100\r\n:-1\r\n:-2\r\n"},
+		{[]string{"HTTL", "missing", "FIELDS", "1", "a"}, "*1\r\n:-2\r\n"},
+		{[]string{"HEXPIRE", "h", "200", "NX", "FIELDS", "2", "a", "b"}, "*2\r\n:0\r\n:1\r\n"},
+		{[]string{"HEXPIRE", "h", "50", "GT", "FIELDS", "2", "a", "c"}, "*2\r\n:0\r\n:0\r\n"},
+		{[]string{"HEXPIRE", "h", "50", "LT", "FIELDS", "2", "a", "c"}, "*2\r\n:1\r\n:1\r\n"},
+		{[]string{"HEXPIRE", "h", "50", "XX", "FIELDS", "1", "d"}, "*1\r\n:0\r\n"},
+		{[]string{"HPEXPIREAT", "h", later, "FIELDS", "1", "d"}, "*1\r\n:1\r\n"},
+		{[]string{"HPEXPIRETIME", "h", "FIELDS", "1", "d"}, "*1\r\n:" + later + "\r\n"},
+		{[]string{"HPERSIST", "h", "FIELDS", "3", "d", "d", "nope"}, "*3\r\n:1\r\n:-1\r\n:-2\r\n"},
+		{[]string{"HEXPIRETIME", "h", "FIELDS", "1", "d"}, "*1\r\n:-1\r\n"},
+		{[]string{"HEXPIREAT", "h", "1", "FIELDS", "1", "c"}, "*1\r\n:2\r\n"},
+		{[]string{"HEXISTS", "h", "c"}, ":0\r\n"},
+		{[]string{"HEXPIRE", "h", "-1", "FIELDS", "1", "a"}, "-ERR invalid expire time in 'hexpire' command\r\n"},
+		{[]string{"HPEXPIRE", "h", "9223372036854775807", "FIELDS", "1", "a"}, "-ERR invalid expire time in 'hpexpire' command\r\n"},
+		{[]string{"HEXPIRE", "h", "x", "FIELDS", "1", "a"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"HEXPIRE", "h", "10", "FIELDS", "0", "a"}, "-ERR Parameter `numFields` should be greater than 0\r\n"},
+		{[]string{"HEXPIRE", "h", "10", "FIELDS", "2", "a"}, "-ERR The `numfields` parameter must match the number of arguments\r\n"},
+		{[]string{"HEXPIRE", "h", "10", "YY", "FIELDS", "1", "a"}, "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n"},
+		{[]string{"HTTL", "h", "FIELD", "1", "a"}, "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n"},
+		{[]string{"HEXPIRE", "str", "10", "FIELDS", "1", "a"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+
+		// HSET clears a field's TTL, HINCRBY keeps it.
+		{[]string{"HSET", "h", "b", "20"}, ":0\r\n"},
+		{[]string{"HINCRBY", "h", "a", "1"}, ":2\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "2", "a", "b"}, "*2\r\n:50\r\n:-1\r\n"},
+
+		{[]string{"HGETEX", "h", "EX", "30", "FIELDS", "2", "b", "nope"}, "*2\r\n$2\r\n20\r\n$-1\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "b"}, "*1\r\n:30\r\n"},
+		{[]string{"HGETEX", "h", "PERSIST", "FIELDS", "1", "b"}, "*1\r\n$2\r\n20\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "b"}, "*1\r\n:-1\r\n"},
+		{[]string{"HGETEX", "h", "FIELDS", "1", "a"}, "*1\r\n$1\r\n2\r\n"},
+		{[]string{"HGETEX", "h", "EX", "0", "FIELDS", "1", "a"}, "-ERR invalid expire time in 'hgetex' command\r\n"},
+		{[]string{"HGETEX", "h", "KEEPTTL", "FIELDS", "1", "a"}, "-ERR Mandatory argument FIELDS is missing or not at the right position\r\n"},
+
+		{[]string{"HSETEX", "h", "FNX", "FIELDS", "2", "x", "1", "a", "1"}, ":0\r\n"},
+		{[]string{"HSETEX", "h", "FXX", "KEEPTTL", "FIELDS", "1", "a", "5"}, ":1\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "a"}, "*1\r\n:50\r\n"},
+		{[]string{"HSETEX", "h", "FNX", "PX", "20000", "FIELDS", "2", "x", "1", "y", "2"}, ":1\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "2", "x", "y"}, "*2\r\n:20\r\n:20\r\n"},
+		{[]string{"HSETEX", "h", "FIELDS", "1", "x", "3"}, ":1\r\n"},
+		{[]string{"HTTL", "h", "FIELDS", "1", "x"}, "*1\r\n:-1\r\n"},
+		{[]string{"HSETEX", "h", "FIELDS", "2", "x", "1", "y"}, "-ERR The `numfields` parameter must match the number of arguments\r\n"},
+		{[]string{"HSETEX", "h", "EX", "10", "PX", "10", "FIELDS", "1", "x", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"HSETEX", "h", "FNX", "FXX", "FIELDS", "1", "x", "1"}, "-ERR syntax error\r\n"},
+
+		// Expiring every field deletes the key.
+		{[]string{"HEXPIREAT", "h", "1", "FIELDS", "5", "a", "b", "d", "x", "y"}, "*5\r\n:2\r\n:2\r\n:2\r\n:2\r\n:2\r\n"},
+		{[]string{"EXISTS", "h"}, ":0\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+}
+
+func TestStore_HashFieldExpire(t *testing.T) {
+	s := newStore()
+	var expired []string
+	s.SetFieldExpireHook(func(key string, deleted bool) {
+		expired = append(expired, key+":"+strconv.FormatBool(deleted))
+	})
+
+	s.HSet("lazy", "a", "1", "b", "2")
+	s.HSet("active", "a", "1")
+	for i := 0; i < 50; i++ {
+		s.HSet("many", strconv.Itoa(i), "v")
+	}
+	s.HExpire("lazy", mstime()+10, 0, "a")
+	s.HExpire("active", mstime()+10, 0, "a")
+	s.HExpire("many", mstime()+10, 0, "1", "2", "3")
+	time.Sleep(20 * time.Millisecond)
+
+	if fields, _ := s.HKeys("lazy"); !reflect.DeepEqual(fields, []string{"b"}) {
+		t.Errorf("Expected only b left, got %v", fields)
+	}
+	s.ActiveExpireCycle()
+	if s.Exists("active") {
+		t.Error("Expected the hash to be deleted once its last field expired")
+	}
+	if n, _ := s.HLen("many"); n != 47 {
+		t.Errorf("Expected 47 fields left, got %d", n)
+	}
+	slices.Sort(expired)
+	if want := []string{"active:true", "lazy:false", "many:false"}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("Expected hook calls %v, got %v", want, expired)
+	}
+}
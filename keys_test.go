@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessCommand_Keyspace(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"SET", "hello", "1"})
+	executeTestCommand([]string{"SET", "hallo", "2"})
+	executeTestCommand([]string{"SET", "hxllo", "3", "EX", "100"})
+	executeTestCommand([]string{"RPUSH", "list", "a", "b"})
+	executeTestCommand([]string{"SET", "gone", "v", "PX", "1"})
+	time.Sleep(5 * time.Millisecond)
+
+	members := []struct {
+		command  []string
+		expected []string
+	}{
+		{[]string{"KEYS", "*"}, []string{"hallo", "hello", "hxllo", "list"}},
+		{[]string{"KEYS", "h?llo"}, []string{"hallo", "hello", "hxllo"}},
+		{[]string{"KEYS", "h[ae]llo"}, []string{"hallo", "hello"}},
+		{[]string{"KEYS", "h[^e]llo"}, []string{"hallo", "hxllo"}},
+		{[]string{"KEYS", "h[a-b]llo"}, []string{"hallo"}},
+		{[]string{"KEYS", "l\\ist"}, []string{"list"}},
+		{[]string{"KEYS", "nothing*"}, []string{}},
+	}
+	for _, test := range members {
+		if got := replyMembers(t, executeTestCommand(test.command)); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Command %v: expected %v, got %v", test.command, test.expected, got)
+		}
+	}
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"DBSIZE"}, ":4\r\n"},
+		{[]string{"EXISTS", "hello", "hello", "missing"}, ":2\r\n"},
+
+		{[]string{"RENAME", "missing", "x"}, "-ERR no such key\r\n"},
+		{[]string{"RENAME", "hxllo", "hxllo"}, "+OK\r\n"},
+		{[]string{"RENAME", "hxllo", "moved"}, "+OK\r\n"},
+		{[]string{"EXISTS", "hxllo"}, ":0\r\n"},
+		{[]string{"GET", "moved"}, "$1\r\n3\r\n"},
+		{[]string{"TTL", "moved"}, ":100\r\n"},
+		{[]string{"RENAME", "list", "hello"}, "+OK\r\n"},
+		{[]string{"TYPE", "hello"}, "+list\r\n"},
+		{[]string{"RENAMENX", "hello", "hallo"}, ":0\r\n"},
+		{[]string{"RENAMENX", "hello", "hello"}, ":0\r\n"},
+		{[]string{"RENAMENX", "hello", "list"}, ":1\r\n"},
+		{[]string{"RENAMENX", "missing", "x"}, "-ERR no such key\r\n"},
+
+		{[]string{"COPY", "list", "copy"}, ":1\r\n"},
+		{[]string{"RPUSH", "copy", "c"}, ":3\r\n"},
+		{[]string{"LLEN", "list"}, ":2\r\n"},
+		{[]string{"COPY", "list", "copy"}, ":0\r\n"},
+		{[]string{"COPY", "list", "copy", "REPLACE"}, ":1\r\n"},
+		{[]string{"LLEN", "copy"}, ":2\r\n"},
+		{[]string{"COPY", "moved", "copy", "DB", "0", "REPLACE"}, ":1\r\n"},
+		{[]string{"TTL", "copy"}, ":100\r\n"},
+		{[]string{"COPY", "missing", "copy", "REPLACE"}, ":0\r\n"},
+		{[]string{"COPY", "list", "list"}, "-ERR source and destination objects are the same\r\n"},
+		{[]string{"COPY", "list", "x", "DB", "16"}, "-ERR DB index is out of range\r\n"},
+		{[]string{"COPY", "list", "x", "DB"}, "-ERR syntax error\r\n"},
+
+		{[]string{"OBJECT", "HELP", "x"}, "-ERR wrong number of arguments for 'object|help' command\r\n"},
+		{[]string{"OBJECT", "BOGUS"}, "-ERR unknown subcommand 'BOGUS'. Try OBJECT HELP.\r\n"},
+
+		{[]string{"DEL", "list", "copy", "missing", "list"}, ":2\r\n"},
+		{[]string{"DBSIZE"}, ":2\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+
+	help := string(executeTestCommand([]string{"OBJECT", "help"}))
+	if !strings.HasPrefix(help, "*5\r\n+OBJECT <subcommand>") || !strings.Contains(help, "+VERSION <key>\r\n") {
+		t.Errorf("Unexpected OBJECT HELP reply %q", help)
+	}
+
+	keys := replyMembers(t, executeTestCommand([]string{"KEYS", "*"}))
+	for i := 0; i < 20; i++ {
+		if key := string(executeTestCommand([]string{"RANDOMKEY"})); !slices.Contains(keys, key[4:len(key)-2]) {
+			t.Errorf("RANDOMKEY returned %q, not one of %v", key, keys)
+		}
+	}
+	executeTestCommand([]string{"DEL", "hallo", "moved"})
+	if got := string(executeTestCommand([]string{"RANDOMKEY"})); got != "$-1\r\n" {
+		t.Errorf("Expected nil from an empty keyspace, got %q", got)
+	}
+}
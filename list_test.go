@@ -0,0 +1,115 @@
+package main
+
+import "testing"
+
+func TestProcessCommand_Lists(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"RPUSH", "list", "a", "b", "c", "b", "a"})
+	executeTestCommand([]string{"SET", "str", "v"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"LINDEX", "list", "1"}, "$1\r\nb\r\n"},
+		{[]string{"LINDEX", "list", "-1"}, "$1\r\na\r\n"},
+		{[]string{"LINDEX", "list", "5"}, "$-1\r\n"},
+		{[]string{"LINDEX", "list", "-6"}, "$-1\r\n"},
+		{[]string{"LINDEX", "list", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"LINDEX", "missing", "0"}, "$-1\r\n"},
+		{[]string{"LSET", "list", "-2", "B"}, "+OK\r\n"},
+		{[]string{"LSET", "list", "5", "x"}, "-ERR index out of range\r\n"},
+		{[]string{"LSET", "missing", "0", "x"}, "-ERR no such key\r\n"},
+		{[]string{"LSET", "str", "0", "x"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nB\r\n$1\r\na\r\n"},
+		{[]string{"LINSERT", "list", "BEFORE", "c", "x"}, ":6\r\n"},
+		{[]string{"LINSERT", "list", "after", "a", "y"}, ":7\r\n"},
+		{[]string{"LINSERT", "list", "AFTER", "nope", "z"}, ":-1\r\n"},
+		{[]string{"LINSERT", "missing", "AFTER", "a", "z"}, ":0\r\n"},
+		{[]string{"LINSERT", "list", "NEAR", "a", "z"}, "-ERR syntax error\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*7\r\n$1\r\na\r\n$1\r\ny\r\n$1\r\nb\r\n$1\r\nx\r\n$1\r\nc\r\n$1\r\nB\r\n$1\r\na\r\n"},
+		{[]string{"LREM", "list", "-1", "a"}, ":1\r\n"},
+		{[]string{"LREM", "list", "0", "nope"}, ":0\r\n"},
+		{[]string{"LREM", "list", "1", "a"}, ":1\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*5\r\n$1\r\ny\r\n$1\r\nb\r\n$1\r\nx\r\n$1\r\nc\r\n$1\r\nB\r\n"},
+		{[]string{"LTRIM", "list", "1", "-2"}, "+OK\r\n"},
+		{[]string{"LRANGE", "list", "0", "-1"}, "*3\r\n$1\r\nb\r\n$1\r\nx\r\n$1\r\nc\r\n"},
+		{[]string{"LTRIM", "missing", "0", "1"}, "+OK\r\n"},
+		{[]string{"LPUSHX", "list", "l1", "l2"}, ":5\r\n"},
+		{[]string{"RPUSHX", "list", "r1"}, ":6\r\n"},
+		{[]string{"LPUSHX", "missing", "v"}, ":0\r\n"},
+		{[]string{"RPUSHX", "str", "v"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"EXISTS", "missing"}, ":0\r\n"},
+		{[]string{"LPOP", "list", "2"}, "*2\r\n$2\r\nl2\r\n$2\r\nl1\r\n"},
+		{[]string{"RPOP", "list", "0"}, "*0\r\n"},
+		{[]string{"RPOP", "list"}, "$2\r\nr1\r\n"},
+		{[]string{"LPOP", "missing", "2"}, "*-1\r\n"},
+		{[]string{"LPOP", "list", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"LPOP", "list", "1", "2"}, "-ERR wrong number of arguments for 'lpop' command\r\n"},
+		{[]string{"LMOVE", "list", "other", "LEFT", "RIGHT"}, "$1\r\nb\r\n"},
+		{[]string{"LMOVE", "list", "list", "RIGHT", "LEFT"}, "$1\r\nc\r\n"},
+		{[]string{"LMOVE", "missing", "other", "LEFT", "LEFT"}, "$-1\r\n"},
+		{[]string{"LMOVE", "list", "str", "LEFT", "LEFT"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"LMOVE", "list", "other", "UP", "LEFT"}, "-ERR syntax error\r\n"},
+		{[]string{"LMOVE", "list", "other", "LEFT", "LEFT"}, "$1\r\nc\r\n"},
+		{[]string{"LMOVE", "list", "other", "LEFT", "LEFT"}, "$1\r\nx\r\n"},
+		{[]string{"EXISTS", "list"}, ":0\r\n"},
+		{[]string{"LRANGE", "other", "0", "-1"}, "*3\r\n$1\r\nx\r\n$1\r\nc\r\n$1\r\nb\r\n"},
+		{[]string{"LMPOP", "2", "missing", "other", "RIGHT", "COUNT", "5"}, "*2\r\n$5\r\nother\r\n*3\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nx\r\n"},
+		{[]string{"LMPOP", "1", "other", "LEFT"}, "*-1\r\n"},
+		{[]string{"LMPOP", "0", "other", "LEFT"}, "-ERR numkeys should be greater than 0\r\n"},
+		{[]string{"LMPOP", "1", "other", "LEFT", "COUNT", "0"}, "-ERR count should be greater than 0\r\n"},
+		{[]string{"LMPOP", "1", "str", "LEFT"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"RPUSH", "short", "a", "b", "c"}, ":3\r\n"},
+		{[]string{"LTRIM", "short", "5", "10"}, "+OK\r\n"},
+		{[]string{"EXISTS", "short"}, ":0\r\n"},
+		{[]string{"RPUSH", "one", "v"}, ":1\r\n"},
+		{[]string{"EXPIRE", "one", "100"}, ":1\r\n"},
+		{[]string{"LMOVE", "one", "one", "LEFT", "RIGHT"}, "$1\r\nv\r\n"},
+		{[]string{"TTL", "one"}, ":100\r\n"},
+	}
+
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+}
+
+func TestProcessCommand_LPOS(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"RPUSH", "list", "a", "b", "c", "1", "2", "3", "c", "c"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"LPOS", "list", "c"}, ":2\r\n"},
+		{[]string{"LPOS", "list", "nope"}, "$-1\r\n"},
+		{[]string{"LPOS", "missing", "c"}, "$-1\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "2"}, ":6\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "-1"}, ":7\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "4"}, "$-1\r\n"},
+		{[]string{"LPOS", "list", "c", "COUNT", "2"}, "*2\r\n:2\r\n:6\r\n"},
+		{[]string{"LPOS", "list", "c", "COUNT", "0"}, "*3\r\n:2\r\n:6\r\n:7\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "-1", "COUNT", "2"}, "*2\r\n:7\r\n:6\r\n"},
+		{[]string{"LPOS", "list", "c", "COUNT", "0", "MAXLEN", "7"}, "*2\r\n:2\r\n:6\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "-1", "MAXLEN", "1"}, ":7\r\n"},
+		{[]string{"LPOS", "list", "a", "RANK", "-1", "MAXLEN", "2"}, "$-1\r\n"},
+		{[]string{"LPOS", "list", "nope", "COUNT", "1"}, "*0\r\n"},
+		{[]string{"LPOS", "missing", "c", "COUNT", "1"}, "*0\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK", "0"}, "-ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list\r\n"},
+		{[]string{"LPOS", "list", "c", "COUNT", "-1"}, "-ERR COUNT can't be negative\r\n"},
+		{[]string{"LPOS", "list", "c", "MAXLEN", "-1"}, "-ERR MAXLEN can't be negative\r\n"},
+		{[]string{"LPOS", "list", "c", "RANK"}, "-ERR syntax error\r\n"},
+		{[]string{"LPOS", "list", "c", "FIRST", "1"}, "-ERR syntax error\r\n"},
+	}
+
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+}
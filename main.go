@@ -1,16 +1,27 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"log"
-	"net"
-	"strings"
+	"path/filepath"
+	"strconv"
 )
 
+// hz is how many times per second the server cron runs background tasks.
+const hz = 10
+
 func main() {
 	host := flag.String("host", "localhost", "Host to listen on")
 	port := flag.String("port", "6379", "Port to listen on")
+	dir := flag.String("dir", ".", "Directory for the dump and append-only files")
+	dbFilename := flag.String("dbfilename", "dump.rdb", "Name of the dump file")
+	databases := flag.Int("databases", defaultDatabases, "Number of databases, selected with SELECT")
+	appendOnly := flag.Bool("appendonly", false, "Log every write to the append-only file")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "Name of the append-only file")
+	appendFsyncPolicy := flag.String("appendfsync", "everysec", "When to fsync the append-only file: always, everysec or no")
+	clusterEnabled := flag.Bool("cluster-enabled", false, "Run as a node of a Redis Cluster")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "Name of the file describing the cluster's nodes and slots")
+	notifyKeyspaceEvents := flag.String("notify-keyspace-events", "", "Keyspace event classes to publish, such as KEA or Ex")
 	help := flag.Bool("help", false, "Show help")
 
 	flag.Parse()
@@ -22,63 +33,48 @@ func main() {
 
 	address := *host + ":" + *port
 
-	listener, err := net.Listen("tcp", address)
+	fsync, err := parseAppendFsync(*appendFsyncPolicy)
 	if err != nil {
-		log.Fatal("Failed to start server:", err)
+		log.Fatal(err)
 	}
 
-	log.Printf("Redis server listening on %s", address)
-
-	storeInstance = newStore()
-	connManager := NewConnectionManager()
+	if *databases < 1 {
+		log.Fatalf("Invalid number of databases %d: it must be at least 1", *databases)
+	}
 
-	for {
-		conn, err := listener.Accept()
+	srv := newServerWithDatabases(*databases)
+	if err := srv.configSet("notify-keyspace-events", *notifyKeyspaceEvents); err != nil {
+		log.Fatal(err)
+	}
+	srv.rdb.path = filepath.Join(*dir, *dbFilename)
+	srv.aof.path = filepath.Join(*dir, *appendFilename)
+	if err := srv.loadData(*appendOnly); err != nil {
+		log.Fatal(err)
+	}
+	if *clusterEnabled {
+		nodePort, err := strconv.Atoi(*port)
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			log.Fatalf("Invalid port %q", *port)
 		}
-
-		go handleConnection(conn, connManager)
+		path := filepath.Join(*dir, *clusterConfigFile)
+		if srv.cluster, err = loadClusterConfig(path, nodePort); err != nil {
+			log.Fatalf("Can't load the cluster config %s: %v", path, err)
+		}
+		log.Printf("Cluster node %s serving as %s", srv.cluster.myself.id, srv.cluster.myself.addr())
 	}
-}
-
-func handleConnection(conn net.Conn, connManager *ConnectionManager) {
-	connManager.Increment(conn.RemoteAddr())
-	defer func() {
-		conn.Close()
-		connManager.Decrement(conn.RemoteAddr())
-	}()
-
-	reader := bufio.NewReader(conn)
-
-	for {
-		value, err := ReadRESP(reader)
-		if err != nil {
-			if err.Error() == "EOF" {
-				return
-			}
-			log.Printf("Error reading RESP: %v", err)
-			return
+	if *appendOnly {
+		if err := srv.aof.open(srv.aof.path, fsync); err != nil {
+			log.Fatalf("Can't open the append-only file %s: %v", srv.aof.path, err)
 		}
+	}
 
-		command, err := value.ToCommand()
-		if err != nil {
-			response := SerializeError("ERR " + err.Error())
-			conn.Write(response)
-			continue
-		}
+	if err := srv.listen(address); err != nil {
+		log.Fatal("Failed to start server:", err)
+	}
 
-		cmdUpper := make([]string, len(command))
-		for i, arg := range command {
-			if i == 0 {
-				cmdUpper[i] = strings.ToUpper(arg)
-			} else {
-				cmdUpper[i] = arg
-			}
-		}
+	log.Printf("Redis server listening on %s", address)
 
-		response := executeCommand(cmdUpper)
-		conn.Write(response)
+	if err := srv.serve(); err != nil {
+		log.Fatal(err)
 	}
 }
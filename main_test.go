@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"strconv"
 	"strings"
 	"testing"
 )
 
+// testServer is the server tests run commands against. Tests reset it with
+// newServer to start from an empty keyspace.
+var testServer = newServer()
+
 func executeTestCommand(command []string) []byte {
+	return executeClientCommand(testServer.newClient(io.Discard), command)
+}
+
+// executeClientCommand runs a command for a specific client, for tests that
+// depend on per-connection state.
+func executeClientCommand(c *client, command []string) []byte {
 	cmdUpper := make([]string, len(command))
 	for i, arg := range command {
 		if i == 0 {
@@ -14,11 +27,11 @@ func executeTestCommand(command []string) []byte {
 			cmdUpper[i] = arg
 		}
 	}
-	return executeCommand(cmdUpper)
+	return executeCommand(c, cmdUpper)
 }
 
 func TestProcessCommand_PING(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"PING"})
 	expected := SerializeSimpleString("PONG")
@@ -29,7 +42,7 @@ func TestProcessCommand_PING(t *testing.T) {
 }
 
 func TestProcessCommand_PING_WithMessage(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"PING", "hello"})
 	expected := SerializeBulkString("hello")
@@ -40,7 +53,7 @@ func TestProcessCommand_PING_WithMessage(t *testing.T) {
 }
 
 func TestProcessCommand_ECHO(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"ECHO", "hello world"})
 	expected := SerializeBulkString("hello world")
@@ -51,7 +64,7 @@ func TestProcessCommand_ECHO(t *testing.T) {
 }
 
 func TestProcessCommand_SET_GET(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"SET", "mykey", "myvalue"})
 	expected := SerializeSimpleString("OK")
@@ -69,7 +82,7 @@ func TestProcessCommand_SET_GET(t *testing.T) {
 }
 
 func TestProcessCommand_GET_NonExistent(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"GET", "nonexistent"})
 	expected := SerializeNullBulkString()
@@ -80,7 +93,7 @@ func TestProcessCommand_GET_NonExistent(t *testing.T) {
 }
 
 func TestProcessCommand_INCR(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"INCR", "counter"})
 	expected := SerializeInteger(1)
@@ -98,7 +111,7 @@ func TestProcessCommand_INCR(t *testing.T) {
 }
 
 func TestProcessCommand_DECR(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"DECR", "counter"})
 	expected := SerializeInteger(-1)
@@ -109,9 +122,9 @@ func TestProcessCommand_DECR(t *testing.T) {
 }
 
 func TestProcessCommand_DEL(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
-	storeInstance.Set("key1", "value1")
+	testServer.dbs[0].Set("key1", "value1")
 
 	response := executeTestCommand([]string{"DEL", "key1"})
 	expected := SerializeInteger(1)
@@ -129,9 +142,9 @@ func TestProcessCommand_DEL(t *testing.T) {
 }
 
 func TestProcessCommand_EXISTS(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
-	storeInstance.Set("key1", "value1")
+	testServer.dbs[0].Set("key1", "value1")
 
 	response := executeTestCommand([]string{"EXISTS", "key1"})
 	expected := SerializeInteger(1)
@@ -149,7 +162,7 @@ func TestProcessCommand_EXISTS(t *testing.T) {
 }
 
 func TestProcessCommand_CaseInsensitive(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"ping"})
 	expected := SerializeSimpleString("PONG")
@@ -167,7 +180,7 @@ func TestProcessCommand_CaseInsensitive(t *testing.T) {
 }
 
 func TestProcessCommand_UnknownCommand(t *testing.T) {
-	storeInstance = newStore()
+	testServer = newServer()
 
 	response := executeTestCommand([]string{"UNKNOWN"})
 	expected := SerializeError("ERR unknown command 'UNKNOWN'")
@@ -176,3 +189,708 @@ func TestProcessCommand_UnknownCommand(t *testing.T) {
 		t.Errorf("Expected %q, got %q", expected, response)
 	}
 }
+
+func TestProcessCommand_EXPIRE_TTL(t *testing.T) {
+	testServer = newServer()
+
+	response := executeTestCommand([]string{"EXPIRE", "missing", "100"})
+	expected := SerializeInteger(0)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	testServer.dbs[0].Set("key1", "value1")
+
+	response = executeTestCommand([]string{"TTL", "key1"})
+	expected = SerializeInteger(-1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXPIRE", "key1", "100"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"TTL", "key1"})
+	expected = SerializeInteger(100)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PERSIST", "key1"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PTTL", "missing"})
+	expected = SerializeInteger(-2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_EXPIREAT(t *testing.T) {
+	testServer = newServer()
+
+	testServer.dbs[0].Set("key1", "value1")
+
+	response := executeTestCommand([]string{"PEXPIREAT", "key1", "99999999999999"})
+	expected := SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PEXPIRETIME", "key1"})
+	expected = SerializeInteger(99999999999999)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXPIREAT", "key1", "1"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXISTS", "key1"})
+	expected = SerializeInteger(0)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_EXPIRE_Errors(t *testing.T) {
+	testServer = newServer()
+
+	testServer.dbs[0].Set("key1", "value1")
+
+	response := executeTestCommand([]string{"EXPIRE", "key1", "abc"})
+	expected := SerializeError("ERR value is not an integer or out of range")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXPIRE", "key1", "10", "NX", "XX"})
+	expected = SerializeError("ERR NX and XX, GT or LT options at the same time are not compatible")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXPIRE", "key1", "10", "GT", "LT"})
+	expected = SerializeError("ERR GT and LT options at the same time are not compatible")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXPIRE", "key1", "9223372036854775807"})
+	expected = SerializeError("ERR invalid expire time in 'expire' command")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_SET_NX_PX(t *testing.T) {
+	testServer = newServer()
+
+	response := executeTestCommand([]string{"SET", "lock", "token1", "NX", "PX", "30000"})
+	expected := SerializeSimpleString("OK")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "lock", "token2", "NX", "PX", "30000"})
+	expected = SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GET", "lock"})
+	expected = SerializeBulkString("token1")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"TTL", "lock"})
+	expected = SerializeInteger(30)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_SET_GET_Option(t *testing.T) {
+	testServer = newServer()
+
+	response := executeTestCommand([]string{"SET", "key1", "value1", "GET"})
+	expected := SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "key1", "value2", "GET", "EX", "100"})
+	expected = SerializeBulkString("value1")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "key1", "value3", "KEEPTTL"})
+	expected = SerializeSimpleString("OK")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"TTL", "key1"})
+	expected = SerializeInteger(100)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_SET_Errors(t *testing.T) {
+	testServer = newServer()
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"SET", "k", "v", "NX", "XX"}, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "EX", "10", "PX", "100"}, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "EX", "10", "KEEPTTL"}, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "EX"}, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "BOGUS"}, "ERR syntax error"},
+		{[]string{"SET", "k", "v", "EX", "abc"}, "ERR value is not an integer or out of range"},
+		{[]string{"SET", "k", "v", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "v", "EX", "9223372036854775807"}, "ERR invalid expire time in 'set' command"},
+	}
+
+	for _, test := range tests {
+		response := executeTestCommand(test.command)
+		expected := SerializeError(test.expected)
+
+		if string(response) != string(expected) {
+			t.Errorf("%v: Expected %q, got %q", test.command, expected, response)
+		}
+	}
+}
+
+func TestProcessCommand_WRONGTYPE(t *testing.T) {
+	testServer = newServer()
+
+	executeTestCommand([]string{"SET", "k", "v"})
+
+	response := executeTestCommand([]string{"LPUSH", "k", "a"})
+	expected := SerializeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GET", "k"})
+	expected = SerializeBulkString("v")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	executeTestCommand([]string{"HSET", "h", "f", "v"})
+
+	response = executeTestCommand([]string{"GET", "h"})
+	expected = SerializeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "h", "v", "GET"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_TYPE(t *testing.T) {
+	testServer = newServer()
+
+	executeTestCommand([]string{"SADD", "s", "a"})
+
+	response := executeTestCommand([]string{"TYPE", "s"})
+	expected := SerializeSimpleString("set")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"TYPE", "missing"})
+	expected = SerializeSimpleString("none")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_ZADD_ZRANGE(t *testing.T) {
+	testServer = newServer()
+
+	response := executeTestCommand([]string{"ZADD", "board", "10", "alice", "20", "bob", "15", "carol"})
+	expected := SerializeInteger(3)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZRANGE", "board", "0", "-1", "WITHSCORES"})
+	expected = serializeStringArray([]string{"alice", "10", "carol", "15", "bob", "20"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZRANGE", "board", "+inf", "(10", "BYSCORE", "REV", "LIMIT", "0", "1"})
+	expected = serializeStringArray([]string{"bob"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZREVRANK", "board", "alice"})
+	expected = SerializeInteger(2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZADD", "board", "INCR", "2.5", "alice"})
+	expected = SerializeBulkString("12.5")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZCOUNT", "board", "12.5", "(20"})
+	expected = SerializeInteger(2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_ZRANGE_Errors(t *testing.T) {
+	testServer = newServer()
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"ZRANGE", "z", "0", "1", "LIMIT", "0", "1"}, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"},
+		{[]string{"ZRANGE", "z", "-", "+", "BYLEX", "WITHSCORES"}, "ERR syntax error, WITHSCORES not supported in combination with BYLEX"},
+		{[]string{"ZRANGE", "z", "a", "1", "BYSCORE"}, "ERR min or max is not a float"},
+		{[]string{"ZRANGE", "z", "a", "+", "BYLEX"}, "ERR min or max not valid string range item"},
+		{[]string{"ZADD", "z", "NX", "XX", "1", "a"}, "ERR XX and NX options at the same time are not compatible"},
+		{[]string{"ZADD", "z", "GT", "LT", "1", "a"}, "ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{[]string{"ZADD", "z", "INCR", "1", "a", "2", "b"}, "ERR INCR option supports a single increment-element pair"},
+		{[]string{"ZADD", "z", "1", "a", "2"}, "ERR syntax error"},
+		{[]string{"ZADD", "z", "x", "a"}, "ERR value is not a valid float"},
+		{[]string{"ZPOPMIN", "z", "-1"}, "ERR value is out of range, must be positive"},
+	}
+
+	for _, test := range tests {
+		response := executeTestCommand(test.command)
+		expected := SerializeError(test.expected)
+
+		if string(response) != string(expected) {
+			t.Errorf("%v: Expected %q, got %q", test.command, expected, response)
+		}
+	}
+}
+
+func TestProcessCommand_ZREMRANGE(t *testing.T) {
+	testServer = newServer()
+
+	executeTestCommand([]string{"ZADD", "z", "1", "a", "2", "b", "3", "c", "4", "d"})
+
+	response := executeTestCommand([]string{"ZREMRANGEBYRANK", "z", "0", "1"})
+	expected := SerializeInteger(2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZREMRANGEBYSCORE", "z", "-inf", "(4"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZPOPMAX", "z"})
+	expected = serializeStringArray([]string{"d", "4"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"TYPE", "z"})
+	expected = SerializeSimpleString("none")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_GEO(t *testing.T) {
+	testServer = newServer()
+
+	response := executeTestCommand([]string{"GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"})
+	expected := SerializeInteger(2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEODIST", "Sicily", "Palermo", "Catania", "km"})
+	expected = SerializeBulkString("166.2742")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEOHASH", "Sicily", "Palermo", "Catania", "Agrigento"})
+	expected = SerializeArray([][]byte{
+		SerializeBulkString("sqc8b49rny0"),
+		SerializeBulkString("sqdtr74hyu0"),
+		SerializeNullBulkString(),
+	})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEOPOS", "Sicily", "Palermo"})
+	expected = SerializeArray([][]byte{serializeStringArray([]string{"13.36138933897018433", "38.11555639549629859"})})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "WITHDIST"})
+	expected = SerializeArray([][]byte{
+		serializeStringArray([]string{"Catania", "56.4413"}),
+		serializeStringArray([]string{"Palermo", "190.4424"}),
+	})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", "100", "100", "km", "WITHHASH"})
+	expected = SerializeArray([][]byte{
+		SerializeArray([][]byte{SerializeBulkString("Palermo"), SerializeInteger(3479099956230698)}),
+	})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "DESC", "COUNT", "1", "STOREDIST"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"ZRANGE", "near", "0", "-1"})
+	expected = serializeStringArray([]string{"Palermo"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_GEO_Errors(t *testing.T) {
+	testServer = newServer()
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"GEOADD", "g", "200", "10", "x"}, "ERR invalid longitude,latitude pair 200.000000,10.000000"},
+		{[]string{"GEOADD", "g", "NX", "XX", "1", "1", "x"}, "ERR syntax error"},
+		{[]string{"GEODIST", "g", "a", "b", "yd"}, "ERR unsupported unit provided. please use M, KM, FT, MI"},
+		{[]string{"GEOSEARCH", "g", "BYRADIUS", "1", "m", "ASC", "WITHDIST"}, "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch"},
+		{[]string{"GEOSEARCH", "g", "FROMLONLAT", "1", "1", "ASC", "WITHDIST"}, "ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch"},
+		{[]string{"GEOSEARCH", "g", "FROMLONLAT", "1", "1", "BYRADIUS", "1", "m", "ANY"}, "ERR the ANY argument requires COUNT argument"},
+		{[]string{"GEOSEARCH", "g", "FROMLONLAT", "1", "1", "BYRADIUS", "-1", "m"}, "ERR radius cannot be negative"},
+		{[]string{"GEOSEARCH", "g", "FROMMEMBER", "x", "BYRADIUS", "1", "m"}, "ERR could not decode requested zset member"},
+		{[]string{"GEOSEARCHSTORE", "d", "g", "FROMLONLAT", "1", "1", "BYRADIUS", "1", "m", "WITHDIST"}, "ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"},
+	}
+
+	for _, test := range tests {
+		response := executeTestCommand(test.command)
+		expected := SerializeError(test.expected)
+
+		if string(response) != string(expected) {
+			t.Errorf("%v: Expected %q, got %q", test.command, expected, response)
+		}
+	}
+}
+
+func TestProcessCommand_PUBSUB(t *testing.T) {
+	testServer = newServer()
+
+	var out bytes.Buffer
+	subscriber := testServer.newClient(&out)
+
+	response := executeClientCommand(subscriber, []string{"SUBSCRIBE", "news", "sports"})
+	expected := append(serializeSubscription("subscribe", "news", 1), serializeSubscription("subscribe", "sports", 2)...)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(subscriber, []string{"PSUBSCRIBE", "n*"})
+	expected = serializeSubscription("psubscribe", "n*", 3)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(subscriber, []string{"GET", "key"})
+	expected = SerializeError("ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(subscriber, []string{"PING"})
+	expected = serializeStringArray([]string{"pong", ""})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PUBLISH", "news", "hello"})
+	expected = SerializeInteger(2)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	pushed := out.String()
+	message := string(serializeStringArray([]string{"message", "news", "hello"}))
+	pmessage := string(serializeStringArray([]string{"pmessage", "n*", "news", "hello"}))
+	if pushed != message+pmessage {
+		t.Errorf("Expected pushes %q, got %q", message+pmessage, pushed)
+	}
+
+	response = executeTestCommand([]string{"PUBSUB", "NUMSUB", "news", "other"})
+	expected = SerializeArray([][]byte{
+		SerializeBulkString("news"), SerializeInteger(1),
+		SerializeBulkString("other"), SerializeInteger(0),
+	})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PUBSUB", "CHANNELS", "s*"})
+	expected = serializeStringArray([]string{"sports"})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(subscriber, []string{"UNSUBSCRIBE"})
+	expected = append(serializeSubscription("unsubscribe", "news", 2), serializeSubscription("unsubscribe", "sports", 1)...)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	executeClientCommand(subscriber, []string{"PUNSUBSCRIBE"})
+
+	response = executeClientCommand(subscriber, []string{"PING"})
+	expected = SerializeSimpleString("PONG")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"PUBSUB", "NUMPAT"})
+	expected = SerializeInteger(0)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_MULTI_EXEC(t *testing.T) {
+	testServer = newServer()
+	c := testServer.newClient(io.Discard)
+
+	response := executeClientCommand(c, []string{"MULTI"})
+	expected := SerializeSimpleString("OK")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	for _, command := range [][]string{{"INCR", "counter"}, {"LPUSH", "counter", "x"}, {"LPUSH", "jobs", "a"}} {
+		response = executeClientCommand(c, command)
+		expected = SerializeSimpleString("QUEUED")
+
+		if string(response) != string(expected) {
+			t.Errorf("%v: Expected %q, got %q", command, expected, response)
+		}
+	}
+
+	response = executeTestCommand([]string{"GET", "counter"})
+	expected = SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected queued commands not to run yet, got %q", response)
+	}
+
+	response = executeClientCommand(c, []string{"EXEC"})
+	expected = SerializeArray([][]byte{
+		SerializeInteger(1),
+		SerializeError("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		SerializeInteger(1),
+	})
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(c, []string{"EXEC"})
+	expected = SerializeError("ERR EXEC without MULTI")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+func TestProcessCommand_MULTI_Abort(t *testing.T) {
+	testServer = newServer()
+	c := testServer.newClient(io.Discard)
+
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"SET", "key", "value"})
+
+	response := executeClientCommand(c, []string{"GET"})
+	expected := SerializeError("ERR wrong number of arguments for 'get' command")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(c, []string{"EXEC"})
+	expected = SerializeError("EXECABORT Transaction discarded because of previous errors.")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"EXISTS", "key"})
+	expected = SerializeInteger(0)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected aborted transaction not to run, got %q", response)
+	}
+
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"SET", "key", "value"})
+
+	response = executeClientCommand(c, []string{"DISCARD"})
+	expected = SerializeSimpleString("OK")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeClientCommand(c, []string{"GET", "key"})
+	expected = SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected discarded transaction not to run, got %q", response)
+	}
+}
+
+func TestProcessCommand_ConditionalWrites(t *testing.T) {
+	testServer = newServer()
+
+	executeTestCommand([]string{"SET", "lock", "owner-1"})
+
+	response := executeTestCommand([]string{"OBJECT", "VERSION", "lock"})
+	version, _ := testServer.dbs[0].Version("lock")
+	expected := SerializeInteger(int(version))
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "lock", "owner-2", "IFVER", strconv.FormatUint(version+1, 10)})
+	expected = SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "lock", "owner-2", "IFEQ", "owner-1", "GET"})
+	expected = SerializeBulkString("owner-1")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"DELIFEQ", "lock", "owner-1"})
+	expected = SerializeInteger(0)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"DELIFEQ", "lock", "owner-2"})
+	expected = SerializeInteger(1)
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"OBJECT", "VERSION", "lock"})
+	expected = SerializeNullBulkString()
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	response = executeTestCommand([]string{"SET", "lock", "x", "NX", "IFEQ", "y"})
+	expected = SerializeError("ERR syntax error")
+
+	if string(response) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Keyspace event classes, selected by the characters of the
+// notify-keyspace-events setting.
+const (
+	notifyKeyspace = 1 << iota // K: published to __keyspace@<db>__:<key>
+	notifyKeyevent             // E: published to __keyevent@<db>__:<event>
+	notifyGeneric              // g: del, expire, persist, ...
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyExpired              // x: a key reached its expiry
+	notifyEvicted              // e: a key was evicted for memory
+	notifyStream               // t
+
+	// notifyAll is what A stands for.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted | notifyStream
+)
+
+var errNotifyClasses = errors.New("Invalid event class character. Use 'Ag$lshzxetKE'.")
+
+// keyspaceEventClasses maps each class character, in the order they are
+// reported, to its flag.
+var keyspaceEventClasses = []struct {
+	char byte
+	flag int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZSet},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+}
+
+// parseKeyspaceEvents converts a notify-keyspace-events value such as "Ex" or
+// "KA" to flags.
+func parseKeyspaceEvents(classes string) (int, error) {
+	flags := 0
+outer:
+	for i := 0; i < len(classes); i++ {
+		if classes[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		for _, class := range keyspaceEventClasses {
+			if class.char == classes[i] {
+				flags |= class.flag
+				continue outer
+			}
+		}
+		return 0, errNotifyClasses
+	}
+	return flags, nil
+}
+
+// formatKeyspaceEvents is the inverse of parseKeyspaceEvents, using A when
+// every class is enabled.
+func formatKeyspaceEvents(flags int) string {
+	var out []byte
+	all := flags&notifyAll == notifyAll
+	if all {
+		out = append(out, 'A')
+	}
+	for _, class := range keyspaceEventClasses {
+		if flags&class.flag != 0 && !(all && class.flag&notifyAll != 0) {
+			out = append(out, class.char)
+		}
+	}
+	return string(out)
+}
+
+// keyspaceEvent is a notification waiting to be published.
+type keyspaceEvent struct {
+	channel, message string
+}
+
+// keyspaceNotifier turns changes to keys into pub/sub messages.
+//
+// Events are raised while keyspaceLock or the store's lock is held, but
+// delivering a message waits on its subscribers, so events are queued and
+// published by flush once those locks are released.
+type keyspaceNotifier struct {
+	flags atomic.Int64
+
+	mu         sync.Mutex
+	pending    []keyspaceEvent
+	hasPending atomic.Bool
+}
+
+// notify raises event for key in database dbid if its class is enabled.
+func (n *keyspaceNotifier) notify(class int, event, key string, dbid int) {
+	flags := int(n.flags.Load())
+	if flags&class == 0 || flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	db := strconv.Itoa(dbid)
+	if flags&notifyKeyspace != 0 {
+		n.pending = append(n.pending, keyspaceEvent{"__keyspace@" + db + "__:" + key, event})
+	}
+	if flags&notifyKeyevent != 0 {
+		n.pending = append(n.pending, keyspaceEvent{"__keyevent@" + db + "__:" + event, key})
+	}
+	n.hasPending.Store(true)
+}
+
+// flush publishes the queued events.
+func (n *keyspaceNotifier) flush(ps *pubSub) {
+	if !n.hasPending.Load() {
+		return
+	}
+	n.mu.Lock()
+	events := n.pending
+	n.pending = nil
+	n.hasPending.Store(false)
+	n.mu.Unlock()
+
+	for _, e := range events {
+		ps.publish(e.channel, e.message)
+	}
+}
+
+// notifyKeyspaceEvent raises an event for a key changed by c's command in
+// its selected database.
+func notifyKeyspaceEvent(c *client, class int, event, key string) {
+	c.srv.events.notify(class, event, key, c.dbid)
+}
+
+// notifyIfDeleted raises del for a key that its command emptied.
+func notifyIfDeleted(c *client, key string) {
+	if !c.db.Exists(key) {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+	}
+}
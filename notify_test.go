@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		classes, formatted string
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Ex", "xE"},
+		{"g$lshzxetK", "AK"},
+		{"g$lshzxeK", "g$lshzxeK"},
+		{"El$", "$lE"},
+	}
+	for _, test := range tests {
+		flags, err := parseKeyspaceEvents(test.classes)
+		if err != nil {
+			t.Errorf("%q: %v", test.classes, err)
+			continue
+		}
+		if got := formatKeyspaceEvents(flags); got != test.formatted {
+			t.Errorf("%q: expected %q, got %q", test.classes, test.formatted, got)
+		}
+	}
+	if _, err := parseKeyspaceEvents("KEq"); err == nil {
+		t.Error("Expected an error for an unknown class")
+	}
+}
+
+// subscribeKeyspaceEvents enables the classes and returns a buffer that
+// collects every keyspace notification.
+func subscribeKeyspaceEvents(t *testing.T, classes string) *bytes.Buffer {
+	t.Helper()
+	testServer = newServer()
+	if err := testServer.configSet("notify-keyspace-events", classes); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	executeClientCommand(testServer.newClient(&out), []string{"PSUBSCRIBE", "__key*__:*"})
+	out.Reset()
+	return &out
+}
+
+// keyspaceMessages decodes the pmessages in out as channel, message pairs.
+func keyspaceMessages(t *testing.T, out *bytes.Buffer) []string {
+	t.Helper()
+	var got []string
+	reader := bufio.NewReader(bytes.NewReader(out.Bytes()))
+	for {
+		if _, err := reader.Peek(1); err != nil {
+			break
+		}
+		value, err := ReadRESP(reader)
+		if err != nil {
+			t.Fatalf("Bad message: %v", err)
+		}
+		fields, _ := value.ToCommand()
+		got = append(got, fields[2], fields[3])
+	}
+	return got
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	out := subscribeKeyspaceEvents(t, "KEA")
+	for _, cmd := range [][]string{
+		{"SET", "s", "v", "EX", "100"},
+		{"SET", "s", "w", "NX"}, // not written
+		{"INCR", "n"},
+		{"RPUSH", "l", "a"},
+		{"LPOP", "l"},
+		{"SREM", "missing", "x"}, // nothing removed
+		{"HSET", "h", "f", "v"},
+		{"ZADD", "z", "1", "m"},
+		{"ZADD", "z", "1", "m"}, // unchanged
+		{"PERSIST", "s"},
+		{"EXPIRE", "h", "-1"},
+		{"DEL", "s"},
+		{"RENAME", "n", "m"},
+		{"COPY", "m", "c"},
+	} {
+		executeTestCommand(cmd)
+	}
+
+	want := []string{
+		"__keyspace@0__:s", "set", "__keyevent@0__:set", "s",
+		"__keyspace@0__:s", "expire", "__keyevent@0__:expire", "s",
+		"__keyspace@0__:n", "incrby", "__keyevent@0__:incrby", "n",
+		"__keyspace@0__:l", "rpush", "__keyevent@0__:rpush", "l",
+		"__keyspace@0__:l", "lpop", "__keyevent@0__:lpop", "l",
+		"__keyspace@0__:l", "del", "__keyevent@0__:del", "l",
+		"__keyspace@0__:h", "hset", "__keyevent@0__:hset", "h",
+		"__keyspace@0__:z", "zadd", "__keyevent@0__:zadd", "z",
+		"__keyspace@0__:s", "persist", "__keyevent@0__:persist", "s",
+		"__keyspace@0__:h", "del", "__keyevent@0__:del", "h",
+		"__keyspace@0__:s", "del", "__keyevent@0__:del", "s",
+		"__keyspace@0__:n", "rename_from", "__keyevent@0__:rename_from", "n",
+		"__keyspace@0__:m", "rename_to", "__keyevent@0__:rename_to", "m",
+		"__keyspace@0__:c", "copy_to", "__keyevent@0__:copy_to", "c",
+	}
+	if got := keyspaceMessages(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected notifications:\n got %q\nwant %q", got, want)
+	}
+}
+
+// TestKeyspaceEvents_Databases checks that events name the database of the
+// key, which for MOVE and COPY DB is the destination's for the second event.
+func TestKeyspaceEvents_Databases(t *testing.T) {
+	out := subscribeKeyspaceEvents(t, "Kg$")
+	c := testServer.newClient(io.Discard)
+	for _, cmd := range [][]string{
+		{"SELECT", "1"},
+		{"SET", "k", "v"},
+		{"MOVE", "k", "2"},
+		{"SELECT", "2"},
+		{"COPY", "k", "c", "DB", "3"},
+	} {
+		executeClientCommand(c, cmd)
+	}
+
+	want := []string{
+		"__keyspace@1__:k", "set",
+		"__keyspace@1__:k", "move_from",
+		"__keyspace@2__:k", "move_to",
+		"__keyspace@3__:c", "copy_to",
+	}
+	if got := keyspaceMessages(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected notifications:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestKeyspaceEvents_Classes(t *testing.T) {
+	// Only key events for lists and expiries.
+	out := subscribeKeyspaceEvents(t, "Elx")
+	executeTestCommand([]string{"SET", "s", "v", "PX", "10"})
+	executeTestCommand([]string{"LPUSH", "l", "a"})
+	executeTestCommand([]string{"SADD", "set", "a"})
+	time.Sleep(20 * time.Millisecond)
+	executeTestCommand([]string{"GET", "s"})
+
+	want := []string{"__keyevent@0__:lpush", "l", "__keyevent@0__:expired", "s"}
+	if got := keyspaceMessages(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected notifications:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestKeyspaceEvents_Disabled(t *testing.T) {
+	out := subscribeKeyspaceEvents(t, "")
+	executeTestCommand([]string{"SET", "s", "v"})
+	if out.Len() != 0 {
+		t.Errorf("Expected no notifications, got %q", out.String())
+	}
+
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "KA"})
+	if reply := executeClientCommand(c, []string{"CONFIG", "GET", "notify-*"}); string(reply) != string(serializeStringArray([]string{"notify-keyspace-events", "AK"})) {
+		t.Errorf("Unexpected CONFIG GET reply %q", reply)
+	}
+	executeTestCommand([]string{"DEL", "s"})
+	if got := keyspaceMessages(t, out); !reflect.DeepEqual(got, []string{"__keyspace@0__:s", "del"}) {
+		t.Errorf("Unexpected notifications %q", got)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// pubSub routes published messages to the clients subscribed to a channel or
+// to a glob pattern matching it.
+type pubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*client]struct{}
+	patterns map[string]map[*client]struct{}
+}
+
+func newPubSub() *pubSub {
+	return &pubSub{
+		channels: make(map[string]map[*client]struct{}),
+		patterns: make(map[string]map[*client]struct{}),
+	}
+}
+
+// subscribe adds c to channel and returns the client's subscription count.
+func (ps *pubSub) subscribe(c *client, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	c.channels[channel] = struct{}{}
+	addSubscriber(ps.channels, channel, c)
+	return len(c.channels) + len(c.patterns)
+}
+
+func (ps *pubSub) unsubscribe(c *client, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(c.channels, channel)
+	removeSubscriber(ps.channels, channel, c)
+	return len(c.channels) + len(c.patterns)
+}
+
+func (ps *pubSub) psubscribe(c *client, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	c.patterns[pattern] = struct{}{}
+	addSubscriber(ps.patterns, pattern, c)
+	return len(c.channels) + len(c.patterns)
+}
+
+func (ps *pubSub) punsubscribe(c *client, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(c.patterns, pattern)
+	removeSubscriber(ps.patterns, pattern, c)
+	return len(c.channels) + len(c.patterns)
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client.
+func (ps *pubSub) unsubscribeAll(c *client) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for channel := range c.channels {
+		removeSubscriber(ps.channels, channel, c)
+	}
+	for pattern := range c.patterns {
+		removeSubscriber(ps.patterns, pattern, c)
+	}
+	clear(c.channels)
+	clear(c.patterns)
+}
+
+// subscriptions returns the channels and patterns c is subscribed to, sorted.
+func (ps *pubSub) subscriptions(c *client) (channels, patterns []string) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return sortedKeys(c.channels), sortedKeys(c.patterns)
+}
+
+// subscriptionCount returns how many channels and patterns c listens to. A
+// client with subscriptions is in subscribed mode.
+func (ps *pubSub) subscriptionCount(c *client) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(c.channels) + len(c.patterns)
+}
+
+// publish delivers message to the subscribers of channel and of every pattern
+// matching it, returning the number of deliveries.
+func (ps *pubSub) publish(channel, message string) int {
+	type delivery struct {
+		c   *client
+		msg []byte
+	}
+	var deliveries []delivery
+
+	ps.mu.RLock()
+	if subscribers, ok := ps.channels[channel]; ok {
+		msg := SerializeArray([][]byte{
+			SerializeBulkString("message"),
+			SerializeBulkString(channel),
+			SerializeBulkString(message),
+		})
+		for c := range subscribers {
+			deliveries = append(deliveries, delivery{c, msg})
+		}
+	}
+	for pattern, subscribers := range ps.patterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		msg := SerializeArray([][]byte{
+			SerializeBulkString("pmessage"),
+			SerializeBulkString(pattern),
+			SerializeBulkString(channel),
+			SerializeBulkString(message),
+		})
+		for c := range subscribers {
+			deliveries = append(deliveries, delivery{c, msg})
+		}
+	}
+	ps.mu.RUnlock()
+
+	// Write outside the hub lock so a slow subscriber cannot stall
+	// subscriptions elsewhere.
+	for _, d := range deliveries {
+		d.c.push(d.msg)
+	}
+	return len(deliveries)
+}
+
+// activeChannels returns the channels with at least one subscriber,
+// optionally filtered by a glob pattern.
+func (ps *pubSub) activeChannels(pattern string, filter bool) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	channels := make([]string, 0, len(ps.channels))
+	for channel := range ps.channels {
+		if !filter || stringMatch(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (ps *pubSub) numSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.channels[channel])
+}
+
+// numPat returns the number of distinct patterns subscribed to.
+func (ps *pubSub) numPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(ps.patterns)
+}
+
+func addSubscriber(index map[string]map[*client]struct{}, name string, c *client) {
+	subscribers, ok := index[name]
+	if !ok {
+		subscribers = make(map[*client]struct{})
+		index[name] = subscribers
+	}
+	subscribers[c] = struct{}{}
+}
+
+func removeSubscriber(index map[string]map[*client]struct{}, name string, c *client) {
+	subscribers, ok := index[name]
+	if !ok {
+		return
+	}
+	delete(subscribers, c)
+	if len(subscribers) == 0 {
+		delete(index, name)
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
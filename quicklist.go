@@ -0,0 +1,398 @@
+package main
+
+// A quicklist stores a list as a doubly linked list of nodes, each holding a
+// bounded run of elements, like Redis does. Pushing and popping at either end
+// only touches the end node, so it is O(1), and finding an index skips whole
+// nodes from the nearer end. A small list is a single node whose slice is
+// sized to its elements, the compact form Redis keeps in a listpack. Popped
+// slots are cleared and emptied nodes unlinked, so their memory is reclaimed.
+
+// Node limits: a node is full at quicklistNodeMaxEntries elements or
+// quicklistNodeMaxBytes bytes of element data, whichever comes first. An
+// element larger than that gets a node of its own.
+const (
+	quicklistNodeMaxEntries = 128
+	quicklistNodeMaxBytes   = 8 << 10
+)
+
+type quicklist struct {
+	head, tail *quicklistNode
+	length     int
+}
+
+// quicklistNode holds the elements elems[off:]. The room before off makes
+// pushing at the head of a node as cheap as appending at its tail.
+type quicklistNode struct {
+	prev, next *quicklistNode
+	elems      []string
+	off        int
+	size       int // bytes of element data
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+// quicklistFrom returns a list holding elems in order.
+func quicklistFrom(elems []string) *quicklist {
+	q := newQuicklist()
+	for _, elem := range elems {
+		q.pushBack(elem)
+	}
+	return q
+}
+
+func (n *quicklistNode) len() int {
+	return len(n.elems) - n.off
+}
+
+func (n *quicklistNode) at(i int) *string {
+	return &n.elems[n.off+i]
+}
+
+// full reports whether v can not be added to the node.
+func (n *quicklistNode) full(v string) bool {
+	return n.len() >= quicklistNodeMaxEntries || n.len() > 0 && n.size+len(v) > quicklistNodeMaxBytes
+}
+
+func (n *quicklistNode) pushFront(v string) {
+	if n.off == 0 {
+		// Move the elements up, leaving as much room as they take.
+		room := min(max(n.len(), 4), quicklistNodeMaxEntries)
+		elems := make([]string, room+n.len())
+		copy(elems[room:], n.elems)
+		n.elems, n.off = elems, room
+	}
+	n.off--
+	n.elems[n.off] = v
+	n.size += len(v)
+}
+
+func (n *quicklistNode) pushBack(v string) {
+	if len(n.elems) == cap(n.elems) && n.off > 0 && n.off >= len(n.elems)/2 {
+		// Reuse the room popped at the front rather than growing, so that
+		// a node used as a queue stays the same size.
+		live := copy(n.elems, n.elems[n.off:])
+		clear(n.elems[live:])
+		n.elems, n.off = n.elems[:live], 0
+	}
+	n.elems = append(n.elems, v)
+	n.size += len(v)
+}
+
+func (n *quicklistNode) popFront() string {
+	v := n.elems[n.off]
+	n.elems[n.off] = ""
+	n.off++
+	n.size -= len(v)
+	return v
+}
+
+func (n *quicklistNode) popBack() string {
+	last := len(n.elems) - 1
+	v := n.elems[last]
+	n.elems[last] = ""
+	n.elems = n.elems[:last]
+	n.size -= len(v)
+	return v
+}
+
+func (q *quicklist) len() int {
+	return q.length
+}
+
+func (q *quicklist) pushFront(v string) {
+	if q.head == nil || q.head.full(v) {
+		n := &quicklistNode{next: q.head}
+		if q.head != nil {
+			q.head.prev = n
+		} else {
+			q.tail = n
+		}
+		q.head = n
+	}
+	q.head.pushFront(v)
+	q.length++
+}
+
+func (q *quicklist) pushBack(v string) {
+	if q.tail == nil || q.tail.full(v) {
+		n := &quicklistNode{prev: q.tail}
+		if q.tail != nil {
+			q.tail.next = n
+		} else {
+			q.head = n
+		}
+		q.tail = n
+	}
+	q.tail.pushBack(v)
+	q.length++
+}
+
+func (q *quicklist) popFront() (string, bool) {
+	if q.length == 0 {
+		return "", false
+	}
+	v := q.head.popFront()
+	if q.head.len() == 0 {
+		q.unlink(q.head)
+	}
+	q.length--
+	return v, true
+}
+
+func (q *quicklist) popBack() (string, bool) {
+	if q.length == 0 {
+		return "", false
+	}
+	v := q.tail.popBack()
+	if q.tail.len() == 0 {
+		q.unlink(q.tail)
+	}
+	q.length--
+	return v, true
+}
+
+// unlink removes a node from the list.
+func (q *quicklist) unlink(n *quicklistNode) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		q.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		q.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+}
+
+// locate returns the node holding the element at index i, which must be in
+// range, and the element's position in it. It walks from the nearer end.
+func (q *quicklist) locate(i int) (*quicklistNode, int) {
+	if i < q.length/2 {
+		n := q.head
+		for i >= n.len() {
+			i -= n.len()
+			n = n.next
+		}
+		return n, i
+	}
+	n, fromTail := q.tail, q.length-1-i
+	for fromTail >= n.len() {
+		fromTail -= n.len()
+		n = n.prev
+	}
+	return n, n.len() - 1 - fromTail
+}
+
+// index returns the element at index i, counting from 0 at the head.
+func (q *quicklist) index(i int) (string, bool) {
+	if i < 0 || i >= q.length {
+		return "", false
+	}
+	n, pos := q.locate(i)
+	return *n.at(pos), true
+}
+
+// set replaces the element at index i, and reports whether there is one.
+func (q *quicklist) set(i int, v string) bool {
+	if i < 0 || i >= q.length {
+		return false
+	}
+	n, pos := q.locate(i)
+	elem := n.at(pos)
+	n.size += len(v) - len(*elem)
+	*elem = v
+	return true
+}
+
+// rangeElems returns the elements from index start to stop inclusive, which
+// must be in range.
+func (q *quicklist) rangeElems(start, stop int) []string {
+	result := make([]string, 0, stop-start+1)
+	n, pos := q.locate(start)
+	for len(result) < cap(result) {
+		take := min(n.len()-pos, cap(result)-len(result))
+		result = append(result, n.elems[n.off+pos:n.off+pos+take]...)
+		n, pos = n.next, 0
+	}
+	return result
+}
+
+// elements returns every element in order.
+func (q *quicklist) elements() []string {
+	if q.length == 0 {
+		return nil
+	}
+	return q.rangeElems(0, q.length-1)
+}
+
+// clone returns a copy of the list, with its nodes packed.
+func (q *quicklist) clone() *quicklist {
+	return quicklistFrom(q.elements())
+}
+
+// link puts node m in the list right after n, or at the head when n is nil.
+func (q *quicklist) link(n, m *quicklistNode) {
+	m.prev = n
+	if n != nil {
+		m.next, n.next = n.next, m
+	} else {
+		m.next, q.head = q.head, m
+	}
+	if m.next != nil {
+		m.next.prev = m
+	} else {
+		q.tail = m
+	}
+}
+
+// split moves the elements of n from position pos on to a new node linked
+// after it.
+func (q *quicklist) split(n *quicklistNode, pos int) {
+	m := &quicklistNode{}
+	for n.len() > pos {
+		m.pushFront(n.popBack())
+	}
+	q.link(n, m)
+}
+
+// insertAt puts v at position pos of the node, moving the elements after it
+// up.
+func (n *quicklistNode) insertAt(pos int, v string) {
+	n.elems = append(n.elems, "")
+	copy(n.elems[n.off+pos+1:], n.elems[n.off+pos:])
+	n.elems[n.off+pos] = v
+	n.size += len(v)
+}
+
+// removeAt removes the element at position pos of the node, moving the
+// elements after it down.
+func (n *quicklistNode) removeAt(pos int) {
+	n.size -= len(*n.at(pos))
+	copy(n.elems[n.off+pos:], n.elems[n.off+pos+1:])
+	last := len(n.elems) - 1
+	n.elems[last] = ""
+	n.elems = n.elems[:last]
+}
+
+// insert puts v at index i, from 0 at the head to len at the tail, moving the
+// elements from i on one place towards the tail. A full node is split at the
+// insertion point, and v goes in a node of its own when neither half takes it.
+func (q *quicklist) insert(i int, v string) {
+	switch {
+	case i == 0:
+		q.pushFront(v)
+		return
+	case i == q.length:
+		q.pushBack(v)
+		return
+	}
+	n, pos := q.locate(i)
+	switch {
+	case !n.full(v):
+		n.insertAt(pos, v)
+	case pos == 0 && !n.prev.full(v):
+		n.prev.pushBack(v)
+	default:
+		if pos == 0 {
+			n = n.prev
+		} else {
+			q.split(n, pos)
+		}
+		if n.full(v) {
+			q.link(n, &quicklistNode{})
+			n = n.next
+		}
+		n.pushBack(v)
+	}
+	q.length++
+}
+
+// each calls fn with the index and value of each element, from the head, or
+// from the tail when reverse is set, until fn returns false.
+func (q *quicklist) each(reverse bool, fn func(i int, v string) bool) {
+	if !reverse {
+		i := 0
+		for n := q.head; n != nil; n = n.next {
+			for pos := 0; pos < n.len(); pos++ {
+				if !fn(i, *n.at(pos)) {
+					return
+				}
+				i++
+			}
+		}
+		return
+	}
+	i := q.length - 1
+	for n := q.tail; n != nil; n = n.prev {
+		for pos := n.len() - 1; pos >= 0; pos-- {
+			if !fn(i, *n.at(pos)) {
+				return
+			}
+			i--
+		}
+	}
+}
+
+// remove removes up to count elements equal to v, all of them when count is
+// 0, from the head, or from the tail when reverse is set. It returns how many
+// it removed.
+func (q *quicklist) remove(v string, count int, reverse bool) int {
+	removed := 0
+	n := q.head
+	if reverse {
+		n = q.tail
+	}
+	for n != nil && (count == 0 || removed < count) {
+		next := n.next
+		if reverse {
+			next = n.prev
+		}
+		for j := 0; j < n.len() && (count == 0 || removed < count); j++ {
+			pos := j
+			if reverse {
+				pos = n.len() - 1 - j
+			}
+			if *n.at(pos) == v {
+				// The next element to look at is now j again.
+				n.removeAt(pos)
+				removed++
+				j--
+			}
+		}
+		if n.len() == 0 {
+			q.unlink(n)
+		}
+		n = next
+	}
+	q.length -= removed
+	return removed
+}
+
+// trim keeps only the elements from index start to stop inclusive, which
+// must be in range.
+func (q *quicklist) trim(start, stop int) {
+	for drop := start; drop > 0; {
+		if n := q.head; n.len() <= drop {
+			drop -= n.len()
+			q.length -= n.len()
+			q.unlink(n)
+			continue
+		}
+		q.popFront()
+		drop--
+	}
+	for drop := q.length - (stop - start + 1); drop > 0; {
+		if n := q.tail; n.len() <= drop {
+			drop -= n.len()
+			q.length -= n.len()
+			q.unlink(n)
+			continue
+		}
+		q.popBack()
+		drop--
+	}
+}
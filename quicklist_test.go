@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// checkQuicklist checks a list against the elements it should hold, and that
+// its nodes are linked both ways, within their limits and sized right.
+func checkQuicklist(t *testing.T, q *quicklist, want []string) {
+	t.Helper()
+	if q.len() != len(want) {
+		t.Fatalf("Expected %d elements, got %d", len(want), q.len())
+	}
+	if got := q.elements(); !reflect.DeepEqual(got, want) && len(want) > 0 {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+
+	count := 0
+	var prev *quicklistNode
+	for n := q.head; n != nil; prev, n = n, n.next {
+		if n.prev != prev {
+			t.Fatal("Node linked to the wrong previous node")
+		}
+		if n.len() == 0 || n.len() > quicklistNodeMaxEntries {
+			t.Fatalf("Node with %d elements", n.len())
+		}
+		size := 0
+		for i := 0; i < n.len(); i++ {
+			size += len(*n.at(i))
+		}
+		if size != n.size {
+			t.Fatalf("Node counts %d bytes, holds %d", n.size, size)
+		}
+		if n.len() > 1 && size > quicklistNodeMaxBytes {
+			t.Fatalf("Node of %d elements holds %d bytes", n.len(), size)
+		}
+		count += n.len()
+	}
+	if q.tail != prev {
+		t.Fatal("Tail is not the last node")
+	}
+	if count != q.len() {
+		t.Fatalf("Nodes hold %d elements, list counts %d", count, q.len())
+	}
+}
+
+func TestQuicklist_PushPop(t *testing.T) {
+	q := newQuicklist()
+	var want []string
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		v := strconv.Itoa(i)
+		if rng.Intn(50) == 0 {
+			v = strings.Repeat("x", rng.Intn(2*quicklistNodeMaxBytes))
+		}
+		switch op := rng.Intn(10); {
+		case op < 3:
+			q.pushFront(v)
+			want = append([]string{v}, want...)
+		case op < 6:
+			q.pushBack(v)
+			want = append(want, v)
+		case op < 8:
+			got, ok := q.popFront()
+			if ok != (len(want) > 0) || ok && got != want[0] {
+				t.Fatalf("popFront: expected %.10q, got %.10q", want[0], got)
+			}
+			if ok {
+				want = want[1:]
+			}
+		default:
+			got, ok := q.popBack()
+			if ok != (len(want) > 0) || ok && got != want[len(want)-1] {
+				t.Fatalf("popBack: expected %.10q, got %.10q", want[len(want)-1], got)
+			}
+			if ok {
+				want = want[:len(want)-1]
+			}
+		}
+	}
+	checkQuicklist(t, q, want)
+
+	for len(want) > 0 {
+		v, _ := q.popFront()
+		if v != want[0] {
+			t.Fatalf("Expected %.10q, got %.10q", want[0], v)
+		}
+		want = want[1:]
+	}
+	if q.head != nil || q.tail != nil {
+		t.Error("Expected an empty list to have no nodes")
+	}
+}
+
+// TestQuicklist_Queue checks that a list used as a queue, where the head
+// node never empties, reuses the room popped instead of growing.
+func TestQuicklist_Queue(t *testing.T) {
+	q := newQuicklist()
+	for i := 0; i < 10; i++ {
+		q.pushBack(strconv.Itoa(i))
+	}
+	for i := 10; i < 1000000; i++ {
+		q.pushBack(strconv.Itoa(i))
+		if v, _ := q.popFront(); v != strconv.Itoa(i-10) {
+			t.Fatalf("Expected %d, got %s", i-10, v)
+		}
+	}
+	if q.head != q.tail || cap(q.head.elems) > 64 {
+		t.Errorf("Expected a single small node, got capacity %d", cap(q.head.elems))
+	}
+	checkQuicklist(t, q, []string{"999990", "999991", "999992", "999993", "999994", "999995", "999996", "999997", "999998", "999999"})
+}
+
+func TestQuicklist_IndexSetRange(t *testing.T) {
+	q := newQuicklist()
+	var want []string
+	for i := 0; i < 1000; i++ {
+		q.pushFront("l" + strconv.Itoa(i))
+		q.pushBack("r" + strconv.Itoa(i))
+		want = append([]string{"l" + strconv.Itoa(i)}, want...)
+		want = append(want, "r"+strconv.Itoa(i))
+	}
+
+	for i := range want {
+		if got, ok := q.index(i); !ok || got != want[i] {
+			t.Fatalf("index(%d): expected %q, got %q", i, want[i], got)
+		}
+	}
+	if _, ok := q.index(len(want)); ok {
+		t.Error("Expected no element past the end")
+	}
+
+	for i := 0; i < len(want); i += 7 {
+		want[i] = strings.Repeat("v", i%100)
+		if !q.set(i, want[i]) {
+			t.Fatalf("set(%d) failed", i)
+		}
+	}
+	if q.set(-1, "x") {
+		t.Error("Expected set out of range to fail")
+	}
+	checkQuicklist(t, q, want)
+
+	if got := q.rangeElems(120, 400); !reflect.DeepEqual(got, want[120:401]) {
+		t.Errorf("Unexpected range %v", got)
+	}
+	if got := q.clone().elements(); !reflect.DeepEqual(got, want) {
+		t.Error("Expected the clone to hold the same elements")
+	}
+}
+
+// TestQuicklist_SmallList checks that a small list is a single node no larger
+// than it needs to be.
+func TestQuicklist_SmallList(t *testing.T) {
+	q := quicklistFrom([]string{"a", "b", "c"})
+	if q.head != q.tail || cap(q.head.elems) > 4 {
+		t.Errorf("Expected a single node with room for 4 elements, got capacity %d", cap(q.head.elems))
+	}
+}
+
+func TestQuicklist_InsertRemoveTrim(t *testing.T) {
+	q := newQuicklist()
+	var want []string
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		v := strconv.Itoa(rng.Intn(20))
+		if rng.Intn(50) == 0 {
+			v = strings.Repeat("x", rng.Intn(2*quicklistNodeMaxBytes))
+		}
+		switch op := rng.Intn(20); {
+		case op < 14:
+			at := rng.Intn(len(want) + 1)
+			q.insert(at, v)
+			want = append(want[:at], append([]string{v}, want[at:]...)...)
+		case op < 18:
+			count, reverse := rng.Intn(3), rng.Intn(2) == 0
+			var kept []string
+			removed := 0
+			for j := range want {
+				if reverse {
+					j = len(want) - 1 - j
+				}
+				if want[j] == v && (count == 0 || removed < count) {
+					removed++
+					continue
+				}
+				kept = append(kept, want[j])
+			}
+			if reverse {
+				slices.Reverse(kept)
+			}
+			if got := q.remove(v, count, reverse); got != removed {
+				t.Fatalf("remove(%q, %d, %v): expected %d, got %d", v, count, reverse, removed, got)
+			}
+			want = kept
+		default:
+			if len(want) == 0 {
+				continue
+			}
+			start := rng.Intn(len(want))
+			stop := start + rng.Intn(len(want)-start)
+			q.trim(start, stop)
+			want = append([]string(nil), want[start:stop+1]...)
+		}
+		checkQuicklist(t, q, want)
+	}
+
+	var got []string
+	q.each(true, func(i int, v string) bool {
+		if v != want[i] {
+			t.Fatalf("each: expected %q at %d, got %q", want[i], i, v)
+		}
+		got = append(got, v)
+		return len(got) < 10
+	})
+	if len(got) != min(10, len(want)) {
+		t.Errorf("Expected each to stop after 10 elements, got %d", len(got))
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rdbVersion is the version written to new files, that of Redis 8, which
+// added the types hashes with field TTLs are saved as. Files up to
+// rdbMaxVersion can be loaded.
+const (
+	rdbVersion    = 12
+	rdbMaxVersion = 12
+)
+
+// Value types.
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeSetListpack     = 20
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+)
+
+// Opcodes.
+const (
+	rdbOpFunction2    = 245
+	rdbOpModuleAux    = 247
+	rdbOpIdle         = 248
+	rdbOpFreq         = 249
+	rdbOpAux          = 250
+	rdbOpResizeDB     = 251
+	rdbOpExpireTimeMs = 252
+	rdbOpExpireTime   = 253
+	rdbOpSelectDB     = 254
+	rdbOpEOF          = 255
+)
+
+// Length encodings.
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// crc64Table is for the Jones polynomial used by Redis, in reflected form.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Jones continues a Redis CRC-64 checksum. Unlike hash/crc64 Redis does
+// not invert the value before and after the update.
+func crc64Jones(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+// rdbPersistence is the state of SAVE and BGSAVE.
+type rdbPersistence struct {
+	mu         sync.Mutex
+	path       string
+	inProgress bool
+	lastSave   int64 // unix seconds of the last successful save
+}
+
+var errSaveInProgress = fmt.Errorf("ERR Background save already in progress")
+
+// startSave claims the right to write the dump file.
+func (p *rdbPersistence) startSave() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inProgress {
+		return errSaveInProgress
+	}
+	p.inProgress = true
+	return nil
+}
+
+func (p *rdbPersistence) finishSave(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inProgress = false
+	if err == nil {
+		p.lastSave = time.Now().Unix()
+	}
+}
+
+func (p *rdbPersistence) lastSaveTime() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSave
+}
+
+// save writes a snapshot of the databases, given in order, to the dump file.
+func (p *rdbPersistence) save(dbs ...DataStore) error {
+	if err := p.startSave(); err != nil {
+		return err
+	}
+	snaps := takeSnapshots(dbs)
+	defer closeSnapshots(snaps)
+
+	err := writeRDBFile(p.path, snaps...)
+	p.finishSave(err)
+	return err
+}
+
+// bgsave takes a snapshot of the databases, given in order, and writes it to
+// the dump file in the background.
+func (p *rdbPersistence) bgsave(dbs ...DataStore) error {
+	if err := p.startSave(); err != nil {
+		return err
+	}
+	snaps := takeSnapshots(dbs)
+
+	go func() {
+		defer closeSnapshots(snaps)
+		start := time.Now()
+		err := writeRDBFile(p.path, snaps...)
+		p.finishSave(err)
+		if err != nil {
+			log.Printf("Background saving error: %v", err)
+			return
+		}
+		log.Printf("Background saving terminated with success in %v", time.Since(start))
+	}()
+	return nil
+}
+
+// writeRDBFile writes the snapshots to a temporary file which then atomically
+// replaces path.
+func writeRDBFile(path string, snaps ...*Snapshot) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := writeRDB(w, snaps...); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeRDB writes a complete RDB file holding the snapshots, the first as
+// database 0 and so on; empty databases are left out. Each value is encoded
+// while its store is locked and written out after.
+func writeRDB(w io.Writer, snaps ...*Snapshot) error {
+	var buf bytes.Buffer
+	var crc uint64
+	flush := func() error {
+		crc = crc64Jones(crc, buf.Bytes())
+		_, err := w.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+
+	fmt.Fprintf(&buf, "REDIS%04d", rdbVersion)
+	rdbAppendAux(&buf, "redis-bits", "64")
+	rdbAppendAux(&buf, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+
+	encode := func(key string, value any, expireAt int64) {
+		if expireAt > 0 {
+			buf.WriteByte(rdbOpExpireTimeMs)
+			binary.Write(&buf, binary.LittleEndian, expireAt)
+		}
+		buf.WriteByte(rdbValueType(value))
+		rdbAppendString(&buf, key)
+		rdbAppendValue(&buf, value)
+	}
+	for dbid, snap := range snaps {
+		if snap.Len() == 0 {
+			continue
+		}
+		buf.WriteByte(rdbOpSelectDB)
+		rdbAppendLen(&buf, uint64(dbid))
+		buf.WriteByte(rdbOpResizeDB)
+		rdbAppendLen(&buf, uint64(snap.Len()))
+		rdbAppendLen(&buf, 0)
+		for snap.Next(encode) {
+			if buf.Len() >= 64*1024 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	buf.WriteByte(rdbOpEOF)
+	if err := flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc)
+}
+
+func rdbAppendAux(buf *bytes.Buffer, key, value string) {
+	buf.WriteByte(rdbOpAux)
+	rdbAppendString(buf, key)
+	rdbAppendString(buf, value)
+}
+
+func rdbAppendLen(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 1<<6:
+		buf.WriteByte(byte(n) | rdb6BitLen<<6)
+	case n < 1<<14:
+		buf.WriteByte(byte(n>>8) | rdb14BitLen<<6)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(rdb32BitLen)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(rdb64BitLen)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// rdbAppendString writes a string, as a compact integer when it is the
+// canonical form of one that fits in 32 bits.
+func rdbAppendString(buf *bytes.Buffer, s string) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				buf.WriteByte(rdbEncVal<<6 | rdbEncInt8)
+				buf.WriteByte(byte(int8(v)))
+				return
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				buf.WriteByte(rdbEncVal<<6 | rdbEncInt16)
+				binary.Write(buf, binary.LittleEndian, int16(v))
+				return
+			case v >= math.MinInt32 && v <= math.MaxInt32:
+				buf.WriteByte(rdbEncVal<<6 | rdbEncInt32)
+				binary.Write(buf, binary.LittleEndian, int32(v))
+				return
+			}
+		}
+	}
+	rdbAppendLen(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// rdbValueType returns the type byte used to save a value.
+func rdbValueType(value any) byte {
+	switch v := value.(type) {
+	case *quicklist:
+		return rdbTypeList
+	case *dict[struct{}]:
+		return rdbTypeSet
+	case *hash:
+		if len(v.expires) > 0 {
+			return rdbTypeHashMetadata
+		}
+		return rdbTypeHash
+	case *zset:
+		return rdbTypeZSet2
+	case *stream:
+		return rdbTypeStreamListpacks3
+	default:
+		return rdbTypeString
+	}
+}
+
+// rdbAppendValue writes a value in the plain encoding of its type.
+func rdbAppendValue(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case string:
+		rdbAppendString(buf, v)
+	case *quicklist:
+		rdbAppendLen(buf, uint64(v.len()))
+		for _, elem := range v.elements() {
+			rdbAppendString(buf, elem)
+		}
+	case *dict[struct{}]:
+		rdbAppendLen(buf, uint64(v.len()))
+		for member := range v.keys() {
+			rdbAppendString(buf, member)
+		}
+	case *hash:
+		if len(v.expires) > 0 {
+			rdbAppendHashMetadata(buf, v)
+			return
+		}
+		rdbAppendLen(buf, uint64(v.len()))
+		for field, val := range v.fields.all() {
+			rdbAppendString(buf, field)
+			rdbAppendString(buf, val)
+		}
+	case *zset:
+		// Highest score first, like Redis, so that loading keeps inserting
+		// at the head of the skiplist.
+		rdbAppendLen(buf, uint64(v.length()))
+		for x := v.zsl.tail; x != nil; x = x.backward {
+			rdbAppendString(buf, x.member)
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(x.score))
+		}
+	case *stream:
+		rdbAppendStream(buf, v)
+	}
+}
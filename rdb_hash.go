@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Hashes with field TTLs are saved like Redis 8 does: the earliest field
+// expiry in milliseconds, then the fields, each preceded by its expiry
+// relative to that, plus one, or 0 when it has none. Redis also keeps small
+// ones as a listpack of field, value and absolute expiry triplets, which is
+// loaded too. Fields whose TTL elapsed by the time they are loaded are
+// dropped.
+
+const (
+	rdbTypeHashMetadata   = 24
+	rdbTypeHashListpackEx = 25
+)
+
+var errHashEncoding = errors.New("invalid hash encoding in RDB file")
+
+// rdbAppendHashMetadata writes a hash that has field TTLs.
+func rdbAppendHashMetadata(buf *bytes.Buffer, h *hash) {
+	minExpire := int64(hashMaxExpireTime)
+	for _, when := range h.expires {
+		minExpire = min(minExpire, when)
+	}
+	binary.Write(buf, binary.LittleEndian, minExpire)
+	rdbAppendLen(buf, uint64(h.len()))
+	for field, value := range h.fields.all() {
+		if when, ok := h.expireTime(field); ok {
+			rdbAppendLen(buf, uint64(when-minExpire+1))
+		} else {
+			rdbAppendLen(buf, 0)
+		}
+		rdbAppendString(buf, field)
+		rdbAppendString(buf, value)
+	}
+}
+
+// readHashMetadata reads a hash saved with rdbAppendHashMetadata.
+func (r *rdbReader) readHashMetadata() (*hash, error) {
+	minExpire, err := r.readUint64()
+	if err != nil {
+		return nil, err
+	}
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+
+	h, now := newHash(), mstime()
+	for i := 0; i < n; i++ {
+		ttl, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		field, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		when := int64(minExpire + ttl - 1)
+		if ttl != 0 && when <= now {
+			continue
+		}
+		h.fields.set(field, value)
+		if ttl != 0 {
+			h.setExpire(field, when)
+		}
+	}
+	return h, nil
+}
+
+// readHashListpackEx reads a hash saved as a listpack of field, value and
+// expiry triplets, after the earliest expiry.
+func (r *rdbReader) readHashListpackEx() (*hash, error) {
+	if _, err := r.readUint64(); err != nil {
+		return nil, err
+	}
+	entries, err := r.readPacked(decodeListpack)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%3 != 0 {
+		return nil, errHashEncoding
+	}
+
+	h, now := newHash(), mstime()
+	for i := 0; i < len(entries); i += 3 {
+		when, err := strconv.ParseInt(entries[i+2], 10, 64)
+		if err != nil {
+			return nil, errHashEncoding
+		}
+		if when != 0 && when <= now {
+			continue
+		}
+		h.fields.set(entries[i], entries[i+1])
+		if when != 0 {
+			h.setExpire(entries[i], when)
+		}
+	}
+	return h, nil
+}
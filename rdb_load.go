@@ -0,0 +1,818 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+var errRDBShort = errors.New("unexpected end of RDB file")
+
+// rdbReader decodes an RDB file held in memory.
+type rdbReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *rdbReader) readN(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, errRDBShort
+	}
+	p := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return p, nil
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	p, err := r.readN(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+// readLen reads a length, or the kind of a specially encoded string when
+// encoded is set.
+func (r *rdbReader) readLen() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdb6BitLen:
+		return uint64(b & 0x3f), false, nil
+	case rdb14BitLen:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case rdbEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdb32BitLen:
+		p, err := r.readN(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case rdb64BitLen:
+		p, err := r.readN(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %#x in RDB file", b)
+}
+
+// readCount reads a length that counts elements still to be read, so it can
+// not exceed the remaining bytes.
+func (r *rdbReader) readCount() (int, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > uint64(len(r.buf)-r.pos) {
+		return 0, errRDBShort
+	}
+	return int(n), nil
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > uint64(len(r.buf)-r.pos) {
+			return "", errRDBShort
+		}
+		p, err := r.readN(int(n))
+		return string(p), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		p, err := r.readN(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p)))), nil
+	case rdbEncInt32:
+		p, err := r.readN(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p)))), nil
+	case rdbEncLZF:
+		clen, err := r.readCount()
+		if err != nil {
+			return "", err
+		}
+		ulen, _, err := r.readLen()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.readN(clen)
+		if err != nil {
+			return "", err
+		}
+		return lzfDecompress(compressed, ulen)
+	}
+	return "", fmt.Errorf("unknown string encoding %d in RDB file", n)
+}
+
+func (r *rdbReader) readUint64() (uint64, error) {
+	p, err := r.readN(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(p), nil
+}
+
+// readStringDouble reads a score of the old ZSET type, saved as text.
+func (r *rdbReader) readStringDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := r.readN(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(p), 64)
+}
+
+// lzfDecompress expands data compressed with LZF into ulen bytes.
+func lzfDecompress(in []byte, ulen uint64) (string, error) {
+	if ulen > uint64(len(in))*264 {
+		return "", errors.New("invalid LZF compressed string in RDB file")
+	}
+	out := make([]byte, 0, ulen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes.
+			ctrl++
+			if ip+ctrl > len(in) {
+				return "", errors.New("invalid LZF compressed string in RDB file")
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		// Back reference.
+		length := ctrl >> 5
+		ref := len(out) - (ctrl&0x1f)<<8 - 1
+		if length == 7 {
+			if ip >= len(in) {
+				return "", errors.New("invalid LZF compressed string in RDB file")
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return "", errors.New("invalid LZF compressed string in RDB file")
+		}
+		ref -= int(in[ip])
+		ip++
+		if ref < 0 {
+			return "", errors.New("invalid LZF compressed string in RDB file")
+		}
+		// The reference may overlap the bytes being written.
+		for i := 0; i < length+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if uint64(len(out)) != ulen {
+		return "", errors.New("invalid LZF compressed string in RDB file")
+	}
+	return string(out), nil
+}
+
+// loadRDBFile loads the dump file at path into the databases, given in
+// order, and returns the number of keys read. A missing file is not an
+// error: the server starts empty.
+func loadRDBFile(path string, dbs ...DataStore) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return loadRDB(data, dbs...)
+}
+
+// loadRDB loads a complete RDB file into the databases, given in order. Keys
+// that have already expired are skipped.
+func loadRDB(data []byte, dbs ...DataStore) (int, error) {
+	r := &rdbReader{buf: data}
+	header, err := r.readN(9)
+	if err != nil || string(header[:5]) != "REDIS" {
+		return 0, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return 0, fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	var (
+		loaded   int
+		db       uint64
+		expireAt int64
+		now      = mstime()
+	)
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return loaded, err
+		}
+
+		switch opcode {
+		case rdbOpEOF:
+			return loaded, r.verifyChecksum(version)
+		case rdbOpSelectDB:
+			if db, _, err = r.readLen(); err != nil {
+				return loaded, err
+			}
+			if db >= uint64(len(dbs)) {
+				return loaded, fmt.Errorf("FATAL: Data file was created with a Redis server configured to handle more than %d databases", len(dbs))
+			}
+		case rdbOpResizeDB:
+			if _, _, err = r.readLen(); err == nil {
+				_, _, err = r.readLen()
+			}
+		case rdbOpExpireTimeMs:
+			var ms uint64
+			ms, err = r.readUint64()
+			expireAt = int64(ms)
+		case rdbOpExpireTime:
+			var p []byte
+			if p, err = r.readN(4); err == nil {
+				expireAt = int64(int32(binary.LittleEndian.Uint32(p))) * 1000
+			}
+		case rdbOpIdle:
+			_, _, err = r.readLen()
+		case rdbOpFreq:
+			_, err = r.readByte()
+		case rdbOpAux:
+			if _, err = r.readString(); err == nil {
+				_, err = r.readString()
+			}
+		case rdbOpFunction2:
+			_, err = r.readString()
+		case rdbOpModuleAux:
+			return loaded, errors.New("can't load module data from RDB file")
+		default:
+			key, value, kerr := r.readObject(opcode)
+			if kerr != nil {
+				return loaded, kerr
+			}
+			if value != nil && (expireAt == 0 || expireAt > now) {
+				dbs[db].RestoreKey(key, value, expireAt)
+				loaded++
+			}
+			expireAt = 0
+			continue
+		}
+		if err != nil {
+			return loaded, err
+		}
+	}
+}
+
+// verifyChecksum checks the CRC-64 following the EOF opcode. Files written
+// with checksums disabled carry a zero checksum.
+func (r *rdbReader) verifyChecksum(version int) error {
+	if version < 5 {
+		return nil
+	}
+	end := r.pos
+	expected, err := r.readUint64()
+	if err != nil {
+		return err
+	}
+	if expected != 0 && crc64Jones(0, r.buf[:end]) != expected {
+		return errors.New("wrong RDB checksum")
+	}
+	return nil
+}
+
+// readObject reads a key and its value of the given type. The value is nil
+// when it turns out to be empty.
+func (r *rdbReader) readObject(typ byte) (string, any, error) {
+	key, err := r.readString()
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := r.readValue(typ)
+	return key, value, err
+}
+
+// readValue reads a value of the given type, returning nil when it turns out
+// to be empty.
+func (r *rdbReader) readValue(typ byte) (any, error) {
+	var value any
+	var err error
+	switch typ {
+	case rdbTypeString:
+		value, err = r.readString()
+	case rdbTypeList:
+		var elems []string
+		if elems, err = r.readStrings(); err == nil {
+			value = quicklistFrom(elems)
+		}
+	case rdbTypeSet:
+		var members []string
+		if members, err = r.readStrings(); err == nil {
+			value = setFromMembers(members)
+		}
+	case rdbTypeZSet, rdbTypeZSet2:
+		value, err = r.readZSet(typ == rdbTypeZSet2)
+	case rdbTypeHash:
+		var pairs []string
+		if pairs, err = r.readStrings2(); err == nil {
+			value = hashFromPairs(pairs)
+		}
+	case rdbTypeHashZipmap:
+		var pairs []string
+		if pairs, err = r.readZipmap(); err == nil {
+			value = hashFromPairs(pairs)
+		}
+	case rdbTypeListZiplist:
+		var elems []string
+		if elems, err = r.readPacked(decodeZiplist); err == nil {
+			value = quicklistFrom(elems)
+		}
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		var elems []string
+		if elems, err = r.readQuicklist(typ == rdbTypeListQuicklist2); err == nil {
+			value = quicklistFrom(elems)
+		}
+	case rdbTypeSetIntset:
+		var members []string
+		if members, err = r.readPacked(decodeIntset); err == nil {
+			value = setFromMembers(members)
+		}
+	case rdbTypeSetListpack:
+		var members []string
+		if members, err = r.readPacked(decodeListpack); err == nil {
+			value = setFromMembers(members)
+		}
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		var pairs []string
+		if pairs, err = r.readPacked(packedDecoder(typ == rdbTypeHashListpack)); err == nil {
+			if len(pairs)%2 != 0 {
+				return nil, errors.New("invalid hash encoding in RDB file")
+			}
+			value = hashFromPairs(pairs)
+		}
+	case rdbTypeHashMetadata:
+		value, err = r.readHashMetadata()
+	case rdbTypeHashListpackEx:
+		value, err = r.readHashListpackEx()
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		var pairs []string
+		if pairs, err = r.readPacked(packedDecoder(typ == rdbTypeZSetListpack)); err == nil {
+			value, err = zsetFromPairs(pairs)
+		}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		value, err = r.readStream(typ)
+	default:
+		return nil, fmt.Errorf("unsupported object type %d in RDB file", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isEmptyValue(value) {
+		return nil, nil
+	}
+	return value, nil
+}
+
+func packedDecoder(listpack bool) func([]byte) ([]string, error) {
+	if listpack {
+		return decodeListpack
+	}
+	return decodeZiplist
+}
+
+// readStrings reads a length prefixed sequence of strings.
+func (r *rdbReader) readStrings() ([]string, error) {
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// readStrings2 reads a length prefixed sequence of string pairs.
+func (r *rdbReader) readStrings2() ([]string, error) {
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, 2*n)
+	for i := 0; i < 2*n; i++ {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func (r *rdbReader) readZSet(binaryScores bool) (*zset, error) {
+	n, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	zs := newZSet()
+	for i := 0; i < n; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScores {
+			var bits uint64
+			bits, err = r.readUint64()
+			score = math.Float64frombits(bits)
+		} else {
+			score, err = r.readStringDouble()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, errors.New("zset with NAN score detected in RDB file")
+		}
+		zs.set(member, score)
+	}
+	return zs, nil
+}
+
+// readPacked reads a string holding a packed encoding and decodes it.
+func (r *rdbReader) readPacked(decode func([]byte) ([]string, error)) ([]string, error) {
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(s))
+}
+
+// readQuicklist reads a list saved as a sequence of ziplist nodes or, in the
+// newer format, of listpack and plain nodes.
+func (r *rdbReader) readQuicklist(v2 bool) ([]string, error) {
+	nodes, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for i := 0; i < nodes; i++ {
+		container := uint64(rdbQuicklistNodePacked)
+		if v2 {
+			if container, _, err = r.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		node, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case container == rdbQuicklistNodePlain:
+			list = append(list, node)
+		case container != rdbQuicklistNodePacked:
+			return nil, fmt.Errorf("unknown quicklist node container %d in RDB file", container)
+		case v2:
+			elems, err := decodeListpack([]byte(node))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elems...)
+		default:
+			elems, err := decodeZiplist([]byte(node))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elems...)
+		}
+	}
+	return list, nil
+}
+
+// readZipmap reads a hash in the zipmap encoding of old RDB versions.
+func (r *rdbReader) readZipmap() ([]string, error) {
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	zm := &rdbReader{buf: []byte(s)}
+	if _, err := zm.readByte(); err != nil {
+		return nil, err
+	}
+
+	readLen := func() (int, bool, error) {
+		b, err := zm.readByte()
+		switch {
+		case err != nil:
+			return 0, false, err
+		case b == 255:
+			return 0, true, nil
+		case b == 254:
+			p, err := zm.readN(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return int(binary.LittleEndian.Uint32(p)), false, nil
+		}
+		return int(b), false, nil
+	}
+
+	var pairs []string
+	for {
+		klen, end, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return pairs, nil
+		}
+		field, err := zm.readN(klen)
+		if err != nil {
+			return nil, err
+		}
+		vlen, end, err := readLen()
+		if err != nil || end {
+			return nil, errors.New("invalid zipmap in RDB file")
+		}
+		free, err := zm.readByte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := zm.readN(vlen)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zm.readN(int(free)); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, string(field), string(value))
+	}
+}
+
+// decodeZiplist returns the entries of a ziplist.
+func decodeZiplist(zl []byte) ([]string, error) {
+	r := &rdbReader{buf: zl}
+	if _, err := r.readN(10); err != nil { // zlbytes, zltail, zllen
+		return nil, err
+	}
+
+	var entries []string
+	for {
+		prevlen, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if prevlen == 0xff {
+			return entries, nil
+		}
+		if prevlen == 0xfe {
+			if _, err := r.readN(4); err != nil {
+				return nil, err
+			}
+		}
+
+		enc, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		var entry string
+		switch {
+		case enc>>6 == 0:
+			entry, err = r.readRawString(int(enc & 0x3f))
+		case enc>>6 == 1:
+			var next byte
+			if next, err = r.readByte(); err == nil {
+				entry, err = r.readRawString(int(enc&0x3f)<<8 | int(next))
+			}
+		case enc == 0x80:
+			var p []byte
+			if p, err = r.readN(4); err == nil {
+				entry, err = r.readRawString(int(binary.BigEndian.Uint32(p)))
+			}
+		case enc == 0xc0:
+			entry, err = r.readIntLE(2)
+		case enc == 0xd0:
+			entry, err = r.readIntLE(4)
+		case enc == 0xe0:
+			entry, err = r.readIntLE(8)
+		case enc == 0xf0:
+			entry, err = r.readIntLE(3)
+		case enc == 0xfe:
+			entry, err = r.readIntLE(1)
+		case enc >= 0xf1 && enc <= 0xfd:
+			entry = strconv.Itoa(int(enc&0x0f) - 1)
+		default:
+			err = fmt.Errorf("invalid ziplist entry encoding %#x in RDB file", enc)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// decodeListpack returns the entries of a listpack.
+func decodeListpack(lp []byte) ([]string, error) {
+	r := &rdbReader{buf: lp}
+	if _, err := r.readN(6); err != nil { // total bytes, number of elements
+		return nil, err
+	}
+
+	var entries []string
+	for {
+		start := r.pos
+		enc, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if enc == 0xff {
+			return entries, nil
+		}
+
+		var entry string
+		switch {
+		case enc&0x80 == 0:
+			entry = strconv.Itoa(int(enc))
+		case enc&0xc0 == 0x80:
+			entry, err = r.readRawString(int(enc & 0x3f))
+		case enc&0xe0 == 0xc0:
+			var next byte
+			if next, err = r.readByte(); err == nil {
+				v := int(enc&0x1f)<<8 | int(next)
+				if v >= 1<<12 {
+					v -= 1 << 13
+				}
+				entry = strconv.Itoa(v)
+			}
+		case enc&0xf0 == 0xe0:
+			var next byte
+			if next, err = r.readByte(); err == nil {
+				entry, err = r.readRawString(int(enc&0x0f)<<8 | int(next))
+			}
+		case enc == 0xf0:
+			var p []byte
+			if p, err = r.readN(4); err == nil {
+				entry, err = r.readRawString(int(binary.LittleEndian.Uint32(p)))
+			}
+		case enc == 0xf1:
+			entry, err = r.readIntLE(2)
+		case enc == 0xf2:
+			entry, err = r.readIntLE(3)
+		case enc == 0xf3:
+			entry, err = r.readIntLE(4)
+		case enc == 0xf4:
+			entry, err = r.readIntLE(8)
+		default:
+			err = fmt.Errorf("invalid listpack entry encoding %#x in RDB file", enc)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := r.readN(listpackBacklenSize(r.pos - start)); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// listpackBacklenSize returns how many bytes the back length of a listpack
+// entry of the given size takes, matching lpEncodeBacklen.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// decodeIntset returns the members of an intset.
+func decodeIntset(is []byte) ([]string, error) {
+	r := &rdbReader{buf: is}
+	header, err := r.readN(8)
+	if err != nil {
+		return nil, err
+	}
+	width := int(binary.LittleEndian.Uint32(header))
+	n := int(binary.LittleEndian.Uint32(header[4:]))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("invalid intset encoding %d in RDB file", width)
+	}
+	if n > (len(is)-8)/width {
+		return nil, errRDBShort
+	}
+
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		member, err := r.readIntLE(width)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (r *rdbReader) readRawString(n int) (string, error) {
+	p, err := r.readN(n)
+	return string(p), err
+}
+
+// readIntLE reads a signed little endian integer of 1 to 8 bytes.
+func (r *rdbReader) readIntLE(size int) (string, error) {
+	p, err := r.readN(size)
+	if err != nil {
+		return "", err
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	shift := 64 - 8*size
+	return strconv.FormatInt(int64(v<<shift)>>shift, 10), nil
+}
+
+func setFromMembers(members []string) *dict[struct{}] {
+	set := newDict[struct{}]()
+	for _, member := range members {
+		set.set(member, struct{}{})
+	}
+	return set
+}
+
+func zsetFromPairs(pairs []string) (*zset, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("invalid zset encoding in RDB file")
+	}
+	zs := newZSet()
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, errors.New("invalid zset score in RDB file")
+		}
+		zs.set(pairs[i], score)
+	}
+	return zs, nil
+}
+
+func isEmptyValue(value any) bool {
+	switch v := value.(type) {
+	case *quicklist:
+		return v.len() == 0
+	case *dict[struct{}]:
+		return v.len() == 0
+	case *hash:
+		return v.len() == 0
+	case *zset:
+		return v.length() == 0
+	}
+	return false
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Streams are saved like Redis does: as a sequence of listpack nodes keyed
+// by their master ID, followed by the stream's metadata and its consumer
+// groups. Each node starts with a master entry holding the fields of its
+// first entry, and entries with the same fields only store their values.
+
+const (
+	rdbTypeStreamListpacks  = 15
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeStreamListpacks3 = 21
+
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+var errStreamEncoding = errors.New("invalid stream encoding in RDB file")
+
+// listpackBuilder encodes a listpack.
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	// Room for the total bytes and the number of elements.
+	return &listpackBuilder{buf: make([]byte, 6)}
+}
+
+// appendInt appends an integer in the smallest encoding that holds it.
+func (lp *listpackBuilder) appendInt(v int64) {
+	start := len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint16(v) & 0x1fff
+		lp.buf = append(lp.buf, 0xc0|byte(u>>8), byte(u))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		lp.buf = append(lp.buf, 0xf1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		u := uint32(v)
+		lp.buf = append(lp.buf, 0xf2, byte(u), byte(u>>8), byte(u>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		lp.buf = append(lp.buf, 0xf3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, 0xf4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.finishEntry(start)
+}
+
+// appendString appends a string, as an integer when it is the canonical form
+// of one.
+func (lp *listpackBuilder) appendString(s string) {
+	if len(s) <= 20 {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+			lp.appendInt(v)
+			return
+		}
+	}
+
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 1<<6:
+		lp.buf = append(lp.buf, 0x80|byte(n))
+	case n < 1<<12:
+		lp.buf = append(lp.buf, 0xe0|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xf0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.finishEntry(start)
+}
+
+// finishEntry appends the back length of the entry starting at start, like
+// lpEncodeBacklen.
+func (lp *listpackBuilder) finishEntry(start int) {
+	size := len(lp.buf) - start
+	n := listpackBacklenSize(size)
+	lp.buf = append(lp.buf, byte(size>>(7*(n-1))))
+	for i := n - 2; i >= 0; i-- {
+		lp.buf = append(lp.buf, byte(size>>(7*i))&0x7f|0x80)
+	}
+	lp.count++
+}
+
+// bytes terminates the listpack and returns it.
+func (lp *listpackBuilder) bytes() []byte {
+	lp.buf = append(lp.buf, 0xff)
+	binary.LittleEndian.PutUint32(lp.buf, uint32(len(lp.buf)))
+	binary.LittleEndian.PutUint16(lp.buf[4:], uint16(min(lp.count, math.MaxUint16)))
+	return lp.buf
+}
+
+// rdbStreamID returns the 16 byte big endian form of an ID that keys nodes.
+func rdbStreamID(id StreamID) string {
+	var p [16]byte
+	binary.BigEndian.PutUint64(p[:], id.Ms)
+	binary.BigEndian.PutUint64(p[8:], id.Seq)
+	return string(p[:])
+}
+
+// rdbAppendStream writes a stream as a STREAM_LISTPACKS_3 value, one node per
+// chunk.
+func rdbAppendStream(buf *bytes.Buffer, s *stream) {
+	rdbAppendLen(buf, uint64(len(s.chunks)))
+	for _, chunk := range s.chunks {
+		master := chunk[0]
+		rdbAppendString(buf, rdbStreamID(master.ID))
+
+		lp := newListpackBuilder()
+		masterFields := make([]string, 0, len(master.Fields)/2)
+		for i := 0; i < len(master.Fields); i += 2 {
+			masterFields = append(masterFields, master.Fields[i])
+		}
+		lp.appendInt(int64(len(chunk)))
+		lp.appendInt(0) // deleted entries
+		lp.appendInt(int64(len(masterFields)))
+		for _, field := range masterFields {
+			lp.appendString(field)
+		}
+		lp.appendInt(0)
+
+		for _, entry := range chunk {
+			sameFields := len(entry.Fields) == 2*len(masterFields)
+			for i := 0; sameFields && i < len(masterFields); i++ {
+				sameFields = entry.Fields[2*i] == masterFields[i]
+			}
+
+			numFields := len(entry.Fields) / 2
+			if sameFields {
+				lp.appendInt(streamItemFlagSameFields)
+			} else {
+				lp.appendInt(0)
+			}
+			lp.appendInt(int64(entry.ID.Ms - master.ID.Ms))
+			lp.appendInt(int64(entry.ID.Seq - master.ID.Seq))
+			if sameFields {
+				for i := 1; i < len(entry.Fields); i += 2 {
+					lp.appendString(entry.Fields[i])
+				}
+				lp.appendInt(int64(numFields + 3))
+			} else {
+				lp.appendInt(int64(numFields))
+				for _, s := range entry.Fields {
+					lp.appendString(s)
+				}
+				lp.appendInt(int64(2*numFields + 4))
+			}
+		}
+		rdbAppendString(buf, string(lp.bytes()))
+	}
+
+	rdbAppendLen(buf, uint64(s.length))
+	rdbAppendLen(buf, s.lastID.Ms)
+	rdbAppendLen(buf, s.lastID.Seq)
+	first := s.firstID()
+	rdbAppendLen(buf, first.Ms)
+	rdbAppendLen(buf, first.Seq)
+	rdbAppendLen(buf, s.maxDeletedID.Ms)
+	rdbAppendLen(buf, s.maxDeletedID.Seq)
+	rdbAppendLen(buf, s.entriesAdded)
+	rdbAppendStreamGroups(buf, s)
+}
+
+// rdbAppendStreamGroups writes the consumer groups of a stream in the
+// STREAM_LISTPACKS_3 form: each group's entries read counter and PEL with the
+// delivery times and counts, then its consumers with their seen and active
+// times and the IDs of their pending entries.
+func rdbAppendStreamGroups(buf *bytes.Buffer, s *stream) {
+	rdbAppendLen(buf, uint64(len(s.groups)))
+	for _, name := range s.groupNames() {
+		g := s.groups[name]
+		rdbAppendString(buf, name)
+		rdbAppendLen(buf, g.lastID.Ms)
+		rdbAppendLen(buf, g.lastID.Seq)
+		rdbAppendLen(buf, uint64(g.entriesRead))
+
+		rdbAppendLen(buf, uint64(g.pel.len()))
+		for _, id := range g.pel.ids {
+			nack := g.pel.nacks[id]
+			buf.WriteString(rdbStreamID(id))
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(nack.deliveryTime)))
+			rdbAppendLen(buf, nack.deliveryCount)
+		}
+
+		rdbAppendLen(buf, uint64(len(g.consumers)))
+		for _, consumerName := range g.consumerNames() {
+			consumer := g.consumers[consumerName]
+			rdbAppendString(buf, consumerName)
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(consumer.seenTime)))
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(consumer.activeTime)))
+			rdbAppendLen(buf, uint64(consumer.pel.len()))
+			for _, id := range consumer.pel.ids {
+				buf.WriteString(rdbStreamID(id))
+			}
+		}
+	}
+}
+
+// readStream reads a stream saved with one of the STREAM_LISTPACKS types.
+func (r *rdbReader) readStream(typ byte) (*stream, error) {
+	nodes, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	s := newStream()
+	for i := 0; i < nodes; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errStreamEncoding
+		}
+		master := readRawStreamID([]byte(key))
+
+		elems, err := r.readPacked(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		if err := readStreamNode(s, master, elems); err != nil {
+			return nil, err
+		}
+	}
+
+	length, _, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(s.length) {
+		return nil, errStreamEncoding
+	}
+	if s.lastID, err = r.readStreamID(); err != nil {
+		return nil, err
+	}
+	s.entriesAdded = uint64(s.length)
+	if typ != rdbTypeStreamListpacks {
+		// The first ID, which is known from the entries.
+		if _, err := r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.maxDeletedID, err = r.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.entriesAdded, _, err = r.readLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.readStreamGroups(s, typ); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	ms, _, err := r.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := r.readLen()
+	return StreamID{ms, seq}, err
+}
+
+// readStreamNode adds the entries of a node that are not deleted to s.
+func readStreamNode(s *stream, master StreamID, elems []string) error {
+	pos := 0
+	next := func() (int64, error) {
+		if pos >= len(elems) {
+			return 0, errStreamEncoding
+		}
+		pos++
+		v, err := strconv.ParseInt(elems[pos-1], 10, 64)
+		if err != nil {
+			return 0, errStreamEncoding
+		}
+		return v, nil
+	}
+	take := func(n int64) ([]string, error) {
+		if n < 0 || n > int64(len(elems)-pos) {
+			return nil, errStreamEncoding
+		}
+		pos += int(n)
+		return elems[pos-int(n) : pos], nil
+	}
+
+	if _, err := next(); err != nil { // valid entries
+		return err
+	}
+	if _, err := next(); err != nil { // deleted entries
+		return err
+	}
+	numMasterFields, err := next()
+	if err != nil {
+		return err
+	}
+	masterFields, err := take(numMasterFields)
+	if err != nil {
+		return err
+	}
+	if _, err := next(); err != nil { // the master entry's terminator
+		return err
+	}
+
+	for pos < len(elems) {
+		flags, err := next()
+		if err != nil {
+			return err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return err
+		}
+		id := StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}
+
+		var fields []string
+		if flags&streamItemFlagSameFields != 0 {
+			values, err := take(int64(len(masterFields)))
+			if err != nil {
+				return err
+			}
+			fields = make([]string, 0, 2*len(values))
+			for i, value := range values {
+				fields = append(fields, masterFields[i], value)
+			}
+		} else {
+			numFields, err := next()
+			if err != nil {
+				return err
+			}
+			pairs, err := take(2 * numFields)
+			if err != nil {
+				return err
+			}
+			fields = append([]string(nil), pairs...)
+		}
+		if _, err := next(); err != nil { // lp-count
+			return err
+		}
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		if s.length > 0 && id.compare(s.lastID) <= 0 {
+			return errStreamEncoding
+		}
+		s.add(StreamEntry{ID: id, Fields: fields})
+	}
+	return nil
+}
+
+// readStreamGroups reads the consumer groups of a stream. The types before
+// STREAM_LISTPACKS_2 have no entries read counters, which are then estimated,
+// and those before STREAM_LISTPACKS_3 no consumer active times, which are
+// taken to be the seen times.
+func (r *rdbReader) readStreamGroups(s *stream, typ byte) error {
+	groups, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < groups; i++ {
+		name, err := r.readString()
+		if err != nil {
+			return err
+		}
+		lastID, err := r.readStreamID()
+		if err != nil {
+			return err
+		}
+		entriesRead := s.estimateEntriesRead(lastID)
+		if typ != rdbTypeStreamListpacks {
+			read, _, err := r.readLen()
+			if err != nil {
+				return err
+			}
+			entriesRead = int64(read)
+		}
+		g, created := s.createGroup(name, lastID, entriesRead)
+		if !created {
+			return errStreamEncoding
+		}
+
+		pending, err := r.readCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pending; j++ {
+			raw, err := r.readN(16 + 8)
+			if err != nil {
+				return err
+			}
+			count, _, err := r.readLen()
+			if err != nil {
+				return err
+			}
+			id := readRawStreamID(raw)
+			if _, exists := g.pel.nacks[id]; exists {
+				return errStreamEncoding
+			}
+			g.pel.add(id, &streamNACK{
+				deliveryTime:  int64(binary.LittleEndian.Uint64(raw[16:])),
+				deliveryCount: count,
+			})
+		}
+
+		consumers, err := r.readCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			consumerName, err := r.readString()
+			if err != nil {
+				return err
+			}
+			times := 8
+			if typ == rdbTypeStreamListpacks3 {
+				times += 8
+			}
+			raw, err := r.readN(times)
+			if err != nil {
+				return err
+			}
+			consumer, created := g.createConsumer(consumerName, int64(binary.LittleEndian.Uint64(raw)))
+			if !created {
+				return errStreamEncoding
+			}
+			consumer.activeTime = consumer.seenTime
+			if typ == rdbTypeStreamListpacks3 {
+				consumer.activeTime = int64(binary.LittleEndian.Uint64(raw[8:]))
+			}
+
+			owned, err := r.readCount()
+			if err != nil {
+				return err
+			}
+			for k := 0; k < owned; k++ {
+				raw, err := r.readN(16)
+				if err != nil {
+					return err
+				}
+				// Every entry a consumer owns is in the group's PEL, once.
+				id := readRawStreamID(raw)
+				nack := g.pel.nacks[id]
+				if nack == nil || nack.consumer != nil {
+					return errStreamEncoding
+				}
+				nack.consumer = consumer
+				consumer.pel.add(id, nack)
+			}
+		}
+
+		for _, id := range g.pel.ids {
+			if g.pel.nacks[id].consumer == nil {
+				return errStreamEncoding
+			}
+		}
+	}
+	return nil
+}
+
+// readRawStreamID decodes the 16 byte big endian form of an ID.
+func readRawStreamID(raw []byte) StreamID {
+	return StreamID{binary.BigEndian.Uint64(raw), binary.BigEndian.Uint64(raw[8:16])}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCRC64Jones(t *testing.T) {
+	if crc := crc64Jones(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected 0xe9c6d914c4b8d9ca, got %#x", crc)
+	}
+	// The checksum can be computed piecewise.
+	if crc := crc64Jones(crc64Jones(0, []byte("1234")), []byte("56789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected piecewise checksum to match, got %#x", crc)
+	}
+}
+
+func dumpRDB(t *testing.T, s DataStore) []byte {
+	t.Helper()
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, snap); err != nil {
+		t.Fatalf("writeRDB: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func fillTestStore(s DataStore) {
+	s.Set("str", "hello")
+	s.Set("int", "-12345")
+	s.Set("big", "98765432101234")
+	s.Set("long", strings.Repeat("x", 20000))
+	s.RPush("list", "a", "1", "b")
+	s.SAdd("set", "m1", "m2", "300")
+	s.HSet("hash", "f1", "v1")
+	s.HSet("hash", "f2", "")
+	s.ZAdd("zset", ZAddOptions{}, ScoredMember{Member: "low", Score: math.Inf(-1)},
+		ScoredMember{Member: "mid", Score: 1.5}, ScoredMember{Member: "high", Score: math.Inf(1)})
+	s.XAdd("stream", XAddArgs{ID: StreamID{1, 1}}, []string{"f", "1", "g", "a"})
+	s.XAdd("stream", XAddArgs{ID: StreamID{1, 2}}, []string{"f", "2", "g", "b"})
+	s.XAdd("stream", XAddArgs{ID: StreamID{5, 0}}, []string{"other", "x"})
+	s.XAdd("stream", XAddArgs{ID: StreamID{9, 0}}, []string{"f", "3"})
+	s.XDel("stream", StreamID{9, 0})
+	s.XGroupCreate("stream", "group", StreamID{1, 1}, streamEntriesReadUnknown, false)
+	s.XReadGroup("stream", "group", "reader", XReadGroupArgs{Count: 1})
+	s.XGroupCreateConsumer("stream", "group", "idle")
+	s.Set("ttl", "v")
+	s.Expire("ttl", mstime()+60000, 0)
+}
+
+func checkTestStore(t *testing.T, s DataStore) {
+	t.Helper()
+	for key, want := range map[string]string{"str": "hello", "int": "-12345", "big": "98765432101234", "long": strings.Repeat("x", 20000)} {
+		if got, _, _ := s.Get(key); got != want {
+			t.Errorf("%s: expected %.20q, got %.20q", key, want, got)
+		}
+	}
+	if list, _ := s.LRange("list", 0, -1); !reflect.DeepEqual(list, []string{"a", "1", "b"}) {
+		t.Errorf("Unexpected list %v", list)
+	}
+	members, _ := s.SMembers("set")
+	sort.Strings(members)
+	if !reflect.DeepEqual(members, []string{"300", "m1", "m2"}) {
+		t.Errorf("Unexpected set %v", members)
+	}
+	if hash, _ := s.HGetAll("hash"); !reflect.DeepEqual(hash, map[string]string{"f1": "v1", "f2": ""}) {
+		t.Errorf("Unexpected hash %v", hash)
+	}
+	zrange, _ := s.ZRange("zset", ZRangeQuery{Start: 0, Stop: -1})
+	want := []ScoredMember{{"low", math.Inf(-1)}, {"mid", 1.5}, {"high", math.Inf(1)}}
+	if !reflect.DeepEqual(zrange, want) {
+		t.Errorf("Unexpected zset %v", zrange)
+	}
+	entries, _ := s.XRange("stream", StreamID{}, maxStreamID, 0, false)
+	wantEntries := []StreamEntry{
+		{StreamID{1, 1}, []string{"f", "1", "g", "a"}},
+		{StreamID{1, 2}, []string{"f", "2", "g", "b"}},
+		{StreamID{5, 0}, []string{"other", "x"}},
+	}
+	if !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("Unexpected stream %v", entries)
+	}
+	if lastID, _, _ := s.XLastID("stream"); lastID != (StreamID{9, 0}) {
+		t.Errorf("Expected the stream's last ID to be 9-0, got %v", lastID)
+	}
+	pending, _ := s.XPending("stream", "group", PendingQuery{End: maxStreamID, Count: 10})
+	if len(pending) != 1 || pending[0].ID != (StreamID{1, 2}) || pending[0].Consumer != "reader" || pending[0].DeliveryCount != 1 {
+		t.Errorf("Unexpected pending entries %v", pending)
+	}
+	consumers, _ := s.XInfoConsumers("stream", "group")
+	if len(consumers) != 2 || consumers[0].Name != "idle" || consumers[1].Name != "reader" {
+		t.Errorf("Unexpected consumers %v", consumers)
+	}
+	if when := s.ExpireTime("ttl"); when <= mstime() {
+		t.Errorf("Expected ttl to keep its expiry, got %d", when)
+	}
+	if when := s.ExpireTime("str"); when != -1 {
+		t.Errorf("Expected str to have no expiry, got %d", when)
+	}
+}
+
+func TestRDB_RoundTrip(t *testing.T) {
+	src := newStore()
+	fillTestStore(src)
+	src.RestoreKey("expired", "gone", mstime()-1000)
+
+	data := dumpRDB(t, src)
+	if !bytes.HasPrefix(data, []byte("REDIS0012")) {
+		t.Fatalf("Unexpected header %q", data[:9])
+	}
+
+	dst := newStore()
+	loaded, err := loadRDB(data, dst)
+	if err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	if loaded != 10 {
+		t.Errorf("Expected 10 keys loaded, got %d", loaded)
+	}
+	if dst.Exists("expired") {
+		t.Error("Expected the expired key to be skipped")
+	}
+	checkTestStore(t, dst)
+}
+
+func TestRDB_Checksum(t *testing.T) {
+	src := newStore()
+	src.Set("key", "value")
+	data := dumpRDB(t, src)
+
+	// Corrupt the value.
+	i := bytes.Index(data, []byte("value"))
+	data[i] = 'V'
+	if _, err := loadRDB(data, newStore()); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+
+	// A zero checksum means checksums were disabled when saving.
+	binary.LittleEndian.PutUint64(data[len(data)-8:], 0)
+	dst := newStore()
+	if _, err := loadRDB(data, dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	if v, _, _ := dst.Get("key"); v != "Value" {
+		t.Errorf("Expected Value, got %q", v)
+	}
+
+	if _, err := loadRDB(data[:len(data)-10], newStore()); err == nil {
+		t.Error("Expected an error for a truncated file")
+	}
+}
+
+// testListpack encodes short strings and small integers as a listpack.
+func testListpack(entries ...any) string {
+	var body []byte
+	for _, e := range entries {
+		var entry []byte
+		switch v := e.(type) {
+		case int:
+			if v >= 0 && v < 128 {
+				entry = []byte{byte(v)}
+			} else {
+				u := uint16(v) & 0x1fff
+				entry = []byte{0xc0 | byte(u>>8), byte(u)}
+			}
+		case string:
+			entry = append([]byte{0x80 | byte(len(v))}, v...)
+		}
+		body = append(body, entry...)
+		body = append(body, byte(len(entry)))
+	}
+	lp := make([]byte, 6, 7+len(body))
+	binary.LittleEndian.PutUint32(lp, uint32(7+len(body)))
+	binary.LittleEndian.PutUint16(lp[4:], uint16(len(entries)))
+	return string(append(append(lp, body...), 0xff))
+}
+
+// testZiplist encodes short strings and integers as a ziplist.
+func testZiplist(entries ...any) string {
+	zl := make([]byte, 10)
+	prevlen := 0
+	for _, e := range entries {
+		var entry []byte
+		switch v := e.(type) {
+		case int:
+			if v >= 0 && v <= 12 {
+				entry = []byte{0xf1 + byte(v)}
+			} else {
+				entry = []byte{0xc0, byte(v), byte(v >> 8)}
+			}
+		case string:
+			entry = append([]byte{byte(len(v))}, v...)
+		}
+		entry = append([]byte{byte(prevlen)}, entry...)
+		prevlen = len(entry)
+		zl = append(zl, entry...)
+	}
+	binary.LittleEndian.PutUint16(zl[8:], uint16(len(entries)))
+	return string(append(zl, 0xff))
+}
+
+func TestRDB_LoadEncodings(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("REDIS0011")
+	rdbAppendAux(&buf, "redis-ver", "7.2.0")
+	buf.WriteByte(rdbOpSelectDB)
+	rdbAppendLen(&buf, 0)
+
+	object := func(typ byte, key, value string) {
+		buf.WriteByte(typ)
+		rdbAppendString(&buf, key)
+		rdbAppendLen(&buf, uint64(len(value)))
+		buf.WriteString(value)
+	}
+
+	// "aaaaaaaaaa" compressed with LZF: one literal and a back reference.
+	buf.WriteByte(rdbTypeString)
+	rdbAppendString(&buf, "lzf")
+	buf.Write([]byte{rdbEncVal<<6 | rdbEncLZF, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00})
+
+	intset := []byte{2, 0, 0, 0, 3, 0, 0, 0}
+	for _, v := range []int16{-2, 1, 300} {
+		intset = binary.LittleEndian.AppendUint16(intset, uint16(v))
+	}
+	object(rdbTypeSetIntset, "intset", string(intset))
+	object(rdbTypeSetListpack, "lpset", testListpack("a", 5, -100))
+	object(rdbTypeHashListpack, "lphash", testListpack("f", "v", "n", 7))
+	object(rdbTypeZSetListpack, "lpzset", testListpack("x", "2.5", "y", 1))
+	object(rdbTypeHashZiplist, "zlhash", testZiplist("f", 1000))
+	object(rdbTypeListZiplist, "zllist", testZiplist("a", 3, -7))
+
+	buf.WriteByte(rdbTypeListQuicklist2)
+	rdbAppendString(&buf, "qlist")
+	rdbAppendLen(&buf, 2)
+	rdbAppendLen(&buf, rdbQuicklistNodePacked)
+	rdbAppendString(&buf, testListpack("a", "b"))
+	rdbAppendLen(&buf, rdbQuicklistNodePlain)
+	rdbAppendString(&buf, "plain")
+
+	// Keys of other databases go to those.
+	buf.WriteByte(rdbOpSelectDB)
+	rdbAppendLen(&buf, 1)
+	buf.WriteByte(rdbTypeString)
+	rdbAppendString(&buf, "db1")
+	rdbAppendString(&buf, "v")
+
+	buf.WriteByte(rdbOpEOF)
+	buf.Write(make([]byte, 8))
+
+	if _, err := loadRDB(buf.Bytes(), newStore()); err == nil || !strings.Contains(err.Error(), "more than 1 databases") {
+		t.Errorf("Expected loading database 1 into a single database to fail, got %v", err)
+	}
+	dbs := newDatabases(2)
+	s := dbs[0]
+	loaded, err := loadRDB(buf.Bytes(), dbs...)
+	if err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	if loaded != 9 {
+		t.Errorf("Expected 9 keys loaded, got %d", loaded)
+	}
+
+	if v, _, _ := s.Get("lzf"); v != "aaaaaaaaaa" {
+		t.Errorf("Unexpected LZF string %q", v)
+	}
+	for key, want := range map[string][]string{"intset": {"-2", "1", "300"}, "lpset": {"-100", "5", "a"}} {
+		members, _ := s.SMembers(key)
+		sort.Strings(members)
+		if !reflect.DeepEqual(members, want) {
+			t.Errorf("%s: expected %v, got %v", key, want, members)
+		}
+	}
+	if hash, _ := s.HGetAll("lphash"); !reflect.DeepEqual(hash, map[string]string{"f": "v", "n": "7"}) {
+		t.Errorf("Unexpected listpack hash %v", hash)
+	}
+	if hash, _ := s.HGetAll("zlhash"); !reflect.DeepEqual(hash, map[string]string{"f": "1000"}) {
+		t.Errorf("Unexpected ziplist hash %v", hash)
+	}
+	if zrange, _ := s.ZRange("lpzset", ZRangeQuery{Start: 0, Stop: -1}); !reflect.DeepEqual(zrange, []ScoredMember{{"y", 1}, {"x", 2.5}}) {
+		t.Errorf("Unexpected listpack zset %v", zrange)
+	}
+	if list, _ := s.LRange("zllist", 0, -1); !reflect.DeepEqual(list, []string{"a", "3", "-7"}) {
+		t.Errorf("Unexpected ziplist list %v", list)
+	}
+	if list, _ := s.LRange("qlist", 0, -1); !reflect.DeepEqual(list, []string{"a", "b", "plain"}) {
+		t.Errorf("Unexpected quicklist %v", list)
+	}
+	if s.Exists("db1") || !dbs[1].Exists("db1") {
+		t.Error("Expected db1 to be loaded into database 1 only")
+	}
+}
+
+// TestRDB_HashFieldTTL checks that field TTLs are saved and loaded, and that
+// fields whose TTL elapsed are dropped on load.
+func TestRDB_HashFieldTTL(t *testing.T) {
+	later := mstime() + 100000
+	src := newStore()
+	src.HSet("hash", "a", "1", "b", "2", "c", "3")
+	src.HExpire("hash", later, 0, "a")
+	src.HExpire("hash", later+5000, 0, "b")
+	gone := hashFromPairs([]string{"old", "v", "kept", "v"})
+	gone.setExpire("old", mstime()-1000)
+	src.RestoreKey("gone", gone, 0)
+
+	var buf bytes.Buffer
+	buf.Write(dumpRDB(t, src))
+	buf.Truncate(buf.Len() - 9) // EOF and checksum
+	old := strconv.FormatInt(mstime()-1000, 10)
+	buf.WriteByte(rdbTypeHashListpackEx)
+	rdbAppendString(&buf, "lphash")
+	binary.Write(&buf, binary.LittleEndian, later)
+	rdbAppendString(&buf, testListpack("f", "v", strconv.FormatInt(later, 10), "g", "w", 0, "old", "x", old))
+	buf.WriteByte(rdbOpEOF)
+	buf.Write(make([]byte, 8))
+
+	dst := newStore()
+	if _, err := loadRDB(buf.Bytes(), dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	if times, _ := dst.HExpireTime("hash", "a", "b", "c"); !reflect.DeepEqual(times, []int64{later, later + 5000, -1}) {
+		t.Errorf("Unexpected field expiry times %v", times)
+	}
+	if fields, _ := dst.HKeys("gone"); !reflect.DeepEqual(fields, []string{"kept"}) {
+		t.Errorf("Expected only the field without TTL to be loaded, got %v", fields)
+	}
+	if times, _ := dst.HExpireTime("lphash", "f", "g", "old"); !reflect.DeepEqual(times, []int64{later, -1, -2}) {
+		t.Errorf("Unexpected listpack field expiry times %v", times)
+	}
+}
+
+// TestRDB_StreamMetadata checks that a stream keeps its entries added
+// counter and maximal deleted ID through a save and load.
+func TestRDB_StreamMetadata(t *testing.T) {
+	src := newStore()
+	src.XAdd("xs", XAddArgs{ID: StreamID{1, 1}}, []string{"f", "v"})
+	src.XAdd("xs", XAddArgs{ID: StreamID{2, 1}}, []string{"f", "v"})
+	entriesAdded, maxDeletedID := uint64(10), StreamID{3, 1}
+	if err := src.XSetID("xs", StreamID{3, 1}, &entriesAdded, &maxDeletedID); err != nil {
+		t.Fatalf("XSetID: %v", err)
+	}
+
+	dst := newStore()
+	if _, err := loadRDB(dumpRDB(t, src), dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	want, _ := src.XInfoStream("xs", false, 0)
+	got, _ := dst.XInfoStream("xs", false, 0)
+	if got.EntriesAdded != 10 || got.MaxDeletedID != maxDeletedID || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+// TestRDB_StreamGroups checks that consumer groups keep their entries read
+// counters, unknown ones included, and consumers their seen and active times
+// through a save and load.
+func TestRDB_StreamGroups(t *testing.T) {
+	src := newStore()
+	for _, id := range []StreamID{{1, 1}, {2, 1}, {3, 1}} {
+		src.XAdd("xs", XAddArgs{ID: id}, []string{"f", "v"})
+	}
+	src.XDel("xs", StreamID{2, 1})
+	src.XGroupCreate("xs", "unknown", StreamID{1, 1}, streamEntriesReadUnknown, false)
+	src.XGroupCreate("xs", "known", StreamID{}, 0, false)
+	src.XReadGroup("xs", "known", "reader", XReadGroupArgs{Count: 1})
+	src.XGroupCreateConsumer("xs", "known", "idle")
+
+	dst := newStore()
+	if _, err := loadRDB(dumpRDB(t, src), dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	want, _ := src.XInfoGroups("xs")
+	if len(want) != 2 || want[1].EntriesRead != streamEntriesReadUnknown {
+		t.Fatalf("Expected the unknown group's entries read to be unknown, got %+v", want)
+	}
+	if got, _ := dst.XInfoGroups("xs"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected groups %+v, got %+v", want, got)
+	}
+	for _, group := range []string{"known", "unknown"} {
+		want, _ := src.XInfoConsumers("xs", group)
+		if got, _ := dst.XInfoConsumers("xs", group); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected consumers %+v, got %+v", group, want, got)
+		}
+	}
+}
+
+// TestRDB_VersionCoversTypes checks that the version in the header is recent
+// enough for every type the file holds.
+func TestRDB_VersionCoversTypes(t *testing.T) {
+	// The version each type was added in.
+	since := map[byte]int{
+		rdbTypeString:           1,
+		rdbTypeList:             1,
+		rdbTypeSet:              1,
+		rdbTypeHash:             1,
+		rdbTypeZSet2:            8,
+		rdbTypeStreamListpacks3: 11,
+		rdbTypeHashMetadata:     12,
+	}
+	s := newStore()
+	fillTestStore(s)
+	s.HSet("fieldttl", "f", "v")
+	s.HExpire("fieldttl", mstime()+60000, 0, "f")
+
+	version, err := strconv.Atoi(string(dumpRDB(t, s)[5:9]))
+	if err != nil {
+		t.Fatalf("Unexpected header: %v", err)
+	}
+	snap := s.Snapshot()
+	defer snap.Close()
+	check := func(key string, value any, expireAt int64) {
+		typ := rdbValueType(value)
+		if want, ok := since[typ]; !ok || version < want {
+			t.Errorf("%s: type %d saved in a version %d file", key, typ, version)
+		}
+	}
+	for snap.Next(check) {
+	}
+}
+
+// TestSnapshot_CopyOnWrite checks that a snapshot keeps seeing the keyspace
+// as it was when taken while the keys are changed under it.
+func TestSnapshot_CopyOnWrite(t *testing.T) {
+	s := newStore()
+	fillTestStore(s)
+	snap := s.Snapshot()
+	defer snap.Close()
+
+	s.Set("str", "changed")
+	s.Delete("int")
+	s.RPush("list", "c")
+	s.LPop("list")
+	s.SRem("set", "m1")
+	s.HSet("hash", "f1", "changed")
+	s.ZAdd("zset", ZAddOptions{}, ScoredMember{Member: "mid", Score: 100})
+	s.Persist("ttl")
+	s.Set("new", "value")
+	s.Delete("big")
+	s.Set("big", "recreated")
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, snap); err != nil {
+		t.Fatalf("writeRDB: %v", err)
+	}
+	dst := newStore()
+	if _, err := loadRDB(buf.Bytes(), dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	checkTestStore(t, dst)
+	if dst.Exists("new") {
+		t.Error("Expected a key created after the snapshot to be left out")
+	}
+
+	if v, _, _ := s.Get("str"); v != "changed" {
+		t.Errorf("Expected the live keyspace to keep changes, got %q", v)
+	}
+}
+
+func TestRDB_SaveFile(t *testing.T) {
+	p := &rdbPersistence{path: filepath.Join(t.TempDir(), "dump.rdb")}
+
+	// A missing dump file loads nothing.
+	if loaded, err := loadRDBFile(p.path, newStore()); loaded != 0 || err != nil {
+		t.Fatalf("Expected an empty load, got %d, %v", loaded, err)
+	}
+
+	src := newStore()
+	fillTestStore(src)
+	if err := p.save(src); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if p.lastSaveTime() == 0 {
+		t.Error("Expected LASTSAVE to be updated")
+	}
+
+	p.startSave()
+	if err := p.bgsave(src); err != errSaveInProgress {
+		t.Errorf("Expected a save in progress error, got %v", err)
+	}
+	p.finishSave(errSaveInProgress)
+
+	dst := newStore()
+	if _, err := loadRDBFile(p.path, dst); err != nil {
+		t.Fatalf("loadRDBFile: %v", err)
+	}
+	checkTestStore(t, dst)
+}
+
+// TestRDB_Databases checks that every database is saved and loaded back into
+// the one of the same number.
+func TestRDB_Databases(t *testing.T) {
+	src := newDatabases(4)
+	fillTestStore(src[0])
+	src[3].Set("k", "3")
+	snaps := takeSnapshots(src)
+	defer closeSnapshots(snaps)
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, snaps...); err != nil {
+		t.Fatalf("writeRDB: %v", err)
+	}
+	dst := newDatabases(4)
+	if _, err := loadRDB(buf.Bytes(), dst...); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	checkTestStore(t, dst[0])
+	if v, _, _ := dst[3].Get("k"); v != "3" || dst[0].Exists("k") {
+		t.Errorf("Expected k only in database 3, got %q", v)
+	}
+	if dst[1].DBSize() != 0 || dst[2].DBSize() != 0 {
+		t.Error("Expected databases 1 and 2 to stay empty")
+	}
+}
+
+// TestSnapshot_SwapDB checks that a snapshot keeps the keys of its database
+// once they are swapped with another's.
+func TestSnapshot_SwapDB(t *testing.T) {
+	dbs := newDatabases(2)
+	fillTestStore(dbs[0])
+	dbs[1].Set("str", "other")
+	dbs[1].Set("other", "v")
+	snap := dbs[0].Snapshot()
+	defer snap.Close()
+
+	dbs[0].SwapWith(dbs[1])
+	// The keys now in database 1 are modified in place.
+	dbs[1].RPush("list", "c")
+	dbs[1].Set("str", "changed")
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, snap); err != nil {
+		t.Fatalf("writeRDB: %v", err)
+	}
+	dst := newStore()
+	if _, err := loadRDB(buf.Bytes(), dst); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+	checkTestStore(t, dst)
+	if dst.Exists("other") {
+		t.Error("Expected the keys swapped in to be left out")
+	}
+}
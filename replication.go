@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication tuning, with the defaults of Redis' configuration.
+const (
+	replBacklogSize = 1 << 20          // bytes of the stream kept for partial resyncs
+	replPingPeriod  = 10 * time.Second // how often a master pings its replicas
+	replAckPeriod   = time.Second      // how often a replica reports its offset
+	replTimeout     = 60 * time.Second // silence after which a link is dropped
+	replRetryPeriod = time.Second      // wait before reconnecting to the master
+	replOutputLimit = 256 << 20        // pending bytes after which a replica is dropped
+)
+
+var errLinkStopped = errors.New("replication link stopped")
+
+// replState is where a replica is in connecting to its master.
+type replState int
+
+const (
+	replNone       replState = iota // not a replica
+	replConnect                     // waiting to connect
+	replConnecting                  // handshake in progress
+	replTransfer                    // receiving the snapshot
+	replConnected                   // streaming commands
+)
+
+// String returns the state as reported by ROLE.
+func (s replState) String() string {
+	switch s {
+	case replConnect:
+		return "connect"
+	case replConnecting:
+		return "connecting"
+	case replTransfer:
+		return "sync"
+	case replConnected:
+		return "connected"
+	}
+	return "none"
+}
+
+// replication is the master and replica side state of a server.
+//
+// The replication stream is every write command in RESP. Its history is
+// named by a replication ID, and the offset counts the bytes of it produced
+// so far. A replica that knows both can continue from where it stopped as
+// long as the missing part is still in the backlog; otherwise it needs a
+// full resynchronisation from a snapshot.
+type replication struct {
+	srv *server
+	mu  sync.Mutex
+
+	replid  string
+	offset  int64
+	backlog *replBacklog // nil until a replica first attaches
+
+	// replid2 is the ID of the history this server followed before it was
+	// promoted, which continues up to secondReplidOffset. Replicas of the
+	// old master can still partially resync from it.
+	replid2            string
+	secondReplidOffset int64
+
+	replicas map[*client]*replicaLink
+	lastPing time.Time
+
+	// selectedDB is the database the commands fed last apply to, or -1 when
+	// the next command must select one first.
+	selectedDB int
+
+	// Full and partial resynchronisations served.
+	fullSyncs, partialSyncs int
+
+	// Replica side: the master to follow and the link to it.
+	masterHost, masterPort string
+	state                  replState
+	masterConn             net.Conn
+	stopLink               chan struct{}
+
+	// masterDB is the database the master's stream had selected when the
+	// link was lost, which a partial resync continues with.
+	masterDB int
+}
+
+func newReplication(srv *server) *replication {
+	return &replication{
+		srv:                srv,
+		replid:             newReplID(),
+		secondReplidOffset: -1,
+		replicas:           make(map[*client]*replicaLink),
+		selectedDB:         -1,
+	}
+}
+
+// newReplID returns a random 40 character replication ID.
+func newReplID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// replBacklog is a ring buffer holding the latest part of the replication
+// stream.
+type replBacklog struct {
+	buf     []byte
+	idx     int // where the next byte goes
+	histlen int // bytes held
+}
+
+func newReplBacklog(size int) *replBacklog {
+	return &replBacklog{buf: make([]byte, size)}
+}
+
+func (b *replBacklog) write(p []byte) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		p = p[n:]
+	}
+}
+
+// last returns the latest n bytes, which must be held.
+func (b *replBacklog) last(n int) []byte {
+	out := make([]byte, 0, n)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append(out, b.buf[start:start+n]...)
+	}
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:n-(len(b.buf)-start)]...)
+}
+
+// replicaLink streams the replication stream to one replica. Writes are
+// queued and sent by a goroutine of its own, so that a slow replica never
+// holds up the master's clients.
+type replicaLink struct {
+	c             *client
+	listeningPort string
+	ackOffset     int64
+
+	mu      sync.Mutex
+	pending bytes.Buffer
+	notify  chan struct{}
+	closed  bool
+
+	// A full resynchronisation first sends header and then the snapshots
+	// of the databases as an RDB file.
+	snapshots []*Snapshot
+	header    string
+}
+
+// send queues data for the replica, dropping the replica if it has fallen
+// too far behind.
+func (l *replicaLink) send(data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	if l.pending.Len()+len(data) > replOutputLimit {
+		log.Printf("Replica %s is too far behind, disconnecting it", l.c.addr())
+		l.closed = true
+		close(l.notify)
+		l.c.close()
+		return
+	}
+	l.pending.Write(data)
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (l *replicaLink) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+}
+
+func (l *replicaLink) write(data []byte) error {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	_, err := l.c.conn.Write(data)
+	return err
+}
+
+func (l *replicaLink) run() {
+	if l.snapshots != nil {
+		var rdb bytes.Buffer
+		err := writeRDB(&rdb, l.snapshots...)
+		closeSnapshots(l.snapshots)
+		if err == nil {
+			err = l.write([]byte(l.header + "$" + strconv.Itoa(rdb.Len()) + "\r\n"))
+		}
+		if err == nil {
+			err = l.write(rdb.Bytes())
+		}
+		if err != nil {
+			log.Printf("Failed to send the snapshot to replica %s: %v", l.c.addr(), err)
+			l.c.close()
+			return
+		}
+	}
+
+	for range l.notify {
+		l.mu.Lock()
+		data := bytes.Clone(l.pending.Bytes())
+		l.pending.Reset()
+		l.mu.Unlock()
+
+		if err := l.write(data); err != nil {
+			l.c.close()
+			return
+		}
+	}
+}
+
+// feed appends a command run in database dbid to the replication stream,
+// preceded by a SELECT when the previous one ran in another database.
+func (r *replication) feed(dbid int, command []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backlog == nil {
+		return
+	}
+	if dbid != r.selectedDB {
+		r.feedLocked(serializeStringArray([]string{"SELECT", strconv.Itoa(dbid)}))
+		r.selectedDB = dbid
+	}
+	r.feedLocked(serializeStringArray(command))
+}
+
+// feedFromMaster relays part of the master's stream exactly as received, so
+// that this replica's offsets stay the same as its master's.
+func (r *replication) feedFromMaster(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backlog == nil {
+		r.backlog = newReplBacklog(replBacklogSize)
+	}
+	// The master's stream selects databases of its own.
+	r.selectedDB = -1
+	r.feedLocked(data)
+}
+
+func (r *replication) feedLocked(data []byte) {
+	r.backlog.write(data)
+	r.offset += int64(len(data))
+	for _, link := range r.replicas {
+		link.send(data)
+	}
+}
+
+// isReplica reports whether the server follows a master.
+func (r *replication) isReplica() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.masterHost != ""
+}
+
+// syncReplica serves PSYNC: it continues the replica's stream from the
+// backlog if possible and otherwise sends a snapshot. Callers must hold
+// keyspaceLock so that no write slips in between the snapshot and the stream
+// that follows it.
+func (r *replication) syncReplica(c *client, replid string, psyncOffset int64) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost != "" && r.state != replConnected {
+		return SerializeError("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	if r.backlog == nil {
+		// Without a backlog there was no history to continue, so start a
+		// new one.
+		r.replid, r.replid2, r.secondReplidOffset = newReplID(), "", -1
+		r.backlog = newReplBacklog(replBacklogSize)
+	}
+
+	link := &replicaLink{c: c, listeningPort: c.replListeningPort, notify: make(chan struct{}, 1)}
+	if r.canContinue(replid, psyncOffset) {
+		link.send([]byte("+CONTINUE " + r.replid + "\r\n"))
+		link.send(r.backlog.last(int(r.offset - psyncOffset + 1)))
+		r.partialSyncs++
+		log.Printf("Partial resynchronization request from %s accepted", c.addr())
+	} else {
+		link.snapshots = takeSnapshots(r.srv.dbs)
+		// The snapshot may be followed by commands for any database.
+		r.selectedDB = -1
+		link.header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", r.replid, r.offset)
+		r.fullSyncs++
+		log.Printf("Starting full resynchronization of replica %s", c.addr())
+	}
+	if old := r.replicas[c]; old != nil {
+		old.stop()
+	}
+	r.replicas[c] = link
+	go link.run()
+	return nil
+}
+
+// canContinue reports whether a replica that has the stream of replid up to
+// psyncOffset-1 can be sent the rest from the backlog.
+func (r *replication) canContinue(replid string, psyncOffset int64) bool {
+	if replid != r.replid && (replid != r.replid2 || psyncOffset > r.secondReplidOffset) {
+		return false
+	}
+	first := r.offset - int64(r.backlog.histlen) + 1
+	return psyncOffset >= first && psyncOffset <= r.offset+1
+}
+
+// ack records the offset a replica has processed.
+func (r *replication) ack(c *client, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if link := r.replicas[c]; link != nil {
+		link.ackOffset = offset
+	}
+}
+
+// removeReplica forgets c if it was a replica.
+func (r *replication) removeReplica(c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if link := r.replicas[c]; link != nil {
+		link.stop()
+		delete(r.replicas, c)
+	}
+}
+
+// disconnectReplicasLocked drops every replica, which makes them reconnect
+// and resync. Callers must hold r.mu.
+func (r *replication) disconnectReplicasLocked() {
+	for c, link := range r.replicas {
+		link.stop()
+		c.close()
+		delete(r.replicas, c)
+	}
+}
+
+// cron pings the replicas now and then, so they can tell a quiet master from
+// a lost one.
+func (r *replication) cron() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost != "" || len(r.replicas) == 0 || time.Since(r.lastPing) < replPingPeriod {
+		return
+	}
+	r.lastPing = time.Now()
+	r.feedLocked(serializeStringArray([]string{"PING"}))
+}
+
+func (r *replication) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopLinkLocked()
+	r.disconnectReplicasLocked()
+}
+
+// setMaster makes the server a replica of host:port. It reports false if it
+// already was.
+func (r *replication) setMaster(host, port string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost == host && r.masterPort == port {
+		return false
+	}
+	r.stopLinkLocked()
+	r.disconnectReplicasLocked()
+	r.masterHost, r.masterPort, r.state = host, port, replConnect
+
+	stop := make(chan struct{})
+	r.stopLink = stop
+	go r.runLink(host, port, stop)
+	log.Printf("Connecting to MASTER %s:%s", host, port)
+	return true
+}
+
+// becomeMaster stops following the master. The history received so far is
+// kept as replid2, so other replicas of the old master can partially resync
+// from this server.
+func (r *replication) becomeMaster() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost == "" {
+		return
+	}
+	r.stopLinkLocked()
+	r.masterHost, r.masterPort, r.state = "", "", replNone
+	r.replid2, r.secondReplidOffset = r.replid, r.offset+1
+	r.replid = newReplID()
+	r.selectedDB = -1
+	log.Printf("MASTER MODE enabled")
+}
+
+func (r *replication) stopLinkLocked() {
+	if r.stopLink != nil {
+		close(r.stopLink)
+		r.stopLink = nil
+	}
+	if r.masterConn != nil {
+		r.masterConn.Close()
+		r.masterConn = nil
+	}
+}
+
+// setState moves the link to state unless it has been replaced since.
+func (r *replication) setState(stop chan struct{}, state replState) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopLink != stop {
+		return false
+	}
+	r.state = state
+	return true
+}
+
+// runLink keeps the server in sync with its master until stop is closed,
+// reconnecting whenever the connection is lost.
+func (r *replication) runLink(host, port string, stop chan struct{}) {
+	for {
+		err := r.syncWithMaster(host, port, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("Connection with master %s:%s lost: %v", host, port, err)
+		if !r.setState(stop, replConnect) {
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(replRetryPeriod):
+		}
+	}
+}
+
+// syncWithMaster connects to the master, resynchronises and then applies the
+// commands it streams until the connection fails.
+func (r *replication) syncWithMaster(host, port string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	if r.stopLink != stop {
+		r.mu.Unlock()
+		return errLinkStopped
+	}
+	r.masterConn = conn
+	r.state = replConnecting
+	replid, offset := r.replid, r.offset
+	r.mu.Unlock()
+
+	stream := &replStreamReader{r: conn}
+	reader := bufio.NewReader(stream)
+	conn.SetDeadline(time.Now().Add(replTimeout))
+
+	request := func(args ...string) (string, error) {
+		if _, err := conn.Write(serializeStringArray(args)); err != nil {
+			return "", err
+		}
+		return readReplLine(reader)
+	}
+
+	reply, err := request("PING")
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") && !strings.HasPrefix(reply, "-NOPERM") {
+		return fmt.Errorf("error reply to PING from master: %s", reply)
+	}
+	// Masters that do not know these options still work.
+	if _, err := request("REPLCONF", "listening-port", r.srv.port()); err != nil {
+		return err
+	}
+	if _, err := request("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	reply, err = request("PSYNC", replid, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(reply, "+FULLRESYNC"):
+		if err := r.fullResync(stop, reply, reader); err != nil {
+			return err
+		}
+	case strings.HasPrefix(reply, "+CONTINUE"):
+		r.continueResync(strings.TrimSpace(strings.TrimPrefix(reply, "+CONTINUE")))
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+
+	if !r.setState(stop, replConnected) {
+		return errLinkStopped
+	}
+	log.Printf("MASTER <-> REPLICA sync: Master accepted a %s resynchronization", strings.ToLower(strings.Fields(reply[1:])[0]))
+	conn.SetDeadline(time.Time{})
+	return r.streamFromMaster(conn, reader, stream)
+}
+
+// fullResync replaces the keyspace with the snapshot the master sends after
+// +FULLRESYNC <replid> <offset>.
+func (r *replication) fullResync(stop chan struct{}, reply string, reader *bufio.Reader) error {
+	fields := strings.Fields(reply)
+	if len(fields) != 3 {
+		return fmt.Errorf("bad FULLRESYNC reply from master: %s", reply)
+	}
+	replid := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad FULLRESYNC reply from master: %s", reply)
+	}
+	if !r.setState(stop, replTransfer) {
+		return errLinkStopped
+	}
+
+	// The master may send newlines to keep the link alive while it
+	// prepares the snapshot.
+	preamble, err := readReplLine(reader)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.TrimPrefix(preamble, "$"))
+	if !strings.HasPrefix(preamble, "$") || err != nil || size < 0 {
+		return fmt.Errorf("bad snapshot preamble from master: %q", preamble)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+
+	srv := r.srv
+	srv.keyspaceLock.Lock()
+	srv.flushAll(false)
+	loaded, err := loadRDB(data, srv.dbs...)
+	srv.keyspaceLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to load the snapshot from master: %v", err)
+	}
+	log.Printf("MASTER <-> REPLICA sync: Loaded %d keys from master", loaded)
+
+	r.mu.Lock()
+	r.replid, r.offset = replid, offset
+	r.replid2, r.secondReplidOffset = "", -1
+	r.backlog = newReplBacklog(replBacklogSize)
+	r.masterDB = 0
+	// Replicas of this server followed the old data set.
+	r.disconnectReplicasLocked()
+	r.mu.Unlock()
+
+	// The log no longer describes the keyspace.
+	if srv.aof.enabled() {
+		if err := srv.aof.bgrewrite(srv.dbs...); err != nil {
+			log.Printf("Can't rewrite the append only file after the sync with master: %v", err)
+		}
+	}
+	return nil
+}
+
+// continueResync follows the master's history from the current offset. A
+// master that has been promoted since names its new replication ID.
+func (r *replication) continueResync(replid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.backlog == nil {
+		r.backlog = newReplBacklog(replBacklogSize)
+	}
+	if replid != "" && replid != r.replid {
+		r.replid2, r.secondReplidOffset = r.replid, r.offset+1
+		r.replid = replid
+		// Replicas of this server must learn the new ID.
+		r.disconnectReplicasLocked()
+	}
+}
+
+// streamFromMaster applies the commands the master streams, relays them to
+// this server's own replicas, and reports the offset back to the master.
+func (r *replication) streamFromMaster(conn net.Conn, reader *bufio.Reader, stream *replStreamReader) error {
+	var writeMu sync.Mutex
+	sendAck := func() error {
+		r.mu.Lock()
+		offset := r.offset
+		r.mu.Unlock()
+
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(serializeStringArray([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}))
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(replAckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sendAck()
+			}
+		}
+	}()
+
+	master := r.srv.newClient(io.Discard)
+	master.isMaster = true
+	r.mu.Lock()
+	master.selectDB(r.masterDB)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.masterDB = master.dbid
+		r.mu.Unlock()
+	}()
+	stream.startRecording(reader)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		value, err := ReadRESP(reader)
+		if err != nil {
+			return err
+		}
+		raw := stream.take(reader)
+
+		command, err := value.ToCommand()
+		if err != nil || len(command) == 0 {
+			return fmt.Errorf("bad command from master: %v", err)
+		}
+		command[0] = strings.ToUpper(command[0])
+		getAck := command[0] == "REPLCONF" && len(command) > 1 && strings.EqualFold(command[1], "GETACK")
+		if !getAck {
+			executeCommand(master, command)
+		}
+		r.feedFromMaster(raw)
+		if getAck {
+			if err := sendAck(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replStreamReader reads from the master, and once recording keeps the bytes
+// read so that each command can be relayed exactly as it was received.
+type replStreamReader struct {
+	r         io.Reader
+	recording bool
+	rec       bytes.Buffer
+}
+
+func (s *replStreamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.recording {
+		s.rec.Write(p[:n])
+	}
+	return n, err
+}
+
+// startRecording starts keeping the bytes read, including those reader has
+// already buffered.
+func (s *replStreamReader) startRecording(reader *bufio.Reader) {
+	buffered, _ := reader.Peek(reader.Buffered())
+	s.rec.Write(buffered)
+	s.recording = true
+}
+
+// take returns the bytes reader has consumed since the last call.
+func (s *replStreamReader) take(reader *bufio.Reader) []byte {
+	return bytes.Clone(s.rec.Next(s.rec.Len() - reader.Buffered()))
+}
+
+// readReplLine reads a reply line, skipping the bare newlines a master sends
+// as keepalives.
+func readReplLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			return line, nil
+		}
+	}
+}
+
+// role returns the reply to ROLE.
+func (r *replication) role() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost != "" {
+		port, _ := strconv.Atoi(r.masterPort)
+		offset := r.offset
+		if r.state != replConnected {
+			offset = -1
+		}
+		return SerializeArray([][]byte{
+			SerializeBulkString("slave"),
+			SerializeBulkString(r.masterHost),
+			SerializeInteger(port),
+			SerializeBulkString(r.state.String()),
+			SerializeInteger(int(offset)),
+		})
+	}
+
+	replicas := make([][]byte, 0, len(r.replicas))
+	for c, link := range r.replicas {
+		host, _, _ := net.SplitHostPort(c.addr())
+		replicas = append(replicas, serializeStringArray([]string{host, link.listeningPort, strconv.FormatInt(link.ackOffset, 10)}))
+	}
+	return SerializeArray([][]byte{
+		SerializeBulkString("master"),
+		SerializeInteger(int(r.offset)),
+		SerializeArray(replicas),
+	})
+}
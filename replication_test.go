@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestServer runs a server on a free localhost port until the test ends.
+func startTestServer(t *testing.T) *server {
+	t.Helper()
+	srv := newServer()
+	if err := srv.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve()
+	t.Cleanup(srv.close)
+	return srv
+}
+
+// startTestReplica starts a server replicating master and waits for the
+// initial sync.
+func startTestReplica(t *testing.T, master *server) *server {
+	t.Helper()
+	replica := startTestServer(t)
+	reply := executeClientCommand(replica.newClient(io.Discard), []string{"REPLICAOF", "127.0.0.1", master.port()})
+	if string(reply) != "+OK\r\n" {
+		t.Fatalf("REPLICAOF: %q", reply)
+	}
+	waitFor(t, "the initial sync", func() bool {
+		replica.repl.mu.Lock()
+		defer replica.repl.mu.Unlock()
+		return replica.repl.state == replConnected
+	})
+	return replica
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForValue(t *testing.T, srv *server, key, want string) {
+	t.Helper()
+	waitFor(t, key+" = "+want, func() bool {
+		srv.keyspaceLock.RLock()
+		defer srv.keyspaceLock.RUnlock()
+		v, _, _ := srv.dbs[0].Get(key)
+		return v == want
+	})
+}
+
+func TestReplication_SyncAndStream(t *testing.T) {
+	master := startTestServer(t)
+	mc := master.newClient(io.Discard)
+	executeClientCommand(mc, []string{"SET", "before", "1"})
+	executeClientCommand(mc, []string{"RPUSH", "list", "a", "b"})
+	executeClientCommand(mc, []string{"SET", "ttl", "v", "EX", "100"})
+
+	replica := startTestReplica(t, master)
+	waitForValue(t, replica, "before", "1")
+	if list, _ := replica.dbs[0].LRange("list", 0, -1); len(list) != 2 {
+		t.Errorf("Expected the list in the snapshot, got %v", list)
+	}
+	if replica.dbs[0].ExpireTime("ttl") != master.dbs[0].ExpireTime("ttl") {
+		t.Error("Expected the expiry in the snapshot")
+	}
+
+	executeClientCommand(mc, []string{"SET", "after", "2"})
+	executeClientCommand(mc, []string{"MULTI"})
+	executeClientCommand(mc, []string{"INCR", "counter"})
+	executeClientCommand(mc, []string{"INCR", "counter"})
+	executeClientCommand(mc, []string{"EXEC"})
+	executeClientCommand(mc, []string{"DEL", "before"})
+	waitForValue(t, replica, "after", "2")
+	waitForValue(t, replica, "counter", "2")
+	waitForValue(t, replica, "before", "")
+
+	rc := replica.newClient(io.Discard)
+	if reply := executeClientCommand(rc, []string{"SET", "k", "v"}); string(reply) != "-READONLY You can't write against a read only replica.\r\n" {
+		t.Errorf("Expected a READONLY error, got %q", reply)
+	}
+	if reply := executeClientCommand(rc, []string{"GET", "after"}); string(reply) != "$1\r\n2\r\n" {
+		t.Errorf("Expected reads to work on a replica, got %q", reply)
+	}
+
+	role := string(executeClientCommand(rc, []string{"ROLE"}))
+	want := "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:" + master.port() + "\r\n$9\r\nconnected\r\n"
+	if len(role) < len(want) || role[:len(want)] != want {
+		t.Errorf("Unexpected ROLE reply %q", role)
+	}
+
+	waitFor(t, "the replica to catch up", func() bool {
+		master.repl.mu.Lock()
+		defer master.repl.mu.Unlock()
+		replica.repl.mu.Lock()
+		defer replica.repl.mu.Unlock()
+		return master.repl.offset == replica.repl.offset && master.repl.replid == replica.repl.replid
+	})
+}
+
+// TestReplication_PartialResync checks that a replica that loses its link
+// only receives what it missed.
+func TestReplication_PartialResync(t *testing.T) {
+	master := startTestServer(t)
+	mc := master.newClient(io.Discard)
+	executeClientCommand(mc, []string{"SET", "a", "1"})
+	replica := startTestReplica(t, master)
+	waitForValue(t, replica, "a", "1")
+
+	replica.repl.mu.Lock()
+	replica.repl.masterConn.Close()
+	replica.repl.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		executeClientCommand(mc, []string{"INCR", "counter"})
+	}
+
+	waitForValue(t, replica, "counter", "10")
+	master.repl.mu.Lock()
+	defer master.repl.mu.Unlock()
+	if master.repl.fullSyncs != 1 || master.repl.partialSyncs != 1 {
+		t.Errorf("Expected 1 full and 1 partial sync, got %d and %d", master.repl.fullSyncs, master.repl.partialSyncs)
+	}
+}
+
+// TestReplication_Databases checks that the snapshot and the stream keep
+// keys in their databases, also across a partial resync.
+func TestReplication_Databases(t *testing.T) {
+	master := startTestServer(t)
+	mc0, mc := master.newClient(io.Discard), master.newClient(io.Discard)
+	executeClientCommand(mc, []string{"SELECT", "2"})
+	executeClientCommand(mc, []string{"SET", "a", "2"})
+	replica := startTestReplica(t, master)
+
+	waitForDBValue := func(db int, key, want string) {
+		t.Helper()
+		waitFor(t, key+" = "+want, func() bool {
+			replica.keyspaceLock.RLock()
+			defer replica.keyspaceLock.RUnlock()
+			v, _, _ := replica.dbs[db].Get(key)
+			return v == want
+		})
+	}
+	waitForDBValue(2, "a", "2")
+
+	executeClientCommand(mc, []string{"SELECT", "3"})
+	executeClientCommand(mc, []string{"SET", "b", "3"})
+	executeClientCommand(mc0, []string{"SET", "b", "0"})
+	executeClientCommand(mc, []string{"SET", "c", "3"})
+	waitForDBValue(3, "c", "3")
+	waitForDBValue(3, "b", "3")
+	waitForDBValue(0, "b", "0")
+
+	// The stream continues in database 3 without selecting it again.
+	replica.repl.mu.Lock()
+	replica.repl.masterConn.Close()
+	replica.repl.mu.Unlock()
+	executeClientCommand(mc, []string{"SET", "d", "3"})
+	waitForDBValue(3, "d", "3")
+	if replica.dbs[0].Exists("d") {
+		t.Error("Expected d only in database 3")
+	}
+	master.repl.mu.Lock()
+	defer master.repl.mu.Unlock()
+	if master.repl.partialSyncs != 1 {
+		t.Errorf("Expected 1 partial sync, got %d", master.repl.partialSyncs)
+	}
+}
+
+// TestReplication_Promote checks that a promoted replica accepts writes and
+// that a replica of the old master can continue from it.
+func TestReplication_Promote(t *testing.T) {
+	master := startTestServer(t)
+	mc := master.newClient(io.Discard)
+	executeClientCommand(mc, []string{"SET", "a", "1"})
+	first := startTestReplica(t, master)
+	second := startTestReplica(t, master)
+	waitFor(t, "both replicas to catch up", func() bool {
+		v1, _, _ := first.dbs[0].Get("a")
+		v2, _, _ := second.dbs[0].Get("a")
+		return v1 == "1" && v2 == "1"
+	})
+
+	master.close()
+	fc := first.newClient(io.Discard)
+	executeClientCommand(fc, []string{"REPLICAOF", "NO", "ONE"})
+	if reply := executeClientCommand(fc, []string{"SET", "b", "2"}); string(reply) != "+OK\r\n" {
+		t.Fatalf("Expected the promoted replica to accept writes, got %q", reply)
+	}
+
+	executeClientCommand(second.newClient(io.Discard), []string{"REPLICAOF", "127.0.0.1", first.port()})
+	waitForValue(t, second, "b", "2")
+	first.repl.mu.Lock()
+	defer first.repl.mu.Unlock()
+	if first.repl.fullSyncs != 0 || first.repl.partialSyncs != 1 {
+		t.Errorf("Expected a partial sync from the old history, got %d full and %d partial", first.repl.fullSyncs, first.repl.partialSyncs)
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	b := newReplBacklog(8)
+	b.write([]byte("abcde"))
+	if got := string(b.last(3)); got != "cde" {
+		t.Errorf("Expected cde, got %q", got)
+	}
+	b.write([]byte("fghijk"))
+	if b.histlen != 8 {
+		t.Errorf("Expected a full backlog, got %d bytes", b.histlen)
+	}
+	if got := string(b.last(8)); got != "defghijk" {
+		t.Errorf("Expected defghijk, got %q", got)
+	}
+	for n := 0; n <= 8; n++ {
+		if got := string(b.last(n)); got != "defghijk"[8-n:] {
+			t.Errorf("last(%d): got %q", n, got)
+		}
+	}
+	b.write([]byte(strconv.Itoa(123456789)))
+	if got := string(b.last(8)); got != "23456789" {
+		t.Errorf("Expected 23456789, got %q", got)
+	}
+}
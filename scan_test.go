@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// scanToEnd runs a scan command to completion, starting with cursor 0 at
+// command[cursorPos], and returns the sorted elements it returned.
+func scanToEnd(t *testing.T, command []string, cursorPos int) []string {
+	t.Helper()
+	command = slices.Clone(command)
+	var elements []string
+	cursor := "0"
+	for {
+		command[cursorPos] = cursor
+		reply := executeTestCommand(command)
+		value, err := ReadRESP(bufio.NewReader(bytes.NewReader(reply)))
+		if err != nil || len(value.Array) != 2 {
+			t.Fatalf("Command %v: bad reply %q", command, reply)
+		}
+		for _, element := range value.Array[1].Array {
+			elements = append(elements, element.Bulk)
+		}
+		if cursor = value.Array[0].Bulk; cursor == "0" {
+			slices.Sort(elements)
+			return elements
+		}
+	}
+}
+
+func TestProcessCommand_Scan(t *testing.T) {
+	testServer = newServer()
+	for i := 0; i < 100; i++ {
+		executeTestCommand([]string{"SET", "key:" + strconv.Itoa(i), "v"})
+	}
+	executeTestCommand([]string{"RPUSH", "list", "a"})
+	executeTestCommand([]string{"SADD", "set", "a"})
+	executeTestCommand([]string{"SET", "gone", "v", "PX", "1"})
+	executeTestCommand([]string{"DEL", "key:99"})
+	time.Sleep(5 * time.Millisecond)
+
+	keys := scanToEnd(t, []string{"SCAN", "0", "COUNT", "7"}, 1)
+	if len(keys) != 101 || !slices.Contains(keys, "list") || slices.Contains(keys, "key:99") {
+		t.Errorf("Expected the 101 live keys, got %d: %v", len(keys), keys)
+	}
+	if keys := scanToEnd(t, []string{"SCAN", "0", "MATCH", "key:9?"}, 1); len(keys) != 9 {
+		t.Errorf("Expected key:90 to key:98, got %v", keys)
+	}
+	if keys := scanToEnd(t, []string{"SCAN", "0", "TYPE", "SET"}, 1); !reflect.DeepEqual(keys, []string{"set"}) {
+		t.Errorf("Expected only the set, got %v", keys)
+	}
+	if keys := scanToEnd(t, []string{"SCAN", "0", "TYPE", "list", "MATCH", "s*"}, 1); len(keys) != 0 {
+		t.Errorf("Expected no key, got %v", keys)
+	}
+	// The largest COUNT scans the whole keyspace in one call.
+	if reply := executeTestCommand([]string{"SCAN", "0", "COUNT", "9223372036854775807", "MATCH", "list"}); string(reply) != "*2\r\n$1\r\n0\r\n*1\r\n$4\r\nlist\r\n" {
+		t.Errorf("Expected the whole keyspace scanned at once, got %q", reply)
+	}
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"SCAN", "x"}, "-ERR invalid cursor\r\n"},
+		{[]string{"SCAN", "-1"}, "-ERR invalid cursor\r\n"},
+		{[]string{"SCAN", "0", "COUNT", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"SCAN", "0", "COUNT", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SCAN", "0", "MATCH"}, "-ERR syntax error\r\n"},
+		{[]string{"SCAN", "0", "TYPE", "nope"}, "-ERR unknown type name 'nope'\r\n"},
+		{[]string{"SSCAN", "set", "0", "TYPE", "set"}, "-ERR syntax error\r\n"},
+		{[]string{"SSCAN", "list", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"HSCAN", "missing", "0"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{[]string{"ZSCAN", "missing", "0"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+}
+
+func TestProcessCommand_ScanElements(t *testing.T) {
+	testServer = newServer()
+	var members []string
+	for i := 0; i < 300; i++ {
+		members = append(members, "m"+strconv.Itoa(i))
+	}
+	executeTestCommand(append([]string{"SADD", "s"}, members...))
+	slices.Sort(members)
+	if got := scanToEnd(t, []string{"SSCAN", "s", "0", "COUNT", "20"}, 2); !reflect.DeepEqual(got, members) {
+		t.Errorf("SSCAN returned %d members, expected %d", len(got), len(members))
+	}
+	if got := scanToEnd(t, []string{"SSCAN", "s", "0", "MATCH", "m1?"}, 2); len(got) != 10 {
+		t.Errorf("Expected m10 to m19, got %v", got)
+	}
+
+	executeTestCommand([]string{"HSET", "h", "a", "1", "b", "2", "c", "3"})
+	executeTestCommand([]string{"HPEXPIRE", "h", "1", "FIELDS", "1", "c"})
+	executeTestCommand([]string{"ZADD", "z", "1.5", "a", "2", "b"})
+	time.Sleep(5 * time.Millisecond)
+	// Hash and sorted set replies are pairs; check them as such.
+	pairs := func(reply []string) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i+1 < len(reply); i += 2 {
+			m[reply[i]] = reply[i+1]
+		}
+		return m
+	}
+	for _, test := range []struct {
+		command  []string
+		expected map[string]string
+	}{
+		{[]string{"HSCAN", "h", "0"}, map[string]string{"a": "1", "b": "2"}},
+		{[]string{"HSCAN", "h", "0", "MATCH", "b"}, map[string]string{"b": "2"}},
+		{[]string{"ZSCAN", "z", "0"}, map[string]string{"a": "1.5", "b": "2"}},
+	} {
+		// Small tables are returned whole by the first call.
+		reply := replyStrings(t, executeTestCommand(test.command)[len("*2\r\n$1\r\n0\r\n"):])
+		if got := pairs(reply); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Command %v: expected %v, got %v", test.command, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDatabases is how many databases a server has unless configured
+// otherwise.
+const defaultDatabases = 16
+
+// server is one Redis server: its keyspace and everything its clients share.
+// A process normally runs a single one, but tests run several side by side,
+// such as a master and its replica.
+type server struct {
+	// dbs are the numbered databases clients choose from with SELECT.
+	dbs []DataStore
+
+	// keyspaceLock keeps transactions atomic: every command runs holding it
+	// shared, while EXEC holds it exclusively for its whole queue. Write
+	// commands hold it exclusively too, so that they are propagated in the
+	// order they were applied.
+	keyspaceLock sync.RWMutex
+
+	pubsub   *pubSub
+	events   *keyspaceNotifier
+	blocking *blockingState
+	aof      *appendOnlyFile
+	rdb      *rdbPersistence
+	repl     *replication
+
+	// expired queues the keys whose TTL elapsed until they are propagated.
+	expired expiredKeys
+
+	// lastClientID is the ID of the last client connected.
+	lastClientID atomic.Int64
+
+	// cluster is the slot layout, or nil when cluster mode is off.
+	cluster *clusterState
+
+	connManager *ConnectionManager
+	listener    net.Listener
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func newServer() *server {
+	return newServerWithDatabases(defaultDatabases)
+}
+
+// newServerWithDatabases returns a server with n databases.
+func newServerWithDatabases(n int) *server {
+	srv := &server{
+		dbs:         newDatabases(n),
+		pubsub:      newPubSub(),
+		events:      &keyspaceNotifier{},
+		blocking:    newBlockingState(),
+		aof:         &appendOnlyFile{},
+		rdb:         &rdbPersistence{lastSave: time.Now().Unix()},
+		connManager: NewConnectionManager(),
+		done:        make(chan struct{}),
+	}
+	srv.repl = newReplication(srv)
+	for dbid, db := range srv.dbs {
+		db.SetExpireHook(func(key string) {
+			srv.events.notify(notifyExpired, "expired", key, dbid)
+			srv.expired.add(dbid, key)
+		})
+		db.SetFieldExpireHook(func(key string, deleted bool) {
+			srv.events.notify(notifyHash, "hexpired", key, dbid)
+			if deleted {
+				srv.events.notify(notifyGeneric, "del", key, dbid)
+			}
+		})
+	}
+	return srv
+}
+
+// newClient returns the state of a new connection to the server.
+func (srv *server) newClient(conn io.Writer) *client {
+	return &client{
+		id:       srv.lastClientID.Add(1),
+		srv:      srv,
+		db:       srv.dbs[0],
+		conn:     conn,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// loadData fills the keyspace from disk: from the append-only file when it is
+// enabled, since it is the more complete of the two, and otherwise from the
+// dump file.
+func (srv *server) loadData(appendOnly bool) error {
+	start := time.Now()
+	if appendOnly {
+		loaded, err := srv.loadAppendOnlyFile(srv.aof.path)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", srv.aof.path, err)
+		}
+		if loaded > 0 {
+			log.Printf("DB loaded from append only file: %d commands in %v", loaded, time.Since(start))
+		}
+		return nil
+	}
+
+	loaded, err := loadRDBFile(srv.rdb.path, srv.dbs...)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", srv.rdb.path, err)
+	}
+	if loaded > 0 {
+		log.Printf("DB loaded from disk: %d keys in %v", loaded, time.Since(start))
+	}
+	return nil
+}
+
+// flushAll deletes every key of every database.
+func (srv *server) flushAll(async bool) {
+	for _, db := range srv.dbs {
+		db.Flush(async)
+	}
+}
+
+// listen opens the server's listening socket on address.
+func (srv *server) listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	srv.listener = listener
+	return nil
+}
+
+// serve accepts connections until the server is closed.
+func (srv *server) serve() error {
+	go srv.cron()
+
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			select {
+			case <-srv.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		go srv.handleConnection(conn)
+	}
+}
+
+// port returns the port the server listens on.
+func (srv *server) port() string {
+	if srv.listener == nil {
+		return "0"
+	}
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return port
+}
+
+// close stops accepting connections, background tasks and replication.
+// Connections already accepted are left to finish.
+func (srv *server) close() {
+	srv.closeOnce.Do(func() {
+		close(srv.done)
+		if srv.listener != nil {
+			srv.listener.Close()
+		}
+		srv.repl.close()
+	})
+}
+
+// cron runs periodic housekeeping such as active key expiry, the everysec
+// fsync of the append-only file and replication keepalives.
+func (srv *server) cron() {
+	ticker := time.NewTicker(time.Second / hz)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-srv.done:
+			return
+		case <-ticker.C:
+		}
+		srv.activeExpire()
+		srv.events.flush(srv.pubsub)
+		srv.aof.cron()
+		srv.repl.cron()
+	}
+}
+
+// activeExpire runs an active expiry cycle on each database and propagates
+// the keys it deleted. It holds keyspaceLock exclusively, like a write, so
+// that no key vanishes in the middle of a transaction or under a write's
+// check of the keyspace's dirty counter.
+func (srv *server) activeExpire() {
+	for _, db := range srv.dbs {
+		srv.keyspaceLock.Lock()
+		db.ActiveExpireCycle()
+		srv.propagateExpired()
+		srv.keyspaceLock.Unlock()
+	}
+}
+
+func (srv *server) handleConnection(conn net.Conn) {
+	srv.connManager.Increment(conn.RemoteAddr())
+	defer func() {
+		conn.Close()
+		srv.connManager.Decrement(conn.RemoteAddr())
+	}()
+
+	c := srv.newClient(conn)
+	defer srv.pubsub.unsubscribeAll(c)
+	defer srv.repl.removeReplica(c)
+
+	c.in = &connReader{conn: conn}
+	reader := bufio.NewReader(c.in)
+	c.reader = reader
+
+	for {
+		value, err := ReadRESP(reader)
+		if err != nil {
+			if err.Error() == "EOF" || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading RESP: %v", err)
+			return
+		}
+
+		command, err := value.ToCommand()
+		if err != nil {
+			c.push(SerializeError("ERR " + err.Error()))
+			continue
+		}
+
+		cmdUpper := make([]string, len(command))
+		for i, arg := range command {
+			if i == 0 {
+				cmdUpper[i] = strings.ToUpper(arg)
+			} else {
+				cmdUpper[i] = arg
+			}
+		}
+
+		// Hold the client lock until the reply is written so messages
+		// published to this client cannot overtake it.
+		c.mu.Lock()
+		response := executeCommand(c, cmdUpper)
+		conn.Write(response)
+		c.mu.Unlock()
+
+		if c.closeAfterReply {
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// replyStrings decodes an array of bulk strings.
+func replyStrings(t *testing.T, reply []byte) []string {
+	t.Helper()
+	value, err := ReadRESP(bufio.NewReader(bytes.NewReader(reply)))
+	if err != nil {
+		t.Fatalf("Bad reply %q: %v", reply, err)
+	}
+	values, err := value.ToCommand()
+	if err != nil {
+		t.Fatalf("Expected an array, got %q", reply)
+	}
+	return values
+}
+
+// replyMembers decodes an array of bulk strings, sorted, as set replies come
+// in no particular order.
+func replyMembers(t *testing.T, reply []byte) []string {
+	t.Helper()
+	members := replyStrings(t, reply)
+	slices.Sort(members)
+	return members
+}
+
+func TestProcessCommand_SetAlgebra(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"SADD", "a", "1", "2", "3", "4"})
+	executeTestCommand([]string{"SADD", "b", "3", "4", "5"})
+	executeTestCommand([]string{"SADD", "c", "4", "5", "6"})
+	executeTestCommand([]string{"SET", "str", "v"})
+	executeTestCommand([]string{"SET", "text", "v"})
+
+	members := []struct {
+		command  []string
+		expected []string
+	}{
+		{[]string{"SINTER", "a", "b"}, []string{"3", "4"}},
+		{[]string{"SINTER", "a", "b", "c"}, []string{"4"}},
+		{[]string{"SINTER", "a", "missing"}, []string{}},
+		{[]string{"SUNION", "a", "c", "missing"}, []string{"1", "2", "3", "4", "5", "6"}},
+		{[]string{"SDIFF", "a", "b"}, []string{"1", "2"}},
+		{[]string{"SDIFF", "a", "b", "c", "missing"}, []string{"1", "2"}},
+		{[]string{"SDIFF", "missing", "a"}, []string{}},
+	}
+	for _, test := range members {
+		if got := replyMembers(t, executeTestCommand(test.command)); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Command %v: expected %v, got %v", test.command, test.expected, got)
+		}
+	}
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"SINTER", "a", "str"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"SUNIONSTORE", "str", "b", "c"}, ":4\r\n"},
+		{[]string{"TYPE", "str"}, "+set\r\n"},
+		{[]string{"SINTERSTORE", "dest", "a", "b"}, ":2\r\n"},
+		{[]string{"SDIFFSTORE", "dest", "dest", "c"}, ":1\r\n"},
+		{[]string{"SMEMBERS", "dest"}, "*1\r\n$1\r\n3\r\n"},
+		{[]string{"SINTERSTORE", "dest", "a", "missing"}, ":0\r\n"},
+		{[]string{"EXISTS", "dest"}, ":0\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b"}, ":2\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "1"}, ":1\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "0"}, ":2\r\n"},
+		{[]string{"SINTERCARD", "1", "missing"}, ":0\r\n"},
+		{[]string{"SINTERCARD", "0", "a"}, "-ERR numkeys should be greater than 0\r\n"},
+		{[]string{"SINTERCARD", "3", "a", "b"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+		{[]string{"SINTERCARD", "2", "a", "b", "LIMIT", "-1"}, "-ERR LIMIT can't be negative\r\n"},
+		{[]string{"SINTERCARD", "1", "a", "b"}, "-ERR syntax error\r\n"},
+		{[]string{"SMISMEMBER", "a", "1", "5", "4"}, "*3\r\n:1\r\n:0\r\n:1\r\n"},
+		{[]string{"SMISMEMBER", "missing", "1"}, "*1\r\n:0\r\n"},
+		{[]string{"SMOVE", "a", "b", "1"}, ":1\r\n"},
+		{[]string{"SMOVE", "a", "b", "1"}, ":0\r\n"},
+		{[]string{"SMOVE", "a", "a", "2"}, ":1\r\n"},
+		{[]string{"SMOVE", "a", "new", "2"}, ":1\r\n"},
+		{[]string{"SMEMBERS", "new"}, "*1\r\n$1\r\n2\r\n"},
+		{[]string{"SMOVE", "new", "text", "2"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{[]string{"SMOVE", "new", "other", "2"}, ":1\r\n"},
+		{[]string{"EXISTS", "new"}, ":0\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+}
+
+func TestProcessCommand_SPOP_SRANDMEMBER(t *testing.T) {
+	testServer = newServer()
+	all := []string{"a", "b", "c", "d", "e"}
+	executeTestCommand(append([]string{"SADD", "s"}, all...))
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"SRANDMEMBER", "missing"}, "$-1\r\n"},
+		{[]string{"SRANDMEMBER", "missing", "3"}, "*0\r\n"},
+		{[]string{"SRANDMEMBER", "s", "0"}, "*0\r\n"},
+		{[]string{"SRANDMEMBER", "s", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SRANDMEMBER", "s", "-9223372036854775808"}, "-ERR value is out of range\r\n"},
+		{[]string{"SRANDMEMBER", "s", "-4611686018427387904"}, "-ERR value is out of range\r\n"},
+		{[]string{"SRANDMEMBER", "missing", "-4611686018427387903"}, "*0\r\n"},
+		{[]string{"SRANDMEMBER", "s", "-4611686018427387903"}, "-ERR value is out of range\r\n"},
+		{[]string{"SRANDMEMBER", "s", "-16777217"}, "-ERR value is out of range\r\n"},
+		{[]string{"SPOP", "missing"}, "$-1\r\n"},
+		{[]string{"SPOP", "missing", "2"}, "*0\r\n"},
+		{[]string{"SPOP", "s", "0"}, "*0\r\n"},
+		{[]string{"SPOP", "s", "-1"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"SPOP", "s", "1", "2"}, "-ERR wrong number of arguments for 'spop' command\r\n"},
+	}
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	// A positive count picks different members, at most all of them.
+	if got := replyMembers(t, executeTestCommand([]string{"SRANDMEMBER", "s", "10"})); !reflect.DeepEqual(got, all) {
+		t.Errorf("Expected every member, got %v", got)
+	}
+	if got := slices.Compact(replyMembers(t, executeTestCommand([]string{"SRANDMEMBER", "s", "3"}))); len(got) != 3 {
+		t.Errorf("Expected 3 different members, got %v", got)
+	}
+	// A negative count may repeat them.
+	repeated := replyMembers(t, executeTestCommand([]string{"SRANDMEMBER", "s", "-20"}))
+	if len(repeated) != 20 || len(slices.Compact(repeated)) == 20 {
+		t.Errorf("Expected 20 members with repeats, got %v", repeated)
+	}
+
+	popped := replyMembers(t, executeTestCommand([]string{"SPOP", "s", "3"}))
+	left := replyMembers(t, executeTestCommand([]string{"SMEMBERS", "s"}))
+	if got := slices.Sorted(slices.Values(append(popped, left...))); !reflect.DeepEqual(got, all) {
+		t.Errorf("Expected SPOP to remove what it returns, popped %v, left %v", popped, left)
+	}
+	executeTestCommand([]string{"SPOP", "s", "10"})
+	if got := string(executeTestCommand([]string{"EXISTS", "s"})); got != ":0\r\n" {
+		t.Errorf("Expected popping every member to delete the set, got %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+// Snapshot is a point-in-time view of the keyspace that stays consistent while
+// clients keep writing, so that BGSAVE never has to block them. Taking one only
+// copies the list of keys. Afterwards, the first modification of a key that
+// is still part of the snapshot preserves its value for the snapshot before
+// the change is applied (copy-on-write). Whether a key is still unmodified is
+// told by its version: every change moves it past the snapshot's version.
+type Snapshot struct {
+	s         *store
+	version   uint64
+	keys      []string
+	pos       int
+	preserved map[string]snapshotEntry
+}
+
+type snapshotEntry struct {
+	value    any
+	expireAt int64
+}
+
+// Snapshot starts a snapshot of the keyspace. It must be closed once done
+// with.
+func (s *store) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &Snapshot{
+		s:         s,
+		version:   s.version.Load(),
+		keys:      make([]string, 0, s.data.len()),
+		preserved: make(map[string]snapshotEntry),
+	}
+	for key := range s.data.keys() {
+		snap.keys = append(snap.keys, key)
+	}
+	s.snapshots = append(s.snapshots, snap)
+	return snap
+}
+
+// takeSnapshots snapshots each of dbs.
+func takeSnapshots(dbs []DataStore) []*Snapshot {
+	snaps := make([]*Snapshot, len(dbs))
+	for i, db := range dbs {
+		snaps[i] = db.Snapshot()
+	}
+	return snaps
+}
+
+func closeSnapshots(snaps []*Snapshot) {
+	for _, snap := range snaps {
+		snap.Close()
+	}
+}
+
+// Len returns the number of keys in the snapshot.
+func (snap *Snapshot) Len() int {
+	return len(snap.keys)
+}
+
+// Next passes the next key of the snapshot with its value and absolute expiry
+// (0 for none) to fn, and reports whether there was one. fn runs with the
+// store locked and must not keep references into the value.
+func (snap *Snapshot) Next(fn func(key string, value any, expireAt int64)) bool {
+	s := snap.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for snap.pos < len(snap.keys) {
+		key := snap.keys[snap.pos]
+		snap.pos++
+
+		if entry, ok := snap.preserved[key]; ok {
+			delete(snap.preserved, key)
+			fn(key, entry.value, entry.expireAt)
+			return true
+		}
+		// Keys changed since the snapshot was taken were preserved above.
+		if value, exists := s.data.get(key); exists && s.versions[key] <= snap.version {
+			fn(key, value, s.expires[key])
+			return true
+		}
+	}
+	return false
+}
+
+// Close detaches the snapshot from the store.
+func (snap *Snapshot) Close() {
+	s := snap.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, other := range s.snapshots {
+		if other == snap {
+			s.snapshots = append(s.snapshots[:i], s.snapshots[i+1:]...)
+			break
+		}
+	}
+	snap.preserved = nil
+}
+
+// preserve keeps the current value of key for the snapshot if the key is part
+// of it and has not been changed yet. The value is cloned unless the caller
+// is about to drop its reference from the keyspace anyway.
+func (snap *Snapshot) preserve(key string, clone bool) {
+	if _, done := snap.preserved[key]; done {
+		return
+	}
+	value, exists := snap.s.data.get(key)
+	if !exists || snap.s.versions[key] > snap.version {
+		return
+	}
+	if clone {
+		value = cloneValue(value)
+	}
+	snap.preserved[key] = snapshotEntry{value: value, expireAt: snap.s.expires[key]}
+}
+
+// preserveAll preserves every key of the snapshot not yet returned, for when
+// the store is about to have its keys replaced by another store's.
+func (snap *Snapshot) preserveAll() {
+	for _, key := range snap.keys[snap.pos:] {
+		snap.preserve(key, true)
+	}
+}
+
+// beforeWrite must be called before key's value or TTL is modified in place
+// or replaced. Callers must hold s.mu.
+func (s *store) beforeWrite(key string) {
+	for _, snap := range s.snapshots {
+		snap.preserve(key, true)
+	}
+}
+
+// beforeRemove is beforeWrite for a key about to be removed from the
+// keyspace, whose value can be handed to snapshots without a copy. Callers
+// must hold s.mu.
+func (s *store) beforeRemove(key string) {
+	for _, snap := range s.snapshots {
+		snap.preserve(key, false)
+	}
+}
+
+// cloneValue returns a deep copy of a stored value.
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case *quicklist:
+		return v.clone()
+	case *dict[struct{}]:
+		return v.clone(nil)
+	case *hash:
+		return v.clone()
+	case *zset:
+		return v.clone()
+	case *stream:
+		return v.clone()
+	default:
+		// Strings are immutable.
+		return v
+	}
+}
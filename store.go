@@ -1,236 +1,650 @@
 package main
 
 import (
+	"cmp"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
-// Grouped declaration; Common convention for package-level variables
+// Store errors carry their RESP error code so handlers can send them as is.
 var (
-	storeInstance DataStore
-	once          sync.Once
+	errWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errOutOfRange = errors.New("ERR index out of range")
 )
 
-func GetStore() DataStore {
-	once.Do(func() {
-		storeInstance = newStore()
-	})
-	return storeInstance
+// store keeps every key in a single keyspace so that a key holds exactly one
+// type. Values are a string, a *quicklist list, a *dict[struct{}] set, a
+// *hash, a *zset sorted set or a *stream.
+//
+// Every modification gives the key a new version from a counter that the
+// databases of a server share, so versions only ever grow, even across a
+// delete and re-create, or a key moving between databases.
+type store struct {
+	data     *dict[any]
+	expires  map[string]int64
+	versions map[string]uint64
+	version  *atomic.Uint64 // last version handed out
+	mu       sync.RWMutex
+
+	// snapshots in progress, which must see every key as it was when they
+	// were taken.
+	snapshots []*Snapshot
+
+	// hashTTLKeys holds the keys of hashes that may have fields with a TTL,
+	// for the active expiry cycle to go through.
+	hashTTLKeys map[string]struct{}
+
+	// onExpire is called for each key deleted because its TTL elapsed, and
+	// onFieldExpire for each hash that had fields deleted because theirs
+	// did, with whether that deleted the key.
+	onExpire      func(key string)
+	onFieldExpire func(key string, deleted bool)
 }
 
-type store struct {
-	strings map[string]string
-	lists   map[string][]string
-	sets    map[string]map[string]struct{}
-	hashes  map[string]map[string]string
-	mu      sync.RWMutex
+// SetOptions are the conditional and expiry arguments accepted by SET.
+type SetOptions struct {
+	NX       bool  // only write if the key does not exist
+	XX       bool  // only write if the key already exists
+	Get      bool  // the old value is wanted, so it must be a string
+	KeepTTL  bool  // retain the key's current TTL
+	ExpireAt int64 // absolute expiry in unix milliseconds, 0 for none
+
+	IfEq    bool   // only write if the current string value equals Compare
+	Compare string // value compared by IfEq
+	IfVer   bool   // only write if the key's version equals Version
+	Version uint64 // version compared by IfVer, 0 for a missing key
 }
 
 type DataStore interface {
 	Set(key, value string)
-	Get(key string) (string, bool)
+	SetWithOptions(key, value string, opts SetOptions) (old string, hadOld bool, written bool, err error)
+	Get(key string) (string, bool, error)
 	Exists(key string) bool
 	Delete(key string) bool
+	DeleteIfEqual(key, value string) (bool, error)
+	Version(key string) (uint64, bool)
+	Dirty() uint64
+	Flush(async bool)
+	RestoreKey(key string, value any, expireAt int64)
+	Dump(key string) (payload []byte, expireAt int64, exists bool)
+	Snapshot() *Snapshot
+	Type(key string) string
 	Incr(key string) (int, error)
 	Decr(key string) (int, error)
 
-	LPush(key string, values ...string) int
-	RPush(key string, values ...string) int
-	LPop(key string) (string, bool)
-	RPop(key string) (string, bool)
-	LRange(key string, start, stop int) []string
-	LLen(key string) int
+	LPush(key string, values ...string) (int, error)
+	RPush(key string, values ...string) (int, error)
+	LPop(key string) (string, bool, error)
+	RPop(key string) (string, bool, error)
+	LMPop(key string, left bool, count int) ([]string, error)
+	LMove(source, destination string, fromLeft, toLeft bool) (string, bool, error)
+	LRange(key string, start, stop int) ([]string, error)
+	LLen(key string) (int, error)
+	LPushX(key string, values ...string) (int, error)
+	RPushX(key string, values ...string) (int, error)
+	LIndex(key string, index int) (string, bool, error)
+	LSet(key string, index int, value string) error
+	LInsert(key string, before bool, pivot, value string) (int, error)
+	LRem(key string, count int, value string) (int, error)
+	LTrim(key string, start, stop int) error
+	LPos(key, value string, rank, count, maxLen int) ([]int, error)
+
+	SAdd(key string, members ...string) (int, error)
+	SMembers(key string) ([]string, error)
+	SIsMember(key string, member string) (bool, error)
+	SRem(key string, members ...string) (int, error)
+	SCard(key string) (int, error)
+	SMIsMember(key string, members ...string) ([]bool, error)
+	SInter(keys ...string) ([]string, error)
+	SUnion(keys ...string) ([]string, error)
+	SDiff(keys ...string) ([]string, error)
+	SInterStore(destination string, keys ...string) (int, error)
+	SUnionStore(destination string, keys ...string) (int, error)
+	SDiffStore(destination string, keys ...string) (int, error)
+	SInterCard(limit int, keys ...string) (int, error)
+	SMove(source, destination, member string) (bool, error)
+	SPop(key string, count int) ([]string, error)
+	SRandMember(key string, count int) ([]string, error)
+	SScan(key string, cursor uint64, args ScanArgs) (uint64, []string, error)
+
+	HSet(key string, fieldsAndValues ...string) (int, error)
+	HSetNX(key, field, value string) (bool, error)
+	HGet(key, field string) (string, bool, error)
+	HGetAll(key string) (map[string]string, error)
+	HDel(key string, fields ...string) (int, error)
+	HExists(key, field string) (bool, error)
+	HLen(key string) (int, error)
+	HMGet(key string, fields ...string) ([]string, []bool, error)
+	HKeys(key string) ([]string, error)
+	HVals(key string) ([]string, error)
+	HIncrBy(key, field string, delta int64) (int64, error)
+	HIncrByFloat(key, field string, delta float64) (float64, error)
+	HStrLen(key, field string) (int, error)
+	HRandField(key string, count int) ([]string, []string, error)
+	HExpire(key string, when int64, flags ExpireFlags, fields ...string) ([]int, error)
+	HExpireTime(key string, fields ...string) ([]int64, error)
+	HPersist(key string, fields ...string) ([]int, error)
+	HGetEx(key string, expireAt int64, persist bool, fields ...string) ([]string, []bool, error)
+	HSetEx(key string, opts HSetExOptions, fieldsAndValues ...string) (bool, error)
+	HScan(key string, cursor uint64, args ScanArgs) (uint64, []string, error)
+
+	ZAdd(key string, opts ZAddOptions, members ...ScoredMember) (int, error)
+	ZIncrBy(key string, opts ZAddOptions, member string, delta float64) (float64, bool, error)
+	ZRem(key string, members ...string) (int, error)
+	ZScore(key, member string) (float64, bool, error)
+	ZCard(key string) (int, error)
+	ZCount(key string, r ZScoreRange) (int, error)
+	ZLexCount(key string, r ZLexRange) (int, error)
+	ZRank(key, member string, reverse bool) (int, float64, bool, error)
+	ZRange(key string, q ZRangeQuery) ([]ScoredMember, error)
+	ZRemRange(key string, q ZRangeQuery) (int, error)
+	ZPop(key string, count int, max bool) ([]ScoredMember, error)
+	ZReplace(key string, members []ScoredMember) int
+	ZScan(key string, cursor uint64, args ScanArgs) (uint64, []ScoredMember, error)
+
+	GeoSearch(key string, q GeoQuery) ([]GeoPoint, error)
+
+	XAdd(key string, args XAddArgs, fields []string) (StreamID, int, bool, error)
+	XRange(key string, start, end StreamID, count int, rev bool) ([]StreamEntry, error)
+	XLen(key string) (int, error)
+	XLastID(key string) (StreamID, bool, error)
+	XDel(key string, ids ...StreamID) (int, error)
+	XTrim(key string, t StreamTrim) (int, error)
+	XSetID(key string, lastID StreamID, entriesAdded *uint64, maxDeletedID *StreamID) error
+	XGroupCreate(key, group string, id StreamID, entriesRead int64, mkStream bool) error
+	XGroupSetID(key, group string, id StreamID, entriesRead int64) error
+	XGroupDestroy(key, group string) (bool, error)
+	XGroupCreateConsumer(key, group, consumer string) (bool, error)
+	XGroupDelConsumer(key, group, consumer string) (int, bool, error)
+	XGroupExists(key, group string) error
+	XReadGroup(key, group, consumer string, args XReadGroupArgs) (XReadGroupResult, error)
+	XAck(key, group string, ids ...StreamID) (int, error)
+	XPendingSummary(key, group string) (PendingSummary, error)
+	XPending(key, group string, q PendingQuery) ([]PendingEntry, error)
+	XClaim(key, group, consumer string, ids []StreamID, args XClaimArgs) (XClaimResult, error)
+	XAutoClaim(key, group, consumer string, start StreamID, count int, args XClaimArgs) (XClaimResult, error)
+	XInfoStream(key string, full bool, count int) (StreamInfo, error)
+	XInfoGroups(key string) ([]StreamGroupInfo, error)
+	XInfoConsumers(key, group string) ([]StreamConsumerInfo, error)
+
+	Expire(key string, when int64, flags ExpireFlags) bool
+	ExpireTime(key string) int64
+	Persist(key string) bool
+	ActiveExpireCycle() int
+	SetExpireHook(fn func(key string))
+	SetFieldExpireHook(fn func(key string, deleted bool))
+	ForEachKey(fn func(key string) bool)
+	Scan(cursor uint64, args ScanArgs) (uint64, []string)
+	Keys(pattern string) []string
+	RandomKey() (string, bool)
+	DBSize() int
+	Rename(source, destination string, nx bool) (bool, error)
+	Copy(source string, target DataStore, destination string, replace bool) (bool, error)
+	Move(key string, target DataStore) (bool, error)
+	SwapWith(other DataStore)
+}
 
-	SAdd(key string, members ...string) int
-	SMembers(key string) []string
-	SIsMember(key string, member string) bool
-	SRem(key string, members ...string) int
-	SCard(key string) int
+func newStore() DataStore {
+	return newStoreSharing(new(atomic.Uint64))
+}
 
-	HSet(key, field, value string) int
-	HGet(key, field string) (string, bool)
-	HGetAll(key string) map[string]string
-	HDel(key string, fields ...string) int
-	HExists(key, field string) bool
-	HLen(key string) int
+// newDatabases returns the n numbered databases of a server.
+func newDatabases(n int) []DataStore {
+	version := new(atomic.Uint64)
+	dbs := make([]DataStore, n)
+	for i := range dbs {
+		dbs[i] = newStoreSharing(version)
+	}
+	return dbs
 }
 
-func newStore() DataStore {
+// newStoreSharing returns a store that hands out versions from version.
+func newStoreSharing(version *atomic.Uint64) *store {
 	return &store{
-		strings: make(map[string]string),
-		lists:   make(map[string][]string),
-		sets:    make(map[string]map[string]struct{}),
-		hashes:  make(map[string]map[string]string),
+		data:        newDict[any](),
+		expires:     make(map[string]int64),
+		versions:    make(map[string]uint64),
+		version:     version,
+		hashTTLKeys: make(map[string]struct{}),
 	}
 }
 
-func (s *store) Set(key, value string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.strings[key] = value
+// lookupTyped returns the value stored at key when it holds a T. A missing
+// key yields the zero value and false, a key of another type errWrongType.
+// Callers must hold s.mu.
+func lookupTyped[T any](s *store, key string) (T, bool, error) {
+	var zero T
+	s.expireIfNeeded(key)
+
+	value, exists := s.data.get(key)
+	if !exists {
+		return zero, false, nil
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, false, errWrongType
+	}
+	return typed, true, nil
 }
 
-func (s *store) Get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// typeName returns the name TYPE reports for a stored value.
+func typeName(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case *quicklist:
+		return "list"
+	case *dict[struct{}]:
+		return "set"
+	case *hash:
+		return "hash"
+	case *zset:
+		return "zset"
+	case *stream:
+		return "stream"
+	default:
+		return "none"
+	}
+}
 
-	value, exists := s.strings[key]
-	return value, exists
+// exists reports whether key is present. Callers must hold s.mu.
+func (s *store) exists(key string) bool {
+	return s.data.has(key)
 }
 
-func (s *store) Exists(key string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// value returns the value at key, or nil. Callers must hold s.mu.
+func (s *store) value(key string) any {
+	value, _ := s.data.get(key)
+	return value
+}
 
-	if _, exists := s.strings[key]; exists {
-		return true
-	}
-	if _, exists := s.lists[key]; exists {
-		return true
+// touch records a modification of key by giving it a new version, and
+// tracks it for active expiry if it is now a hash with field TTLs. Callers
+// must hold s.mu.
+func (s *store) touch(key string) {
+	s.versions[key] = s.version.Add(1)
+	if h, ok := s.value(key).(*hash); ok && len(h.expires) > 0 {
+		s.hashTTLKeys[key] = struct{}{}
 	}
-	if _, exists := s.sets[key]; exists {
-		return true
+}
+
+// removeKey deletes key along with its expiry and version. Callers must hold
+// s.mu.
+func (s *store) removeKey(key string) bool {
+	if !s.data.has(key) {
+		return false
 	}
-	if _, exists := s.hashes[key]; exists {
-		return true
+	s.beforeRemove(key)
+	s.data.delete(key)
+	delete(s.expires, key)
+	delete(s.versions, key)
+	delete(s.hashTTLKeys, key)
+	s.version.Add(1)
+	return true
+}
+
+// ForEachKey calls fn with every key that has not expired, until fn returns
+// false. fn runs with the store locked and must not call back into it.
+func (s *store) ForEachKey(fn func(key string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := mstime()
+	for key := range s.data.keys() {
+		if when, ok := s.expires[key]; ok && when <= now {
+			continue
+		}
+		if !fn(key) {
+			return
+		}
 	}
-	return false
 }
 
-func (s *store) Delete(key string) bool {
+func (s *store) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeRemove(key)
+	s.data.set(key, value)
+	delete(s.expires, key)
+	s.touch(key)
+}
+
+// SetWithOptions writes value under key honouring the NX/XX, IFEQ and IFVER
+// conditions and the expiry options in a single critical section. It returns
+// the previous string value, whether there was one and whether the write
+// happened. Like plain SET it replaces a value of any type, unless opts.Get
+// asks for the old value and that value is not a string.
+func (s *store) SetWithOptions(key, value string, opts SetOptions) (string, bool, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	found := false
-	if _, exists := s.strings[key]; exists {
-		delete(s.strings, key)
-		found = true
+	old, hadOld, err := lookupTyped[string](s, key)
+	if err != nil && opts.Get {
+		return "", false, false, err
 	}
-	if _, exists := s.lists[key]; exists {
-		delete(s.lists, key)
-		found = true
+
+	if opts.IfEq && err != nil {
+		return "", false, false, err
+	}
+
+	exists := s.exists(key)
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		return old, hadOld, false, nil
 	}
-	if _, exists := s.sets[key]; exists {
-		delete(s.sets, key)
-		found = true
+	if (opts.IfEq && (!hadOld || old != opts.Compare)) || (opts.IfVer && s.versions[key] != opts.Version) {
+		return old, hadOld, false, nil
 	}
-	if _, exists := s.hashes[key]; exists {
-		delete(s.hashes, key)
-		found = true
+
+	s.beforeRemove(key)
+	s.data.set(key, value)
+	s.touch(key)
+	if opts.ExpireAt > 0 {
+		s.expires[key] = opts.ExpireAt
+		s.expireIfNeeded(key)
+	} else if !opts.KeepTTL {
+		delete(s.expires, key)
 	}
-	return found
+	return old, hadOld, true, nil
 }
 
-func (s *store) Incr(key string) (int, error) {
+func (s *store) Get(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, exists := s.strings[key]
-	if !exists {
-		s.strings[key] = "1"
-		return 1, nil
+	return lookupTyped[string](s, key)
+}
+
+func (s *store) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	return s.exists(key)
+}
+
+func (s *store) Delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expireIfNeeded(key) {
+		return false
 	}
 
-	num, err := strconv.Atoi(value)
-	if err != nil {
-		return 0, err
+	return s.removeKey(key)
+}
+
+// DeleteIfEqual deletes key only if it holds the string value.
+func (s *store) DeleteIfEqual(key, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists, err := lookupTyped[string](s, key)
+	if err != nil || !exists || current != value {
+		return false, err
 	}
+	return s.removeKey(key), nil
+}
 
-	num++
-	s.strings[key] = strconv.Itoa(num)
-	return num, nil
+// Version returns the current version of key.
+func (s *store) Version(key string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	version, exists := s.versions[key]
+	return version, exists
 }
 
-func (s *store) Decr(key string) (int, error) {
+// Dirty returns a counter that moves on every change to the keyspace of any
+// database, so comparing two readings tells whether anything was modified in
+// between.
+func (s *store) Dirty() uint64 {
+	return s.version.Load()
+}
+
+// Flush deletes every key. Unless async is set the tables are emptied in
+// place before it returns; otherwise they are swapped for new ones, leaving
+// the old ones to the garbage collector, which frees them in the background.
+func (s *store) Flush(async bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, exists := s.strings[key]
-	if !exists {
-		s.strings[key] = "-1"
-		return -1, nil
+	if len(s.snapshots) > 0 {
+		for key := range s.data.keys() {
+			s.beforeRemove(key)
+		}
+	}
+	if async {
+		s.data = newDict[any]()
+		s.expires = make(map[string]int64)
+		s.versions = make(map[string]uint64)
+		s.hashTTLKeys = make(map[string]struct{})
+	} else {
+		s.data.clear()
+		clear(s.expires)
+		clear(s.versions)
+		clear(s.hashTTLKeys)
 	}
+	s.version.Add(1)
+}
+
+func (s *store) Type(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIfNeeded(key)
+
+	return typeName(s.value(key))
+}
+
+func (s *store) Incr(key string) (int, error) {
+	return s.incrBy(key, 1)
+}
+
+func (s *store) Decr(key string) (int, error) {
+	return s.incrBy(key, -1)
+}
+
+func (s *store) incrBy(key string, delta int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	num, err := strconv.Atoi(value)
+	value, exists, err := lookupTyped[string](s, key)
 	if err != nil {
 		return 0, err
 	}
 
-	num--
-	s.strings[key] = strconv.Itoa(num)
+	num := 0
+	if exists {
+		num, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, errNotInteger
+		}
+	}
+
+	num += delta
+	s.beforeRemove(key)
+	s.data.set(key, strconv.Itoa(num))
+	s.touch(key)
 	return num, nil
 }
 
-func (s *store) LPush(key string, values ...string) int {
+// lookupList returns the list at key, creating an empty one when absent.
+// Callers must hold s.mu and store the list if they leave it non-empty.
+func lookupList(s *store, key string) (*quicklist, error) {
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || exists {
+		return list, err
+	}
+	return newQuicklist(), nil
+}
+
+// storeList stores a list that was changed, or deletes it once empty.
+// Callers must hold s.mu.
+func storeList(s *store, key string, list *quicklist) {
+	if list.len() == 0 {
+		s.removeKey(key)
+		return
+	}
+	s.data.set(key, list)
+	s.touch(key)
+}
+
+func (s *store) LPush(key string, values ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list := s.lists[key]
-	for i := len(values) - 1; i >= 0; i-- {
-		list = append([]string{values[i]}, list...)
+	list, err := lookupList(s, key)
+	if err != nil {
+		return 0, err
 	}
-	s.lists[key] = list
-	return len(list)
+
+	s.beforeWrite(key)
+	for _, value := range values {
+		list.pushFront(value)
+	}
+	storeList(s, key, list)
+	return list.len(), nil
 }
 
-func (s *store) RPush(key string, values ...string) int {
+func (s *store) RPush(key string, values ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list := s.lists[key]
-	list = append(list, values...)
-	s.lists[key] = list
-	return len(list)
+	list, err := lookupList(s, key)
+	if err != nil {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	for _, value := range values {
+		list.pushBack(value)
+	}
+	storeList(s, key, list)
+	return list.len(), nil
 }
 
-func (s *store) LPop(key string) (string, bool) {
+func (s *store) LPop(key string) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, exists := s.lists[key]
-	if !exists || len(list) == 0 {
-		return "", false
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return "", false, err
 	}
 
-	value := list[0]
-	s.lists[key] = list[1:]
+	s.beforeWrite(key)
+	value, _ := list.popFront()
+	storeList(s, key, list)
+	return value, true, nil
+}
+
+func (s *store) RPop(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(s.lists[key]) == 0 {
-		delete(s.lists, key)
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return "", false, err
 	}
 
-	return value, true
+	s.beforeWrite(key)
+	value, _ := list.popBack()
+	storeList(s, key, list)
+	return value, true, nil
 }
 
-func (s *store) RPop(key string) (string, bool) {
+// LMPop pops up to count elements from the head of a list, or from its tail
+// when left is false, and returns them in the order they were popped, nil when
+// there is no list.
+func (s *store) LMPop(key string, left bool, count int) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	list, exists := s.lists[key]
-	if !exists || len(list) == 0 {
-		return "", false
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if count == 0 {
+		return []string{}, nil
+	}
+
+	s.beforeWrite(key)
+	popped := make([]string, min(count, list.len()))
+	for i := range popped {
+		if left {
+			popped[i], _ = list.popFront()
+		} else {
+			popped[i], _ = list.popBack()
+		}
 	}
+	storeList(s, key, list)
+	return popped, nil
+}
 
-	value := list[len(list)-1]
-	s.lists[key] = list[:len(list)-1]
+// LMove pops an element from the head of the source list, or its tail when
+// fromLeft is false, and pushes it to the head of the destination list, or
+// its tail when toLeft is false. Nothing is moved when the destination holds
+// something other than a list.
+func (s *store) LMove(source, destination string, fromLeft, toLeft bool) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(s.lists[key]) == 0 {
-		delete(s.lists, key)
+	list, exists, err := lookupTyped[*quicklist](s, source)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	if _, _, err := lookupTyped[*quicklist](s, destination); err != nil {
+		return "", false, err
 	}
 
-	return value, true
+	s.beforeWrite(source)
+	var value string
+	if fromLeft {
+		value, _ = list.popFront()
+	} else {
+		value, _ = list.popBack()
+	}
+	if source == destination {
+		// Rotating a list never empties it, so the key keeps its TTL.
+		if toLeft {
+			list.pushFront(value)
+		} else {
+			list.pushBack(value)
+		}
+		s.touch(source)
+		return value, true, nil
+	}
+	storeList(s, source, list)
+
+	s.beforeWrite(destination)
+	target, _ := lookupList(s, destination)
+	if toLeft {
+		target.pushFront(value)
+	} else {
+		target.pushBack(value)
+	}
+	storeList(s, destination, target)
+	return value, true, nil
 }
 
-func (s *store) LRange(key string, start, stop int) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) LRange(key string, start, stop int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	list, exists := s.lists[key]
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
-		return []string{}
+		return []string{}, nil
 	}
 
-	length := len(list)
+	length := list.len()
 
 	if start < 0 {
 		start = length + start
@@ -247,201 +661,901 @@ func (s *store) LRange(key string, start, stop int) []string {
 	}
 
 	if start > stop || start >= length {
-		return []string{}
+		return []string{}, nil
+	}
+	return list.rangeElems(start, stop), nil
+}
+
+func (s *store) LLen(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return 0, err
 	}
+	return list.len(), nil
+}
 
-	result := make([]string, stop-start+1)
-	copy(result, list[start:stop+1])
-	return result
+// LPushX pushes values to the head of a list only if it exists, and returns
+// its length, 0 when there is no list.
+func (s *store) LPushX(key string, values ...string) (int, error) {
+	return s.pushExisting(key, true, values)
 }
 
-func (s *store) LLen(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// RPushX is LPushX for the tail of a list.
+func (s *store) RPushX(key string, values ...string) (int, error) {
+	return s.pushExisting(key, false, values)
+}
+
+func (s *store) pushExisting(key string, left bool, values []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	list, exists := s.lists[key]
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	for _, value := range values {
+		if left {
+			list.pushFront(value)
+		} else {
+			list.pushBack(value)
+		}
+	}
+	s.touch(key)
+	return list.len(), nil
+}
+
+// listIndex resolves an index that may count back from the end of a list of
+// the given length, and reports whether it is in range.
+func listIndex(index, length int) (int, bool) {
+	if index < 0 {
+		index += length
+	}
+	return index, index >= 0 && index < length
+}
+
+func (s *store) LIndex(key string, index int) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	i, ok := listIndex(index, list.len())
+	if !ok {
+		return "", false, nil
+	}
+	value, _ := list.index(i)
+	return value, true, nil
+}
+
+func (s *store) LSet(key string, index int, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil {
+		return err
+	}
 	if !exists {
-		return 0
+		return errNoSuchKey
+	}
+	i, ok := listIndex(index, list.len())
+	if !ok {
+		return errOutOfRange
 	}
-	return len(list)
+
+	s.beforeWrite(key)
+	list.set(i, value)
+	s.touch(key)
+	return nil
 }
 
-func (s *store) SAdd(key string, members ...string) int {
+// LInsert inserts value before or after the first element equal to pivot,
+// and returns the length of the list, 0 when there is no list and -1 when
+// pivot is not in it.
+func (s *store) LInsert(key string, before bool, pivot, value string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, exists := s.sets[key]
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	at := -1
+	list.each(false, func(i int, v string) bool {
+		if v == pivot {
+			at = i
+			return false
+		}
+		return true
+	})
+	if at < 0 {
+		return -1, nil
+	}
+	if !before {
+		at++
+	}
+
+	s.beforeWrite(key)
+	list.insert(at, value)
+	s.touch(key)
+	return list.len(), nil
+}
+
+// LRem removes the first count elements equal to value, the last -count when
+// count is negative, or all of them when it is 0, and returns how many it
+// removed.
+func (s *store) LRem(key string, count int, value string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	var removed int
+	if count < 0 {
+		removed = list.remove(value, -count, true)
+	} else {
+		removed = list.remove(value, count, false)
+	}
+	if removed > 0 {
+		storeList(s, key, list)
+	}
+	return removed, nil
+}
+
+// LTrim keeps only the elements from start to stop inclusive, which count
+// back from the end when negative, deleting the list when none are left.
+func (s *store) LTrim(key string, start, stop int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return err
+	}
+
+	length := list.len()
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+	if start == 0 && stop == length-1 {
+		return nil
+	}
+
+	s.beforeWrite(key)
+	if start > stop {
+		s.removeKey(key)
+		return nil
+	}
+	list.trim(start, stop)
+	s.touch(key)
+	return nil
+}
+
+// LPos returns the indexes of the elements equal to value. It skips the
+// first rank-1 matches, or searches from the tail when rank is negative,
+// returns at most count indexes, all when count is 0, and compares at most
+// maxLen elements, all when maxLen is 0.
+func (s *store) LPos(key, value string, rank, count, maxLen int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, exists, err := lookupTyped[*quicklist](s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	var matches []int
+	compared := 0
+	list.each(rank < 0, func(i int, v string) bool {
+		if maxLen > 0 && compared == maxLen {
+			return false
+		}
+		compared++
+		if v != value {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		matches = append(matches, i)
+		return count == 0 || len(matches) < count
+	})
+	return matches, nil
+}
+
+func (s *store) SAdd(key string, members ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, exists, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return 0, err
+	}
 	if !exists {
-		set = make(map[string]struct{})
-		s.sets[key] = set
+		set = newDict[struct{}]()
+		s.data.set(key, set)
 	}
 
+	s.beforeWrite(key)
 	added := 0
 	for _, member := range members {
-		if _, exists := set[member]; !exists {
-			set[member] = struct{}{}
+		if set.set(member, struct{}{}) {
 			added++
 		}
 	}
-	return added
+	if added > 0 {
+		s.touch(key)
+	}
+	return added, nil
 }
 
-func (s *store) SMembers(key string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) SMembers(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	set, exists := s.sets[key]
-	if !exists {
-		return []string{}
+	set, _, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return nil, err
 	}
 
-	members := make([]string, 0, len(set))
-	for member := range set {
-		members = append(members, member)
-	}
-	return members
+	return slices.AppendSeq(make([]string, 0, set.len()), set.keys()), nil
 }
 
-func (s *store) SIsMember(key string, member string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) SIsMember(key string, member string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	set, exists := s.sets[key]
-	if !exists {
-		return false
+	set, _, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return false, err
 	}
 
-	_, isMember := set[member]
-	return isMember
+	return set.has(member), nil
 }
 
-func (s *store) SRem(key string, members ...string) int {
+func (s *store) SRem(key string, members ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	set, exists := s.sets[key]
-	if !exists {
-		return 0
+	set, exists, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil || !exists {
+		return 0, err
 	}
 
+	s.beforeWrite(key)
 	removed := 0
 	for _, member := range members {
-		if _, exists := set[member]; exists {
-			delete(set, member)
+		if set.delete(member) {
 			removed++
 		}
 	}
 
-	if len(set) == 0 {
-		delete(s.sets, key)
+	if removed > 0 {
+		s.touch(key)
+	}
+	if set.len() == 0 {
+		s.removeKey(key)
 	}
 
-	return removed
+	return removed, nil
 }
 
-func (s *store) SCard(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) SCard(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	set, exists := s.sets[key]
-	if !exists {
-		return 0
+	set, _, err := lookupTyped[*dict[struct{}]](s, key)
+	return set.len(), err
+}
+
+func (s *store) SMIsMember(key string, members ...string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, _, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]bool, len(members))
+	for i, member := range members {
+		result[i] = set.has(member)
 	}
-	return len(set)
+	return result, nil
 }
 
-func (s *store) HSet(key, field, value string) int {
+// setOp is a set algebra operation of SINTER, SUNION or SDIFF.
+type setOp int
+
+const (
+	setInter setOp = iota
+	setUnion
+	setDiff
+)
+
+// combineSets applies op to the sets at keys, a missing key counting as an
+// empty set, and returns a new set. Callers must hold s.mu.
+func (s *store) combineSets(op setOp, keys []string) (*dict[struct{}], error) {
+	sets := make([]*dict[struct{}], len(keys))
+	for i, key := range keys {
+		set, _, err := lookupTyped[*dict[struct{}]](s, key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	result := newDict[struct{}]()
+	switch op {
+	case setInter:
+		// Checking the members of the smallest set against the others
+		// does the least work.
+		smallest := slices.MinFunc(sets, func(a, b *dict[struct{}]) int {
+			return cmp.Compare(a.len(), b.len())
+		})
+	members:
+		for member := range smallest.keys() {
+			for _, set := range sets {
+				if !set.has(member) {
+					continue members
+				}
+			}
+			result.set(member, struct{}{})
+		}
+	case setUnion:
+		for _, set := range sets {
+			for member := range set.keys() {
+				result.set(member, struct{}{})
+			}
+		}
+	case setDiff:
+	diff:
+		for member := range sets[0].keys() {
+			for _, set := range sets[1:] {
+				if set.has(member) {
+					continue diff
+				}
+			}
+			result.set(member, struct{}{})
+		}
+	}
+	return result, nil
+}
+
+func (s *store) setOpMembers(op setOp, keys []string) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		hash = make(map[string]string)
-		s.hashes[key] = hash
+	result, err := s.combineSets(op, keys)
+	if err != nil {
+		return nil, err
 	}
+	return slices.AppendSeq(make([]string, 0, result.len()), result.keys()), nil
+}
 
-	_, existed := hash[field]
-	hash[field] = value
+// setOpStore stores the result of op at destination, replacing whatever it
+// held, or deletes destination when the result is empty. It returns the
+// size of the result.
+func (s *store) setOpStore(op setOp, destination string, keys []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if existed {
-		return 0
+	result, err := s.combineSets(op, keys)
+	if err != nil {
+		return 0, err
 	}
-	return 1
+	if result.len() == 0 {
+		s.removeKey(destination)
+		return 0, nil
+	}
+	s.beforeRemove(destination)
+	s.data.set(destination, result)
+	delete(s.expires, destination)
+	s.touch(destination)
+	return result.len(), nil
 }
 
-func (s *store) HGet(key, field string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// SInter returns the members of the intersection of the sets at keys.
+func (s *store) SInter(keys ...string) ([]string, error) {
+	return s.setOpMembers(setInter, keys)
+}
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		return "", false
+// SUnion returns the members of the union of the sets at keys.
+func (s *store) SUnion(keys ...string) ([]string, error) {
+	return s.setOpMembers(setUnion, keys)
+}
+
+// SDiff returns the members of the first set that are in none of the others.
+func (s *store) SDiff(keys ...string) ([]string, error) {
+	return s.setOpMembers(setDiff, keys)
+}
+
+func (s *store) SInterStore(destination string, keys ...string) (int, error) {
+	return s.setOpStore(setInter, destination, keys)
+}
+
+func (s *store) SUnionStore(destination string, keys ...string) (int, error) {
+	return s.setOpStore(setUnion, destination, keys)
+}
+
+func (s *store) SDiffStore(destination string, keys ...string) (int, error) {
+	return s.setOpStore(setDiff, destination, keys)
+}
+
+// SInterCard returns the size of the intersection of the sets at keys,
+// stopping once it reaches limit when limit is not 0.
+func (s *store) SInterCard(limit int, keys ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets := make([]*dict[struct{}], len(keys))
+	for i, key := range keys {
+		set, _, err := lookupTyped[*dict[struct{}]](s, key)
+		if err != nil {
+			return 0, err
+		}
+		sets[i] = set
 	}
+	smallest := slices.MinFunc(sets, func(a, b *dict[struct{}]) int {
+		return cmp.Compare(a.len(), b.len())
+	})
 
-	value, exists := hash[field]
-	return value, exists
+	count := 0
+members:
+	for member := range smallest.keys() {
+		for _, set := range sets {
+			if !set.has(member) {
+				continue members
+			}
+		}
+		count++
+		if count == limit {
+			break
+		}
+	}
+	return count, nil
 }
 
-func (s *store) HGetAll(key string) map[string]string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// SMove moves member from the source set to the destination set, and reports
+// whether it was in the source.
+func (s *store) SMove(source, destination, member string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		return map[string]string{}
+	set, exists, err := lookupTyped[*dict[struct{}]](s, source)
+	if err != nil {
+		return false, err
+	}
+	target, targetExists, err := lookupTyped[*dict[struct{}]](s, destination)
+	if err != nil {
+		return false, err
+	}
+	if !exists || !set.has(member) {
+		return false, nil
+	}
+	if source == destination {
+		return true, nil
+	}
+
+	s.beforeWrite(source)
+	set.delete(member)
+	if set.len() == 0 {
+		s.removeKey(source)
+	} else {
+		s.touch(source)
+	}
+
+	s.beforeWrite(destination)
+	if !targetExists {
+		target = newDict[struct{}]()
+		s.data.set(destination, target)
+	}
+	target.set(member, struct{}{})
+	s.touch(destination)
+	return true, nil
+}
+
+// randomRepeatMax bounds how many members SRANDMEMBER and HRANDFIELD pick
+// for a negative count, as the reply is built in memory.
+const randomRepeatMax = 1 << 24
+
+var errRandomCount = errors.New("ERR value is out of range")
+
+// randomKeys returns count keys of a set or hash picked at random, all
+// different and at most all of them, or when repeat is set, each picked
+// independently so that they may repeat.
+func randomKeys[V any](d *dict[V], count int, repeat bool) []string {
+	if count == 1 && d.len() > 0 {
+		key, _ := d.randomKey()
+		return []string{key}
+	}
+	members := slices.AppendSeq(make([]string, 0, d.len()), d.keys())
+	if repeat {
+		picked := make([]string, count)
+		for i := range picked {
+			picked[i] = members[rand.Intn(len(members))]
+		}
+		return picked
+	}
+	count = min(count, len(members))
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
+
+// SPop removes up to count members picked at random from a set and returns
+// them, nil when there is no set.
+func (s *store) SPop(key string, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, exists, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if count == 0 {
+		return []string{}, nil
+	}
+
+	s.beforeWrite(key)
+	popped := randomKeys(set, count, false)
+	for _, member := range popped {
+		set.delete(member)
+	}
+	if set.len() == 0 {
+		s.removeKey(key)
+	} else {
+		s.touch(key)
+	}
+	return popped, nil
+}
+
+// SRandMember returns up to count different members of a set picked at
+// random, or when count is negative, -count members that may repeat, of
+// which there may be at most randomRepeatMax.
+func (s *store) SRandMember(key string, count int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, exists, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists || count == 0 {
+		return []string{}, nil
+	}
+	if count < 0 {
+		if -count > randomRepeatMax {
+			return nil, errRandomCount
+		}
+		return randomKeys(set, -count, true), nil
+	}
+	return randomKeys(set, count, false), nil
+}
+
+// HSet sets each field to the value following it, clearing any TTL the field
+// had, and returns how many fields were added rather than updated.
+func (s *store) HSet(key string, fieldsAndValues ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := lookupHash(s, key)
+	if err != nil {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	added := 0
+	for i := 0; i+1 < len(fieldsAndValues); i += 2 {
+		field, value := fieldsAndValues[i], fieldsAndValues[i+1]
+		if _, existed := h.fields.get(field); !existed {
+			added++
+		}
+		h.set(field, value)
+	}
+	s.data.set(key, h)
+	s.touch(key)
+	return added, nil
+}
+
+// HSetNX sets field only if the hash does not hold it yet, and reports
+// whether it did.
+func (s *store) HSetNX(key, field, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := lookupHash(s, key)
+	if err != nil {
+		return false, err
 	}
+	if _, exists := h.fields.get(field); exists {
+		return false, nil
+	}
+
+	s.beforeWrite(key)
+	h.set(field, value)
+	s.data.set(key, h)
+	s.touch(key)
+	return true, nil
+}
+
+// lookupHash returns the hash at key, creating an empty one when absent.
+// Callers must hold s.mu and store the hash once they have added to it.
+func lookupHash(s *store, key string) (*hash, error) {
+	h, exists, err := findHash(s, key)
+	if err != nil || exists {
+		return h, err
+	}
+	return newHash(), nil
+}
+
+func (s *store) HGet(key, field string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	result := make(map[string]string, len(hash))
-	for field, value := range hash {
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return "", false, err
+	}
+
+	value, exists := h.fields.get(field)
+	return value, exists, nil
+}
+
+func (s *store) HGetAll(key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	result := make(map[string]string, h.len())
+	for field, value := range h.fields.all() {
 		result[field] = value
 	}
-	return result
+	return result, nil
 }
 
-func (s *store) HDel(key string, fields ...string) int {
+func (s *store) HDel(key string, fields ...string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		return 0
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return 0, err
 	}
 
+	s.beforeWrite(key)
 	deleted := 0
 	for _, field := range fields {
-		if _, exists := hash[field]; exists {
-			delete(hash, field)
+		if h.delete(field) {
 			deleted++
 		}
 	}
 
-	if len(hash) == 0 {
-		delete(s.hashes, key)
+	if deleted > 0 {
+		s.touch(key)
+	}
+	if h.len() == 0 {
+		s.removeKey(key)
 	}
 
-	return deleted
+	return deleted, nil
 }
 
-func (s *store) HExists(key, field string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) HExists(key, field string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		return false
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return false, err
 	}
 
-	_, exists = hash[field]
-	return exists
+	_, exists = h.fields.get(field)
+	return exists, nil
 }
 
-func (s *store) HLen(key string) int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *store) HLen(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	hash, exists := s.hashes[key]
-	if !exists {
-		return 0
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return h.len(), nil
+}
+
+// HMGet returns the values of fields, and whether the hash holds each.
+func (s *store) HMGet(key string, fields ...string) ([]string, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values, exist := make([]string, len(fields)), make([]bool, len(fields))
+	if exists {
+		for i, field := range fields {
+			values[i], exist[i] = h.fields.get(field)
+		}
+	}
+	return values, exist, nil
+}
+
+func (s *store) HKeys(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	fields := make([]string, 0, h.len())
+	for field := range h.fields.keys() {
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func (s *store) HVals(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	values := make([]string, 0, h.len())
+	for _, value := range h.fields.all() {
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+var (
+	errHashNotInteger = errors.New("ERR hash value is not an integer")
+	errHashNotFloat   = errors.New("ERR hash value is not a float")
+	errOverflow       = errors.New("ERR increment or decrement would overflow")
+	errNaNOrInfinity  = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+// HIncrBy adds delta to the integer value of field, which starts at 0 when
+// missing, and returns the result. The field keeps its TTL.
+func (s *store) HIncrBy(key, field string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := lookupHash(s, key)
+	if err != nil {
+		return 0, err
+	}
+	var num int64
+	if value, ok := h.fields.get(field); ok {
+		if num, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, errHashNotInteger
+		}
+	}
+	if delta > 0 && num > math.MaxInt64-delta || delta < 0 && num < math.MinInt64-delta {
+		return 0, errOverflow
+	}
+
+	num += delta
+	s.beforeWrite(key)
+	h.fields.set(field, strconv.FormatInt(num, 10))
+	s.data.set(key, h)
+	s.touch(key)
+	return num, nil
+}
+
+// HIncrByFloat adds delta to the float value of field, which starts at 0
+// when missing, and returns the result. The field keeps its TTL.
+func (s *store) HIncrByFloat(key, field string, delta float64) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := lookupHash(s, key)
+	if err != nil {
+		return 0, err
+	}
+	var num float64
+	if value, ok := h.fields.get(field); ok {
+		if num, err = parseFloatArg(value); err != nil || math.IsInf(num, 0) {
+			return 0, errHashNotFloat
+		}
+	}
+	num += delta
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return 0, errNaNOrInfinity
+	}
+
+	s.beforeWrite(key)
+	h.fields.set(field, formatFloat(num))
+	s.data.set(key, h)
+	s.touch(key)
+	return num, nil
+}
+
+// HStrLen returns the length of the value of field, 0 when missing.
+func (s *store) HStrLen(key, field string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	value, _ := h.fields.get(field)
+	return len(value), nil
+}
+
+// HRandField returns up to count different fields picked at random and their
+// values, or when count is negative, -count fields that may repeat, of which
+// there may be at most randomRepeatMax.
+func (s *store) HRandField(key string, count int) ([]string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists || count == 0 {
+		return nil, nil, err
+	}
+
+	var fields []string
+	if count < 0 {
+		if -count > randomRepeatMax {
+			return nil, nil, errRandomCount
+		}
+		fields = randomKeys(h.fields, -count, true)
+	} else {
+		fields = randomKeys(h.fields, count, false)
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i], _ = h.fields.get(field)
+	}
+	return fields, values, nil
+}
+
+// RestoreKey stores an already built value under key, replacing any previous
+// one. It is used to load persisted data.
+func (s *store) RestoreKey(key string, value any, expireAt int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeKey(key)
+	s.data.set(key, value)
+	if expireAt > 0 {
+		s.expires[key] = expireAt
 	}
-	return len(hash)
+	s.touch(key)
 }
@@ -0,0 +1,119 @@
+package main
+
+import "errors"
+
+var errGeoMember = errors.New("ERR could not decode requested zset member")
+
+// GeoPoint is a member found by GeoSearch. Dist is measured in meters from
+// the centre of the search.
+type GeoPoint struct {
+	Member    string
+	Score     float64
+	Longitude float64
+	Latitude  float64
+	Dist      float64
+}
+
+// GeoQuery describes a GEOSEARCH. When FromMember is set the shape is
+// centred on that member's position instead of the shape's coordinates.
+type GeoQuery struct {
+	Shape      GeoShape
+	FromMember string
+	UseMember  bool
+	Limit      int // stop once this many matches were found, 0 for no limit
+}
+
+// GeoSearch returns the members of the sorted set at key that lie inside the
+// query's shape, in no particular order. Geo positions are stored as 52-bit
+// geohash scores, so only the score ranges of the geohash box containing the
+// centre and of its neighbours need to be visited.
+func (s *store) GeoSearch(key string, q GeoQuery) ([]GeoPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if q.UseMember {
+			return nil, errGeoMember
+		}
+		return []GeoPoint{}, nil
+	}
+
+	shape := q.Shape
+	if q.UseMember {
+		score, found := zs.dict.get(q.FromMember)
+		if !found {
+			return nil, errGeoMember
+		}
+		shape.Longitude, shape.Latitude = decodeGeoScore(score)
+	}
+
+	areas := shape.areas()
+	n := areas.neighbors
+	boxes := [...]geoHashBits{areas.hash, n.north, n.south, n.east, n.west, n.northEast, n.northWest, n.southEast, n.southWest}
+
+	points := []GeoPoint{}
+	lastProcessed := 0
+	for i, box := range boxes {
+		if box.isZero() {
+			continue
+		}
+		// With huge radii neighbouring boxes can be the same one; skip
+		// repeats so members are not reported twice.
+		if lastProcessed != 0 && box == boxes[lastProcessed] {
+			continue
+		}
+		if q.Limit > 0 && len(points) >= q.Limit {
+			break
+		}
+		points = zs.geoPointsInBox(box, shape, points, q.Limit)
+		lastProcessed = i
+	}
+	return points, nil
+}
+
+// geoPointsInBox appends the members whose score falls inside the geohash
+// box and whose position lies inside the shape.
+func (zs *zset) geoPointsInBox(box geoHashBits, shape GeoShape, points []GeoPoint, limit int) []GeoPoint {
+	min := float64(box.align52())
+	box.bits++
+	max := float64(box.align52())
+
+	r := ZScoreRange{Min: min, Max: max, MaxEx: true}
+	for x := zs.zsl.firstInScoreRange(r); x != nil && r.lteMax(x.score); x = x.level[0].forward {
+		longitude, latitude := decodeGeoScore(x.score)
+		dist, ok := shape.distanceIfInShape(longitude, latitude)
+		if !ok {
+			continue
+		}
+		points = append(points, GeoPoint{Member: x.member, Score: x.score, Longitude: longitude, Latitude: latitude, Dist: dist})
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+	}
+	return points
+}
+
+// ZReplace overwrites key with a sorted set holding members, discarding any
+// previous value and TTL. An empty member list just deletes the key. It
+// returns the size of the new set.
+func (s *store) ZReplace(key string, members []ScoredMember) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeKey(key)
+	if len(members) == 0 {
+		return 0
+	}
+
+	zs := newZSet()
+	for _, m := range members {
+		zs.set(m.Member, m.Score)
+	}
+	s.data.set(key, zs)
+	s.touch(key)
+	return zs.length()
+}
@@ -0,0 +1,250 @@
+package main
+
+// Per field results of the hash field expiry commands.
+const (
+	hashFieldMissing = -2 // no such field, or no such key
+	hashFieldNoTTL   = -1 // the field has no TTL
+	hashFieldSkipped = 0  // the NX, XX, GT or LT condition was not met
+	hashFieldUpdated = 1  // the TTL was set, or removed by HPERSIST
+	hashFieldDeleted = 2  // the expiry was not in the future, so the field was deleted
+)
+
+// HSetExOptions are the conditions and expiry accepted by HSETEX.
+type HSetExOptions struct {
+	FNX      bool  // only set the fields if none of them exists
+	FXX      bool  // only set the fields if all of them exist
+	KeepTTL  bool  // keep the TTL of the fields that have one
+	ExpireAt int64 // expiry of the fields in unix milliseconds, 0 for none
+}
+
+// findHash returns the hash at key once the fields whose TTL elapsed are
+// deleted, and reports it missing if that left none. Callers must hold s.mu.
+func findHash(s *store, key string) (*hash, bool, error) {
+	h, exists, err := lookupTyped[*hash](s, key)
+	if err != nil || !exists || h.expires == nil {
+		return h, exists, err
+	}
+	s.expireHashFields(key, h, mstime())
+	if h.len() == 0 {
+		return nil, false, nil
+	}
+	return h, true, nil
+}
+
+// expireHashFields deletes the fields of the hash at key whose TTL elapsed by
+// now, and the key when none is left. It returns how many fields it deleted.
+// Callers must hold s.mu.
+func (s *store) expireHashFields(key string, h *hash, now int64) int {
+	if !h.hasElapsed(now) {
+		return 0
+	}
+	s.beforeWrite(key)
+	expired := h.expireFields(now)
+	deleted := h.len() == 0
+	if deleted {
+		s.removeKey(key)
+	} else {
+		s.touch(key)
+	}
+	if s.onFieldExpire != nil {
+		s.onFieldExpire(key, deleted)
+	}
+	return expired
+}
+
+// storeHash records a change to the hash at key, deleting the key once the
+// hash is empty. Callers must hold s.mu.
+func storeHash(s *store, key string, h *hash) {
+	if h.len() == 0 {
+		s.removeKey(key)
+		return
+	}
+	s.data.set(key, h)
+	s.touch(key)
+}
+
+// HExpire sets the expiry of fields to when, in unix milliseconds, where the
+// flags allow it. An expiry that is not in the future deletes the field. It
+// returns a hashField result for each field.
+func (s *store) HExpire(key string, when int64, flags ExpireFlags, fields ...string) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]int, len(fields))
+	now, changed := mstime(), false
+	for i, field := range fields {
+		if !exists || !hasField(h, field) {
+			result[i] = hashFieldMissing
+			continue
+		}
+		current, hasTTL := h.expireTime(field)
+		if !flags.allow(current, hasTTL, when) {
+			result[i] = hashFieldSkipped
+			continue
+		}
+		if !changed {
+			s.beforeWrite(key)
+			changed = true
+		}
+		if when <= now {
+			h.delete(field)
+			result[i] = hashFieldDeleted
+		} else {
+			h.setExpire(field, when)
+			result[i] = hashFieldUpdated
+		}
+	}
+	if changed {
+		storeHash(s, key, h)
+	}
+	return result, nil
+}
+
+func hasField(h *hash, field string) bool {
+	return h.fields.has(field)
+}
+
+// HExpireTime returns the expiry of each field in unix milliseconds, or
+// hashFieldNoTTL or hashFieldMissing.
+func (s *store) HExpireTime(key string, fields ...string) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]int64, len(fields))
+	for i, field := range fields {
+		if !exists || !hasField(h, field) {
+			result[i] = hashFieldMissing
+			continue
+		}
+		when, hasTTL := h.expireTime(field)
+		if !hasTTL {
+			when = hashFieldNoTTL
+		}
+		result[i] = when
+	}
+	return result, nil
+}
+
+// HPersist removes the TTL of fields, and returns a hashField result for
+// each.
+func (s *store) HPersist(key string, fields ...string) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]int, len(fields))
+	changed := false
+	for i, field := range fields {
+		if !exists || !hasField(h, field) {
+			result[i] = hashFieldMissing
+			continue
+		}
+		if _, hasTTL := h.expireTime(field); !hasTTL {
+			result[i] = hashFieldNoTTL
+			continue
+		}
+		if !changed {
+			s.beforeWrite(key)
+			changed = true
+		}
+		h.persist(field)
+		result[i] = hashFieldUpdated
+	}
+	if changed {
+		s.touch(key)
+	}
+	return result, nil
+}
+
+// HGetEx returns the values of fields, and whether the hash holds each, then
+// sets the expiry of those it holds to expireAt unless that is 0, deleting
+// them if it is not in the future, or removes their TTL when persist is set.
+func (s *store) HGetEx(key string, expireAt int64, persist bool, fields ...string) ([]string, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, exist := make([]string, len(fields)), make([]bool, len(fields))
+	if !exists {
+		return values, exist, nil
+	}
+
+	now, changed := mstime(), false
+	for i, field := range fields {
+		if values[i], exist[i] = h.fields.get(field); !exist[i] {
+			continue
+		}
+		if expireAt == 0 && !persist {
+			continue
+		}
+		if !changed {
+			s.beforeWrite(key)
+			changed = true
+		}
+		switch {
+		case persist:
+			h.persist(field)
+		case expireAt <= now:
+			h.delete(field)
+		default:
+			h.setExpire(field, expireAt)
+		}
+	}
+	if changed {
+		storeHash(s, key, h)
+	}
+	return values, exist, nil
+}
+
+// HSetEx sets each field to the value following it, unless the FNX or FXX
+// condition is not met, and gives them the expiry of opts. It reports whether
+// it set the fields.
+func (s *store) HSetEx(key string, opts HSetExOptions, fieldsAndValues ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := lookupHash(s, key)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i+1 < len(fieldsAndValues); i += 2 {
+		exists := hasField(h, fieldsAndValues[i])
+		if opts.FNX && exists || opts.FXX && !exists {
+			return false, nil
+		}
+	}
+
+	s.beforeWrite(key)
+	now := mstime()
+	for i := 0; i+1 < len(fieldsAndValues); i += 2 {
+		field, value := fieldsAndValues[i], fieldsAndValues[i+1]
+		if opts.KeepTTL {
+			h.fields.set(field, value)
+		} else {
+			h.set(field, value)
+		}
+		switch {
+		case opts.ExpireAt == 0:
+		case opts.ExpireAt <= now:
+			h.delete(field)
+		default:
+			h.setExpire(field, opts.ExpireAt)
+		}
+	}
+	storeHash(s, key, h)
+	return true, nil
+}
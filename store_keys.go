@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+var errSameKey = errors.New("ERR source and destination objects are the same")
+
+// Keys returns the keys matching the glob-style pattern. Keys whose TTL
+// elapsed are deleted rather than returned.
+func (s *store) Keys(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	allKeys := pattern == "*"
+	var keys []string
+	for key := range s.data.keys() {
+		if !allKeys && !stringMatch(pattern, key, false) {
+			continue
+		}
+		if !s.expireIfNeeded(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// RandomKey returns a key picked at random, or false when there is none.
+func (s *store) RandomKey() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		key, ok := s.data.randomKey()
+		if !ok {
+			return "", false
+		}
+		if !s.expireIfNeeded(key) {
+			return key, true
+		}
+	}
+}
+
+// DBSize returns the number of keys, including those whose TTL elapsed but
+// that were not deleted yet.
+func (s *store) DBSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.len()
+}
+
+// Rename moves the value and TTL of source to destination, replacing what it
+// held unless nx is set, in which case it reports false if destination
+// exists. It fails with errNoSuchKey if source does not exist.
+func (s *store) Rename(source, destination string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireIfNeeded(source)
+	value, exists := s.data.get(source)
+	if !exists {
+		return false, errNoSuchKey
+	}
+	if source == destination {
+		return !nx, nil
+	}
+	s.expireIfNeeded(destination)
+	if nx && s.exists(destination) {
+		return false, nil
+	}
+
+	expireAt, hasTTL := s.expires[source]
+	// The value lives on under destination, where snapshots no longer
+	// preserve it, so they must get a copy.
+	s.beforeWrite(source)
+	s.removeKey(source)
+	s.removeKey(destination)
+	s.data.set(destination, value)
+	if hasTTL {
+		s.expires[destination] = expireAt
+	}
+	s.touch(destination)
+	return true, nil
+}
+
+// lockPair locks s and t, which may be the same store, and returns the
+// function that unlocks them. Only commands holding keyspaceLock exclusively
+// lock two stores, so they can not deadlock with one another, and everything
+// else locks a single store.
+func lockPair(s, t *store) func() {
+	s.mu.Lock()
+	if t == s {
+		return s.mu.Unlock
+	}
+	t.mu.Lock()
+	return func() {
+		t.mu.Unlock()
+		s.mu.Unlock()
+	}
+}
+
+// Copy copies the value and TTL of source to destination in target, which
+// may be this store, replacing what it held only if replace is set. It
+// reports whether it copied the key.
+func (s *store) Copy(source string, target DataStore, destination string, replace bool) (bool, error) {
+	t := target.(*store)
+	if t == s && source == destination {
+		return false, errSameKey
+	}
+	defer lockPair(s, t)()
+
+	s.expireIfNeeded(source)
+	value, exists := s.data.get(source)
+	if !exists {
+		return false, nil
+	}
+	t.expireIfNeeded(destination)
+	if !replace && t.exists(destination) {
+		return false, nil
+	}
+
+	t.removeKey(destination)
+	t.data.set(destination, cloneValue(value))
+	if expireAt, ok := s.expires[source]; ok {
+		t.expires[destination] = expireAt
+	}
+	t.touch(destination)
+	return true, nil
+}
+
+// Move moves key with its TTL to target, another store, unless target already
+// holds the key. It reports whether it moved the key.
+func (s *store) Move(key string, target DataStore) (bool, error) {
+	t := target.(*store)
+	if t == s {
+		return false, errSameKey
+	}
+	defer lockPair(s, t)()
+
+	s.expireIfNeeded(key)
+	value, exists := s.data.get(key)
+	if !exists {
+		return false, nil
+	}
+	t.expireIfNeeded(key)
+	if t.exists(key) {
+		return false, nil
+	}
+
+	expireAt, hasTTL := s.expires[key]
+	// As in Rename, snapshots of this store must get a copy.
+	s.beforeWrite(key)
+	s.removeKey(key)
+	t.data.set(key, value)
+	if hasTTL {
+		t.expires[key] = expireAt
+	}
+	t.touch(key)
+	return true, nil
+}
+
+// SwapWith exchanges the keys of the store with those of other, so that the
+// clients of each see the keys of the other from then on.
+func (s *store) SwapWith(other DataStore) {
+	o := other.(*store)
+	if o == s {
+		return
+	}
+	defer lockPair(s, o)()
+
+	// Snapshots stay with their store, so they keep what they still need
+	// before its keys go.
+	for _, snap := range append(slices.Clip(s.snapshots), o.snapshots...) {
+		snap.preserveAll()
+	}
+	s.data, o.data = o.data, s.data
+	s.expires, o.expires = o.expires, s.expires
+	s.versions, o.versions = o.versions, s.versions
+	s.hashTTLKeys, o.hashTTLKeys = o.hashTTLKeys, s.hashTTLKeys
+	s.version.Add(1)
+}
@@ -0,0 +1,109 @@
+package main
+
+import "math"
+
+// ScanArgs are the filters accepted by SCAN and its siblings.
+type ScanArgs struct {
+	Match string // glob pattern the keys or elements must match, "" for any
+	Count int    // how much work to do per call, in elements
+	Type  string // type the keys must hold, "" for any; SCAN only
+}
+
+// matches reports whether key passes the MATCH filter.
+func (args ScanArgs) matches(key string) bool {
+	return args.Match == "" || args.Match == "*" || stringMatch(args.Match, key, false)
+}
+
+// scanDict scans d from cursor, calling emit for each entry, until it has
+// emitted count entries or visited count*10 buckets, as in Redis, so that a
+// sparse table does not make a call slow. It returns the next cursor.
+func scanDict[V any](d *dict[V], cursor uint64, count int, emit func(key string, value V)) uint64 {
+	emitted := 0
+	for iterations := min(count, math.MaxInt/10) * 10; ; iterations-- {
+		cursor = d.scan(cursor, func(key string, value V) {
+			emit(key, value)
+			emitted++
+		})
+		if cursor == 0 || iterations <= 1 || emitted >= count {
+			return cursor
+		}
+	}
+}
+
+// Scan returns the keys of one step of a SCAN starting at cursor, and the
+// cursor of the next step, which is 0 once the whole keyspace was scanned.
+// Keys whose TTL elapsed are deleted rather than returned.
+func (s *store) Scan(cursor uint64, args ScanArgs) (uint64, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	cursor = scanDict(s.data, cursor, args.Count, func(key string, value any) {
+		if args.Type == "" || typeName(value) == args.Type {
+			keys = append(keys, key)
+		}
+	})
+
+	// Filtered once the scan is done, as expiring keys changes the table.
+	filtered := keys[:0]
+	for _, key := range keys {
+		if args.matches(key) && !s.expireIfNeeded(key) {
+			filtered = append(filtered, key)
+		}
+	}
+	return cursor, filtered
+}
+
+// SScan returns the members of one step of an SSCAN, like Scan.
+func (s *store) SScan(key string, cursor uint64, args ScanArgs) (uint64, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, _, err := lookupTyped[*dict[struct{}]](s, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	var members []string
+	cursor = scanDict(set, cursor, args.Count, func(member string, _ struct{}) {
+		if args.matches(member) {
+			members = append(members, member)
+		}
+	})
+	return cursor, members, nil
+}
+
+// HScan returns the fields and values of one step of an HSCAN, like Scan.
+func (s *store) HScan(key string, cursor uint64, args ScanArgs) (uint64, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, exists, err := findHash(s, key)
+	if err != nil || !exists {
+		return 0, nil, err
+	}
+	var pairs []string
+	cursor = scanDict(h.fields, cursor, args.Count, func(field, value string) {
+		if args.matches(field) {
+			pairs = append(pairs, field, value)
+		}
+	})
+	return cursor, pairs, nil
+}
+
+// ZScan returns the members and scores of one step of a ZSCAN, like Scan.
+func (s *store) ZScan(key string, cursor uint64, args ScanArgs) (uint64, []ScoredMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, nil, err
+	}
+	var members []ScoredMember
+	cursor = scanDict(zs.dict, cursor, args.Count, func(member string, score float64) {
+		if args.matches(member) {
+			members = append(members, ScoredMember{Member: member, Score: score})
+		}
+	})
+	return cursor, members, nil
+}
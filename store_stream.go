@@ -0,0 +1,744 @@
+package main
+
+import "errors"
+
+var (
+	errNoSuchKey          = errors.New("ERR no such key")
+	errXSetIDSmaller      = errors.New("ERR The ID specified in XSETID is smaller than the target stream top item")
+	errXSetIDEntriesAdded = errors.New("ERR The entries_added specified in XSETID is smaller than the target stream length")
+	errXSetIDMaxDeletedID = errors.New("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+)
+
+// XAddArgs are the arguments of XADD.
+type XAddArgs struct {
+	ID      StreamID
+	AutoID  bool // "*": generate the whole ID
+	AutoSeq bool // "ms-*": generate the sequence number
+
+	NoMkStream bool
+	Trim       *StreamTrim
+}
+
+// XAdd appends an entry to the stream at key, creating it unless NoMkStream
+// is set, and trims it. It returns the new entry's ID, how many entries
+// trimming dropped, and whether the entry was added, which it is not when
+// the stream is missing and may not be created.
+func (s *store) XAdd(key string, args XAddArgs, fields []string) (StreamID, int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return StreamID{}, 0, false, err
+	}
+	if !exists {
+		if args.NoMkStream {
+			return StreamID{}, 0, false, nil
+		}
+		st = newStream()
+	}
+
+	id, err := st.nextID(args.ID, args.AutoID, args.AutoSeq, uint64(mstime()))
+	if err != nil {
+		return StreamID{}, 0, false, err
+	}
+	if !exists {
+		s.data.set(key, st)
+	}
+	s.beforeWrite(key)
+	st.add(StreamEntry{ID: id, Fields: fields})
+	trimmed := 0
+	if args.Trim != nil {
+		trimmed = st.trim(*args.Trim)
+	}
+	s.touch(key)
+	return id, trimmed, true, nil
+}
+
+// XRange returns up to count entries (all with count 0) of the stream at key
+// with IDs from start to end, in reverse order with rev.
+func (s *store) XRange(key string, start, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return st.rangeEntries(start, end, count, rev), nil
+}
+
+func (s *store) XLen(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return st.length, nil
+}
+
+// XLastID returns the ID of the last entry ever added to the stream at key.
+func (s *store) XLastID(key string) (StreamID, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil || !exists {
+		return StreamID{}, false, err
+	}
+	return st.lastID, true, nil
+}
+
+// XDel removes entries from the stream at key and returns how many there
+// were. The stream remains even once empty.
+func (s *store) XDel(key string, ids ...StreamID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	deleted := 0
+	for _, id := range ids {
+		if st.delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.touch(key)
+	}
+	return deleted, nil
+}
+
+// XTrim trims the stream at key and returns how many entries were dropped.
+func (s *store) XTrim(key string, t StreamTrim) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	trimmed := st.trim(t)
+	if trimmed > 0 {
+		s.touch(key)
+	}
+	return trimmed, nil
+}
+
+// XSetID sets the last ID of the stream at key, and when not nil, its count
+// of entries ever added and its greatest deleted ID.
+func (s *store) XSetID(key string, lastID StreamID, entriesAdded *uint64, maxDeletedID *StreamID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNoSuchKey
+	}
+
+	if st.length > 0 {
+		if last := st.rangeEntries(StreamID{}, maxStreamID, 1, true); lastID.compare(last[0].ID) < 0 {
+			return errXSetIDSmaller
+		}
+	}
+	if entriesAdded != nil && *entriesAdded < uint64(st.length) {
+		return errXSetIDEntriesAdded
+	}
+	if maxDeletedID != nil && lastID.compare(*maxDeletedID) < 0 {
+		return errXSetIDMaxDeletedID
+	}
+
+	s.beforeWrite(key)
+	st.lastID = lastID
+	if entriesAdded != nil {
+		st.entriesAdded = *entriesAdded
+	}
+	if maxDeletedID != nil {
+		st.maxDeletedID = *maxDeletedID
+	}
+	s.touch(key)
+	return nil
+}
+
+var (
+	errNoGroup          = errors.New("NOGROUP No such consumer group")
+	errBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	errXGroupKeyMissing = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+// lookupGroup returns the stream at key and its named group: errNoSuchKey if
+// there is no stream, errNoGroup if it has no such group. Callers must hold
+// s.mu.
+func lookupGroup(s *store, key, name string) (*stream, *streamGroup, error) {
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, errNoSuchKey
+	}
+	g := st.group(name)
+	if g == nil {
+		return st, nil, errNoGroup
+	}
+	return st, g, nil
+}
+
+// XGroupExists returns errNoSuchKey or errNoGroup unless the stream at key
+// has the named group.
+func (s *store) XGroupExists(key, group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, _, err := lookupGroup(s, key, group)
+	return err
+}
+
+// XGroupCreate creates a group of the stream at key that delivers the
+// entries after id. With mkStream a missing stream is created empty.
+func (s *store) XGroupCreate(key, group string, id StreamID, entriesRead int64, mkStream bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if !mkStream {
+			return errXGroupKeyMissing
+		}
+		st = newStream()
+		s.data.set(key, st)
+	} else if st.group(group) != nil {
+		return errBusyGroup
+	}
+
+	s.beforeWrite(key)
+	st.createGroup(group, id, entriesRead)
+	s.touch(key)
+	return nil
+}
+
+// XGroupSetID makes a group deliver the entries after id next.
+func (s *store) XGroupSetID(key, group string, id StreamID, entriesRead int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return err
+	}
+	s.beforeWrite(key)
+	g.lastID, g.entriesRead = id, entriesRead
+	s.touch(key)
+	return nil
+}
+
+// XGroupDestroy deletes a group and reports whether it existed.
+func (s *store) XGroupDestroy(key, group string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupGroup(s, key, group)
+	if err == errNoGroup {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.beforeWrite(key)
+	delete(st.groups, group)
+	s.touch(key)
+	return true, nil
+}
+
+// XGroupCreateConsumer adds a consumer to a group and reports whether it is
+// new.
+func (s *store) XGroupCreateConsumer(key, group, consumer string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return false, err
+	}
+	if _, exists := g.consumers[consumer]; exists {
+		return false, nil
+	}
+	s.beforeWrite(key)
+	g.createConsumer(consumer, mstime())
+	s.touch(key)
+	return true, nil
+}
+
+// XGroupDelConsumer removes a consumer from a group along with its pending
+// entries. It returns how many entries the consumer had pending and whether
+// it existed.
+func (s *store) XGroupDelConsumer(key, group, consumer string) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, exists := g.consumers[consumer]; !exists {
+		return 0, false, nil
+	}
+	s.beforeWrite(key)
+	pending, _ := g.deleteConsumer(consumer)
+	s.touch(key)
+	return pending, true, nil
+}
+
+// XReadGroupArgs are the arguments of XREADGROUP for one stream.
+type XReadGroupArgs struct {
+	// History reads the consumer's pending entries from Start instead of
+	// the entries the group has not read yet.
+	History bool
+	Start   StreamID
+	Count   int
+	NoAck   bool
+}
+
+// XReadGroupResult is what XREADGROUP read from one stream, and the group's
+// state after the read.
+type XReadGroupResult struct {
+	// Entries holds the entries read. In a history read, entries deleted
+	// from the stream have nil fields.
+	Entries         []StreamEntry
+	DeliveryTime    int64
+	ConsumerCreated bool
+	LastID          StreamID
+	EntriesRead     int64
+}
+
+// XReadGroup reads entries of the stream at key for a consumer of a group,
+// creating the consumer if needed.
+func (s *store) XReadGroup(key, group, consumer string, args XReadGroupArgs) (XReadGroupResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return XReadGroupResult{}, err
+	}
+
+	s.beforeWrite(key)
+	now := mstime()
+	var result XReadGroupResult
+	cons, created := g.createConsumer(consumer, now)
+	cons.seenTime = now
+	if args.History {
+		result.Entries = st.deliverHistory(cons, args.Start, args.Count, now)
+	} else {
+		result.Entries = st.deliverNew(g, cons, args.Count, args.NoAck, now)
+	}
+	if created || !args.History && len(result.Entries) > 0 {
+		s.touch(key)
+	}
+	result.DeliveryTime, result.ConsumerCreated = now, created
+	result.LastID, result.EntriesRead = g.lastID, g.entriesRead
+	return result, nil
+}
+
+// XAck acknowledges pending entries of a group and returns how many were
+// pending.
+func (s *store) XAck(key, group string, ids ...StreamID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err == errNoSuchKey || err == errNoGroup {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		s.touch(key)
+	}
+	return acked, nil
+}
+
+// PendingEntry is an entry delivered to a consumer and not acknowledged yet.
+type PendingEntry struct {
+	ID            StreamID
+	Consumer      string
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// PendingSummary sums up the pending entries of a group.
+type PendingSummary struct {
+	Count       int
+	First, Last StreamID
+	// Consumers lists the consumers with pending entries and how many, by
+	// name.
+	Consumers []ConsumerPending
+}
+
+type ConsumerPending struct {
+	Name  string
+	Count int
+}
+
+// PendingQuery selects pending entries: those with IDs from Start to End, up
+// to Count of them, pending for at least MinIdle milliseconds, and with
+// ByConsumer only those of Consumer.
+type PendingQuery struct {
+	Start, End StreamID
+	Count      int
+	MinIdle    int64
+	ByConsumer bool
+	Consumer   string
+}
+
+func (s *store) XPendingSummary(key, group string) (PendingSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return PendingSummary{}, err
+	}
+	summary := PendingSummary{Count: g.pel.len()}
+	if summary.Count == 0 {
+		return summary, nil
+	}
+	summary.First, summary.Last = g.pel.ids[0], g.pel.ids[summary.Count-1]
+	for _, name := range g.consumerNames() {
+		if n := g.consumers[name].pel.len(); n > 0 {
+			summary.Consumers = append(summary.Consumers, ConsumerPending{name, n})
+		}
+	}
+	return summary, nil
+}
+
+func (s *store) XPending(key, group string, q PendingQuery) ([]PendingEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return nil, err
+	}
+	pel := g.pel
+	if q.ByConsumer {
+		consumer, exists := g.consumers[q.Consumer]
+		if !exists {
+			return nil, nil
+		}
+		pel = consumer.pel
+	}
+
+	now := mstime()
+	var entries []PendingEntry
+	for _, id := range pel.ids[pel.seek(q.Start):] {
+		if id.compare(q.End) > 0 || len(entries) >= q.Count {
+			break
+		}
+		nack := pel.nacks[id]
+		if now-nack.deliveryTime < q.MinIdle {
+			continue
+		}
+		entries = append(entries, PendingEntry{id, nack.consumer.name, nack.deliveryTime, nack.deliveryCount})
+	}
+	return entries, nil
+}
+
+// XClaimArgs are the options of XCLAIM and XAUTOCLAIM.
+type XClaimArgs struct {
+	// MinIdle is how long, in milliseconds, an entry must have been pending
+	// to be claimed.
+	MinIdle int64
+	// DeliveryTime becomes the last delivery time of claimed entries.
+	DeliveryTime int64
+	// RetryCount, unless negative, becomes the delivery count of claimed
+	// entries, which is otherwise incremented unless JustID is set.
+	RetryCount int64
+	// Force makes entries of the stream that are not pending pending.
+	Force  bool
+	JustID bool
+	// LastID, when not nil, moves the group's last delivered ID forward.
+	LastID *StreamID
+}
+
+// XClaimResult is what XCLAIM or XAUTOCLAIM did.
+type XClaimResult struct {
+	// Claimed holds the entries claimed, and Pending their state after.
+	Claimed []StreamEntry
+	Pending []PendingEntry
+	// Deleted lists the pending entries found deleted from the stream,
+	// which are no longer pending.
+	Deleted         []StreamID
+	ConsumerCreated bool
+	// LastIDMoved tells that LastID moved the group's last delivered ID.
+	LastIDMoved bool
+	LastID      StreamID
+	EntriesRead int64
+	// Next is where XAUTOCLAIM should continue from, 0-0 once it is done.
+	Next StreamID
+}
+
+// XClaim gives pending entries of a group to consumer, creating it if
+// needed.
+func (s *store) XClaim(key, group, consumer string, ids []StreamID, args XClaimArgs) (XClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return XClaimResult{}, err
+	}
+
+	s.beforeWrite(key)
+	now := mstime()
+	var result XClaimResult
+	cons, created := g.createConsumer(consumer, now)
+	cons.seenTime = now
+	result.ConsumerCreated = created
+	if args.LastID != nil && args.LastID.compare(g.lastID) > 0 {
+		g.lastID = *args.LastID
+		result.LastIDMoved = true
+	}
+	for _, id := range ids {
+		st.claim(g, cons, id, args, now, &result)
+	}
+
+	result.LastID, result.EntriesRead = g.lastID, g.entriesRead
+	if created || result.LastIDMoved || len(result.Claimed)+len(result.Deleted) > 0 {
+		s.touch(key)
+	}
+	return result, nil
+}
+
+// xautoclaimAttemptsFactor bounds the pending entries XAUTOCLAIM looks at to
+// that many times COUNT, like in Redis.
+const xautoclaimAttemptsFactor = 10
+
+// XAutoClaim claims up to count pending entries of a group with IDs from
+// start on, for consumer.
+func (s *store) XAutoClaim(key, group, consumer string, start StreamID, count int, args XClaimArgs) (XClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return XClaimResult{}, err
+	}
+
+	s.beforeWrite(key)
+	now := mstime()
+	var result XClaimResult
+	cons, created := g.createConsumer(consumer, now)
+	cons.seenTime = now
+	result.ConsumerCreated = created
+
+	// Claiming may remove entries from the PEL, so work on a copy.
+	i := g.pel.seek(start)
+	ids := append([]StreamID(nil), g.pel.ids[i:min(len(g.pel.ids), i+count*xautoclaimAttemptsFactor)]...)
+	for _, id := range ids {
+		if len(result.Claimed) == count {
+			result.Next = id
+			break
+		}
+		st.claim(g, cons, id, args, now, &result)
+	}
+	if result.Next.isZero() && len(ids) > 0 {
+		// Continue after the last entry looked at, if any is left.
+		if after, ok := ids[len(ids)-1].next(); ok {
+			if j := g.pel.seek(after); j < len(g.pel.ids) {
+				result.Next = g.pel.ids[j]
+			}
+		}
+	}
+
+	result.LastID, result.EntriesRead = g.lastID, g.entriesRead
+	if created || len(result.Claimed)+len(result.Deleted) > 0 {
+		s.touch(key)
+	}
+	return result, nil
+}
+
+// StreamInfo describes a stream for XINFO STREAM.
+type StreamInfo struct {
+	Length       int
+	Chunks       int
+	LastID       StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	FirstID      StreamID
+	// First and Last are the first and last entries, nil when the stream
+	// is empty.
+	First, Last *StreamEntry
+	// Groups describes the groups; without full, only their number is set.
+	NumGroups int
+	Groups    []StreamGroupInfo
+	// Entries holds the entries, with full.
+	Entries []StreamEntry
+}
+
+// StreamGroupInfo describes a consumer group for XINFO.
+type StreamGroupInfo struct {
+	Name        string
+	Consumers   int
+	Pending     int
+	LastID      StreamID
+	EntriesRead int64 // streamEntriesReadUnknown when not known
+	Lag         int64
+	LagKnown    bool
+	// PEL and ConsumerInfos are only set for XINFO STREAM FULL.
+	PEL           []PendingEntry
+	ConsumerInfos []StreamConsumerInfo
+}
+
+// StreamConsumerInfo describes a consumer of a group for XINFO.
+type StreamConsumerInfo struct {
+	Name       string
+	Pending    int
+	SeenTime   int64
+	ActiveTime int64 // -1 if it never got an entry
+	// PEL is only set for XINFO STREAM FULL.
+	PEL []PendingEntry
+}
+
+// pendingEntries returns up to count (all with count 0) entries of a PEL.
+func pendingEntries(pel *pendingList, count int) []PendingEntry {
+	ids := pel.ids
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+	entries := make([]PendingEntry, len(ids))
+	for i, id := range ids {
+		nack := pel.nacks[id]
+		entries[i] = PendingEntry{id, nack.consumer.name, nack.deliveryTime, nack.deliveryCount}
+	}
+	return entries
+}
+
+func groupInfo(st *stream, g *streamGroup) StreamGroupInfo {
+	info := StreamGroupInfo{
+		Name:        g.name,
+		Consumers:   len(g.consumers),
+		Pending:     g.pel.len(),
+		LastID:      g.lastID,
+		EntriesRead: g.entriesRead,
+	}
+	info.Lag, info.LagKnown = st.lag(g)
+	return info
+}
+
+func consumerInfo(consumer *streamConsumer) StreamConsumerInfo {
+	return StreamConsumerInfo{
+		Name:       consumer.name,
+		Pending:    consumer.pel.len(),
+		SeenTime:   consumer.seenTime,
+		ActiveTime: consumer.activeTime,
+	}
+}
+
+// XInfoStream describes the stream at key. With full it includes up to count
+// (all with count 0) entries, and of each group and consumer that many
+// pending entries.
+func (s *store) XInfoStream(key string, full bool, count int) (StreamInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	if !exists {
+		return StreamInfo{}, errNoSuchKey
+	}
+
+	info := StreamInfo{
+		Length:       st.length,
+		Chunks:       len(st.chunks),
+		LastID:       st.lastID,
+		MaxDeletedID: st.maxDeletedID,
+		EntriesAdded: st.entriesAdded,
+		FirstID:      st.firstID(),
+		NumGroups:    len(st.groups),
+	}
+	if !full {
+		if st.length > 0 {
+			first := st.chunks[0][0]
+			lastChunk := st.chunks[len(st.chunks)-1]
+			last := lastChunk[len(lastChunk)-1]
+			info.First, info.Last = &first, &last
+		}
+		return info, nil
+	}
+
+	info.Entries = st.rangeEntries(StreamID{}, maxStreamID, count, false)
+	for _, name := range st.groupNames() {
+		g := st.groups[name]
+		gi := groupInfo(st, g)
+		gi.PEL = pendingEntries(g.pel, count)
+		for _, consumerName := range g.consumerNames() {
+			consumer := g.consumers[consumerName]
+			ci := consumerInfo(consumer)
+			ci.PEL = pendingEntries(consumer.pel, count)
+			gi.ConsumerInfos = append(gi.ConsumerInfos, ci)
+		}
+		info.Groups = append(info.Groups, gi)
+	}
+	return info, nil
+}
+
+// XInfoGroups describes the groups of the stream at key, by name.
+func (s *store) XInfoGroups(key string) ([]StreamGroupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, exists, err := lookupTyped[*stream](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errNoSuchKey
+	}
+	infos := make([]StreamGroupInfo, 0, len(st.groups))
+	for _, name := range st.groupNames() {
+		infos = append(infos, groupInfo(st, st.groups[name]))
+	}
+	return infos, nil
+}
+
+// XInfoConsumers describes the consumers of a group, by name.
+func (s *store) XInfoConsumers(key, group string) ([]StreamConsumerInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := lookupGroup(s, key, group)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]StreamConsumerInfo, 0, len(g.consumers))
+	for _, name := range g.consumerNames() {
+		infos = append(infos, consumerInfo(g.consumers[name]))
+	}
+	return infos, nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"math"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestStore_Set_Get(t *testing.T) {
@@ -9,7 +12,7 @@ func TestStore_Set_Get(t *testing.T) {
 
 	store.Set("key1", "value1")
 
-	value, exists := store.Get("key1")
+	value, exists, _ := store.Get("key1")
 	if !exists {
 		t.Error("Expected key1 to exist")
 	}
@@ -21,7 +24,7 @@ func TestStore_Set_Get(t *testing.T) {
 func TestStore_Get_NonExistent(t *testing.T) {
 	store := newStore()
 
-	_, exists := store.Get("nonexistent")
+	_, exists, _ := store.Get("nonexistent")
 	if exists {
 		t.Error("Expected nonexistent key to not exist")
 	}
@@ -90,3 +93,441 @@ func TestStore_Incr_InvalidValue(t *testing.T) {
 		t.Error("Expected error when incrementing non-numeric value")
 	}
 }
+
+func TestStore_Expire_Lazy(t *testing.T) {
+	store := newStore()
+
+	store.Set("key1", "value1")
+	if !store.Expire("key1", mstime()+20, 0) {
+		t.Fatal("Expected Expire on existing key to succeed")
+	}
+
+	if _, exists, _ := store.Get("key1"); !exists {
+		t.Error("Expected key1 to exist before its TTL elapses")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, exists, _ := store.Get("key1"); exists {
+		t.Error("Expected key1 to be expired")
+	}
+	if store.ExpireTime("key1") != -2 {
+		t.Error("Expected expired key to report -2")
+	}
+}
+
+func TestStore_Expire_Flags(t *testing.T) {
+	store := newStore()
+
+	store.Set("key1", "value1")
+	when := mstime() + 10000
+
+	if store.Expire("key1", when, ExpireXX) {
+		t.Error("Expected XX to fail on key without TTL")
+	}
+	if store.Expire("key1", when, ExpireGT) {
+		t.Error("Expected GT to fail on key without TTL")
+	}
+	if !store.Expire("key1", when, ExpireNX) {
+		t.Error("Expected NX to succeed on key without TTL")
+	}
+	if store.Expire("key1", when+1000, ExpireLT) {
+		t.Error("Expected LT with a later time to fail")
+	}
+	if !store.Expire("key1", when+1000, ExpireXX|ExpireGT) {
+		t.Error("Expected XX GT with a later time to succeed")
+	}
+	if store.ExpireTime("key1") != when+1000 {
+		t.Errorf("Expected expire time %d, got %d", when+1000, store.ExpireTime("key1"))
+	}
+}
+
+func TestStore_Expire_PastDeletes(t *testing.T) {
+	store := newStore()
+
+	store.RPush("list", "a")
+	if !store.Expire("list", mstime()-1, 0) {
+		t.Error("Expected Expire in the past to report success")
+	}
+	if store.Exists("list") {
+		t.Error("Expected key to be deleted by an expire time in the past")
+	}
+}
+
+func TestStore_Persist(t *testing.T) {
+	store := newStore()
+
+	store.HSet("hash", "field", "value")
+	if store.Persist("hash") {
+		t.Error("Expected Persist on key without TTL to return false")
+	}
+
+	store.Expire("hash", mstime()+10000, 0)
+	if !store.Persist("hash") {
+		t.Error("Expected Persist to remove TTL")
+	}
+	if store.ExpireTime("hash") != -1 {
+		t.Error("Expected key to have no TTL after Persist")
+	}
+}
+
+func TestStore_Set_ClearsTTL(t *testing.T) {
+	store := newStore()
+
+	store.Set("key1", "value1")
+	store.Expire("key1", mstime()+10000, 0)
+	store.Set("key1", "value2")
+
+	if store.ExpireTime("key1") != -1 {
+		t.Error("Expected SET to clear the TTL")
+	}
+}
+
+func TestStore_ActiveExpireCycle(t *testing.T) {
+	store := newStore()
+
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		store.Set(key, "value")
+		store.Expire(key, mstime()+10, 0)
+	}
+	store.Set("persistent", "value")
+
+	time.Sleep(20 * time.Millisecond)
+
+	if removed := store.ActiveExpireCycle(); removed != 100 {
+		t.Errorf("Expected 100 keys removed, got %d", removed)
+	}
+	if !store.Exists("persistent") {
+		t.Error("Expected key without TTL to survive the cycle")
+	}
+}
+
+func TestStore_SetWithOptions_NX_XX(t *testing.T) {
+	store := newStore()
+
+	_, _, written, _ := store.SetWithOptions("key1", "value1", SetOptions{XX: true})
+	if written {
+		t.Error("Expected XX write on missing key to be skipped")
+	}
+
+	_, _, written, _ = store.SetWithOptions("key1", "value1", SetOptions{NX: true})
+	if !written {
+		t.Error("Expected NX write on missing key to succeed")
+	}
+
+	old, hadOld, written, _ := store.SetWithOptions("key1", "value2", SetOptions{NX: true})
+	if written {
+		t.Error("Expected NX write on existing key to be skipped")
+	}
+	if !hadOld || old != "value1" {
+		t.Errorf("Expected old value value1, got %q", old)
+	}
+}
+
+func TestStore_SetWithOptions_TTL(t *testing.T) {
+	store := newStore()
+
+	when := mstime() + 10000
+	store.SetWithOptions("key1", "value1", SetOptions{ExpireAt: when})
+	if store.ExpireTime("key1") != when {
+		t.Errorf("Expected expire time %d, got %d", when, store.ExpireTime("key1"))
+	}
+
+	store.SetWithOptions("key1", "value2", SetOptions{KeepTTL: true})
+	if store.ExpireTime("key1") != when {
+		t.Error("Expected KEEPTTL to retain the TTL")
+	}
+
+	store.SetWithOptions("key1", "value3", SetOptions{})
+	if store.ExpireTime("key1") != -1 {
+		t.Error("Expected plain write to clear the TTL")
+	}
+}
+
+func TestStore_WrongType(t *testing.T) {
+	store := newStore()
+
+	store.Set("key1", "value1")
+
+	if _, err := store.LPush("key1", "a"); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE from LPush, got %v", err)
+	}
+	if _, err := store.SAdd("key1", "a"); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE from SAdd, got %v", err)
+	}
+	if _, err := store.HSet("key1", "f", "v"); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE from HSet, got %v", err)
+	}
+
+	store.RPush("list", "a")
+	if _, _, err := store.Get("list"); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE from Get, got %v", err)
+	}
+	if _, err := store.Incr("list"); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE from Incr, got %v", err)
+	}
+}
+
+func TestStore_Type(t *testing.T) {
+	store := newStore()
+
+	store.Set("string", "value")
+	store.RPush("list", "a")
+	store.SAdd("set", "a")
+	store.HSet("hash", "f", "v")
+
+	tests := map[string]string{
+		"string":  "string",
+		"list":    "list",
+		"set":     "set",
+		"hash":    "hash",
+		"missing": "none",
+	}
+	for key, expected := range tests {
+		if got := store.Type(key); got != expected {
+			t.Errorf("Expected type %s for %s, got %s", expected, key, got)
+		}
+	}
+}
+
+func TestStore_Set_ReplacesOtherType(t *testing.T) {
+	store := newStore()
+
+	store.RPush("key1", "a")
+	store.Set("key1", "value1")
+
+	if store.Type("key1") != "string" {
+		t.Errorf("Expected string after SET, got %s", store.Type("key1"))
+	}
+
+	if !store.Delete("key1") {
+		t.Error("Expected delete to succeed")
+	}
+	if store.Exists("key1") {
+		t.Error("Expected key to be gone after a single delete")
+	}
+}
+
+func TestStore_ZAdd_Options(t *testing.T) {
+	store := newStore()
+
+	added, _ := store.ZAdd("z", ZAddOptions{}, ScoredMember{"a", 1}, ScoredMember{"b", 2})
+	if added != 2 {
+		t.Errorf("Expected 2 added, got %d", added)
+	}
+
+	changed, _ := store.ZAdd("z", ZAddOptions{CH: true, GT: true}, ScoredMember{"a", 0}, ScoredMember{"b", 5}, ScoredMember{"c", 3})
+	if changed != 2 {
+		t.Errorf("Expected 2 changed, got %d", changed)
+	}
+	if score, _, _ := store.ZScore("z", "a"); score != 1 {
+		t.Errorf("Expected GT to keep score 1, got %v", score)
+	}
+
+	added, _ = store.ZAdd("z", ZAddOptions{XX: true}, ScoredMember{"d", 1})
+	if added != 0 {
+		t.Error("Expected XX not to add new members")
+	}
+
+	_, updated, _ := store.ZIncrBy("z", ZAddOptions{NX: true}, "a", 10)
+	if updated {
+		t.Error("Expected NX INCR on an existing member to be skipped")
+	}
+
+	if _, err := store.ZAdd("missing", ZAddOptions{XX: true}, ScoredMember{"a", 1}); err != nil || store.Exists("missing") {
+		t.Error("Expected XX on a missing key not to create it")
+	}
+}
+
+func TestStore_ZIncrBy_NaN(t *testing.T) {
+	store := newStore()
+
+	store.ZAdd("z", ZAddOptions{}, ScoredMember{"a", math.Inf(1)})
+	if _, _, err := store.ZIncrBy("z", ZAddOptions{}, "a", math.Inf(-1)); err != errScoreNaN {
+		t.Errorf("Expected NaN error, got %v", err)
+	}
+}
+
+func TestStore_ZPop(t *testing.T) {
+	store := newStore()
+
+	store.ZAdd("z", ZAddOptions{}, ScoredMember{"a", 1}, ScoredMember{"b", 2}, ScoredMember{"c", 3})
+
+	popped, _ := store.ZPop("z", 2, true)
+	if len(popped) != 2 || popped[0].Member != "c" || popped[1].Member != "b" {
+		t.Errorf("Expected c, b, got %v", popped)
+	}
+
+	popped, _ = store.ZPop("z", 5, false)
+	if len(popped) != 1 || popped[0].Member != "a" {
+		t.Errorf("Expected a, got %v", popped)
+	}
+	if store.Exists("z") {
+		t.Error("Expected empty sorted set to be deleted")
+	}
+}
+
+func TestStore_Version(t *testing.T) {
+	store := newStore()
+
+	if _, exists := store.Version("key"); exists {
+		t.Error("Expected a missing key to have no version")
+	}
+
+	store.Set("key", "a")
+	v1, _ := store.Version("key")
+
+	// Operations that change nothing keep the version.
+	store.SAdd("set", "x")
+	store.Get("key")
+	store.SetWithOptions("key", "b", SetOptions{NX: true})
+	if v, _ := store.Version("key"); v != v1 {
+		t.Errorf("Expected version %d after no-op writes, got %d", v1, v)
+	}
+
+	store.Expire("key", mstime()+10000, 0)
+	v2, _ := store.Version("key")
+	if v2 <= v1 {
+		t.Errorf("Expected EXPIRE to bump the version past %d, got %d", v1, v2)
+	}
+
+	store.Delete("key")
+	store.Set("key", "a")
+	v3, _ := store.Version("key")
+	if v3 <= v2 {
+		t.Errorf("Expected a re-created key to get a version past %d, got %d", v2, v3)
+	}
+
+	store.Flush(false)
+	if _, exists := store.Version("key"); exists {
+		t.Error("Expected no version after a flush")
+	}
+	store.Set("key", "a")
+	if v, _ := store.Version("key"); v <= v3 {
+		t.Errorf("Expected version past %d after a flush, got %d", v3, v)
+	}
+}
+
+func TestStore_SetWithOptions_IfVer_IfEq(t *testing.T) {
+	store := newStore()
+
+	_, _, written, _ := store.SetWithOptions("key", "a", SetOptions{IfVer: true, Version: 0})
+	if !written {
+		t.Error("Expected IFVER 0 to create a missing key")
+	}
+	version, _ := store.Version("key")
+
+	_, _, written, _ = store.SetWithOptions("key", "b", SetOptions{IfVer: true, Version: version + 1})
+	if written {
+		t.Error("Expected IFVER with a stale version not to write")
+	}
+	_, _, written, _ = store.SetWithOptions("key", "b", SetOptions{IfVer: true, Version: version})
+	if !written {
+		t.Error("Expected IFVER with the current version to write")
+	}
+
+	_, _, written, _ = store.SetWithOptions("key", "c", SetOptions{IfEq: true, Compare: "a"})
+	if written {
+		t.Error("Expected IFEQ with a different value not to write")
+	}
+	_, _, written, _ = store.SetWithOptions("key", "c", SetOptions{IfEq: true, Compare: "b"})
+	if !written {
+		t.Error("Expected IFEQ with the current value to write")
+	}
+	_, _, written, _ = store.SetWithOptions("missing", "c", SetOptions{IfEq: true, Compare: ""})
+	if written {
+		t.Error("Expected IFEQ not to create a missing key")
+	}
+
+	store.LPush("list", "x")
+	if _, _, _, err := store.SetWithOptions("list", "c", SetOptions{IfEq: true, Compare: "x"}); err != errWrongType {
+		t.Errorf("Expected WRONGTYPE for IFEQ on a list, got %v", err)
+	}
+}
+
+// The list benchmarks run at several list sizes: pushes and pops take the same
+// time whatever the size.
+var benchmarkListSizes = []int{1_000, 100_000, 1_000_000}
+
+func benchmarkFilledList(b *testing.B, n int) DataStore {
+	b.Helper()
+	s := newStore()
+	values := make([]string, n)
+	for i := range values {
+		values[i] = strconv.Itoa(i)
+	}
+	s.RPush("list", values...)
+	return s
+}
+
+func BenchmarkStore_LPush(b *testing.B) {
+	for _, n := range benchmarkListSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			s := benchmarkFilledList(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.LPush("list", "value")
+				s.RPop("list")
+			}
+		})
+	}
+}
+
+func BenchmarkStore_RPush(b *testing.B) {
+	for _, n := range benchmarkListSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			s := benchmarkFilledList(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.RPush("list", "value")
+				s.LPop("list")
+			}
+		})
+	}
+}
+
+// BenchmarkStore_LPush_Bulk pushes many elements in one call, which took
+// quadratic time when lists were slices.
+func BenchmarkStore_LPush_Bulk(b *testing.B) {
+	values := make([]string, 10_000)
+	for i := range values {
+		values[i] = strconv.Itoa(i)
+	}
+	for i := 0; i < b.N; i++ {
+		s := newStore()
+		s.LPush("list", values...)
+	}
+}
+
+// BenchmarkStore_LPop_Drain pops a whole list, leaving nothing allocated.
+func BenchmarkStore_LPop_Drain(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := benchmarkFilledList(b, 10_000)
+		b.StartTimer()
+		for {
+			if _, ok, _ := s.LPop("list"); !ok {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkQuicklist_Index reads and replaces elements in the middle of a
+// list, which skips whole nodes to get there.
+func BenchmarkQuicklist_Index(b *testing.B) {
+	for _, n := range benchmarkListSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			q := newQuicklist()
+			for i := 0; i < n; i++ {
+				q.pushBack(strconv.Itoa(i))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.set(n/2, "value")
+				q.index(n / 2)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+var errScoreNaN = errors.New("ERR resulting score is not a number (NaN)")
+
+// ZAddOptions are the flags accepted by ZADD.
+type ZAddOptions struct {
+	NX bool // only add new members
+	XX bool // only update existing members
+	GT bool // only update when the new score is greater
+	LT bool // only update when the new score is less
+	CH bool // count changed members rather than added ones
+}
+
+// ZAdd adds or updates members and returns how many were added, or with CH
+// how many were added or had their score changed.
+func (s *store) ZAdd(key string, opts ZAddOptions, members ...ScoredMember) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if opts.XX {
+			return 0, nil
+		}
+		zs = newZSet()
+		s.data.set(key, zs)
+	}
+
+	s.beforeWrite(key)
+	added, updated := 0, 0
+	for _, m := range members {
+		cur, found := zs.dict.get(m.Member)
+		if !found {
+			if opts.XX {
+				continue
+			}
+			zs.set(m.Member, m.Score)
+			added++
+			continue
+		}
+
+		if opts.NX || (opts.GT && m.Score <= cur) || (opts.LT && m.Score >= cur) {
+			continue
+		}
+		if m.Score != cur {
+			zs.set(m.Member, m.Score)
+			updated++
+		}
+	}
+
+	if added+updated > 0 {
+		s.touch(key)
+	}
+	if zs.length() == 0 {
+		s.removeKey(key)
+	}
+	if opts.CH {
+		return added + updated, nil
+	}
+	return added, nil
+}
+
+// ZIncrBy adds delta to the score of member, creating it with a score of delta
+// if needed. The boolean is false when the ZADD options prevented the update.
+func (s *store) ZIncrBy(key string, opts ZAddOptions, member string, delta float64) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var cur float64
+	found := false
+	if exists {
+		cur, found = zs.dict.get(member)
+	}
+	if (found && opts.NX) || (!found && opts.XX) {
+		return 0, false, nil
+	}
+
+	score := cur + delta
+	if math.IsNaN(score) {
+		return 0, false, errScoreNaN
+	}
+	if found && ((opts.GT && score <= cur) || (opts.LT && score >= cur)) {
+		return 0, false, nil
+	}
+
+	if !exists {
+		zs = newZSet()
+		s.data.set(key, zs)
+	}
+	s.beforeWrite(key)
+	zs.set(member, score)
+	s.touch(key)
+	return score, true, nil
+}
+
+func (s *store) ZRem(key string, members ...string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s.beforeWrite(key)
+	removed := 0
+	for _, member := range members {
+		if zs.remove(member) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		s.touch(key)
+	}
+	if zs.length() == 0 {
+		s.removeKey(key)
+	}
+	return removed, nil
+}
+
+func (s *store) ZScore(key, member string) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	score, found := zs.dict.get(member)
+	return score, found, nil
+}
+
+func (s *store) ZCard(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return zs.length(), nil
+}
+
+func (s *store) ZCount(key string, r ZScoreRange) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return zs.countInRange(zs.zsl.firstInScoreRange(r), zs.zsl.lastInScoreRange(r)), nil
+}
+
+func (s *store) ZLexCount(key string, r ZLexRange) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return zs.countInRange(zs.zsl.firstInLexRange(r), zs.zsl.lastInLexRange(r)), nil
+}
+
+// ZRank returns the 0-based rank of member together with its score.
+func (s *store) ZRank(key, member string, reverse bool) (int, float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, 0, false, err
+	}
+
+	rank, found := zs.rank(member, reverse)
+	score, _ := zs.dict.get(member)
+	return rank, score, found, nil
+}
+
+func (s *store) ZRange(key string, q ZRangeQuery) ([]ScoredMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []ScoredMember{}, nil
+	}
+	return zs.rangeQuery(q), nil
+}
+
+// ZRemRange removes every member selected by q and returns how many there were.
+func (s *store) ZRemRange(key string, q ZRangeQuery) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	removed := zs.rangeQuery(q)
+	s.beforeWrite(key)
+	for _, m := range removed {
+		zs.remove(m.Member)
+	}
+	if len(removed) > 0 {
+		s.touch(key)
+	}
+
+	if zs.length() == 0 {
+		s.removeKey(key)
+	}
+	return len(removed), nil
+}
+
+// ZPop removes and returns up to count members with the lowest scores, or the
+// highest ones when max is set.
+func (s *store) ZPop(key string, count int, max bool) ([]ScoredMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zs, exists, err := lookupTyped[*zset](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []ScoredMember{}, nil
+	}
+
+	s.beforeWrite(key)
+	popped := make([]ScoredMember, 0, min(count, zs.length()))
+	for len(popped) < count && zs.length() > 0 {
+		x := zs.zsl.header.level[0].forward
+		if max {
+			x = zs.zsl.tail
+		}
+		popped = append(popped, ScoredMember{Member: x.member, Score: x.score})
+		zs.remove(x.member)
+	}
+
+	if len(popped) > 0 {
+		s.touch(key)
+	}
+	if zs.length() == 0 {
+		s.removeKey(key)
+	}
+	return popped, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errStreamIDInvalid   = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall  = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero      = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	errStreamIDExhausted = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+)
+
+// StreamID identifies a stream entry: the unix time in milliseconds it was
+// added at, and a sequence number among the entries of that millisecond.
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+var maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) compare(other StreamID) int {
+	switch {
+	case id.Ms < other.Ms:
+		return -1
+	case id.Ms > other.Ms:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+func (id StreamID) isZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// next returns the smallest ID greater than id, or false if id is the
+// largest possible one.
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the largest ID smaller than id, or false if id is 0-0.
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses an ID written as ms-seq. With a bare ms the sequence
+// is missingSeq; seqAuto reports a sequence of "*", which only allowAuto
+// accepts.
+func parseStreamID(s string, missingSeq uint64, allowAuto bool) (id StreamID, seqAuto bool, err error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	if id.Ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+		return id, false, errStreamIDInvalid
+	}
+	switch {
+	case !hasSeq:
+		id.Seq = missingSeq
+	case seqPart == "*" && allowAuto:
+		seqAuto = true
+	default:
+		if id.Seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return id, false, errStreamIDInvalid
+		}
+	}
+	return id, seqAuto, nil
+}
+
+// StreamEntry is an entry of a stream: its ID and its field-value pairs.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// streamChunkSize is the most entries a chunk holds, like Redis'
+// stream-node-max-entries.
+const streamChunkSize = 100
+
+// stream is an append-only log of entries in ID order. Entries are kept in
+// chunks of at most streamChunkSize, so that appending is cheap, a range is
+// found by binary search, and trimming the oldest entries drops whole chunks.
+// Entries are never changed once added, only removed.
+type stream struct {
+	chunks [][]StreamEntry
+	length int
+
+	// lastID is the ID of the last entry ever added, which new IDs must be
+	// greater than even after it is deleted.
+	lastID StreamID
+	// maxDeletedID is the greatest ID removed by XDEL, and entriesAdded the
+	// number of entries ever added.
+	maxDeletedID StreamID
+	entriesAdded uint64
+
+	groups map[string]*streamGroup
+}
+
+func newStream() *stream {
+	return &stream{}
+}
+
+// firstID returns the ID of the first entry, or 0-0 for an empty stream.
+func (s *stream) firstID() StreamID {
+	if s.length == 0 {
+		return StreamID{}
+	}
+	return s.chunks[0][0].ID
+}
+
+// nextID returns the ID for a new entry. With auto, the milliseconds are
+// those of now unless the last ID is from later, and with seqAuto the
+// sequence number follows the last ID's within the same millisecond.
+func (s *stream) nextID(id StreamID, auto, seqAuto bool, now uint64) (StreamID, error) {
+	if s.lastID == maxStreamID {
+		return StreamID{}, errStreamIDExhausted
+	}
+	switch {
+	case auto:
+		if now > s.lastID.Ms {
+			return StreamID{now, 0}, nil
+		}
+		next, _ := s.lastID.next()
+		return next, nil
+	case seqAuto:
+		if id.Ms == s.lastID.Ms {
+			if s.lastID.Seq == math.MaxUint64 {
+				return StreamID{}, errStreamIDTooSmall
+			}
+			return StreamID{id.Ms, s.lastID.Seq + 1}, nil
+		}
+		if id.Ms < s.lastID.Ms {
+			return StreamID{}, errStreamIDTooSmall
+		}
+		return StreamID{id.Ms, 0}, nil
+	}
+	if id.compare(s.lastID) <= 0 {
+		return StreamID{}, errStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// add appends an entry whose ID is greater than the last one.
+func (s *stream) add(entry StreamEntry) {
+	last := len(s.chunks) - 1
+	if last < 0 || len(s.chunks[last]) >= streamChunkSize {
+		s.chunks = append(s.chunks, make([]StreamEntry, 0, streamChunkSize))
+		last++
+	}
+	s.chunks[last] = append(s.chunks[last], entry)
+	s.length++
+	s.lastID = entry.ID
+	s.entriesAdded++
+}
+
+// seek returns the position of the first entry with an ID of at least id, as
+// a chunk index and an index into that chunk. Past the last entry it returns
+// len(s.chunks), 0.
+func (s *stream) seek(id StreamID) (int, int) {
+	lo, hi := 0, len(s.chunks)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		chunk := s.chunks[mid]
+		if chunk[len(chunk)-1].ID.compare(id) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == len(s.chunks) {
+		return lo, 0
+	}
+	chunk := s.chunks[lo]
+	i, j := 0, len(chunk)
+	for i < j {
+		mid := (i + j) / 2
+		if chunk[mid].ID.compare(id) < 0 {
+			i = mid + 1
+		} else {
+			j = mid
+		}
+	}
+	return lo, i
+}
+
+// rangeEntries returns up to count entries (all with count 0) with IDs from
+// start to end inclusive, in reverse order with rev.
+func (s *stream) rangeEntries(start, end StreamID, count int, rev bool) []StreamEntry {
+	var entries []StreamEntry
+	if start.compare(end) > 0 {
+		return entries
+	}
+	full := func() bool { return count > 0 && len(entries) >= count }
+
+	if !rev {
+		ci, ei := s.seek(start)
+		for ; ci < len(s.chunks); ci, ei = ci+1, 0 {
+			for _, entry := range s.chunks[ci][ei:] {
+				if entry.ID.compare(end) > 0 || full() {
+					return entries
+				}
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	// Start from the last entry not greater than end.
+	ci, ei := len(s.chunks), 0
+	if next, ok := end.next(); ok {
+		ci, ei = s.seek(next)
+	}
+	for {
+		if ei == 0 {
+			if ci == 0 {
+				return entries
+			}
+			ci--
+			ei = len(s.chunks[ci])
+		}
+		ei--
+		entry := s.chunks[ci][ei]
+		if entry.ID.compare(start) < 0 || full() {
+			return entries
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// delete removes the entry with the given ID and reports whether there was
+// one.
+func (s *stream) delete(id StreamID) bool {
+	ci, ei := s.seek(id)
+	if ci == len(s.chunks) || s.chunks[ci][ei].ID != id {
+		return false
+	}
+	chunk := s.chunks[ci]
+	if len(chunk) == 1 {
+		s.chunks = append(s.chunks[:ci], s.chunks[ci+1:]...)
+	} else {
+		s.chunks[ci] = append(chunk[:ei], chunk[ei+1:]...)
+	}
+	s.length--
+	if id.compare(s.maxDeletedID) > 0 {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// StreamTrim is a trimming strategy of XADD and XTRIM.
+type StreamTrim struct {
+	// MaxLen keeps at most that many entries when ByMaxLen is set, and
+	// otherwise MinID drops the entries with a smaller ID.
+	ByMaxLen bool
+	MaxLen   int64
+	MinID    StreamID
+	// Approx only drops whole chunks, which may leave a few more entries
+	// than asked for. Limit, when not 0, caps how many entries are dropped.
+	Approx bool
+	Limit  int64
+}
+
+// trim drops the oldest entries as the strategy says and returns how many
+// were dropped.
+func (s *stream) trim(t StreamTrim) int {
+	removed := 0
+	// drops reports whether entry goes, left being the number of entries
+	// from it on.
+	drops := func(entry StreamEntry, left int) bool {
+		if t.ByMaxLen {
+			return int64(left) > t.MaxLen
+		}
+		return entry.ID.compare(t.MinID) < 0
+	}
+	allowed := func(n int) bool {
+		return t.Limit == 0 || int64(removed+n) <= t.Limit
+	}
+
+	for len(s.chunks) > 0 {
+		// The whole chunk goes if its last entry does.
+		chunk := s.chunks[0]
+		if drops(chunk[len(chunk)-1], s.length-len(chunk)+1) && allowed(len(chunk)) {
+			s.chunks = s.chunks[1:]
+			s.length -= len(chunk)
+			removed += len(chunk)
+			continue
+		}
+		if t.Approx {
+			break
+		}
+
+		n := 0
+		for n < len(chunk) && drops(chunk[n], s.length-n) && allowed(n+1) {
+			n++
+		}
+		s.chunks[0] = chunk[n:]
+		s.length -= n
+		removed += n
+		break
+	}
+	return removed
+}
+
+// clone returns a copy of the stream. Entries are immutable, so only the
+// chunks are copied.
+func (s *stream) clone() *stream {
+	clone := *s
+	clone.chunks = make([][]StreamEntry, len(s.chunks))
+	for i, chunk := range s.chunks {
+		clone.chunks[i] = append(make([]StreamEntry, 0, streamChunkSize), chunk...)
+	}
+	if s.groups != nil {
+		clone.groups = make(map[string]*streamGroup, len(s.groups))
+		for name, g := range s.groups {
+			clone.groups[name] = g.clone()
+		}
+	}
+	return &clone
+}
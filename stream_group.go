@@ -0,0 +1,353 @@
+package main
+
+import (
+	"sort"
+)
+
+// Consumer groups share the entries of a stream between consumers. Each new
+// entry is delivered to one consumer of the group, and stays pending in the
+// group until that consumer acknowledges it, so that another consumer can
+// claim it if the first one fails.
+
+// streamEntriesReadUnknown is the entries read counter of a group whose
+// position in the stream can not be told from the entries added.
+const streamEntriesReadUnknown = -1
+
+// streamNACK is an entry delivered to a consumer and not acknowledged yet.
+type streamNACK struct {
+	consumer      *streamConsumer
+	deliveryTime  int64 // unix milliseconds of the last delivery
+	deliveryCount uint64
+}
+
+// pendingList is a pending entries list, or PEL: NACKs by entry ID, with the
+// IDs kept sorted for range queries. Entries are mostly delivered in ID
+// order, so adding one is usually an append.
+type pendingList struct {
+	ids   []StreamID
+	nacks map[StreamID]*streamNACK
+}
+
+func newPendingList() *pendingList {
+	return &pendingList{nacks: make(map[StreamID]*streamNACK)}
+}
+
+func (p *pendingList) len() int {
+	return len(p.ids)
+}
+
+// seek returns the index in p.ids of the first ID not smaller than id.
+func (p *pendingList) seek(id StreamID) int {
+	return sort.Search(len(p.ids), func(i int) bool { return p.ids[i].compare(id) >= 0 })
+}
+
+// add adds a NACK for an ID that is not pending yet.
+func (p *pendingList) add(id StreamID, nack *streamNACK) {
+	p.nacks[id] = nack
+	if n := len(p.ids); n == 0 || p.ids[n-1].compare(id) < 0 {
+		p.ids = append(p.ids, id)
+		return
+	}
+	i := p.seek(id)
+	p.ids = append(p.ids, StreamID{})
+	copy(p.ids[i+1:], p.ids[i:])
+	p.ids[i] = id
+}
+
+func (p *pendingList) remove(id StreamID) bool {
+	if _, ok := p.nacks[id]; !ok {
+		return false
+	}
+	delete(p.nacks, id)
+	i := p.seek(id)
+	p.ids = append(p.ids[:i], p.ids[i+1:]...)
+	return true
+}
+
+// streamConsumer is a consumer of a group, with the entries delivered to it
+// and not acknowledged yet.
+type streamConsumer struct {
+	name string
+	// seenTime is when the consumer last tried to read or claim, and
+	// activeTime when it last got an entry, or -1 if it never did.
+	seenTime   int64
+	activeTime int64
+	pel        *pendingList
+}
+
+// streamGroup is a consumer group of a stream.
+type streamGroup struct {
+	name string
+	// lastID is the ID of the last entry delivered, and entriesRead the
+	// number of entries added to the stream up to it, when known.
+	lastID      StreamID
+	entriesRead int64
+	// pel holds the pending entries of all consumers, which also appear in
+	// the PEL of the consumer they were delivered to.
+	pel       *pendingList
+	consumers map[string]*streamConsumer
+}
+
+func (s *stream) group(name string) *streamGroup {
+	return s.groups[name]
+}
+
+// createGroup adds a group that starts reading after id, or returns false if
+// one with that name exists.
+func (s *stream) createGroup(name string, id StreamID, entriesRead int64) (*streamGroup, bool) {
+	if _, exists := s.groups[name]; exists {
+		return nil, false
+	}
+	if s.groups == nil {
+		s.groups = make(map[string]*streamGroup)
+	}
+	g := &streamGroup{
+		name:        name,
+		lastID:      id,
+		entriesRead: entriesRead,
+		pel:         newPendingList(),
+		consumers:   make(map[string]*streamConsumer),
+	}
+	s.groups[name] = g
+	return g, true
+}
+
+// groupNames returns the names of the stream's groups in order.
+func (s *stream) groupNames() []string {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// consumerNames returns the names of the group's consumers in order.
+func (g *streamGroup) consumerNames() []string {
+	names := make([]string, 0, len(g.consumers))
+	for name := range g.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createConsumer returns the named consumer, creating it first if needed, and
+// whether it was created.
+func (g *streamGroup) createConsumer(name string, now int64) (*streamConsumer, bool) {
+	if consumer, exists := g.consumers[name]; exists {
+		return consumer, false
+	}
+	consumer := &streamConsumer{name: name, seenTime: now, activeTime: -1, pel: newPendingList()}
+	g.consumers[name] = consumer
+	return consumer, true
+}
+
+// deleteConsumer removes a consumer and its pending entries, and returns how
+// many entries it had pending.
+func (g *streamGroup) deleteConsumer(name string) (int, bool) {
+	consumer, exists := g.consumers[name]
+	if !exists {
+		return 0, false
+	}
+	for _, id := range consumer.pel.ids {
+		g.pel.remove(id)
+	}
+	delete(g.consumers, name)
+	return consumer.pel.len(), true
+}
+
+// ack acknowledges a pending entry.
+func (g *streamGroup) ack(id StreamID) bool {
+	nack, ok := g.pel.nacks[id]
+	if !ok {
+		return false
+	}
+	g.pel.remove(id)
+	nack.consumer.pel.remove(id)
+	return true
+}
+
+// assign makes a pending entry, or a new one when nack is nil, pending for
+// consumer and returns its NACK.
+func (g *streamGroup) assign(id StreamID, nack *streamNACK, consumer *streamConsumer) *streamNACK {
+	if nack == nil {
+		nack = &streamNACK{}
+		g.pel.add(id, nack)
+	}
+	if nack.consumer != consumer {
+		if nack.consumer != nil {
+			nack.consumer.pel.remove(id)
+		}
+		nack.consumer = consumer
+		consumer.pel.add(id, nack)
+	}
+	return nack
+}
+
+// entryExists reports whether the stream holds an entry with the given ID.
+func (s *stream) entryExists(id StreamID) bool {
+	ci, ei := s.seek(id)
+	return ci < len(s.chunks) && s.chunks[ci][ei].ID == id
+}
+
+// rangeHasTombstones reports whether an entry with an ID of at least start
+// may have been deleted, which makes counting entries from there unreliable.
+func (s *stream) rangeHasTombstones(start StreamID) bool {
+	if s.length == 0 || s.maxDeletedID.isZero() {
+		return false
+	}
+	if s.firstID().compare(s.maxDeletedID) > 0 {
+		// The last deletion was before the first entry.
+		return false
+	}
+	return start.compare(s.maxDeletedID) <= 0
+}
+
+// estimateEntriesRead returns how many entries were added to the stream up
+// to and including id, or streamEntriesReadUnknown if deletions make that
+// impossible to tell.
+func (s *stream) estimateEntriesRead(id StreamID) int64 {
+	added := int64(s.entriesAdded)
+	if added == 0 {
+		return 0
+	}
+	cmpLast := id.compare(s.lastID)
+	if s.length == 0 && cmpLast <= 0 {
+		return added
+	}
+	switch {
+	case cmpLast == 0:
+		return added
+	case cmpLast > 0:
+		return streamEntriesReadUnknown
+	}
+
+	if s.maxDeletedID.isZero() || s.maxDeletedID.compare(s.firstID()) < 0 {
+		// Nothing was deleted past the first entry.
+		switch id.compare(s.firstID()) {
+		case -1:
+			return added - int64(s.length)
+		case 0:
+			return added - int64(s.length) + 1
+		}
+	}
+	return streamEntriesReadUnknown
+}
+
+// lag returns how many entries the group has yet to read, if that is known.
+func (s *stream) lag(g *streamGroup) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead != streamEntriesReadUnknown && !s.rangeHasTombstones(g.lastID) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+	if read := s.estimateEntriesRead(g.lastID); read != streamEntriesReadUnknown {
+		return int64(s.entriesAdded) - read, true
+	}
+	return 0, false
+}
+
+// deliverNew delivers up to count entries (all with count 0) the group has
+// not read yet to consumer. Unless noAck, they become pending.
+func (s *stream) deliverNew(g *streamGroup, consumer *streamConsumer, count int, noAck bool, now int64) []StreamEntry {
+	start, ok := g.lastID.next()
+	if !ok {
+		return nil
+	}
+	entries := s.rangeEntries(start, maxStreamID, count, false)
+	for _, entry := range entries {
+		if g.entriesRead != streamEntriesReadUnknown && !s.rangeHasTombstones(entry.ID) {
+			g.entriesRead++
+		} else {
+			g.entriesRead = s.estimateEntriesRead(entry.ID)
+		}
+		g.lastID = entry.ID
+
+		if !noAck {
+			// An entry delivered again after XGROUP SETID moves to the new
+			// consumer and starts over.
+			nack := g.assign(entry.ID, g.pel.nacks[entry.ID], consumer)
+			nack.deliveryTime, nack.deliveryCount = now, 1
+		}
+	}
+	if len(entries) > 0 {
+		consumer.activeTime = now
+	}
+	return entries
+}
+
+// deliverHistory delivers again up to count (all with count 0) of the
+// entries pending for consumer with an ID of at least start. Entries deleted
+// from the stream since are returned with nil fields.
+func (s *stream) deliverHistory(consumer *streamConsumer, start StreamID, count int, now int64) []StreamEntry {
+	var entries []StreamEntry
+	for _, id := range consumer.pel.ids[consumer.pel.seek(start):] {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		found := s.rangeEntries(id, id, 1, false)
+		if len(found) == 0 {
+			entries = append(entries, StreamEntry{ID: id})
+			continue
+		}
+		nack := consumer.pel.nacks[id]
+		nack.deliveryTime = now
+		nack.deliveryCount++
+		entries = append(entries, found[0])
+	}
+	return entries
+}
+
+// clone returns a deep copy of a consumer group.
+func (g *streamGroup) clone() *streamGroup {
+	clone := *g
+	clone.pel = newPendingList()
+	clone.consumers = make(map[string]*streamConsumer, len(g.consumers))
+	for name, consumer := range g.consumers {
+		consumerClone := *consumer
+		consumerClone.pel = newPendingList()
+		clone.consumers[name] = &consumerClone
+	}
+	for _, id := range g.pel.ids {
+		nack := *g.pel.nacks[id]
+		nack.consumer = clone.consumers[nack.consumer.name]
+		clone.pel.add(id, &nack)
+		nack.consumer.pel.add(id, &nack)
+	}
+	return &clone
+}
+
+// claim claims the pending entry id for consumer if it was pending long
+// enough, or with args.Force if it is not pending, and adds what it did to
+// result.
+func (s *stream) claim(g *streamGroup, consumer *streamConsumer, id StreamID, args XClaimArgs, now int64, result *XClaimResult) {
+	nack := g.pel.nacks[id]
+	found := s.rangeEntries(id, id, 1, false)
+	if len(found) == 0 {
+		if nack != nil {
+			g.ack(id)
+			result.Deleted = append(result.Deleted, id)
+		}
+		return
+	}
+	if nack == nil && !args.Force {
+		return
+	}
+	if nack != nil && now-nack.deliveryTime < args.MinIdle {
+		return
+	}
+
+	nack = g.assign(id, nack, consumer)
+	nack.deliveryTime = args.DeliveryTime
+	switch {
+	case args.RetryCount >= 0:
+		nack.deliveryCount = uint64(args.RetryCount)
+	case !args.JustID:
+		nack.deliveryCount++
+	}
+	consumer.activeTime = now
+	result.Claimed = append(result.Claimed, found[0])
+	result.Pending = append(result.Pending, PendingEntry{id, consumer.name, nack.deliveryTime, nack.deliveryCount})
+}
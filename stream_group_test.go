@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessCommand_StreamGroups(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"XADD", "s", "1-0", "f", "a"})
+	executeTestCommand([]string{"XADD", "s", "2-0", "f", "b"})
+	executeTestCommand([]string{"XADD", "s", "3-0", "f", "c"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"XGROUP", "CREATE", "missing", "g", "$"}, "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"},
+		{[]string{"XGROUP", "CREATE", "empty", "g", "$", "MKSTREAM"}, "+OK\r\n"},
+		{[]string{"XLEN", "empty"}, ":0\r\n"},
+		{[]string{"XGROUP", "CREATE", "s", "g", "0"}, "+OK\r\n"},
+		{[]string{"XGROUP", "CREATE", "s", "g", "0"}, "-BUSYGROUP Consumer Group name already exists\r\n"},
+		{[]string{"XGROUP", "CREATE", "s", "other", "0", "ENTRIESREAD", "-2"}, "-ERR value for ENTRIESREAD must be positive or -1\r\n"},
+		{[]string{"XGROUP", "CREATE", "s", "other"}, "-ERR wrong number of arguments for 'xgroup|create' command\r\n"},
+		{[]string{"XGROUP", "BOGUS"}, "-ERR unknown subcommand 'BOGUS'. Try XGROUP HELP.\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "nogroup", "c", "STREAMS", "s", ">"}, "-NOGROUP No such key 's' or consumer group 'nogroup' in XREADGROUP with GROUP option\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "s", "$"}, "-ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.\r\n"},
+		{[]string{"XREAD", "GROUP", "g", "c", "STREAMS", "s", ">"}, "-ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.\r\n"},
+		// New entries go to one consumer each.
+		{[]string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\na\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nb\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\nc\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">"}, "*-1\r\n"},
+		// History reads return the consumer's pending entries.
+		{[]string{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "1-0"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\na\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nb\r\n"},
+		{[]string{"XACK", "s", "g", "1-0", "3-0", "9-0"}, ":2\r\n"},
+		{[]string{"XACK", "s", "nogroup", "2-0"}, ":0\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n*0\r\n"},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:1\r\n$3\r\n2-0\r\n$3\r\n2-0\r\n*1\r\n*2\r\n$5\r\nalice\r\n$1\r\n1\r\n"},
+		{[]string{"XPENDING", "s", "nogroup"}, "-NOGROUP No such key 's' or consumer group 'nogroup'\r\n"},
+		{[]string{"XPENDING", "s", "g", "-", "+", "10", "bob"}, "*0\r\n"},
+		// An entry deleted while pending reads as null.
+		{[]string{"XDEL", "s", "2-0"}, ":1\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0"}, "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*-1\r\n"},
+		{[]string{"XGROUP", "DELCONSUMER", "s", "g", "alice"}, ":1\r\n"},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "g", "carol"}, ":1\r\n"},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "g", "carol"}, ":0\r\n"},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "nogroup", "carol"}, "-NOGROUP No such consumer group 'nogroup' for key name 's'\r\n"},
+		// Moving the group back delivers the entries again.
+		{[]string{"XGROUP", "SETID", "s", "g", "0", "ENTRIESREAD", "0"}, "+OK\r\n"},
+		{[]string{"XREADGROUP", "GROUP", "g", "carol", "NOACK", "STREAMS", "s", ">"}, "*1\r\n*2\r\n$1\r\ns\r\n*2\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\na\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\nc\r\n"},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"},
+		{[]string{"XGROUP", "DESTROY", "s", "g"}, ":1\r\n"},
+		{[]string{"XGROUP", "DESTROY", "s", "g"}, ":0\r\n"},
+		{[]string{"XGROUP", "SETID", "missing", "g", "0"}, "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n"},
+	}
+
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+}
+
+func TestProcessCommand_XCLAIM(t *testing.T) {
+	testServer = newServer()
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		executeTestCommand([]string{"XADD", "s", id, "f", "v"})
+	}
+	executeTestCommand([]string{"XGROUP", "CREATE", "s", "g", "0"})
+	executeTestCommand([]string{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		// Entries pending for less than min-idle-time are not claimed.
+		{[]string{"XCLAIM", "s", "g", "bob", "3600000", "1-0"}, "*0\r\n"},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "1-0", "JUSTID"}, "*1\r\n$3\r\n1-0\r\n"},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "2-0", "RETRYCOUNT", "7"}, "*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "9-0"}, "*0\r\n"},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "1-0", "BOGUS"}, "-ERR Unrecognized XCLAIM option 'BOGUS'\r\n"},
+		{[]string{"XCLAIM", "s", "g", "bob", "soon", "1-0"}, "-ERR Invalid min-idle-time argument for XCLAIM\r\n"},
+		{[]string{"XCLAIM", "s", "nogroup", "bob", "0", "1-0"}, "-NOGROUP No such key 's' or consumer group 'nogroup'\r\n"},
+		{[]string{"XPENDING", "s", "g", "-", "+", "10", "bob"}, ""},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:3\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*2\r\n*2\r\n$5\r\nalice\r\n$1\r\n1\r\n*2\r\n$3\r\nbob\r\n$1\r\n2\r\n"},
+		// XAUTOCLAIM scans the PEL from start, and drops entries deleted
+		// from the stream.
+		{[]string{"XDEL", "s", "2-0"}, ":1\r\n"},
+		{[]string{"XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "1", "JUSTID"}, "*3\r\n$3\r\n2-0\r\n*1\r\n$3\r\n1-0\r\n*0\r\n"},
+		{[]string{"XAUTOCLAIM", "s", "g", "carol", "0", "2-0", "COUNT", "5"}, "*3\r\n$3\r\n0-0\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*1\r\n$3\r\n2-0\r\n"},
+		{[]string{"XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "0"}, "-ERR COUNT must be > 0\r\n"},
+		{[]string{"XPENDING", "s", "g"}, "*4\r\n:2\r\n$3\r\n1-0\r\n$3\r\n3-0\r\n*1\r\n*2\r\n$5\r\ncarol\r\n$1\r\n2\r\n"},
+	}
+
+	for _, test := range tests {
+		result := string(executeTestCommand(test.command))
+		if test.expected == "" {
+			// The idle times vary, so only the delivery counts are checked.
+			if !strings.Contains(result, "$3\r\n1-0\r\n$3\r\nbob\r\n") || !strings.HasSuffix(result, ":7\r\n") {
+				t.Errorf("Command %v: unexpected reply %q", test.command, result)
+			}
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, result)
+		}
+	}
+}
+
+func TestProcessCommand_XINFO(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"XADD", "s", "1-0", "f", "a"})
+	executeTestCommand([]string{"XADD", "s", "2-0", "f", "b"})
+	executeTestCommand([]string{"XGROUP", "CREATE", "s", "g", "0"})
+	executeTestCommand([]string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "s", ">"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"XINFO", "STREAM", "s"}, "*20\r\n$6\r\nlength\r\n:2\r\n$15\r\nradix-tree-keys\r\n:1\r\n$16\r\nradix-tree-nodes\r\n:1\r\n$17\r\nlast-generated-id\r\n$3\r\n2-0\r\n$20\r\nmax-deleted-entry-id\r\n$3\r\n0-0\r\n$13\r\nentries-added\r\n:2\r\n$23\r\nrecorded-first-entry-id\r\n$3\r\n1-0\r\n$6\r\ngroups\r\n:1\r\n$11\r\nfirst-entry\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\na\r\n$10\r\nlast-entry\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nb\r\n"},
+		{[]string{"XINFO", "GROUPS", "s"}, "*1\r\n*12\r\n$4\r\nname\r\n$1\r\ng\r\n$9\r\nconsumers\r\n:1\r\n$7\r\npending\r\n:1\r\n$17\r\nlast-delivered-id\r\n$3\r\n1-0\r\n$12\r\nentries-read\r\n:1\r\n$3\r\nlag\r\n:1\r\n"},
+		{[]string{"XINFO", "STREAM", "missing"}, "-ERR no such key\r\n"},
+		{[]string{"XINFO", "CONSUMERS", "s", "nogroup"}, "-NOGROUP No such consumer group 'nogroup' for key name 's'\r\n"},
+		{[]string{"XINFO", "STREAM", "s", "BOGUS"}, "-ERR syntax error\r\n"},
+		{[]string{"XINFO", "GROUPS"}, "-ERR wrong number of arguments for 'xinfo|groups' command\r\n"},
+		{[]string{"XINFO", "BOGUS", "s"}, "-ERR unknown subcommand 'BOGUS'. Try XINFO HELP.\r\n"},
+	}
+
+	for _, test := range tests {
+		result := executeTestCommand(test.command)
+		if string(result) != test.expected {
+			t.Errorf("Command %v: expected %q, got %q", test.command, test.expected, string(result))
+		}
+	}
+
+	consumers := string(executeTestCommand([]string{"XINFO", "CONSUMERS", "s", "g"}))
+	if !strings.HasPrefix(consumers, "*1\r\n*8\r\n$4\r\nname\r\n$5\r\nalice\r\n$7\r\npending\r\n:1\r\n$4\r\nidle\r\n") {
+		t.Errorf("Unexpected XINFO CONSUMERS reply %q", consumers)
+	}
+	full := string(executeTestCommand([]string{"XINFO", "STREAM", "s", "FULL", "COUNT", "1"}))
+	if !strings.Contains(full, "$7\r\nentries\r\n*1\r\n") || !strings.Contains(full, "$9\r\npel-count\r\n:1\r\n") {
+		t.Errorf("Unexpected XINFO STREAM FULL reply %q", full)
+	}
+}
+
+func TestProcessCommand_XREADGROUP_Block(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"})
+
+	// Of two consumers waiting, the first gets the entry and the other keeps
+	// waiting.
+	replies := make(chan string, 2)
+	for _, consumer := range []string{"alice", "bob"} {
+		go func() {
+			replies <- string(executeTestCommand([]string{"XREADGROUP", "GROUP", "g", consumer, "BLOCK", "0", "STREAMS", "s", ">"}))
+		}()
+		waitFor(t, consumer+" to block", func() bool {
+			testServer.keyspaceLock.RLock()
+			defer testServer.keyspaceLock.RUnlock()
+			return len(testServer.blocking.waitingOn(0, "s")) == 1+boolToInt(consumer == "bob")
+		})
+	}
+
+	executeTestCommand([]string{"XADD", "s", "1-0", "f", "v"})
+	want := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"
+	select {
+	case got := <-replies:
+		if got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for XREADGROUP to be served")
+	}
+	if got := string(executeTestCommand([]string{"XPENDING", "s", "g"})); !strings.Contains(got, "$5\r\nalice\r\n") {
+		t.Errorf("Expected the entry to be pending for alice, got %q", got)
+	}
+
+	// Destroying the group unblocks the other consumer with an error.
+	executeTestCommand([]string{"XGROUP", "DESTROY", "s", "g"})
+	select {
+	case got := <-replies:
+		if want := "-NOGROUP the consumer group this client was blocked on no longer exists\r\n"; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for XREADGROUP to be unblocked")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testStream(n int) *stream {
+	s := newStream()
+	for i := 1; i <= n; i++ {
+		s.add(StreamEntry{ID: StreamID{uint64(i), 0}, Fields: []string{"i", strconv.Itoa(i)}})
+	}
+	return s
+}
+
+func TestStream_Range(t *testing.T) {
+	s := testStream(250)
+
+	got := s.rangeEntries(StreamID{95, 0}, StreamID{105, 0}, 0, false)
+	if len(got) != 11 || got[0].ID.Ms != 95 || got[10].ID.Ms != 105 {
+		t.Errorf("Expected 95..105 across chunks, got %v", got)
+	}
+	got = s.rangeEntries(StreamID{105, 0}, maxStreamID, 3, true)
+	if len(got) != 3 || got[0].ID.Ms != 250 || got[2].ID.Ms != 248 {
+		t.Errorf("Expected 250..248 in reverse, got %v", got)
+	}
+	got = s.rangeEntries(StreamID{}, StreamID{100, 5}, 2, true)
+	if len(got) != 2 || got[0].ID.Ms != 100 || got[1].ID.Ms != 99 {
+		t.Errorf("Expected 100 and 99 in reverse, got %v", got)
+	}
+	if got := s.rangeEntries(StreamID{300, 0}, maxStreamID, 0, false); len(got) != 0 {
+		t.Errorf("Expected nothing past the end, got %v", got)
+	}
+
+	for i := 1; i <= 100; i++ {
+		if !s.delete(StreamID{uint64(i), 0}) {
+			t.Fatalf("Expected %d-0 to be deleted", i)
+		}
+	}
+	if s.delete(StreamID{1, 0}) {
+		t.Error("Expected a deleted entry to be gone")
+	}
+	if s.length != 150 || len(s.chunks) != 2 || s.firstID() != (StreamID{101, 0}) {
+		t.Errorf("Expected 150 entries in 2 chunks from 101-0, got %d in %d from %v", s.length, len(s.chunks), s.firstID())
+	}
+	if s.maxDeletedID != (StreamID{100, 0}) || s.lastID != (StreamID{250, 0}) {
+		t.Errorf("Unexpected max deleted ID %v and last ID %v", s.maxDeletedID, s.lastID)
+	}
+}
+
+func TestStream_NextID(t *testing.T) {
+	s := testStream(0)
+	s.lastID = StreamID{5, 3}
+
+	tests := []struct {
+		id            StreamID
+		auto, seqAuto bool
+		now           uint64
+		expected      StreamID
+		err           error
+	}{
+		{auto: true, now: 10, expected: StreamID{10, 0}},
+		// The clock went backwards.
+		{auto: true, now: 4, expected: StreamID{5, 4}},
+		{id: StreamID{5, 0}, seqAuto: true, expected: StreamID{5, 4}},
+		{id: StreamID{6, 0}, seqAuto: true, expected: StreamID{6, 0}},
+		{id: StreamID{4, 0}, seqAuto: true, err: errStreamIDTooSmall},
+		{id: StreamID{5, 3}, err: errStreamIDTooSmall},
+		{id: StreamID{5, 4}, expected: StreamID{5, 4}},
+	}
+	for _, test := range tests {
+		id, err := s.nextID(test.id, test.auto, test.seqAuto, test.now)
+		if id != test.expected || err != test.err {
+			t.Errorf("%+v: expected %v (%v), got %v (%v)", test, test.expected, test.err, id, err)
+		}
+	}
+
+	s.lastID = maxStreamID
+	if _, err := s.nextID(StreamID{}, true, false, 1); err != errStreamIDExhausted {
+		t.Errorf("Expected the IDs to be exhausted, got %v", err)
+	}
+}
+
+func TestStream_Trim(t *testing.T) {
+	tests := []struct {
+		trim              StreamTrim
+		trimmed, firstLen int
+	}{
+		{StreamTrim{ByMaxLen: true, MaxLen: 120}, 130, 70},
+		// Approximate trimming keeps the chunk that would be split.
+		{StreamTrim{ByMaxLen: true, MaxLen: 120, Approx: true}, 100, 100},
+		{StreamTrim{MinID: StreamID{151, 0}}, 150, 50},
+		{StreamTrim{MinID: StreamID{151, 0}, Approx: true}, 100, 100},
+		{StreamTrim{ByMaxLen: true, MaxLen: 0, Approx: true, Limit: 150}, 100, 100},
+		{StreamTrim{ByMaxLen: true, MaxLen: 0, Limit: 150}, 150, 50},
+		{StreamTrim{ByMaxLen: true, MaxLen: 300}, 0, 100},
+	}
+	for _, test := range tests {
+		s := testStream(250)
+		trimmed := s.trim(test.trim)
+		if trimmed != test.trimmed || s.length != 250-test.trimmed || len(s.chunks[0]) != test.firstLen {
+			t.Errorf("%+v: expected %d trimmed and a first chunk of %d, got %d and %d",
+				test.trim, test.trimmed, test.firstLen, trimmed, len(s.chunks[0]))
+		}
+	}
+}
+
+func TestProcessCommand_Streams(t *testing.T) {
+	testServer = newServer()
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"XADD", "s", "1-1", "a", "1"}, "$3\r\n1-1\r\n"},
+		{[]string{"XADD", "s", "1-*", "b", "2"}, "$3\r\n1-2\r\n"},
+		{[]string{"XADD", "s", "1", "c", "3"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n"},
+		{[]string{"XADD", "s", "2-0", "c", "3", "d", "4"}, "$3\r\n2-0\r\n"},
+		{[]string{"XADD", "s", "3-0", "odd"}, "-ERR wrong number of arguments for 'xadd' command\r\n"},
+		{[]string{"XADD", "s", "MAXLEN", "5", "NOMKSTREAM"}, "-ERR wrong number of arguments for 'xadd' command\r\n"},
+		{[]string{"XADD", "new", "0-0", "a", "1"}, "-ERR The ID specified in XADD must be greater than 0-0\r\n"},
+		{[]string{"XADD", "new", "NOMKSTREAM", "*", "a", "1"}, "$-1\r\n"},
+		{[]string{"XADD", "new", "x-1", "a", "1"}, "-ERR Invalid stream ID specified as stream command argument\r\n"},
+		{[]string{"EXISTS", "new"}, ":0\r\n"},
+		{[]string{"TYPE", "s"}, "+stream\r\n"},
+		{[]string{"XLEN", "s"}, ":3\r\n"},
+		{[]string{"XRANGE", "s", "-", "+"}, "*3\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{[]string{"XRANGE", "s", "(1-1", "1"}, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "1"}, "*1\r\n*2\r\n$3\r\n1-1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "0"}, "*-1\r\n"},
+		{[]string{"XRANGE", "s", "(18446744073709551615-18446744073709551615", "+"}, "-ERR invalid start ID for the interval\r\n"},
+		{[]string{"XREVRANGE", "s", "+", "-", "COUNT", "1"}, "*1\r\n*2\r\n$3\r\n2-0\r\n*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{[]string{"XREVRANGE", "s", "(2-0", "(1-1"}, "*1\r\n*2\r\n$3\r\n1-2\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{[]string{"XRANGE", "missing", "-", "+"}, "*0\r\n"},
+		{[]string{"XDEL", "s", "1-2", "9-9"}, ":1\r\n"},
+		{[]string{"XADD", "s", "MAXLEN", "1", "3-0", "e", "5"}, "$3\r\n3-0\r\n"},
+		{[]string{"XLEN", "s"}, ":1\r\n"},
+		{[]string{"XADD", "s", "MAXLEN", "1", "MINID", "1", "*", "e", "5"}, "-ERR syntax error, MAXLEN and MINID options at the same time are not compatible\r\n"},
+		{[]string{"XADD", "s", "MAXLEN", "1", "LIMIT", "5", "*", "e", "5"}, "-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n"},
+		{[]string{"XTRIM", "s", "LIMIT", "5"}, "-ERR syntax error, LIMIT cannot be used without specifying a trimming strategy\r\n"},
+		{[]string{"XTRIM", "s", "MAXLEN", "1", "BOGUS"}, "-ERR syntax error\r\n"},
+		{[]string{"XTRIM", "s", "MAXLEN", "-1"}, "-ERR The MAXLEN argument must be >= 0.\r\n"},
+		{[]string{"XTRIM", "s", "MINID", "4"}, ":1\r\n"},
+		{[]string{"XLEN", "s"}, ":0\r\n"},
+		{[]string{"EXISTS", "s"}, ":1\r\n"},
+		{[]string{"XSETID", "s", "2-0"}, "+OK\r\n"},
+		{[]string{"XADD", "s", "2-1", "f", "6"}, "$3\r\n2-1\r\n"},
+		{[]string{"XSETID", "s", "2-0"}, "-ERR The ID specified in XSETID is smaller than the target stream top item\r\n"},
+		{[]string{"XSETID", "s", "5-0", "ENTRIESADDED", "0"}, "-ERR The entries_added specified in XSETID is smaller than the target stream length\r\n"},
+		{[]string{"XSETID", "s", "5-0", "MAXDELETEDID", "6-0"}, "-ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id\r\n"},
+		{[]string{"XSETID", "missing", "5-0"}, "-ERR no such key\r\n"},
+		{[]string{"SET", "str", "v"}, "+OK\r\n"},
+		{[]string{"XADD", "str", "*", "a", "1"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+}
+
+func TestProcessCommand_XREAD(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"XADD", "a", "1-0", "f", "1"})
+	executeTestCommand([]string{"XADD", "a", "2-0", "f", "2"})
+	executeTestCommand([]string{"XADD", "b", "1-0", "g", "1"})
+
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"XREAD", "STREAMS", "a", "b", "1", "0"}, "*2\r\n*2\r\n$1\r\na\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\n2\r\n*2\r\n$1\r\nb\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\ng\r\n$1\r\n1\r\n"},
+		{[]string{"XREAD", "COUNT", "1", "STREAMS", "a", "0"}, "*1\r\n*2\r\n$1\r\na\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\n1\r\n"},
+		{[]string{"XREAD", "STREAMS", "a", "$"}, "*-1\r\n"},
+		{[]string{"XREAD", "STREAMS", "a", "missing", "2", "0"}, "*-1\r\n"},
+		{[]string{"XREAD", "STREAMS", "a", "b", "0"}, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n"},
+		{[]string{"XREAD", "BLOCK", "-1", "STREAMS", "a", "0"}, "-ERR timeout is negative\r\n"},
+		{[]string{"XREAD", "COUNT", "1", "a", "0"}, "-ERR syntax error\r\n"},
+		{[]string{"XREAD", "BLOCK", "10", "STREAMS", "a", "$"}, "*-1\r\n"},
+	}
+	for _, test := range tests {
+		if got := string(executeTestCommand(test.command)); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.command, test.expected, got)
+		}
+	}
+
+	c := testServer.newClient(io.Discard)
+	executeClientCommand(c, []string{"MULTI"})
+	executeClientCommand(c, []string{"XREAD", "BLOCK", "0", "STREAMS", "a", "$"})
+	if got := string(executeClientCommand(c, []string{"EXEC"})); got != "*1\r\n*-1\r\n" {
+		t.Errorf("Expected XREAD not to block in a transaction, got %q", got)
+	}
+}
+
+func TestProcessCommand_XREAD_Block(t *testing.T) {
+	testServer = newServer()
+	executeTestCommand([]string{"XADD", "s", "1-0", "f", "old"})
+
+	// Two clients wait for entries after the last one and both get the new
+	// entry.
+	replies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			replies <- string(executeTestCommand([]string{"XREAD", "BLOCK", "0", "STREAMS", "missing", "s", "0", "$"}))
+		}()
+	}
+	waitFor(t, "the clients to block", func() bool {
+		testServer.keyspaceLock.RLock()
+		defer testServer.keyspaceLock.RUnlock()
+		return len(testServer.blocking.waitingOn(0, "s")) == 2
+	})
+
+	executeTestCommand([]string{"XADD", "s", "2-0", "f", "new"})
+	want := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$3\r\nnew\r\n"
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-replies:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for XREAD to be served")
+		}
+	}
+	if n := len(testServer.blocking.waitingOn(0, "s")); n != 0 {
+		t.Errorf("Expected no client left waiting, got %d", n)
+	}
+
+	start := time.Now()
+	if got := string(executeTestCommand([]string{"XREAD", "BLOCK", "50", "STREAMS", "s", "$"})); got != "*-1\r\n" {
+		t.Errorf("Expected a timeout, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected XREAD to block for 50ms, returned after %v", elapsed)
+	}
+	if n := len(testServer.blocking.waitingOn(0, "s")); n != 0 {
+		t.Errorf("Expected the timed out client to stop waiting, got %d", n)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 )
 
+var errSyntax = errors.New("syntax error")
+
 func validateMinArgs(command []string, min int, cmdName string) error {
 	if len(command) < min {
 		return fmt.Errorf("wrong number of arguments for '%s' command", cmdName)
@@ -31,3 +35,28 @@ func boolToInt(b bool) int {
 	return 0
 }
 
+
+// parseFloatArg parses a float argument the way Redis' strtod based parsing
+// does, accepting "inf" and "-inf" but rejecting NaN.
+func parseFloatArg(arg string) (float64, error) {
+	val, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(val) {
+		return 0, fmt.Errorf("value is not a valid float")
+	}
+	return val, nil
+}
+
+// formatFloat renders a float in the shortest form that round-trips, using
+// "inf" and "-inf" for infinities like Redis.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(f); abs == 0 || (abs >= 1e-6 && abs < 1e21) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
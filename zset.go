@@ -0,0 +1,602 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+)
+
+// Skiplist parameters, the same as Redis uses for sorted sets.
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP        = 0.25
+)
+
+var (
+	errScoreRange = errors.New("min or max is not a float")
+	errLexRange   = errors.New("min or max not valid string range item")
+)
+
+// ScoredMember is a sorted set element together with its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZScoreRange is a score interval as written in ZRANGEBYSCORE: "(" makes an
+// end exclusive and "-inf"/"+inf" are unbounded.
+type ZScoreRange struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+func (r ZScoreRange) gteMin(score float64) bool {
+	if r.MinEx {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ZScoreRange) lteMax(score float64) bool {
+	if r.MaxEx {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// LexBound is one end of a ZLexRange. Inf is -1 for "-", +1 for "+" and 0
+// when Value holds a real member.
+type LexBound struct {
+	Value     string
+	Exclusive bool
+	Inf       int
+}
+
+// compare orders member against the bound like strings.Compare would.
+func (b LexBound) compare(member string) int {
+	if b.Inf != 0 {
+		return -b.Inf
+	}
+	return strings.Compare(member, b.Value)
+}
+
+// ZLexRange is a lexicographic interval as written in ZRANGEBYLEX.
+type ZLexRange struct {
+	Min, Max LexBound
+}
+
+func (r ZLexRange) gteMin(member string) bool {
+	if r.Min.Exclusive {
+		return r.Min.compare(member) > 0
+	}
+	return r.Min.compare(member) >= 0
+}
+
+func (r ZLexRange) lteMax(member string) bool {
+	if r.Max.Exclusive {
+		return r.Max.compare(member) < 0
+	}
+	return r.Max.compare(member) <= 0
+}
+
+// empty reports whether no member can possibly fall inside the range.
+func (r ZLexRange) empty() bool {
+	if r.Min.Inf == 1 || r.Max.Inf == -1 {
+		return true
+	}
+	if r.Min.Inf != 0 || r.Max.Inf != 0 {
+		return false
+	}
+	cmp := strings.Compare(r.Min.Value, r.Max.Value)
+	return cmp > 0 || (cmp == 0 && (r.Min.Exclusive || r.Max.Exclusive))
+}
+
+// parseScoreRange parses the min and max arguments of a score range.
+func parseScoreRange(min, max string) (ZScoreRange, error) {
+	var r ZScoreRange
+	var err error
+	if r.Min, r.MinEx, err = parseScoreBound(min); err != nil {
+		return r, errScoreRange
+	}
+	if r.Max, r.MaxEx, err = parseScoreBound(max); err != nil {
+		return r, errScoreRange
+	}
+	return r, nil
+}
+
+func parseScoreBound(arg string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	score, err := parseFloatArg(arg)
+	return score, exclusive, err
+}
+
+// parseLexRange parses the min and max arguments of a lexicographic range.
+func parseLexRange(min, max string) (ZLexRange, error) {
+	var r ZLexRange
+	var ok bool
+	if r.Min, ok = parseLexBound(min); !ok {
+		return r, errLexRange
+	}
+	if r.Max, ok = parseLexBound(max); !ok {
+		return r, errLexRange
+	}
+	return r, nil
+}
+
+func parseLexBound(arg string) (LexBound, bool) {
+	switch {
+	case arg == "-":
+		return LexBound{Inf: -1}, true
+	case arg == "+":
+		return LexBound{Inf: 1}, true
+	case strings.HasPrefix(arg, "["):
+		return LexBound{Value: arg[1:]}, true
+	case strings.HasPrefix(arg, "("):
+		return LexBound{Value: arg[1:], Exclusive: true}, true
+	default:
+		return LexBound{}, false
+	}
+}
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+type zskiplistNode struct {
+	member   string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+// zskiplist orders members by score and then lexicographically. Every level
+// records the span it jumps over so that ranks can be computed in O(log n).
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int
+	level  int
+}
+
+func newZSkiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether x sorts before an element with the given score and
+// member.
+func (x *zskiplistNode) before(score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member < member)
+}
+
+// insert adds a new node. The caller makes sure the member is not present.
+func (zsl *zskiplist) insert(score float64, member string) *zskiplistNode {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// findUpdate fills update with the rightmost node before (score, member) on
+// every level.
+func (zsl *zskiplist) findUpdate(score float64, member string, update []*zskiplistNode) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return x.level[0].forward
+}
+
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	x := zsl.findUpdate(score, member, update[:])
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update[:])
+	return true
+}
+
+// updateScore moves member from curScore to newScore, reusing the node when
+// its position does not change.
+func (zsl *zskiplist) updateScore(curScore float64, member string, newScore float64) {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	x := zsl.findUpdate(curScore, member, update[:])
+
+	if (x.backward == nil || x.backward.score < newScore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newScore) {
+		x.score = newScore
+		return
+	}
+
+	zsl.deleteNode(x, update[:])
+	zsl.insert(newScore, member)
+}
+
+// rank returns the 1-based rank of the element, or 0 if it is not present.
+func (zsl *zskiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for f := x.level[i].forward; f != nil && (f.before(score, member) || (f.score == score && f.member == member)); f = x.level[i].forward {
+			rank += x.level[i].span
+			x = f
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1-based rank, or nil if out of range.
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+func (zsl *zskiplist) inScoreRange(r ZScoreRange) bool {
+	if r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx)) {
+		return false
+	}
+	if zsl.tail == nil || !r.gteMin(zsl.tail.score) {
+		return false
+	}
+	first := zsl.header.level[0].forward
+	return first != nil && r.lteMax(first.score)
+}
+
+func (zsl *zskiplist) firstInScoreRange(r ZScoreRange) *zskiplistNode {
+	if !zsl.inScoreRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *zskiplist) lastInScoreRange(r ZScoreRange) *zskiplistNode {
+	if !zsl.inScoreRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *zskiplist) inLexRange(r ZLexRange) bool {
+	if r.empty() {
+		return false
+	}
+	if zsl.tail == nil || !r.gteMin(zsl.tail.member) {
+		return false
+	}
+	first := zsl.header.level[0].forward
+	return first != nil && r.lteMax(first.member)
+}
+
+func (zsl *zskiplist) firstInLexRange(r ZLexRange) *zskiplistNode {
+	if !zsl.inLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *zskiplist) lastInLexRange(r ZLexRange) *zskiplistNode {
+	if !zsl.inLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+// zset is the sorted set value: the skiplist gives ordered and ranked access
+// while dict answers member to score lookups in O(1).
+type zset struct {
+	dict *dict[float64]
+	zsl  *zskiplist
+}
+
+func newZSet() *zset {
+	return &zset{
+		dict: newDict[float64](),
+		zsl:  newZSkiplist(),
+	}
+}
+
+func (zs *zset) length() int {
+	return zs.dict.len()
+}
+
+// set adds member or moves it to a new score.
+func (zs *zset) set(member string, score float64) {
+	if cur, exists := zs.dict.get(member); exists {
+		if cur != score {
+			zs.zsl.updateScore(cur, member, score)
+			zs.dict.set(member, score)
+		}
+		return
+	}
+	zs.zsl.insert(score, member)
+	zs.dict.set(member, score)
+}
+
+func (zs *zset) remove(member string) bool {
+	score, exists := zs.dict.get(member)
+	if !exists {
+		return false
+	}
+	zs.zsl.delete(score, member)
+	zs.dict.delete(member)
+	return true
+}
+
+// clone returns a deep copy of the sorted set.
+func (zs *zset) clone() *zset {
+	clone := newZSet()
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		clone.set(x.member, x.score)
+	}
+	return clone
+}
+
+// rank returns the 0-based rank of member, counted from the highest score
+// when reverse is set.
+func (zs *zset) rank(member string, reverse bool) (int, bool) {
+	score, exists := zs.dict.get(member)
+	if !exists {
+		return 0, false
+	}
+	rank := zs.zsl.rank(score, member)
+	if reverse {
+		return zs.zsl.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// ZRangeBy selects how a ZRangeQuery interprets its bounds.
+type ZRangeBy int
+
+const (
+	ZRangeByIndex ZRangeBy = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeQuery describes a ZRANGE style selection. Start and Stop are used for
+// index ranges, Score and Lex for the other kinds. Offset and Count implement
+// LIMIT; a negative Count means no limit.
+type ZRangeQuery struct {
+	By          ZRangeBy
+	Start, Stop int
+	Score       ZScoreRange
+	Lex         ZLexRange
+	Rev         bool
+	Offset      int
+	Count       int
+}
+
+func (zs *zset) rangeQuery(q ZRangeQuery) []ScoredMember {
+	switch q.By {
+	case ZRangeByScore:
+		var first *zskiplistNode
+		if q.Rev {
+			first = zs.zsl.lastInScoreRange(q.Score)
+		} else {
+			first = zs.zsl.firstInScoreRange(q.Score)
+		}
+		return zs.walk(first, q, func(x *zskiplistNode) bool {
+			if q.Rev {
+				return q.Score.gteMin(x.score)
+			}
+			return q.Score.lteMax(x.score)
+		})
+	case ZRangeByLex:
+		var first *zskiplistNode
+		if q.Rev {
+			first = zs.zsl.lastInLexRange(q.Lex)
+		} else {
+			first = zs.zsl.firstInLexRange(q.Lex)
+		}
+		return zs.walk(first, q, func(x *zskiplistNode) bool {
+			if q.Rev {
+				return q.Lex.gteMin(x.member)
+			}
+			return q.Lex.lteMax(x.member)
+		})
+	default:
+		return zs.rangeByIndex(q.Start, q.Stop, q.Rev)
+	}
+}
+
+// walk collects nodes from first onwards, in the direction of the query,
+// while inRange holds, applying LIMIT offset and count.
+func (zs *zset) walk(first *zskiplistNode, q ZRangeQuery, inRange func(*zskiplistNode) bool) []ScoredMember {
+	result := []ScoredMember{}
+	if q.Offset < 0 {
+		return result
+	}
+
+	next := func(x *zskiplistNode) *zskiplistNode {
+		if q.Rev {
+			return x.backward
+		}
+		return x.level[0].forward
+	}
+
+	x := first
+	for offset := q.Offset; x != nil && offset > 0; offset-- {
+		x = next(x)
+	}
+	for count := q.Count; x != nil && count != 0 && inRange(x); count-- {
+		result = append(result, ScoredMember{Member: x.member, Score: x.score})
+		x = next(x)
+	}
+	return result
+}
+
+func (zs *zset) rangeByIndex(start, stop int, rev bool) []ScoredMember {
+	length := zs.length()
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return []ScoredMember{}
+	}
+
+	result := make([]ScoredMember, 0, stop-start+1)
+	if rev {
+		x := zs.zsl.byRank(length - start)
+		for i := start; i <= stop; i++ {
+			result = append(result, ScoredMember{Member: x.member, Score: x.score})
+			x = x.backward
+		}
+		return result
+	}
+
+	x := zs.zsl.byRank(start + 1)
+	for i := start; i <= stop; i++ {
+		result = append(result, ScoredMember{Member: x.member, Score: x.score})
+		x = x.level[0].forward
+	}
+	return result
+}
+
+// countInRange counts the elements between first and last using their ranks.
+func (zs *zset) countInRange(first, last *zskiplistNode) int {
+	if first == nil || last == nil {
+		return 0
+	}
+	return zs.zsl.rank(last.score, last.member) - zs.zsl.rank(first.score, first.member) + 1
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestZSet_RankAndOrder(t *testing.T) {
+	zs := newZSet()
+
+	for i := 0; i < 1000; i++ {
+		zs.set("m"+strconv.Itoa(i), float64((i*7919)%1000))
+	}
+	for i := 0; i < 1000; i += 3 {
+		zs.set("m"+strconv.Itoa(i), float64(i%50))
+	}
+	for i := 0; i < 1000; i += 5 {
+		zs.remove("m" + strconv.Itoa(i))
+	}
+
+	expected := make([]ScoredMember, 0, zs.dict.len())
+	for member, score := range zs.dict.all() {
+		expected = append(expected, ScoredMember{Member: member, Score: score})
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if expected[i].Score != expected[j].Score {
+			return expected[i].Score < expected[j].Score
+		}
+		return expected[i].Member < expected[j].Member
+	})
+
+	got := zs.rangeByIndex(0, -1, false)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d members, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Position %d: expected %v, got %v", i, expected[i], got[i])
+		}
+		rank, _ := zs.rank(expected[i].Member, false)
+		if rank != i {
+			t.Fatalf("Expected rank %d for %s, got %d", i, expected[i].Member, rank)
+		}
+	}
+}
+
+func TestZSet_ScoreRange(t *testing.T) {
+	zs := newZSet()
+	for i := 1; i <= 10; i++ {
+		zs.set("m"+strconv.Itoa(i), float64(i))
+	}
+
+	r, err := parseScoreRange("(3", "7")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got := zs.rangeQuery(ZRangeQuery{By: ZRangeByScore, Score: r, Count: -1})
+	if len(got) != 4 || got[0].Member != "m4" || got[3].Member != "m7" {
+		t.Errorf("Expected m4..m7, got %v", got)
+	}
+
+	got = zs.rangeQuery(ZRangeQuery{By: ZRangeByScore, Score: r, Rev: true, Offset: 1, Count: 2})
+	if len(got) != 2 || got[0].Member != "m6" || got[1].Member != "m5" {
+		t.Errorf("Expected m6, m5, got %v", got)
+	}
+
+	r, _ = parseScoreRange("-inf", "+inf")
+	if count := zs.countInRange(zs.zsl.firstInScoreRange(r), zs.zsl.lastInScoreRange(r)); count != 10 {
+		t.Errorf("Expected 10 members in range, got %d", count)
+	}
+}
+
+func TestZSet_LexRange(t *testing.T) {
+	zs := newZSet()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		zs.set(member, 0)
+	}
+
+	r, err := parseLexRange("[b", "(e")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got := zs.rangeQuery(ZRangeQuery{By: ZRangeByLex, Lex: r, Count: -1})
+	if len(got) != 3 || got[0].Member != "b" || got[2].Member != "d" {
+		t.Errorf("Expected b..d, got %v", got)
+	}
+
+	r, _ = parseLexRange("-", "+")
+	got = zs.rangeQuery(ZRangeQuery{By: ZRangeByLex, Lex: r, Rev: true, Count: -1})
+	if len(got) != 5 || got[0].Member != "e" {
+		t.Errorf("Expected all members in reverse, got %v", got)
+	}
+
+	if _, err := parseLexRange("b", "+"); err == nil {
+		t.Error("Expected error for a bound without [ or (")
+	}
+}